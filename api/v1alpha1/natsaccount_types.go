@@ -17,26 +17,144 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"fmt"
+	"regexp"
+	"sort"
 	"time"
 
 	"github.com/nats-io/jwt/v2"
 	"github.com/samber/lo"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// AccountPublicKey is the public nkey of a NATS account
+// +kubebuilder:validation:Pattern=`^A[A-Z2-7]{55}$`
+type AccountPublicKey string
+
 // NATS Account import, duplicated here to have codegen
+type Import struct {
+	Name string `json:"name,omitempty"`
+	// Subject field in an import is always from the perspective of the
+	// initial publisher - in the case of a stream it is the account owning
+	// the stream (the exporter), and in the case of a service it is the
+	// account making the request (the importer).
+	// +kubebuilder:validation:Pattern=`^\S+$`
+	Subject jwt.Subject      `json:"subject,omitempty"`
+	Account AccountPublicKey `json:"account,omitempty"`
+	Token   string           `json:"token,omitempty"`
+	// Deprecated: use LocalSubject instead
+	// +kubebuilder:validation:Pattern=`^\S+$`
+	To jwt.Subject `json:"to,omitempty"`
+	// Local subject used to subscribe (for streams) and publish (for services) to.
+	// This value only needs setting if you want to change the value of Subject.
+	// Every * of Subject needs a * or $<n> reference to it, and both need to end in > or not.
+	// +kubebuilder:validation:Pattern=`^\S+$`
+	LocalSubject jwt.RenamingSubject `json:"local_subject,omitempty"`
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Enum=stream;service
+	Type jwt.ExportType `json:"type,omitempty"`
+	// Share information about the requesting clients with the exporter, e.g. for latency tracking.
+	// Only valid for service imports.
+	Share bool `json:"share,omitempty"`
+	// ExporterJWT is the JWT of the exporting account, for imports from an account of another operator the
+	// NATS servers trust as well. It has to be issued for account and export the subject. It is only validated,
+	// NATS import claims have no field for it: the account JWT references the account, like for any other import.
+	ExporterJWT string `json:"exporterJwt,omitempty"`
+	// ExternalOperatorJWT is the JWT of the operator issuing ExporterJWT, which has to be signed by the
+	// operator or one of its signing keys. Like ExporterJWT it is only validated.
+	ExternalOperatorJWT string `json:"externalOperatorJwt,omitempty"`
+}
+
+func (i Import) validate() error {
+	if i.Share && i.Type != jwt.Service {
+		return fmt.Errorf("import %q can only share information if it is a service import", i.Subject)
+	}
+	if err := i.validateExporter(); err != nil {
+		return err
+	}
+	if i.LocalSubject == "" {
+		return nil
+	}
+	if i.To != "" {
+		return fmt.Errorf("import %q sets both to and local_subject, local_subject replaces to", i.Subject)
+	}
+	// Same check as NATS, which rejects the whole account otherwise: every * of the subject needs a
+	// * or $<n> reference in the local subject, and both need to end in > or not
+	vr := jwt.ValidationResults{}
+	i.LocalSubject.Validate(i.Subject, &vr)
+	if errs := vr.Errors(); len(errs) > 0 {
+		return fmt.Errorf("import %q can't be mapped to local subject %q: %v", i.Subject, i.LocalSubject, errs[0])
+	}
+	return nil
+}
+
+// validateExporter verifies the exporter JWT of a cross-operator import exports the subject, and chains to the
+// external operator if given
+func (i Import) validateExporter() error {
+	if i.ExporterJWT == "" {
+		if i.ExternalOperatorJWT != "" {
+			return fmt.Errorf("import %q sets externalOperatorJwt without exporterJwt", i.Subject)
+		}
+		return nil
+	}
+	exporter, err := jwt.DecodeAccountClaims(i.ExporterJWT)
+	if err != nil {
+		return fmt.Errorf("import %q has an invalid exporterJwt: %v", i.Subject, err)
+	}
+	if exporter.Subject != string(i.Account) {
+		return fmt.Errorf("exporterJwt of import %q is issued for %s instead of %s", i.Subject, exporter.Subject, i.Account)
+	}
+	if !lo.ContainsBy(exporter.Exports, func(e *jwt.Export) bool {
+		return e.Type == i.Type && i.Subject.IsContainedIn(e.Subject)
+	}) {
+		return fmt.Errorf("account %s doesn't export %s %q", i.Account, i.Type, i.Subject)
+	}
+	if i.ExternalOperatorJWT == "" {
+		return nil
+	}
+	operator, err := jwt.DecodeOperatorClaims(i.ExternalOperatorJWT)
+	if err != nil {
+		return fmt.Errorf("import %q has an invalid externalOperatorJwt: %v", i.Subject, err)
+	}
+	if exporter.Issuer != operator.Subject && !lo.Contains(operator.SigningKeys, exporter.Issuer) {
+		return fmt.Errorf("exporterJwt of import %q is signed by %s, which is neither the external operator %s nor one of its signing keys",
+			i.Subject, exporter.Issuer, operator.Subject)
+	}
+	return nil
+}
+
+func (i Import) toNats() *jwt.Import {
+	return &jwt.Import{
+		Name:         i.Name,
+		Subject:      i.Subject,
+		Account:      string(i.Account),
+		Token:        i.Token,
+		To:           i.To,
+		LocalSubject: i.LocalSubject,
+		Type:         i.Type,
+		Share:        i.Share,
+	}
+}
 
 // NATS Account export, duplicated here to have codegen
 type Export struct {
-	Name                 string              `json:"name,omitempty"`
-	Subject              jwt.Subject         `json:"subject,omitempty"`
-	Type                 jwt.ExportType      `json:"type,omitempty"`
-	TokenReq             bool                `json:"token_req,omitempty"`
-	Revocations          jwt.RevocationList  `json:"revocations,omitempty"`
+	Name string `json:"name,omitempty"`
+	// +kubebuilder:validation:Pattern=`^\S+$`
+	Subject jwt.Subject `json:"subject,omitempty"`
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Enum=stream;service
+	Type        jwt.ExportType     `json:"type,omitempty"`
+	TokenReq    bool               `json:"token_req,omitempty"`
+	Revocations jwt.RevocationList `json:"revocations,omitempty"`
+	// ResponseType is how a service export responds to a request, with a single message (Singleton, the default),
+	// multiple messages (Stream) or a single response split into chunks (Chunked). Stream exports can't set it.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Enum=Singleton;Stream;Chunked
 	ResponseType         jwt.ResponseType    `json:"response_type,omitempty"`
 	ResponseThreshold    time.Duration       `json:"response_threshold,omitempty"`
 	Latency              *jwt.ServiceLatency `json:"service_latency,omitempty"`
@@ -45,12 +163,340 @@ type Export struct {
 	jwt.Info             `json:",inline"`
 }
 
-// OperatorLimits are used to limit access by an account
+func (e Export) validate() error {
+	if e.ResponseType == "" {
+		return nil
+	}
+	if e.Type != jwt.Service {
+		return fmt.Errorf("export %q sets response_type, which only applies to service exports", e.Subject)
+	}
+	switch e.ResponseType {
+	case jwt.ResponseTypeSingleton, jwt.ResponseTypeStream, jwt.ResponseTypeChunked:
+		return nil
+	}
+	return fmt.Errorf("export %q has response_type %q, which is none of Singleton, Stream or Chunked", e.Subject, e.ResponseType)
+}
+
+// Copied from nats-io/jwt to get codegen. All limits accept -1 for no limit.
+type NatsLimits struct {
+	// Max number of subscriptions
+	// +kubebuilder:validation:Minimum=-1
+	Subs int64 `json:"subs,omitempty"`
+	// Max number of bytes
+	// +kubebuilder:validation:Minimum=-1
+	Data int64 `json:"data,omitempty"`
+	// Max message payload, e.g. 1Mi or -1 for no limit. NATS doesn't allow payloads above 64Mi
+	Payload *resource.Quantity `json:"payload,omitempty"`
+}
+
+// MAX_PAYLOAD is the largest payload NATS allows
+const MAX_PAYLOAD = 64 * 1024 * 1024
+
+func (l NatsLimits) toNats() jwt.NatsLimits {
+	return jwt.NatsLimits{
+		Subs:    l.Subs,
+		Data:    l.Data,
+		Payload: quantityBytes(l.Payload),
+	}
+}
+
+// validate checks the payload limit is a whole number of bytes NATS allows, or -1 for no limit
+func (l NatsLimits) validate() error {
+	if err := validateBytes("payload", l.Payload); err != nil {
+		return err
+	}
+	if payload := quantityBytes(l.Payload); payload > MAX_PAYLOAD {
+		return fmt.Errorf("payload %s exceeds the maximum payload of NATS of 64Mi", l.Payload)
+	}
+	return nil
+}
+
+// Copied from nats-io/jwt to get codegen
+type AccountLimits struct {
+	// Max number of imports, unset or -1 for no limit and 0 to allow none
+	// +kubebuilder:validation:Minimum=-1
+	Imports *int64 `json:"imports,omitempty"`
+	// Max number of exports, unset or -1 for no limit and 0 to allow none
+	// +kubebuilder:validation:Minimum=-1
+	Exports *int64 `json:"exports,omitempty"`
+	// Are wildcards allowed in exports
+	WildcardExports bool `json:"wildcards,omitempty"`
+	// User JWT can't be bearer token
+	DisallowBearer bool `json:"disallow_bearer,omitempty"`
+	// Max number of active connections
+	// +kubebuilder:validation:Minimum=-1
+	Conn int64 `json:"conn,omitempty"`
+	// Max number of active leaf node connections, it can only be set with leafnode.
+	// Accounts without leafnode are issued with no leaf node connections.
+	// +kubebuilder:validation:Minimum=-1
+	LeafNodeConn int64 `json:"leaf,omitempty"`
+	// LeafNode enables leaf node connections of the account, limited by leaf or leaf_percent
+	LeafNode bool `json:"leafnode,omitempty"`
+
+	// ConnPercent limits the active connections to a percentage of the connection pool of the operator,
+	// it is resolved into conn when signing
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	ConnPercent int64 `json:"conn_percent,omitempty"`
+	// LeafNodeConnPercent limits the active leaf node connections to a percentage of the connection pool
+	// of the operator, it is resolved into leaf when signing
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	LeafNodeConnPercent int64 `json:"leaf_percent,omitempty"`
+	// ConnPerUser limits the active connections to this many per NatsUser of the account,
+	// it is resolved into conn when signing and follows users being created and deleted
+	// +kubebuilder:validation:Minimum=0
+	ConnPerUser int64 `json:"conn_per_user,omitempty"`
+}
+
+// countLimit returns the limit of imports or exports, unset ones don't limit them
+func countLimit(limit *int64) int64 {
+	if limit == nil {
+		return jwt.NoLimit
+	}
+	return *limit
+}
+
+func (l AccountLimits) toNats() jwt.AccountLimits {
+	limits := jwt.AccountLimits{
+		Imports:         countLimit(l.Imports),
+		Exports:         countLimit(l.Exports),
+		WildcardExports: l.WildcardExports,
+		DisallowBearer:  l.DisallowBearer,
+		Conn:            l.Conn,
+	}
+	// Leaf node connections are opt in, so none are accepted by accident
+	if l.LeafNode {
+		limits.LeafNodeConn = l.LeafNodeConn
+	}
+	return limits
+}
+
+// validate rejects leaf node limits of accounts without leafnode, and applies the same checks as NATS does to the
+// imports and exports of an account, which rejects claims exceeding the limits. Only the declared imports and exports
+// are counted, as templates, operators and signing key scopes add none to the account JWT.
+func (l AccountLimits) validate(imports []Import, exports []Export) error {
+	if !l.LeafNode && (l.LeafNodeConn != 0 || l.LeafNodeConnPercent != 0) {
+		return fmt.Errorf("leaf and leaf_percent only apply to accounts with leafnode enabled")
+	}
+	if limit := countLimit(l.Imports); limit != jwt.NoLimit && int64(len(imports)) > limit {
+		return fmt.Errorf("account declares %d imports, but its limits allow %d (unset or -1 for no limit)", len(imports), limit)
+	}
+	limit := countLimit(l.Exports)
+	if limit == jwt.NoLimit {
+		return nil
+	}
+	if int64(len(exports)) > limit {
+		return fmt.Errorf("account declares %d exports, but its limits allow %d (unset or -1 for no limit)", len(exports), limit)
+	}
+	if !l.WildcardExports {
+		for _, e := range exports {
+			if e.Subject.HasWildCards() {
+				return fmt.Errorf("export %q has wildcards, but its limits don't allow wildcard exports", e.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveShares returns the limits with the connection percentages resolved against pool,
+// which may be nil if the operator has no connection pool.
+func (l AccountLimits) ResolveShares(pool *ConnectionPool) (AccountLimits, error) {
+	if pool == nil {
+		pool = &ConnectionPool{}
+	}
+	conn, err := resolveShare("conn", l.Conn, l.ConnPercent, pool.Conn)
+	if err != nil {
+		return l, err
+	}
+	leaf, err := resolveShare("leaf", l.LeafNodeConn, l.LeafNodeConnPercent, pool.LeafNodeConn)
+	if err != nil {
+		return l, err
+	}
+	l.Conn, l.ConnPercent = conn, 0
+	l.LeafNodeConn, l.LeafNodeConnPercent = leaf, 0
+	return l, nil
+}
+
+// ResolvePerUser returns the limits with the connections per user resolved for the given number of users
+func (l AccountLimits) ResolvePerUser(users int64) (AccountLimits, error) {
+	switch {
+	case l.ConnPerUser == 0:
+		return l, nil
+	case l.Conn != 0:
+		return l, fmt.Errorf("conn and conn_per_user are mutually exclusive")
+	case l.ConnPercent != 0:
+		return l, fmt.Errorf("conn_percent and conn_per_user are mutually exclusive")
+	}
+	l.Conn, l.ConnPerUser = users*l.ConnPerUser, 0
+	return l, nil
+}
+
+// resolveShare returns the absolute limit of percent of pool, rounded down but at least one connection
+func resolveShare(name string, limit, percent, pool int64) (int64, error) {
+	switch {
+	case percent == 0:
+		return limit, nil
+	case limit != 0:
+		return 0, fmt.Errorf("%s and %s_percent are mutually exclusive", name, name)
+	case pool <= 0:
+		return 0, fmt.Errorf("%s_percent requires the operator to set connectionPool.%s", name, name)
+	}
+	if resolved := pool * percent / 100; resolved > 0 {
+		return resolved, nil
+	}
+	return 1, nil
+}
+
+// Copied from nats-io/jwt to get codegen, the storage limits are quantities instead of byte counts
+type JetStreamLimits struct {
+	// Max number of bytes stored in memory across all streams, e.g. 10Gi or -1 for no limit. (0 means disabled)
+	MemoryStorage *resource.Quantity `json:"mem_storage,omitempty"`
+	// Max number of bytes stored on disk across all streams, e.g. 10Gi or -1 for no limit. (0 means disabled)
+	DiskStorage *resource.Quantity `json:"disk_storage,omitempty"`
+	// Max number of streams
+	// +kubebuilder:validation:Minimum=-1
+	Streams int64 `json:"streams,omitempty"`
+	// Max number of consumers
+	// +kubebuilder:validation:Minimum=-1
+	Consumer int64 `json:"consumer,omitempty"`
+	// Max ack pending of a Stream
+	// +kubebuilder:validation:Minimum=-1
+	MaxAckPending int64 `json:"max_ack_pending,omitempty"`
+	// Max bytes a memory backed stream can have. (0 means disabled/unlimited)
+	// +kubebuilder:validation:Minimum=-1
+	MemoryMaxStreamBytes int64 `json:"mem_max_stream_bytes,omitempty"`
+	// Max bytes a disk backed stream can have. (0 means disabled/unlimited)
+	// +kubebuilder:validation:Minimum=-1
+	DiskMaxStreamBytes int64 `json:"disk_max_stream_bytes,omitempty"`
+	// Max bytes required by all Streams
+	MaxBytesRequired bool `json:"max_bytes_required,omitempty"`
+}
+
+func (l JetStreamLimits) toNats() jwt.JetStreamLimits {
+	return jwt.JetStreamLimits{
+		MemoryStorage:        quantityBytes(l.MemoryStorage),
+		DiskStorage:          quantityBytes(l.DiskStorage),
+		Streams:              l.Streams,
+		Consumer:             l.Consumer,
+		MaxAckPending:        l.MaxAckPending,
+		MemoryMaxStreamBytes: l.MemoryMaxStreamBytes,
+		DiskMaxStreamBytes:   l.DiskMaxStreamBytes,
+		MaxBytesRequired:     l.MaxBytesRequired,
+	}
+}
+
+// validate checks the storage limits are whole bytes, either non negative or -1 for no limit
+func (l JetStreamLimits) validate() error {
+	if err := validateBytes("mem_storage", l.MemoryStorage); err != nil {
+		return err
+	}
+	return validateBytes("disk_storage", l.DiskStorage)
+}
+
+// validateBytes checks the limit name is a whole number of bytes, either non negative or -1 for no limit
+func validateBytes(name string, q *resource.Quantity) error {
+	if q == nil {
+		return nil
+	}
+	bytes, ok := q.AsInt64()
+	if !ok {
+		return fmt.Errorf("%s %s is not a whole number of bytes", name, q)
+	}
+	if bytes < jwt.NoLimit {
+		return fmt.Errorf("%s %s needs to be non negative, or -1 for no limit", name, q)
+	}
+	return nil
+}
+
+// quantityBytes returns the number of bytes of a limit, 0 if unset
+func quantityBytes(q *resource.Quantity) int64 {
+	if q == nil {
+		return 0
+	}
+	return q.Value()
+}
+
+// NATS names the tiers after the replicas of the streams they limit, streams have at most 5 replicas
+var jetStreamTierPattern = regexp.MustCompile(`^R[1-5]$`)
+
+// OperatorLimits are used to limit access by an account.
+// The JetStream limits are inlined, so max_ack_pending can be tuned on its own next to the storage limits.
 type OperatorLimits struct {
-	jwt.NatsLimits            `json:",inline"`
-	jwt.AccountLimits         `json:",inline"`
-	jwt.JetStreamLimits       `json:",inline"`
-	jwt.JetStreamTieredLimits `json:"tiered_limits,omitempty"`
+	NatsLimits      `json:",inline"`
+	AccountLimits   `json:",inline"`
+	JetStreamLimits `json:",inline"`
+	// JetStreamTieredLimits are the JetStream limits per replication tier R1 to R5, e.g. R1 and R3.
+	// They replace the untiered JetStream limits, only max_ack_pending can be set next to them
+	// and is inherited by the tiers not setting one.
+	JetStreamTieredLimits map[string]JetStreamLimits `json:"tiered_limits,omitempty"`
+}
+
+func (l OperatorLimits) toNats() jwt.OperatorLimits {
+	limits := jwt.OperatorLimits{
+		NatsLimits:      l.NatsLimits.toNats(),
+		AccountLimits:   l.AccountLimits.toNats(),
+		JetStreamLimits: l.JetStreamLimits.toNats(),
+	}
+	if l.JetStreamTieredLimits != nil {
+		limits.JetStreamTieredLimits = jwt.JetStreamTieredLimits{}
+		for tier, tierLimits := range l.JetStreamTieredLimits {
+			if tierLimits.MaxAckPending == 0 {
+				tierLimits.MaxAckPending = l.MaxAckPending
+			}
+			limits.JetStreamTieredLimits[tier] = tierLimits.toNats()
+		}
+		// NATS rejects accounts with both tiered and untiered limits, so it's only kept in the tiers
+		limits.JetStreamLimits.MaxAckPending = 0
+	}
+	return limits
+}
+
+// validate rejects invalid byte limits and JetStream settings that have no effect
+func (l OperatorLimits) validate() error {
+	if err := l.NatsLimits.validate(); err != nil {
+		return err
+	}
+	if err := l.JetStreamLimits.validate(); err != nil {
+		return err
+	}
+	tiers := lo.Keys(l.JetStreamTieredLimits)
+	sort.Strings(tiers)
+	for _, tier := range tiers {
+		if !jetStreamTierPattern.MatchString(tier) {
+			return fmt.Errorf("tier %q is not a replication tier, NATS only applies the tiers R1 to R5", tier)
+		}
+		if err := l.JetStreamTieredLimits[tier].validate(); err != nil {
+			return fmt.Errorf("tier %s: %v", tier, err)
+		}
+	}
+	limits := l.toNats()
+	if len(tiers) > 0 && limits.JetStreamLimits != (jwt.JetStreamLimits{}) {
+		return fmt.Errorf("JetStream limits and tiered_limits are mutually exclusive, only max_ack_pending is inherited by the tiers")
+	}
+	if l.MaxAckPending != 0 && !limits.IsJSEnabled() {
+		return fmt.Errorf("max_ack_pending only applies to accounts with JetStream enabled, set mem_storage or disk_storage as well")
+	}
+	return nil
+}
+
+// ScopedSigningKey is a signing key of an account restricting the users it signs
+type ScopedSigningKey struct {
+	// Key is the public key of the signing key
+	Key AccountPublicKey `json:"key"`
+	// Role names the scope for tooling, it has no meaning to NATS
+	Role string `json:"role,omitempty"`
+	// Template contains the permissions and limits of all users signed with the key.
+	// Users signed with it can't carry permissions or limits of their own.
+	Template UserTemplate `json:"template,omitempty"`
+}
+
+func (k ScopedSigningKey) toNats() *jwt.UserScope {
+	scope := jwt.NewUserScope()
+	scope.Key = string(k.Key)
+	scope.Role = k.Role
+	scope.Template = k.Template.toNats()
+	return scope
 }
 
 // NatsAccountSpec defines the desired state of NatsAccount
@@ -62,12 +508,86 @@ type NatsAccountSpec struct {
 	AllowUserNamespaces []string `json:"allowedUserNamespaces,omitempty"`
 
 	// These fields are directly mappejwtd into the NATS JWT claim
-	Imports     []*jwt.Import      `json:"imports,omitempty"`
+	Imports     []Import           `json:"imports,omitempty"`
 	Exports     []Export           `json:"exports,omitempty"`
 	Limits      OperatorLimits     `json:"limits,omitempty"`
 	Revocations jwt.RevocationList `json:"revocations,omitempty"`
 
-	// FIXME: Scoped signing keys
+	// DefaultPermissions apply to users of this account that don't have permissions of their own.
+	// The default response permission is also inherited by users without an explicit one.
+	DefaultPermissions Permissions `json:"defaultPermissions,omitempty"`
+
+	// SigningKeys is a list of additional account public keys that are allowed to sign users on
+	// behalf of this account, e.g. while rotating keys.
+	SigningKeys []AccountPublicKey `json:"signingKeys,omitempty"`
+
+	// ScopedSigningKeys are signing keys whose users get the permissions and limits of the scope
+	// instead of their own.
+	ScopedSigningKeys []ScopedSigningKey `json:"scopedSigningKeys,omitempty"`
+
+	// Expiry is the validity of the issued account JWT. The operator renews the JWT once two thirds of
+	// the validity elapsed. If unset, the JWT never expires.
+	Expiry *metav1.Duration `json:"expiry,omitempty"`
+
+	// NotBefore is the time the issued account JWT becomes valid. It needs to be before the expiry,
+	// which is counted from the time the JWT is issued.
+	NotBefore *metav1.Time `json:"notBefore,omitempty"`
+
+	// DefaultUser makes the operator maintain a NatsUser named <account>-default next to the account.
+	// The user has no permissions of its own, so the default permissions apply, and its credentials are
+	// stored in a Secret of the same name. The user is deleted again once this is unset.
+	DefaultUser bool `json:"defaultUser,omitempty"`
+
+	// SeedSecretRef is a Secret in the namespace of the account containing the account seed in seed.nk.
+	// Its public key becomes the account public key, instead of a randomly generated one, so the account
+	// can be recreated with the same identity from a committed seed.
+	SeedSecretRef *corev1.LocalObjectReference `json:"seedSecretRef,omitempty"`
+
+	// TemplateRef is a NatsAccountTemplate in the namespace of the account its limits and default permissions
+	// are based on. The limits and default permissions the account sets override the ones of the template,
+	// the ones it leaves unset or zero are taken from the template.
+	TemplateRef *corev1.LocalObjectReference `json:"templateRef,omitempty"`
+
+	// SecretTemplate holds labels and annotations for the key secret of the account.
+	SecretTemplate SecretTemplate `json:"secretTemplate,omitempty"`
+}
+
+// SecretTemplate holds the metadata applied to the Secret generated for an account or user.
+// It is merged with the labels managed by the operator, which take precedence. Entries removed from the
+// template are left on the Secret.
+type SecretTemplate struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Validate checks the constraints of the spec that can't be expressed in the CRD schema,
+// for a JWT issued at now.
+func (s NatsAccountSpec) Validate(now time.Time) error {
+	if s.NotBefore != nil && s.Expiry != nil && !s.NotBefore.Time.Before(now.Add(s.Expiry.Duration)) {
+		return fmt.Errorf("notBefore %s is not before the expiry at %s", s.NotBefore.Time.Format(time.RFC3339), now.Add(s.Expiry.Duration).Format(time.RFC3339))
+	}
+	if resp := s.DefaultPermissions.Resp; resp != nil && (resp.MaxMsgs < 0 || resp.Expires < -1) {
+		return fmt.Errorf("default response permission needs a non negative max and a ttl of at least -1")
+	}
+	for _, i := range s.Imports {
+		if err := i.validate(); err != nil {
+			return err
+		}
+	}
+	for _, e := range s.Exports {
+		if err := e.validate(); err != nil {
+			return err
+		}
+	}
+	for _, k := range s.ScopedSigningKeys {
+		if lo.Contains(s.SigningKeys, k.Key) {
+			return fmt.Errorf("signing key %s is listed both with and without a scope", k.Key)
+		}
+	}
+	if err := s.Limits.validate(); err != nil {
+		return err
+	}
+	return s.Limits.AccountLimits.validate(s.Imports, s.Exports)
 }
 
 func (s NatsAccountSpec) ToJWTAccount() jwt.Account {
@@ -86,26 +606,75 @@ func (s NatsAccountSpec) ToJWTAccount() jwt.Account {
 			Info:                 e.Info,
 		}
 	})
+	imports := lo.Map(s.Imports, func(i Import, _ int) *jwt.Import {
+		return i.toNats()
+	})
+	signingKeys := jwt.SigningKeys{}
+	signingKeys.Add(lo.Map(s.SigningKeys, func(k AccountPublicKey, _ int) string {
+		return string(k)
+	})...)
+	for _, k := range s.ScopedSigningKeys {
+		signingKeys.AddScopedSigner(k.toNats())
+	}
 	return jwt.Account{
-		Imports: jwt.Imports(s.Imports),
-		Exports: jwt.Exports(exports),
-		Limits: jwt.OperatorLimits{
-			NatsLimits:            s.Limits.NatsLimits,
-			AccountLimits:         s.Limits.AccountLimits,
-			JetStreamLimits:       s.Limits.JetStreamLimits,
-			JetStreamTieredLimits: s.Limits.JetStreamTieredLimits,
-		},
-		// FIXME: scoped signing keys
-		SigningKeys: jwt.SigningKeys{},
-		Revocations: s.Revocations,
+		Imports:            jwt.Imports(imports),
+		Exports:            jwt.Exports(exports),
+		Limits:             s.Limits.toNats(),
+		DefaultPermissions: s.DefaultPermissions.toNats(),
+		SigningKeys:        signingKeys,
+		Revocations:        s.Revocations,
 	}
 }
 
+// PublishStatus describes the outcome of the last claims update pushed to NATS
+type PublishStatus struct {
+	// Time the claims update was pushed
+	Time metav1.Time `json:"time"`
+	// Acknowledged is true if a NATS server accepted the claims update
+	Acknowledged bool `json:"acknowledged"`
+	// Response summarizes the response of the NATS server, or why there was none
+	Response string `json:"response,omitempty"`
+}
+
 // NatsAccountStatus defines the observed state of NatsAccount
 type NatsAccountStatus struct {
 	AccountSecretName string `json:"accountSecretName,omitempty"`
 	PublicKey         string `json:"publicKey,omitempty"`
 	JWT               string `json:"jwt,omitempty"`
+	// DisabledJWT is issued along with the JWT and locks out all users of the account. The account server pushes
+	// it to NATS once the account is deleted.
+	DisabledJWT string `json:"disabledJWT,omitempty"`
+
+	// SigningKeys contains the signing keys present in the currently issued account JWT.
+	SigningKeys []string `json:"signingKeys,omitempty"`
+	// ActiveSigningKey is the public key new users of this account are signed with.
+	ActiveSigningKey string `json:"activeSigningKey,omitempty"`
+	// LastPublish is the outcome of the last claims update pushed to NATS by the account server
+	LastPublish *PublishStatus `json:"lastPublish,omitempty"`
+	// LastAcknowledged is the time a NATS server last accepted a claims update of the account,
+	// unset if no claims update was accepted yet
+	LastAcknowledged *metav1.Time `json:"lastAcknowledged,omitempty"`
+	// RevokedUsers are the public keys of deleted users of this account, revoked in the account JWT
+	// in addition to the revocations of the spec, with the time they were revoked at.
+	RevokedUsers jwt.RevocationList `json:"revokedUsers,omitempty"`
+	// RevokedUserExpiries are the unix times the JWTs of revoked users expire at, recorded when revoking them.
+	// Users whose JWT never expires aren't listed, their revocations are never pruned.
+	RevokedUserExpiries map[string]int64 `json:"revokedUserExpiries,omitempty"`
+	// ReconcileReason is why the last reconcile of the operator completed or requeued,
+	// only reported if the operator runs with --report-reconcile-reason
+	ReconcileReason string `json:"reconcileReason,omitempty"`
+	// EncodeAlgorithm is the algorithm the current JWT was signed with, ed25519-nkey for v2 claims and ed25519 for v1
+	EncodeAlgorithm string `json:"encodeAlgorithm,omitempty"`
+	// EncodeVersion is the revision of the encoding of the operator the current JWT was encoded with.
+	// Accounts encoded with an older revision are encoded again.
+	EncodeVersion int `json:"encodeVersion,omitempty"`
+
+	// Conditions represent the latest available observations of the account's state
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
 //+kubebuilder:object:root=true
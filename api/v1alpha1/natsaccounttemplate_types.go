@@ -0,0 +1,76 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NatsAccountTemplateSpec is the baseline of the accounts referencing the template
+type NatsAccountTemplateSpec struct {
+	Limits OperatorLimits `json:"limits,omitempty"`
+	// DefaultPermissions are the permissions of users without permissions of their own
+	DefaultPermissions Permissions `json:"defaultPermissions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NatsAccountTemplate holds the limits and default permissions shared by the NatsAccounts referencing it
+type NatsAccountTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec NatsAccountTemplateSpec `json:"spec,omitempty"`
+}
+
+// Apply returns spec based on the template. The limits and default permissions spec sets override the ones of
+// the template field by field, the ones it leaves unset or zero are taken from the template.
+func (t *NatsAccountTemplate) Apply(spec NatsAccountSpec) (NatsAccountSpec, error) {
+	base := t.Spec.DeepCopy()
+	// Decoding the fields of spec into the template overwrites exactly the fields spec sets
+	limits, err := json.Marshal(spec.Limits)
+	if err != nil {
+		return spec, err
+	}
+	if err := json.Unmarshal(limits, &base.Limits); err != nil {
+		return spec, err
+	}
+	permissions, err := json.Marshal(spec.DefaultPermissions)
+	if err != nil {
+		return spec, err
+	}
+	if err := json.Unmarshal(permissions, &base.DefaultPermissions); err != nil {
+		return spec, err
+	}
+	spec.Limits, spec.DefaultPermissions = base.Limits, base.DefaultPermissions
+	return spec, nil
+}
+
+//+kubebuilder:object:root=true
+
+// NatsAccountTemplateList contains a list of NatsAccountTemplate
+type NatsAccountTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NatsAccountTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NatsAccountTemplate{}, &NatsAccountTemplateList{})
+}
@@ -37,6 +37,39 @@ type NatsOperatorSpec struct {
 	// SigningKeys is a Slice of other operator NKeys that can be used to sign on behalf of the main
 	// operator identity.
 	SigningKeys jwt.StringList `json:"signing_keys,omitempty"`
+
+	// ClaimsVersion is the JWT version the accounts of this operator are issued in, 2 if unset.
+	// Version 1 is understood by NATS servers before 2.2, but can't express JetStream limits,
+	// default permissions, scoped signing keys and other claims added since.
+	// +kubebuilder:validation:Enum=1;2
+	// +optional
+	ClaimsVersion int `json:"claimsVersion,omitempty"`
+
+	// ConnectionPool is the number of connections of the cluster, which accounts of this operator can
+	// claim a percentage of with limits.conn_percent and limits.leaf_percent.
+	// +optional
+	ConnectionPool *ConnectionPool `json:"connectionPool,omitempty"`
+}
+
+// ConnectionPool sizes the connections shared by the accounts of an operator
+type ConnectionPool struct {
+	// Conn is the number of client connections conn_percent is resolved against
+	// +kubebuilder:validation:Minimum=0
+	Conn int64 `json:"conn,omitempty"`
+	// LeafNodeConn is the number of leaf node connections leaf_percent is resolved against
+	// +kubebuilder:validation:Minimum=0
+	LeafNodeConn int64 `json:"leaf,omitempty"`
+	// Enforce rejects accounts whose percentages, added to the ones of accounts created before them,
+	// exceed 100 percent of the pool.
+	Enforce bool `json:"enforce,omitempty"`
+}
+
+// AccountClaimsVersion returns the JWT version accounts of this operator are issued in
+func (s NatsOperatorSpec) AccountClaimsVersion() int {
+	if s.ClaimsVersion == 0 {
+		return 2
+	}
+	return s.ClaimsVersion
 }
 
 // NatsOperatorStatus defines the observed state of NatsOperator
@@ -47,6 +80,16 @@ type NatsOperatorStatus struct {
 	// PublicKey is the root public key used to sign all other accounts
 	PublicKey string `json:"publicKey,omitempty"`
 	JWT       string `json:"jwt,omitempty"`
+
+	// ActiveReplica is the operator replica currently holding the leadership, which reconciles all objects
+	ActiveReplica string `json:"activeReplica,omitempty"`
+
+	// Conditions represent the latest available observations of the operator's state
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
 //+kubebuilder:object:root=true
@@ -17,7 +17,11 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/nats-io/jwt/v2"
+	"github.com/samber/lo"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -27,16 +31,37 @@ import (
 
 // Copied from nats-io/jwt to get codegen
 type Permissions struct {
-	Pub  Permission              `json:"pub,omitempty"`
-	Sub  Permission              `json:"sub,omitempty"`
-	Resp *jwt.ResponsePermission `json:"resp,omitempty"`
+	Pub  Permission          `json:"pub,omitempty"`
+	Sub  Permission          `json:"sub,omitempty"`
+	Resp *ResponsePermission `json:"resp,omitempty"`
 }
 
 func (p Permissions) toNats() jwt.Permissions {
 	return jwt.Permissions{
 		Pub:  p.Pub.toNats(),
 		Sub:  p.Sub.toNats(),
-		Resp: p.Resp,
+		Resp: p.Resp.toNats(),
+	}
+}
+
+// ResponsePermission can be used to allow responses to any reply subject
+// that is received on a valid subscription.
+type ResponsePermission struct {
+	// Max number of responses per request
+	// +kubebuilder:validation:Minimum=0
+	MaxMsgs int `json:"max"`
+	// Time in nanoseconds a response may be sent after the request, -1 for no expiry
+	// +kubebuilder:validation:Minimum=-1
+	Expires time.Duration `json:"ttl"`
+}
+
+func (p *ResponsePermission) toNats() *jwt.ResponsePermission {
+	if p == nil {
+		return nil
+	}
+	return &jwt.ResponsePermission{
+		MaxMsgs: p.MaxMsgs,
+		Expires: p.Expires,
 	}
 }
 
@@ -52,14 +77,31 @@ func (p Permission) toNats() jwt.Permission {
 	}
 }
 
+// ConnectionType is a type of client connection a user may use
+// +kubebuilder:validation:Enum=STANDARD;WEBSOCKET;LEAFNODE;LEAFNODE_WS;MQTT;MQTT_WS
+type ConnectionType string
+
 // NatsUserSpec defines the desired state of NatsUser
 type NatsUserSpec struct {
 	// AccountRef is the reference to the account that should sign this user
-	AccountRef             corev1.ObjectReference `json:"accountRef"`
-	Permissions            Permissions            `json:"permissions,omitempty"`
-	Limits                 Limits                 `json:"limits,omitempty"`
-	BearerToken            bool                   `json:"bearer_token,omitempty"`
-	AllowedConnectionTypes jwt.StringList         `json:"allowed_connection_types,omitempty"`
+	AccountRef corev1.ObjectReference `json:"accountRef,omitempty"`
+	// AccountPublicKey is the public key of an account managed outside of the cluster, used instead of AccountRef.
+	// Such users are signed with the seed in SigningKeySecretRef.
+	AccountPublicKey string `json:"accountPublicKey,omitempty"`
+	// SigningKeySecretRef is the Secret in the namespace of the user containing the seed of AccountPublicKey
+	// or of one of its signing keys in the key seed.nk. It is required when AccountPublicKey is set.
+	// Users of an AccountRef are signed with it instead of the account key, if it is one of the signing keys
+	// of the account. Users signed with a scoped signing key get the permissions and limits of the scope.
+	SigningKeySecretRef    *corev1.LocalObjectReference `json:"signingKeySecretRef,omitempty"`
+	Permissions            Permissions                  `json:"permissions,omitempty"`
+	Limits                 Limits                       `json:"limits,omitempty"`
+	BearerToken            bool                         `json:"bearer_token,omitempty"`
+	AllowedConnectionTypes []ConnectionType             `json:"allowed_connection_types,omitempty"`
+	// SecretTemplate holds labels and annotations for the credentials secret of the user.
+	SecretTemplate SecretTemplate `json:"secretTemplate,omitempty"`
+	// Expiry is the validity of the issued user JWT. The operator renews the JWT and the credentials once two
+	// thirds of the validity elapsed. If unset, the JWT never expires.
+	Expiry *metav1.Duration `json:"expiry,omitempty"`
 }
 
 type UserLimits struct {
@@ -76,25 +118,62 @@ func (u UserLimits) toNats() jwt.UserLimits {
 	}
 }
 
+// Limits of a user, subs bounds the subscriptions of every connection of the user
 type Limits struct {
 	UserLimits     `json:",inline"`
 	jwt.NatsLimits `json:",inline"`
 }
 
+// validate checks the subscription limit is non negative, or -1 for no limit
+func (l Limits) validate() error {
+	if l.Subs < jwt.NoLimit {
+		return fmt.Errorf("limits.subs %d needs to be non negative, or -1 for no limit", l.Subs)
+	}
+	return nil
+}
+
 func (l Limits) toNats() jwt.Limits {
 	return jwt.Limits{
 		UserLimits: l.UserLimits.toNats(),
 		NatsLimits: l.NatsLimits,
 	}
 }
+
+// Validate checks the spec can be issued as a user JWT
+func (s NatsUserSpec) Validate() error {
+	if s.Expiry != nil && s.Expiry.Duration <= 0 {
+		return fmt.Errorf("expiry %s needs to be positive", s.Expiry.Duration)
+	}
+	return s.Limits.validate()
+}
+
 func (s NatsUserSpec) ToNatsJWT() jwt.User {
 	return jwt.User{
-		UserPermissionLimits: jwt.UserPermissionLimits{
-			Permissions:            s.Permissions.toNats(),
-			Limits:                 s.Limits.toNats(),
+		UserPermissionLimits: UserTemplate{
+			Permissions:            s.Permissions,
+			Limits:                 s.Limits,
 			BearerToken:            s.BearerToken,
 			AllowedConnectionTypes: s.AllowedConnectionTypes,
-		},
+		}.toNats(),
+	}
+}
+
+// UserTemplate holds the permissions and limits of a user, as used by the scopes of signing keys
+type UserTemplate struct {
+	Permissions            Permissions      `json:"permissions,omitempty"`
+	Limits                 Limits           `json:"limits,omitempty"`
+	BearerToken            bool             `json:"bearer_token,omitempty"`
+	AllowedConnectionTypes []ConnectionType `json:"allowed_connection_types,omitempty"`
+}
+
+func (t UserTemplate) toNats() jwt.UserPermissionLimits {
+	return jwt.UserPermissionLimits{
+		Permissions: t.Permissions.toNats(),
+		Limits:      t.Limits.toNats(),
+		BearerToken: t.BearerToken,
+		AllowedConnectionTypes: lo.Map(t.AllowedConnectionTypes, func(c ConnectionType, _ int) string {
+			return string(c)
+		}),
 	}
 }
 
@@ -23,9 +23,51 @@ package v1alpha1
 
 import (
 	v2 "github.com/nats-io/jwt/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccountLimits) DeepCopyInto(out *AccountLimits) {
+	*out = *in
+	if in.Imports != nil {
+		in, out := &in.Imports, &out.Imports
+		*out = new(int64)
+		**out = **in
+	}
+	if in.Exports != nil {
+		in, out := &in.Exports, &out.Exports
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccountLimits.
+func (in *AccountLimits) DeepCopy() *AccountLimits {
+	if in == nil {
+		return nil
+	}
+	out := new(AccountLimits)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConnectionPool) DeepCopyInto(out *ConnectionPool) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConnectionPool.
+func (in *ConnectionPool) DeepCopy() *ConnectionPool {
+	if in == nil {
+		return nil
+	}
+	out := new(ConnectionPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Export) DeepCopyInto(out *Export) {
 	*out = *in
@@ -54,6 +96,46 @@ func (in *Export) DeepCopy() *Export {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Import) DeepCopyInto(out *Import) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Import.
+func (in *Import) DeepCopy() *Import {
+	if in == nil {
+		return nil
+	}
+	out := new(Import)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JetStreamLimits) DeepCopyInto(out *JetStreamLimits) {
+	*out = *in
+	if in.MemoryStorage != nil {
+		in, out := &in.MemoryStorage, &out.MemoryStorage
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.DiskStorage != nil {
+		in, out := &in.DiskStorage, &out.DiskStorage
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JetStreamLimits.
+func (in *JetStreamLimits) DeepCopy() *JetStreamLimits {
+	if in == nil {
+		return nil
+	}
+	out := new(JetStreamLimits)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Limits) DeepCopyInto(out *Limits) {
 	*out = *in
@@ -77,7 +159,7 @@ func (in *NatsAccount) DeepCopyInto(out *NatsAccount) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccount.
@@ -141,14 +223,8 @@ func (in *NatsAccountSpec) DeepCopyInto(out *NatsAccountSpec) {
 	}
 	if in.Imports != nil {
 		in, out := &in.Imports, &out.Imports
-		*out = make([]*v2.Import, len(*in))
-		for i := range *in {
-			if (*in)[i] != nil {
-				in, out := &(*in)[i], &(*out)[i]
-				*out = new(v2.Import)
-				**out = **in
-			}
-		}
+		*out = make([]Import, len(*in))
+		copy(*out, *in)
 	}
 	if in.Exports != nil {
 		in, out := &in.Exports, &out.Exports
@@ -165,6 +241,39 @@ func (in *NatsAccountSpec) DeepCopyInto(out *NatsAccountSpec) {
 			(*out)[key] = val
 		}
 	}
+	in.DefaultPermissions.DeepCopyInto(&out.DefaultPermissions)
+	if in.SigningKeys != nil {
+		in, out := &in.SigningKeys, &out.SigningKeys
+		*out = make([]AccountPublicKey, len(*in))
+		copy(*out, *in)
+	}
+	if in.ScopedSigningKeys != nil {
+		in, out := &in.ScopedSigningKeys, &out.ScopedSigningKeys
+		*out = make([]ScopedSigningKey, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Expiry != nil {
+		in, out := &in.Expiry, &out.Expiry
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.NotBefore != nil {
+		in, out := &in.NotBefore, &out.NotBefore
+		*out = (*in).DeepCopy()
+	}
+	if in.SeedSecretRef != nil {
+		in, out := &in.SeedSecretRef, &out.SeedSecretRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	if in.TemplateRef != nil {
+		in, out := &in.TemplateRef, &out.TemplateRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	in.SecretTemplate.DeepCopyInto(&out.SecretTemplate)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccountSpec.
@@ -180,6 +289,41 @@ func (in *NatsAccountSpec) DeepCopy() *NatsAccountSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NatsAccountStatus) DeepCopyInto(out *NatsAccountStatus) {
 	*out = *in
+	if in.SigningKeys != nil {
+		in, out := &in.SigningKeys, &out.SigningKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastPublish != nil {
+		in, out := &in.LastPublish, &out.LastPublish
+		*out = new(PublishStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastAcknowledged != nil {
+		in, out := &in.LastAcknowledged, &out.LastAcknowledged
+		*out = (*in).DeepCopy()
+	}
+	if in.RevokedUsers != nil {
+		in, out := &in.RevokedUsers, &out.RevokedUsers
+		*out = make(v2.RevocationList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.RevokedUserExpiries != nil {
+		in, out := &in.RevokedUserExpiries, &out.RevokedUserExpiries
+		*out = make(map[string]int64, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccountStatus.
@@ -192,13 +336,108 @@ func (in *NatsAccountStatus) DeepCopy() *NatsAccountStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NatsAccountTemplate) DeepCopyInto(out *NatsAccountTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccountTemplate.
+func (in *NatsAccountTemplate) DeepCopy() *NatsAccountTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(NatsAccountTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NatsAccountTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NatsAccountTemplateList) DeepCopyInto(out *NatsAccountTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NatsAccountTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccountTemplateList.
+func (in *NatsAccountTemplateList) DeepCopy() *NatsAccountTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(NatsAccountTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NatsAccountTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NatsAccountTemplateSpec) DeepCopyInto(out *NatsAccountTemplateSpec) {
+	*out = *in
+	in.Limits.DeepCopyInto(&out.Limits)
+	in.DefaultPermissions.DeepCopyInto(&out.DefaultPermissions)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccountTemplateSpec.
+func (in *NatsAccountTemplateSpec) DeepCopy() *NatsAccountTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NatsAccountTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NatsLimits) DeepCopyInto(out *NatsLimits) {
+	*out = *in
+	if in.Payload != nil {
+		in, out := &in.Payload, &out.Payload
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsLimits.
+func (in *NatsLimits) DeepCopy() *NatsLimits {
+	if in == nil {
+		return nil
+	}
+	out := new(NatsLimits)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NatsOperator) DeepCopyInto(out *NatsOperator) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsOperator.
@@ -259,6 +498,11 @@ func (in *NatsOperatorSpec) DeepCopyInto(out *NatsOperatorSpec) {
 		*out = make(v2.StringList, len(*in))
 		copy(*out, *in)
 	}
+	if in.ConnectionPool != nil {
+		in, out := &in.ConnectionPool, &out.ConnectionPool
+		*out = new(ConnectionPool)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsOperatorSpec.
@@ -274,6 +518,13 @@ func (in *NatsOperatorSpec) DeepCopy() *NatsOperatorSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NatsOperatorStatus) DeepCopyInto(out *NatsOperatorStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsOperatorStatus.
@@ -349,13 +600,24 @@ func (in *NatsUserList) DeepCopyObject() runtime.Object {
 func (in *NatsUserSpec) DeepCopyInto(out *NatsUserSpec) {
 	*out = *in
 	out.AccountRef = in.AccountRef
+	if in.SigningKeySecretRef != nil {
+		in, out := &in.SigningKeySecretRef, &out.SigningKeySecretRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
 	in.Permissions.DeepCopyInto(&out.Permissions)
 	in.Limits.DeepCopyInto(&out.Limits)
 	if in.AllowedConnectionTypes != nil {
 		in, out := &in.AllowedConnectionTypes, &out.AllowedConnectionTypes
-		*out = make(v2.StringList, len(*in))
+		*out = make([]ConnectionType, len(*in))
 		copy(*out, *in)
 	}
+	in.SecretTemplate.DeepCopyInto(&out.SecretTemplate)
+	if in.Expiry != nil {
+		in, out := &in.Expiry, &out.Expiry
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsUserSpec.
@@ -386,14 +648,14 @@ func (in *NatsUserStatus) DeepCopy() *NatsUserStatus {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OperatorLimits) DeepCopyInto(out *OperatorLimits) {
 	*out = *in
-	out.NatsLimits = in.NatsLimits
-	out.AccountLimits = in.AccountLimits
-	out.JetStreamLimits = in.JetStreamLimits
+	in.NatsLimits.DeepCopyInto(&out.NatsLimits)
+	in.AccountLimits.DeepCopyInto(&out.AccountLimits)
+	in.JetStreamLimits.DeepCopyInto(&out.JetStreamLimits)
 	if in.JetStreamTieredLimits != nil {
 		in, out := &in.JetStreamTieredLimits, &out.JetStreamTieredLimits
-		*out = make(v2.JetStreamTieredLimits, len(*in))
+		*out = make(map[string]JetStreamLimits, len(*in))
 		for key, val := range *in {
-			(*out)[key] = val
+			(*out)[key] = *val.DeepCopy()
 		}
 	}
 }
@@ -440,7 +702,7 @@ func (in *Permissions) DeepCopyInto(out *Permissions) {
 	in.Sub.DeepCopyInto(&out.Sub)
 	if in.Resp != nil {
 		in, out := &in.Resp, &out.Resp
-		*out = new(v2.ResponsePermission)
+		*out = new(ResponsePermission)
 		**out = **in
 	}
 }
@@ -455,6 +717,82 @@ func (in *Permissions) DeepCopy() *Permissions {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PublishStatus) DeepCopyInto(out *PublishStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PublishStatus.
+func (in *PublishStatus) DeepCopy() *PublishStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PublishStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResponsePermission) DeepCopyInto(out *ResponsePermission) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResponsePermission.
+func (in *ResponsePermission) DeepCopy() *ResponsePermission {
+	if in == nil {
+		return nil
+	}
+	out := new(ResponsePermission)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScopedSigningKey) DeepCopyInto(out *ScopedSigningKey) {
+	*out = *in
+	in.Template.DeepCopyInto(&out.Template)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScopedSigningKey.
+func (in *ScopedSigningKey) DeepCopy() *ScopedSigningKey {
+	if in == nil {
+		return nil
+	}
+	out := new(ScopedSigningKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretTemplate) DeepCopyInto(out *SecretTemplate) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretTemplate.
+func (in *SecretTemplate) DeepCopy() *SecretTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UserLimits) DeepCopyInto(out *UserLimits) {
 	*out = *in
@@ -479,3 +817,25 @@ func (in *UserLimits) DeepCopy() *UserLimits {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserTemplate) DeepCopyInto(out *UserTemplate) {
+	*out = *in
+	in.Permissions.DeepCopyInto(&out.Permissions)
+	in.Limits.DeepCopyInto(&out.Limits)
+	if in.AllowedConnectionTypes != nil {
+		in, out := &in.AllowedConnectionTypes, &out.AllowedConnectionTypes
+		*out = make([]ConnectionType, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserTemplate.
+func (in *UserTemplate) DeepCopy() *UserTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(UserTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
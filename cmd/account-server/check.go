@@ -0,0 +1,47 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+// runCheckConnection implements the check-connection subcommand, which connects to NATS with the environment
+// of the account server, e.g. NATS_URL, NATS_CREDS_FILE and the TLS settings, to verify them before deploying.
+func runCheckConnection(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("check-connection", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	url := fs.String("url", os.Getenv("NATS_URL"), "URL of the NATS servers, defaults to NATS_URL.")
+	subscribeLookup := fs.Bool("subscribe-lookup", false, "Also subscribe to account lookups, to verify the permissions of the account server.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	creds, err := natsCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	connConf := controllers.NatsConnConfig{}
+	if err := natsConnConfigFromEnv(&connConf); err != nil {
+		return err
+	}
+	return controllers.CheckConnection(*url, creds, connConf, *subscribeLookup, stdout)
+}
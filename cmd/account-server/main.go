@@ -17,19 +17,27 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"syscall"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	uberzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
 	"github.com/deinstapel/nats-jwt-operator/controllers"
@@ -49,10 +57,54 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-connection" {
+		if err := runCheckConnection(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var probeAddr string
+	var adminAddr string
+	var settingsFile string
+	var reconnectBaseDelay time.Duration
+	var reconnectMaxDelay time.Duration
+	var compression bool
+	var pingInterval time.Duration
+	var maxPingsOutstanding int
+	var flusherTimeout time.Duration
+	accountServer := controllers.NewAccountServer()
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8082", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8083", "The address the probe endpoint binds to.")
+	flag.StringVar(&adminAddr, "admin-bind-address", "", "The address the admin API binds to, disabled if empty. Requires ADMIN_TOKEN to be set.")
+	flag.StringVar(&settingsFile, "settings-file", "", "YAML file of settings reloaded by POST /settings/reload of the admin API, e.g. the log level. Disabled if empty.")
+	flag.DurationVar(&reconnectBaseDelay, "reconnect-base-delay", controllers.DEFAULT_RECONNECT_BASE_DELAY, "Delay before the first NATS reconnect attempt, doubled for every further attempt.")
+	flag.DurationVar(&reconnectMaxDelay, "reconnect-max-delay", controllers.DEFAULT_RECONNECT_MAX_DELAY, "Upper bound for the delay between NATS reconnect attempts.")
+	flag.BoolVar(&compression, "nats-compression", false, "Request compression of the NATS connection, only supported by NATS for websocket URLs.")
+	flag.DurationVar(&pingInterval, "nats-ping-interval", controllers.DEFAULT_PING_INTERVAL, "Interval in which the NATS server is pinged to detect dead connections.")
+	flag.IntVar(&maxPingsOutstanding, "nats-max-pings-outstanding", controllers.DEFAULT_MAX_PINGS_OUTSTANDING, "Unanswered pings after which the NATS connection is considered dead and reconnected.")
+	flag.DurationVar(&flusherTimeout, "nats-flusher-timeout", controllers.DEFAULT_FLUSHER_TIMEOUT, "Time writes to the NATS server may block before the connection is considered dead.")
+	flag.IntVar(&accountServer.PublishRetries, "publish-retries", accountServer.PublishRetries, "How often a failed claims update is retried.")
+	flag.DurationVar(&accountServer.PublishBackoff, "publish-backoff", accountServer.PublishBackoff, "Initial backoff between claims update retries.")
+	flag.DurationVar(&accountServer.PublishTimeout, "publish-timeout", accountServer.PublishTimeout, "Time to wait for NATS to acknowledge a claims update.")
+	flag.DurationVar(&accountServer.PublishFailedRequeue, "publish-failed-requeue", accountServer.PublishFailedRequeue, "Delay until an account is retried after all publish attempts failed.")
+	flag.DurationVar(&accountServer.StaleAfter, "stale-after", 0, "Age of the last claims update accepted by NATS from which on an account is reported stale, 0 only reports accounts never accepted.")
+	flag.IntVar(&accountServer.PublishBreaker.Threshold, "publish-breaker-threshold", accountServer.PublishBreaker.Threshold, "Consecutive failed claims updates after which publishing is suspended, 0 disables suspending.")
+	flag.DurationVar(&accountServer.PublishBreaker.Cooldown, "publish-breaker-cooldown", accountServer.PublishBreaker.Cooldown, "Time publishing stays suspended before a single claims update is tried again.")
+	flag.BoolVar(&accountServer.LookupExistenceChecks, "lookup-existence-checks", false, "Answer account lookups carrying the Nats-Jwt-Operator-Lookup: exists header with a marker instead of the JWT.")
+	flag.BoolVar(&accountServer.LookupFromAPI, "lookup-from-api", false, "Answer lookups of accounts not served yet with the NatsAccount holding the key in its status, e.g. right after the start.")
+	flag.StringVar(&accountServer.LookupQueueGroup, "lookup-queue-group", "", "Queue group to subscribe to account lookups in, so only one replica answers each lookup. Empty lets every replica answer.")
+	flag.StringVar(&accountServer.LookupSubject, "lookup-subject", controllers.LOOKUP_SUBJECT, "Subject account lookups are subscribed on, its single * token stands for the account public key.")
+	flag.IntVar(&accountServer.LookupSizeWarnThreshold, "lookup-size-warn-threshold", accountServer.LookupSizeWarnThreshold, "Size in bytes above which account lookup responses are logged as warning, 0 disables the warning.")
+	flag.DurationVar(&accountServer.CredentialsWatchInterval, "credentials-watch-interval", accountServer.CredentialsWatchInterval, "Interval in which the NATS credential and TLS files are checked for changes to reconnect with them, 0 disables it.")
+	flag.DurationVar(&accountServer.ReconnectingTimeout, "nats-reconnecting-timeout", accountServer.ReconnectingTimeout, "Time the NATS connection may keep reconnecting before a new connection is dialed from scratch, 0 disables it.")
+	flag.DurationVar(&accountServer.RepublishInterval, "republish-interval", 0, "Interval in which all accounts are pushed to NATS again, regardless of changes. 0 disables it.")
+	flag.IntVar(&accountServer.MaxConcurrentReconciles, "max-concurrent-reconciles", accountServer.MaxConcurrentReconciles, "Number of accounts reconciled in parallel.")
+	flag.BoolVar(&accountServer.KeepNewerServerClaims, "keep-newer-server-claims", false, "Skip claims updates of accounts for which NATS holds a JWT issued later or in the same second, e.g. pushed by another tool.")
+	flag.DurationVar(&accountServer.DeletionGracePeriod, "deletion-grace-period", 0, "Time the JWT of a deleted account is still served, so its users aren't rejected right away. Afterwards the account is disabled in NATS. 0 disables it immediately.")
+	flag.BoolVar(&accountServer.FailClosed, "fail-closed", false, "Requeue accounts instead of serving them best effort while NATS is unreachable, and report not ready until all accounts were pushed.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -60,7 +112,20 @@ func main() {
 	flag.Parse()
 	mainContext := ctrl.SetupSignalHandler()
 
+	// The log level can be changed by reloading the settings
+	logLevel, ok := opts.Level.(uberzap.AtomicLevel)
+	if !ok {
+		logLevel = uberzap.NewAtomicLevelAt(zapcore.InfoLevel)
+		if opts.Development {
+			logLevel.SetLevel(zapcore.DebugLevel)
+		}
+		opts.Level = logLevel
+	}
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if err := controllers.ValidateLookupSubject(accountServer.LookupSubject); err != nil {
+		setupLog.Error(err, "invalid lookup subject")
+		os.Exit(1)
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -74,20 +139,56 @@ func main() {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
-	accountServer := controllers.NewAccountServer()
 	accountServer.Scheme = mgr.GetScheme()
 	accountServer.Client = mgr.GetClient()
 
+	if systemAccountFile := os.Getenv("NATS_SYSTEM_ACCOUNT_JWT_FILE"); systemAccountFile != "" {
+		if err := accountServer.SeedSystemAccount(systemAccountFile); err != nil {
+			setupLog.Error(err, "unable to load system account jwt")
+			os.Exit(1)
+		}
+	}
+	if staticDir := os.Getenv("NATS_STATIC_JWTS_DIR"); staticDir != "" {
+		if err := accountServer.LoadStaticAccounts(staticDir); err != nil {
+			setupLog.Error(err, "unable to load static account jwts")
+			os.Exit(1)
+		}
+	}
+
+	if resolverDir := os.Getenv("NATS_RESOLVER_DIR"); resolverDir != "" {
+		if err := controllers.CheckResolverDir(resolverDir); err != nil {
+			setupLog.Error(err, "unable to use resolver directory")
+			os.Exit(1)
+		}
+		accountServer.ResolverDir = resolverDir
+	}
+
+	connConf := controllers.NatsConnConfig{
+		ReconnectDelay:      controllers.CappedExponentialReconnectDelay(reconnectBaseDelay, reconnectMaxDelay),
+		Compression:         compression,
+		PingInterval:        pingInterval,
+		MaxPingsOutstanding: maxPingsOutstanding,
+		FlusherTimeout:      flusherTimeout,
+	}
+	if err := natsConnConfigFromEnv(&connConf); err != nil {
+		setupLog.Error(err, "unable to set up nats connection")
+		os.Exit(1)
+	}
+
 	mgr.AddHealthzCheck("accountServer", accountServer.Healthy)
 	mgr.AddReadyzCheck("accountServer", accountServer.Ready)
 
 	go func() {
-		tlsConf := controllers.NatsTlsConfig {
-			ClientCertPath: os.Getenv("NATS_CLIENT_CERT_PATH"),
-			ClientKeyPath: os.Getenv("NATS_CLIENT_KEY_PATH"),
-			CaPath: os.Getenv("NATS_TLS_CA_PATH"),
+		creds, err := natsCredentialsFromEnv()
+		if err != nil {
+			setupLog.Error(err, "Invalid nats credentials config")
+			os.Exit(1)
+		}
+		// The config file is reloaded on SIGHUP
+		if configFile := os.Getenv("NATS_CONFIG_FILE"); configFile != "" {
+			go accountServer.ReloadOnSignal(mainContext, configFile, syscall.SIGHUP)
 		}
-		if err := accountServer.Run(mainContext, os.Getenv("NATS_URL"), os.Getenv("NATS_CREDS_FILE"), tlsConf); err != nil {
+		if err := accountServer.Run(mainContext, os.Getenv("NATS_URL"), creds.CredsFile, creds.NatsTlsConfig, connConf); err != nil {
 			setupLog.Error(err, "Failed to run accountserver")
 		}
 	}()
@@ -97,6 +198,31 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Readiness waits for the accounts issued before the start to be served
+	if err := mgr.Add(manager.RunnableFunc(accountServer.WarmCache)); err != nil {
+		setupLog.Error(err, "unable to set up account cache warm")
+		os.Exit(1)
+	}
+
+	if adminAddr != "" {
+		adminServer := &controllers.AdminServer{
+			AccountServer: accountServer,
+			Token:         os.Getenv("ADMIN_TOKEN"),
+			SettingsFile:  settingsFile,
+			LogLevel:      &logLevel,
+		}
+		if adminServer.Token == "" {
+			setupLog.Error(nil, "admin API requires ADMIN_TOKEN to be set")
+			os.Exit(1)
+		}
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return adminServer.Start(ctx, adminAddr)
+		})); err != nil {
+			setupLog.Error(err, "unable to set up admin API")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -112,3 +238,69 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// natsCredentialsFromEnv returns the credentials and TLS settings to connect to NATS with.
+// NATS_CONFIG_FILE replaces the credentials from the environment.
+func natsCredentialsFromEnv() (controllers.NatsCredentialsConfig, error) {
+	if configFile := os.Getenv("NATS_CONFIG_FILE"); configFile != "" {
+		return controllers.LoadNatsCredentialsConfig(configFile)
+	}
+	creds := controllers.NatsCredentialsConfig{
+		CredsFile: os.Getenv("NATS_CREDS_FILE"),
+		NatsTlsConfig: controllers.NatsTlsConfig{
+			ClientCertPath:     os.Getenv("NATS_CLIENT_CERT_PATH"),
+			ClientKeyPath:      os.Getenv("NATS_CLIENT_KEY_PATH"),
+			CaPath:             os.Getenv("NATS_TLS_CA_PATH"),
+			MinVersion:         os.Getenv("NATS_TLS_MIN_VERSION"),
+			InsecureSkipVerify: os.Getenv("NATS_TLS_INSECURE_SKIP_VERIFY") == "true",
+		},
+	}
+	for _, suite := range strings.Split(os.Getenv("NATS_TLS_CIPHER_SUITES"), ",") {
+		if suite = strings.TrimSpace(suite); suite != "" {
+			creds.CipherSuites = append(creds.CipherSuites, suite)
+		}
+	}
+	return creds, creds.Validate()
+}
+
+// natsConnConfigFromEnv sets up the proxy, user JWT provider and token of connConf from the environment
+func natsConnConfigFromEnv(connConf *controllers.NatsConnConfig) error {
+	var err error
+	if proxyURL := os.Getenv("NATS_PROXY_URL"); proxyURL != "" {
+		if connConf.Dialer, err = controllers.NewProxyDialer(proxyURL); err != nil {
+			return fmt.Errorf("invalid nats proxy: %w", err)
+		}
+	}
+	userJWTCommand, userJWTFile := os.Getenv("NATS_USER_JWT_COMMAND"), os.Getenv("NATS_USER_JWT_FILE")
+	if userJWTCommand != "" && userJWTFile != "" {
+		return fmt.Errorf("NATS_USER_JWT_COMMAND and NATS_USER_JWT_FILE can't be used together")
+	}
+	if userJWTCommand != "" {
+		if connConf.UserJWT, err = controllers.NewCommandUserJWTProvider(userJWTCommand, os.Getenv("NATS_USER_SEED_FILE")); err != nil {
+			return fmt.Errorf("invalid nats user jwt provider: %w", err)
+		}
+	}
+	if userJWTFile != "" {
+		userJWT, err := os.ReadFile(userJWTFile)
+		if err != nil {
+			return err
+		}
+		seed, err := os.ReadFile(os.Getenv("NATS_USER_SEED_FILE"))
+		if err != nil {
+			return fmt.Errorf("NATS_USER_JWT_FILE requires the user seed in NATS_USER_SEED_FILE: %w", err)
+		}
+		if connConf.UserJWT, err = controllers.NewUserJWTProvider(string(userJWT), seed); err != nil {
+			return fmt.Errorf("invalid nats user jwt: %w", err)
+		}
+	}
+	if tokenFile := os.Getenv("NATS_TOKEN_FILE"); tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		if connConf.Token = strings.TrimSpace(string(token)); connConf.Token == "" {
+			return fmt.Errorf("NATS_TOKEN_FILE %s is empty", tokenFile)
+		}
+	}
+	return nil
+}
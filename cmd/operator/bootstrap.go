@@ -0,0 +1,76 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+// runBootstrap implements the bootstrap subcommand, which prints the NATS server config of an operator of the cluster
+// of the current kubeconfig, to bootstrap NATS servers outside of it.
+func runBootstrap(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	namespace := fs.String("n", "default", "Namespace of the NatsOperator.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("the name of the NatsOperator is required")
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	return bootstrap(context.Background(), c, types.NamespacedName{Namespace: *namespace, Name: fs.Arg(0)}, stdout)
+}
+
+// bootstrap prints the operator, system account and resolver config of NATS servers trusting operator
+func bootstrap(ctx context.Context, c client.Reader, key types.NamespacedName, stdout io.Writer) error {
+	operator := &natsv1alpha1.NatsOperator{}
+	if err := c.Get(ctx, key, operator); err != nil {
+		return err
+	}
+	if operator.Status.JWT == "" {
+		return fmt.Errorf("operator %s has no JWT issued yet", key)
+	}
+	sysacc := &natsv1alpha1.NatsAccount{}
+	if err := c.Get(ctx, controllers.SystemAccountName(key), sysacc); err != nil {
+		return fmt.Errorf("system account of operator %s: %v", key, err)
+	}
+	if sysacc.Status.JWT == "" {
+		return fmt.Errorf("system account %s has no JWT issued yet", controllers.SystemAccountName(key))
+	}
+	_, err := io.WriteString(stdout, controllers.ServerConfig(operator, sysacc))
+	return err
+}
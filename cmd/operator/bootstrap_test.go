@@ -0,0 +1,74 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/conf"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestBootstrapConfig(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	operatorKey, _ := nkeys.CreateOperator()
+	operatorPublic, _ := operatorKey.PublicKey()
+	systemKey, _ := nkeys.CreateAccount()
+	systemPublic, _ := systemKey.PublicKey()
+	operatorClaims := jwt.NewOperatorClaims(operatorPublic)
+	operatorClaims.SystemAccount = systemPublic
+	operatorJWT, err := operatorClaims.Encode(operatorKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	systemJWT, err := jwt.NewAccountClaims(systemPublic).Encode(operatorKey)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	operator := &natsv1alpha1.NatsOperator{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nats", Name: "root"},
+		Status:     natsv1alpha1.NatsOperatorStatus{PublicKey: operatorPublic, JWT: operatorJWT},
+	}
+	system := &natsv1alpha1.NatsAccount{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nats", Name: "root-system"},
+		Status:     natsv1alpha1.NatsAccountStatus{PublicKey: systemPublic, JWT: systemJWT},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, system).Build()
+
+	stdout := &bytes.Buffer{}
+	g.Expect(bootstrap(ctx, c, types.NamespacedName{Namespace: "nats", Name: "root"}, stdout)).To(Succeed())
+	config, err := conf.Parse(stdout.String())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config).To(HaveKeyWithValue("operator", operatorJWT))
+	g.Expect(config).To(HaveKeyWithValue("system_account", systemPublic))
+	g.Expect(config).To(HaveKeyWithValue("resolver", HaveKeyWithValue("type", "full")))
+	g.Expect(config).To(HaveKeyWithValue("resolver_preload", HaveKeyWithValue(systemPublic, systemJWT)))
+
+	// Operators whose system account isn't issued yet can't bootstrap servers
+	g.Expect(bootstrap(ctx, c, types.NamespacedName{Namespace: "nats", Name: "other"}, stdout)).NotTo(Succeed())
+	system.Status.JWT = ""
+	c = fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, system).Build()
+	err = bootstrap(ctx, c, types.NamespacedName{Namespace: "nats", Name: "root"}, stdout)
+	g.Expect(err).To(MatchError("system account nats/root-system has no JWT issued yet"))
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+// invalidNameChars matches everything not allowed in the name of a Kubernetes object
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// nscAccount is an account read from an nsc store, along with its users
+type nscAccount struct {
+	name   string
+	claims *jwt.AccountClaims
+	users  []*jwt.UserClaims
+}
+
+// runImport implements the import subcommand, which converts the accounts and users of an nsc store into
+// NatsAccount and NatsUser manifests. The seeds of the nsc keystore are put into the secrets the controllers
+// pick up, so the public keys of all accounts and users are kept.
+func runImport(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	storeDir := fs.String("store", "", "Path to the nsc store of the operator, e.g. ~/.local/share/nats/nsc/stores/<operator>.")
+	keysDir := fs.String("keys", defaultNscKeysDir(), "Path to the nsc keystore containing the seeds.")
+	operatorName := fs.String("operator", "", "Name of the NatsOperator the accounts are issued by.")
+	namespace := fs.String("namespace", "", "Namespace of the operator, the accounts and their secrets are created in.")
+	userNamespace := fs.String("user-namespace", "", "Namespace of the users and their secrets, defaults to -namespace.")
+	outFile := fs.String("o", "", "Path to write the manifests to, defaults to stdout.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *storeDir == "" || *operatorName == "" || *namespace == "" {
+		fs.Usage()
+		return fmt.Errorf("-store, -operator and -namespace are required")
+	}
+	if *userNamespace == "" {
+		*userNamespace = *namespace
+	}
+
+	accounts, err := readNscStore(*storeDir)
+	if err != nil {
+		return err
+	}
+
+	objects := []interface{}{}
+	names := map[string]string{}
+	for _, account := range accounts {
+		name := objectName(account.name)
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("accounts %q and %q both map to the name %s", other, account.name, name)
+		}
+		names[name] = account.name
+		for _, warning := range unsupportedAccountClaims(account.claims) {
+			fmt.Fprintf(stderr, "account %s: %s are not supported and skipped\n", account.name, warning)
+		}
+		objects = append(objects, &natsv1alpha1.NatsAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: natsv1alpha1.GroupVersion.String(), Kind: "NatsAccount"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: *namespace},
+			Spec:       accountSpec(account.claims, *operatorName, *userNamespace),
+		})
+		if secret := keySecret(stderr, *keysDir, name, *namespace, controllers.ACCOUNT_SECRET_TYPE, account.claims.Subject); secret != nil {
+			objects = append(objects, secret)
+		}
+
+		for _, user := range account.users {
+			userName := objectName(account.name + "-" + user.Name)
+			if other, ok := names[userName]; ok {
+				return fmt.Errorf("%q and user %q of account %q both map to the name %s", other, user.Name, account.name, userName)
+			}
+			names[userName] = user.Name
+			objects = append(objects, &natsv1alpha1.NatsUser{
+				TypeMeta:   metav1.TypeMeta{APIVersion: natsv1alpha1.GroupVersion.String(), Kind: "NatsUser"},
+				ObjectMeta: metav1.ObjectMeta{Name: userName, Namespace: *userNamespace},
+				Spec:       userSpec(user, account.claims, name, *namespace),
+			})
+			if secret := keySecret(stderr, *keysDir, userName, *userNamespace, controllers.USER_SECRET_TYPE, user.Subject); secret != nil {
+				objects = append(objects, secret)
+			}
+		}
+	}
+
+	manifests := &bytes.Buffer{}
+	for _, object := range objects {
+		manifest, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+		manifests.WriteString("---\n")
+		manifests.Write(manifest)
+	}
+	if *outFile != "" {
+		return os.WriteFile(*outFile, manifests.Bytes(), 0600)
+	}
+	_, err = stdout.Write(manifests.Bytes())
+	return err
+}
+
+// defaultNscKeysDir returns the keystore location nsc uses unless NKEYS_PATH is set
+func defaultNscKeysDir() string {
+	if dir := os.Getenv("NKEYS_PATH"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "share", "nats", "nsc", "keys")
+}
+
+// readNscStore decodes the accounts of an nsc operator store, which keeps them in accounts/<name>/<name>.jwt
+// and their users in accounts/<name>/users/<user>.jwt. Accounts are sorted by name, users by name within them.
+func readNscStore(dir string) ([]nscAccount, error) {
+	accountDirs, err := os.ReadDir(filepath.Join(dir, "accounts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading nsc store: %v", err)
+	}
+	accounts := []nscAccount{}
+	for _, accountDir := range accountDirs {
+		if !accountDir.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, "accounts", accountDir.Name())
+		token, err := os.ReadFile(filepath.Join(path, accountDir.Name()+".jwt"))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading account %s: %v", accountDir.Name(), err)
+		}
+		claims, err := jwt.DecodeAccountClaims(string(bytes.TrimSpace(token)))
+		if err != nil {
+			return nil, fmt.Errorf("failed decoding account %s: %v", accountDir.Name(), err)
+		}
+		account := nscAccount{name: accountDir.Name(), claims: claims}
+
+		userFiles, err := filepath.Glob(filepath.Join(path, "users", "*.jwt"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(userFiles)
+		for _, userFile := range userFiles {
+			token, err := os.ReadFile(userFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed reading user %s: %v", userFile, err)
+			}
+			user, err := jwt.DecodeUserClaims(string(bytes.TrimSpace(token)))
+			if err != nil {
+				return nil, fmt.Errorf("failed decoding user %s: %v", userFile, err)
+			}
+			if user.Name == "" {
+				user.Name = strings.TrimSuffix(filepath.Base(userFile), ".jwt")
+			}
+			account.users = append(account.users, user)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// objectName turns an nsc entity name into a valid Kubernetes object name
+func objectName(name string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// keySecret returns the secret adopting the seed of publicKey from the nsc keystore, which nsc keeps in
+// keys/<kind>/<2nd and 3rd character>/<public key>.nk. Missing seeds only print a warning, the controllers
+// create a new key for such objects.
+func keySecret(stderr io.Writer, keysDir, name, namespace, secretType, publicKey string) *corev1.Secret {
+	seedFile := filepath.Join(keysDir, "keys", publicKey[:1], publicKey[1:3], publicKey+".nk")
+	seed, err := os.ReadFile(seedFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "no seed for %s/%s (%s), a new key will be created: %v\n", namespace, name, publicKey, err)
+		return nil
+	}
+	return &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       corev1.SecretType(secretType),
+		Data: map[string][]byte{
+			controllers.OPERATOR_SEED_KEY:   bytes.TrimSpace(seed),
+			controllers.OPERATOR_PUBLIC_KEY: []byte(publicKey),
+		},
+	}
+}
+
+// unsupportedAccountClaims lists the parts of the account claims that NatsAccount can't express
+func unsupportedAccountClaims(claims *jwt.AccountClaims) []string {
+	unsupported := []string{}
+	if len(claims.Mappings) > 0 {
+		unsupported = append(unsupported, "subject mappings")
+	}
+	return unsupported
+}
+
+// accountSpec converts the claims of an nsc account into the spec issuing the same claims
+func accountSpec(claims *jwt.AccountClaims, operatorName, userNamespace string) natsv1alpha1.NatsAccountSpec {
+	spec := natsv1alpha1.NatsAccountSpec{
+		OperatorRef:         corev1.ObjectReference{Name: operatorName},
+		AllowUserNamespaces: []string{userNamespace},
+		Imports: lo.Map(claims.Imports, func(i *jwt.Import, _ int) natsv1alpha1.Import {
+			return natsv1alpha1.Import{
+				Name:         i.Name,
+				Subject:      i.Subject,
+				Account:      natsv1alpha1.AccountPublicKey(i.Account),
+				Token:        i.Token,
+				To:           i.To,
+				LocalSubject: i.LocalSubject,
+				Type:         i.Type,
+				Share:        i.Share,
+			}
+		}),
+		Exports: lo.Map(claims.Exports, func(e *jwt.Export, _ int) natsv1alpha1.Export {
+			return natsv1alpha1.Export{
+				Name:                 e.Name,
+				Subject:              e.Subject,
+				Type:                 e.Type,
+				TokenReq:             e.TokenReq,
+				Revocations:          e.Revocations,
+				ResponseType:         e.ResponseType,
+				ResponseThreshold:    e.ResponseThreshold,
+				Latency:              e.Latency,
+				AccountTokenPosition: e.AccountTokenPosition,
+				Advertise:            e.Advertise,
+				Info:                 e.Info,
+			}
+		}),
+		Limits: natsv1alpha1.OperatorLimits{
+			NatsLimits: natsv1alpha1.NatsLimits{
+				Subs:    claims.Limits.Subs,
+				Data:    claims.Limits.Data,
+				Payload: bytesQuantity(claims.Limits.Payload),
+			},
+			AccountLimits: natsv1alpha1.AccountLimits{
+				Imports:         lo.ToPtr(claims.Limits.Imports),
+				Exports:         lo.ToPtr(claims.Limits.Exports),
+				WildcardExports: claims.Limits.WildcardExports,
+				DisallowBearer:  claims.Limits.DisallowBearer,
+				Conn:            claims.Limits.Conn,
+				LeafNodeConn:    claims.Limits.LeafNodeConn,
+				LeafNode:        claims.Limits.LeafNodeConn != 0,
+			},
+			JetStreamLimits: jetStreamLimits(claims.Limits.JetStreamLimits),
+		},
+		Revocations:        claims.Revocations,
+		DefaultPermissions: permissions(claims.DefaultPermissions),
+	}
+	if len(claims.Limits.JetStreamTieredLimits) > 0 {
+		spec.Limits.JetStreamTieredLimits = map[string]natsv1alpha1.JetStreamLimits{}
+		for tier, limits := range claims.Limits.JetStreamTieredLimits {
+			spec.Limits.JetStreamTieredLimits[tier] = jetStreamLimits(limits)
+		}
+	}
+	signingKeys := lo.Keys(claims.SigningKeys)
+	sort.Strings(signingKeys)
+	for _, key := range signingKeys {
+		switch scope := claims.SigningKeys[key].(type) {
+		case nil:
+			spec.SigningKeys = append(spec.SigningKeys, natsv1alpha1.AccountPublicKey(key))
+		case *jwt.UserScope:
+			spec.ScopedSigningKeys = append(spec.ScopedSigningKeys, natsv1alpha1.ScopedSigningKey{
+				Key:      natsv1alpha1.AccountPublicKey(key),
+				Role:     scope.Role,
+				Template: userTemplate(scope.Template),
+			})
+		}
+	}
+	if claims.Expires != 0 {
+		spec.Expiry = &metav1.Duration{Duration: time.Duration(claims.Expires-claims.IssuedAt) * time.Second}
+	}
+	return spec
+}
+
+func jetStreamLimits(l jwt.JetStreamLimits) natsv1alpha1.JetStreamLimits {
+	return natsv1alpha1.JetStreamLimits{
+		MemoryStorage:        bytesQuantity(l.MemoryStorage),
+		DiskStorage:          bytesQuantity(l.DiskStorage),
+		Streams:              l.Streams,
+		Consumer:             l.Consumer,
+		MaxAckPending:        l.MaxAckPending,
+		MemoryMaxStreamBytes: l.MemoryMaxStreamBytes,
+		DiskMaxStreamBytes:   l.DiskMaxStreamBytes,
+		MaxBytesRequired:     l.MaxBytesRequired,
+	}
+}
+
+// storageQuantity returns the storage limit of the given bytes, nil if unset
+func bytesQuantity(limit int64) *resource.Quantity {
+	if limit == 0 {
+		return nil
+	}
+	return resource.NewQuantity(limit, resource.BinarySI)
+}
+
+func permissions(p jwt.Permissions) natsv1alpha1.Permissions {
+	permissions := natsv1alpha1.Permissions{
+		Pub: natsv1alpha1.Permission{Allow: p.Pub.Allow, Deny: p.Pub.Deny},
+		Sub: natsv1alpha1.Permission{Allow: p.Sub.Allow, Deny: p.Sub.Deny},
+	}
+	if p.Resp != nil {
+		permissions.Resp = &natsv1alpha1.ResponsePermission{MaxMsgs: p.Resp.MaxMsgs, Expires: p.Resp.Expires}
+	}
+	return permissions
+}
+
+// userSpec converts the claims of an nsc user of account into the spec of a user of the NatsAccount accountName.
+// Users of scoped signing keys are signed with the account key by the operator, so they get the template of the scope.
+func userSpec(claims *jwt.UserClaims, account *jwt.AccountClaims, accountName, accountNamespace string) natsv1alpha1.NatsUserSpec {
+	template := userTemplate(claims.UserPermissionLimits)
+	if scope, ok := account.SigningKeys[claims.Issuer].(*jwt.UserScope); ok {
+		template = userTemplate(scope.Template)
+	}
+	return natsv1alpha1.NatsUserSpec{
+		AccountRef:             corev1.ObjectReference{Name: accountName, Namespace: accountNamespace},
+		Permissions:            template.Permissions,
+		Limits:                 template.Limits,
+		BearerToken:            template.BearerToken,
+		AllowedConnectionTypes: template.AllowedConnectionTypes,
+	}
+}
+
+func userTemplate(p jwt.UserPermissionLimits) natsv1alpha1.UserTemplate {
+	return natsv1alpha1.UserTemplate{
+		Permissions: permissions(p.Permissions),
+		Limits: natsv1alpha1.Limits{
+			UserLimits: natsv1alpha1.UserLimits{
+				Src:    p.Src,
+				Times:  p.Times,
+				Locale: p.Locale,
+			},
+			NatsLimits: p.NatsLimits,
+		},
+		BearerToken: p.BearerToken,
+		AllowedConnectionTypes: lo.Map(p.AllowedConnectionTypes, func(c string, _ int) natsv1alpha1.ConnectionType {
+			return natsv1alpha1.ConnectionType(c)
+		}),
+	}
+}
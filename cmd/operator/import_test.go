@@ -0,0 +1,193 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+var nscStore = filepath.Join("testdata", "nsc", "stores", "acme")
+
+func readFixtureClaims(g *WithT, path ...string) string {
+	token, err := os.ReadFile(filepath.Join(append([]string{nscStore}, path...)...))
+	g.Expect(err).NotTo(HaveOccurred())
+	return strings.TrimSpace(string(token))
+}
+
+// splitManifests decodes the manifests printed by the import subcommand by kind and name
+func splitManifests(g *WithT, output string) (map[string]*natsv1alpha1.NatsAccount, map[string]*natsv1alpha1.NatsUser, map[string]*corev1.Secret) {
+	accounts := map[string]*natsv1alpha1.NatsAccount{}
+	users := map[string]*natsv1alpha1.NatsUser{}
+	secrets := map[string]*corev1.Secret{}
+	for _, manifest := range strings.Split(output, "---\n") {
+		if strings.TrimSpace(manifest) == "" {
+			continue
+		}
+		meta := &metav1.TypeMeta{}
+		g.Expect(yaml.Unmarshal([]byte(manifest), meta)).To(Succeed())
+		switch meta.Kind {
+		case "NatsAccount":
+			account := &natsv1alpha1.NatsAccount{}
+			g.Expect(yaml.UnmarshalStrict([]byte(manifest), account)).To(Succeed())
+			accounts[account.Name] = account
+		case "NatsUser":
+			user := &natsv1alpha1.NatsUser{}
+			g.Expect(yaml.UnmarshalStrict([]byte(manifest), user)).To(Succeed())
+			users[user.Name] = user
+		case "Secret":
+			secret := &corev1.Secret{}
+			g.Expect(yaml.UnmarshalStrict([]byte(manifest), secret)).To(Succeed())
+			secrets[secret.Name] = secret
+		default:
+			g.Expect(meta.Kind).To(BeEmpty(), "unexpected manifest")
+		}
+	}
+	return accounts, users, secrets
+}
+
+func TestImportNscStore(t *testing.T) {
+	g := NewWithT(t)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	g.Expect(runImport([]string{
+		"-store", nscStore,
+		"-keys", filepath.Join("testdata", "nsc", "keys"),
+		"-operator", "acme",
+		"-namespace", "nats",
+		"-user-namespace", "apps",
+	}, stdout, stderr)).To(Succeed())
+
+	accounts, users, secrets := splitManifests(g, stdout.String())
+	g.Expect(accounts).To(HaveLen(2))
+	g.Expect(users).To(HaveLen(2))
+
+	for name, path := range map[string][]string{
+		"billing":        {"accounts", "Billing", "Billing.jwt"},
+		"orders-service": {"accounts", "orders_service", "orders_service.jwt"},
+	} {
+		source, err := jwt.DecodeAccountClaims(readFixtureClaims(g, path...))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(accounts).To(HaveKey(name))
+		account := accounts[name]
+		g.Expect(account.Namespace).To(Equal("nats"))
+		g.Expect(account.Spec.OperatorRef.Name).To(Equal("acme"))
+		g.Expect(account.Spec.AllowUserNamespaces).To(Equal([]string{"apps"}))
+		g.Expect(account.Spec.Validate(time.Now())).To(Succeed(), name)
+
+		// The spec issues the same claims as the nsc account
+		issued := controllers.AccountClaims(source.Subject, account.Spec, time.Now()).Account
+		g.Expect(issued.Imports).To(ConsistOf(source.Imports), name)
+		g.Expect(issued.Exports).To(ConsistOf(source.Exports), name)
+		g.Expect(issued.Limits).To(Equal(source.Limits), name)
+		g.Expect(issued.SigningKeys).To(Equal(source.SigningKeys), name)
+		g.Expect(issued.DefaultPermissions).To(Equal(source.DefaultPermissions), name)
+
+		// The account identity is adopted from the keystore
+		g.Expect(secrets).To(HaveKey(name))
+		g.Expect(secrets[name].Namespace).To(Equal("nats"))
+		g.Expect(string(secrets[name].Type)).To(Equal("deinstapel.de/nats-account"))
+		g.Expect(string(secrets[name].Data[controllers.OPERATOR_PUBLIC_KEY])).To(Equal(source.Subject))
+		seed, err := os.ReadFile(filepath.Join("testdata", "nsc", "keys", "keys", source.Subject[:1], source.Subject[1:3], source.Subject+".nk"))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(secrets[name].Data[controllers.OPERATOR_SEED_KEY]).To(Equal(seed))
+	}
+	g.Expect(accounts["billing"].Spec.Expiry).NotTo(BeNil())
+	g.Expect(accounts["orders-service"].Spec.Expiry).To(BeNil())
+
+	for name, tc := range map[string]struct {
+		path    []string
+		account string
+	}{
+		"billing-reporting":  {[]string{"accounts", "Billing", "users", "reporting.jwt"}, "billing"},
+		"orders-service-api": {[]string{"accounts", "orders_service", "users", "api.jwt"}, "orders-service"},
+	} {
+		source, err := jwt.DecodeUserClaims(readFixtureClaims(g, tc.path...))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(users).To(HaveKey(name))
+		user := users[name]
+		g.Expect(user.Namespace).To(Equal("apps"))
+		g.Expect(user.Spec.AccountRef).To(Equal(corev1.ObjectReference{Name: tc.account, Namespace: "nats"}))
+
+		issued := user.Spec.ToNatsJWT()
+		g.Expect(issued.Permissions).To(Equal(source.Permissions), name)
+		g.Expect(issued.Limits).To(Equal(source.Limits), name)
+		g.Expect(issued.BearerToken).To(Equal(source.BearerToken), name)
+		g.Expect(issued.AllowedConnectionTypes).To(ConsistOf([]string(source.AllowedConnectionTypes)), name)
+	}
+
+	g.Expect(secrets).To(HaveKey("orders-service-api"))
+	g.Expect(secrets["orders-service-api"].Namespace).To(Equal("apps"))
+	g.Expect(string(secrets["orders-service-api"].Type)).To(Equal("deinstapel.de/nats-user"))
+	// The seed of the reporting user isn't in the keystore
+	g.Expect(secrets).NotTo(HaveKey("billing-reporting"))
+	g.Expect(stderr.String()).To(ContainSubstring("no seed for apps/billing-reporting"))
+}
+
+func TestImportRequiresStore(t *testing.T) {
+	g := NewWithT(t)
+	err := runImport([]string{"-operator", "acme", "-namespace", "nats"}, &bytes.Buffer{}, &bytes.Buffer{})
+	g.Expect(err).To(MatchError(ContainSubstring("required")))
+	err = runImport([]string{"-store", t.TempDir(), "-operator", "acme", "-namespace", "nats"}, &bytes.Buffer{}, &bytes.Buffer{})
+	g.Expect(err).To(MatchError(ContainSubstring("failed reading nsc store")))
+}
+
+// expectSameJSON compares claims by their encoding, which doesn't tell empty and unset lists apart
+func expectSameJSON(g *WithT, actual, expected interface{}) {
+	actualJSON, err := json.Marshal(actual)
+	g.Expect(err).NotTo(HaveOccurred())
+	expectedJSON, err := json.Marshal(expected)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(actualJSON).To(MatchJSON(expectedJSON))
+}
+
+func TestImportScopedSigningKey(t *testing.T) {
+	g := NewWithT(t)
+	account := jwt.NewAccountClaims("ADWSZBIM5FH5CLJJWDAJIVKJ3FYOQYNS4RL537JQTBXHHHDU5CPKOTCF")
+	scope := jwt.NewUserScope()
+	scope.Key = "ABXP3NDC635VNTKR7WOE2LQYCDRYGCIPHADKEFPKOMRKAHS47TQAJ24K"
+	scope.Role = "readonly"
+	scope.Template.Sub.Allow.Add("app.>")
+	scope.Template.Subs = 10
+	account.SigningKeys.AddScopedSigner(scope)
+
+	spec := accountSpec(account, "acme", "apps")
+	g.Expect(spec.SigningKeys).To(BeEmpty())
+	g.Expect(spec.ScopedSigningKeys).To(HaveLen(1))
+	g.Expect(spec.ScopedSigningKeys[0].Role).To(Equal("readonly"))
+	issued := controllers.AccountClaims(account.Subject, spec, time.Now())
+	expectSameJSON(g, issued.SigningKeys, account.SigningKeys)
+
+	// The scoped user carries no permissions itself, the operator signs it with the template instead
+	user := jwt.NewUserClaims("UB5T6JMBYFYPRCB3FQV7WTWHRTBVQALGQR4PTR32OODTTUMLNVHFBFIZ")
+	user.Issuer = scope.Key
+	user.UserPermissionLimits = jwt.UserPermissionLimits{}
+	expectSameJSON(g, userSpec(user, account, "app", "nats").ToNatsJWT().UserPermissionLimits, scope.Template)
+}
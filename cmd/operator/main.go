@@ -18,13 +18,19 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -48,22 +54,79 @@ func init() {
 	//+kubebuilder:scaffold:scheme
 }
 
+// newLogger returns the logger of the manager writing to out, --zap-encoder selects between console and JSON output
+func newLogger(opts *zap.Options, out io.Writer) logr.Logger {
+	return zap.New(zap.UseFlagOptions(opts), zap.WriteTo(out))
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := runSign(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		if err := runBootstrap(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-chain" {
+		if err := runVerifyChain(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxConcurrentReconciles int
+	var validateImports bool
+	var reportReconcileReason bool
+	var skipVerification bool
+	var externalAccounts string
+	var sweepInterval time.Duration
+	var deleteOrphanedSecrets bool
+	var enableWebhooks bool
+	var accountDirectory string
+	var revocationRetention time.Duration
+	var accountMetricLabels string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&reportReconcileReason, "report-reconcile-reason", false, "Report why the last reconcile of an account completed or requeued in its status.")
+	flag.BoolVar(&skipVerification, "skip-verification", false, "Don't verify that issued account and user JWTs chain to their issuer, for trusted signing paths where it adds measurable latency.")
+	flag.BoolVar(&validateImports, "validate-imports", false, "Warn about account imports from accounts which are neither a NatsAccount nor listed in --external-accounts.")
+	flag.StringVar(&externalAccounts, "external-accounts", "", "Comma separated public keys of accounts managed outside of the operator, which accounts may import from.")
+	flag.DurationVar(&sweepInterval, "orphaned-secrets-sweep-interval", time.Hour, "Interval of looking for key secrets whose NatsAccount or NatsUser doesn't exist anymore, 0 disables it.")
+	flag.BoolVar(&deleteOrphanedSecrets, "delete-orphaned-secrets", false, "Delete the orphaned key secrets found by the sweep, instead of only logging them.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", os.Getenv("ENABLE_WEBHOOKS") == "true", "Serve the validating admission webhook for NatsUsers on port 9443, requires a serving certificate in /tmp/k8s-webhook-server/serving-certs. "+
+		"Defaults to true if the environment variable ENABLE_WEBHOOKS is \"true\".")
+	flag.StringVar(&accountDirectory, "account-directory", "", "ConfigMap as <namespace>/<name> to publish the public keys of all NatsAccounts to, keyed by <namespace>.<name> of the account.")
+	flag.DurationVar(&revocationRetention, "revocation-retention", 0, "Leave revocations of deleted users out of the account JWTs once the revoked user JWT expired longer than this ago. 0 keeps them forever.")
+	flag.StringVar(&accountMetricLabels, "account-metric-labels", "", "Comma separated labels of NatsAccounts to add to the per-account metrics, at most 5.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", controllers.DEFAULT_MAX_CONCURRENT_RECONCILES, "Number of accounts and of users reconciled in parallel.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	ctrl.SetLogger(newLogger(&opts, os.Stderr))
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -89,28 +152,72 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.NatsOperatorReconciler{
+	operatorReconciler := &controllers.NatsOperatorReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	}
+	if err = operatorReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NatsOperator")
 		os.Exit(1)
 	}
+	var directory *types.NamespacedName
+	if accountDirectory != "" {
+		namespace, name, ok := strings.Cut(accountDirectory, "/")
+		if !ok || namespace == "" || name == "" {
+			setupLog.Error(fmt.Errorf("expected <namespace>/<name>, got %q", accountDirectory), "invalid --account-directory")
+			os.Exit(1)
+		}
+		directory = &types.NamespacedName{Namespace: namespace, Name: name}
+	}
+	if err := controllers.SetAccountMetricLabels(splitList(accountMetricLabels)); err != nil {
+		setupLog.Error(err, "invalid --account-metric-labels")
+		os.Exit(1)
+	}
 	if err = (&controllers.NatsAccountReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		ValidateImports:         validateImports,
+		ReportReconcileReason:   reportReconcileReason,
+		SkipVerification:        skipVerification,
+		ExternalAccounts:        splitList(externalAccounts),
+		AccountDirectory:        directory,
+		RevocationRetention:     revocationRetention,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NatsAccount")
 		os.Exit(1)
 	}
 	if err = (&controllers.NatsUserReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		SkipVerification:        skipVerification,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NatsUser")
 		os.Exit(1)
 	}
+	if enableWebhooks {
+		if err = (&controllers.NatsUserValidator{Client: mgr.GetClient()}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "NatsUser")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
+	if err := mgr.Add(controllers.NewLeadershipReporter(mgr.GetClient(), controllers.ReplicaIdentity())); err != nil {
+		setupLog.Error(err, "unable to set up leadership reporting")
+		os.Exit(1)
+	}
+
+	if sweepInterval > 0 {
+		if err := mgr.Add(&controllers.OrphanedSecretSweeper{
+			Client:        mgr.GetClient(),
+			Interval:      sweepInterval,
+			DeleteOrphans: deleteOrphanedSecrets,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up orphaned secret sweep")
+			os.Exit(1)
+		}
+	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
@@ -120,6 +227,10 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("operator-expiry", operatorReconciler.Ready); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -127,3 +238,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated flag value, ignoring empty entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func TestLogFormat(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		json bool
+	}{
+		{args: []string{}},
+		{args: []string{"--zap-encoder=console"}},
+		{args: []string{"--zap-encoder=json"}, json: true},
+	} {
+		g := NewWithT(t)
+		fs := flag.NewFlagSet("operator", flag.ContinueOnError)
+		opts := zap.Options{Development: true}
+		opts.BindFlags(fs)
+		g.Expect(fs.Parse(tc.args)).To(Succeed())
+
+		out := &bytes.Buffer{}
+		newLogger(&opts, out).WithName("setup").Info("starting manager", "accounts", 2)
+		line := map[string]interface{}{}
+		if !tc.json {
+			g.Expect(json.Unmarshal(out.Bytes(), &line)).NotTo(Succeed(), "%v", tc.args)
+			g.Expect(out.String()).To(MatchRegexp(`INFO\tsetup\tstarting manager\t{"accounts": 2}\n$`))
+			continue
+		}
+		g.Expect(json.Unmarshal(out.Bytes(), &line)).To(Succeed())
+		g.Expect(line).To(HaveKeyWithValue("level", "info"))
+		g.Expect(line).To(HaveKeyWithValue("logger", "setup"))
+		g.Expect(line).To(HaveKeyWithValue("msg", "starting manager"))
+		g.Expect(line).To(HaveKeyWithValue("accounts", BeEquivalentTo(2)))
+	}
+}
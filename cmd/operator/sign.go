@@ -0,0 +1,92 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nats-io/nkeys"
+	"sigs.k8s.io/yaml"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+// runSign implements the sign subcommand, which prints the JWT of a NatsAccount manifest without a cluster.
+// The account identity and the signing operator are passed as seed files, e.g. taken from the secrets.
+func runSign(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	accountFile := fs.String("f", "", "Path to the NatsAccount manifest, - reads from stdin.")
+	accountKeyFile := fs.String("account-key", "", "Path to the seed of the account identity key.")
+	signingKeyFile := fs.String("signing-key", "", "Path to the operator seed the account is signed with.")
+	outFile := fs.String("o", "", "Path to write the JWT to, defaults to stdout.")
+	claimsVersion := fs.Int("claims-version", 2, "JWT version to issue the account in, 1 for NATS servers before 2.2.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *accountFile == "" || *accountKeyFile == "" || *signingKeyFile == "" {
+		fs.Usage()
+		return fmt.Errorf("-f, -account-key and -signing-key are required")
+	}
+
+	var manifest []byte
+	var err error
+	if *accountFile == "-" {
+		manifest, err = io.ReadAll(os.Stdin)
+	} else {
+		manifest, err = os.ReadFile(*accountFile)
+	}
+	if err != nil {
+		return err
+	}
+	account := &natsv1alpha1.NatsAccount{}
+	if err := yaml.UnmarshalStrict(manifest, account); err != nil {
+		return fmt.Errorf("failed decoding account manifest: %v", err)
+	}
+
+	accountKp, err := readSeed(*accountKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed reading account key: %v", err)
+	}
+	signerKp, err := readSeed(*signingKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed reading signing key: %v", err)
+	}
+
+	token, err := controllers.SignAccount(account.Spec, accountKp, signerKp, *claimsVersion)
+	if err != nil {
+		return err
+	}
+	if *outFile != "" {
+		return os.WriteFile(*outFile, []byte(token), 0644)
+	}
+	_, err = fmt.Fprintln(stdout, token)
+	return err
+}
+
+func readSeed(path string) (nkeys.KeyPair, error) {
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return nkeys.FromSeed(bytes.TrimSpace(seed))
+}
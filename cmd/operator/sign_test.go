@@ -0,0 +1,90 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+)
+
+func writeSeed(g *WithT, dir, name string, kp nkeys.KeyPair) string {
+	seed, _ := kp.Seed()
+	path := filepath.Join(dir, name)
+	g.Expect(os.WriteFile(path, append(seed, '\n'), 0600)).To(Succeed())
+	return path
+}
+
+func TestSignAccount(t *testing.T) {
+	g := NewWithT(t)
+	dir := t.TempDir()
+	operator, _ := nkeys.CreateOperator()
+	operatorPublic, _ := operator.PublicKey()
+	account, _ := nkeys.CreateAccount()
+	accountPublic, _ := account.PublicKey()
+
+	stdout := &bytes.Buffer{}
+	g.Expect(runSign([]string{
+		"-f", filepath.Join("testdata", "account.yaml"),
+		"-account-key", writeSeed(g, dir, "account.seed", account),
+		"-signing-key", writeSeed(g, dir, "operator.seed", operator),
+	}, stdout, &bytes.Buffer{})).To(Succeed())
+
+	claims, err := jwt.DecodeAccountClaims(strings.TrimSpace(stdout.String()))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Subject).To(Equal(accountPublic))
+	g.Expect(claims.Issuer).To(Equal(operatorPublic))
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(10))
+	g.Expect(claims.Limits.Subs).To(BeEquivalentTo(-1))
+	g.Expect(claims.Exports).To(HaveLen(1))
+	g.Expect(claims.Exports[0].Type).To(Equal(jwt.Service))
+	g.Expect(time.Unix(claims.Expires, 0)).To(BeTemporally("~", time.Now().Add(720*time.Hour), time.Minute))
+}
+
+func TestSignAccountLegacyClaims(t *testing.T) {
+	g := NewWithT(t)
+	dir := t.TempDir()
+	operator, _ := nkeys.CreateOperator()
+	account, _ := nkeys.CreateAccount()
+
+	stdout := &bytes.Buffer{}
+	g.Expect(runSign([]string{
+		"-f", filepath.Join("testdata", "account.yaml"),
+		"-account-key", writeSeed(g, dir, "account.seed", account),
+		"-signing-key", writeSeed(g, dir, "operator.seed", operator),
+		"-claims-version", "1",
+	}, stdout, &bytes.Buffer{})).To(Succeed())
+
+	claims, err := jwt.DecodeAccountClaims(strings.TrimSpace(stdout.String()))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Version).To(Equal(1))
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(10))
+	g.Expect(claims.Exports).To(HaveLen(1))
+}
+
+func TestSignAccountRequiresKeys(t *testing.T) {
+	g := NewWithT(t)
+	err := runSign([]string{"-f", filepath.Join("testdata", "account.yaml")}, &bytes.Buffer{}, &bytes.Buffer{})
+	g.Expect(err).To(MatchError(ContainSubstring("required")))
+}
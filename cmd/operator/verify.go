@@ -0,0 +1,76 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+// runVerifyChain implements the verify-chain subcommand, which checks with the cluster of the current kubeconfig
+// that the JWT of an account chains to its operator and the JWTs of its users chain to the account.
+func runVerifyChain(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("verify-chain", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	namespace := fs.String("n", "default", "Namespace of the NatsAccount.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("the name of the NatsAccount is required")
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	return verifyChain(context.Background(), c, types.NamespacedName{Namespace: *namespace, Name: fs.Arg(0)}, stdout)
+}
+
+// verifyChain prints every link of the chain of account and fails if any of them is broken
+func verifyChain(ctx context.Context, c client.Reader, account types.NamespacedName, stdout io.Writer) error {
+	links, err := controllers.VerifyChain(ctx, c, account)
+	if err != nil {
+		return err
+	}
+	broken := 0
+	for _, link := range links {
+		if link.Error != "" {
+			broken++
+			fmt.Fprintf(stdout, "BROKEN %s %s (%s): %s\n", link.Kind, link.Name, link.PublicKey, link.Error)
+			continue
+		}
+		fmt.Fprintf(stdout, "OK     %s %s (%s) signed by %s\n", link.Kind, link.Name, link.PublicKey, link.Issuer)
+	}
+	if broken > 0 {
+		return fmt.Errorf("%d of %d JWTs of account %s don't chain to their issuer", broken, len(links), account)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestVerifyChainOutput(t *testing.T) {
+	g := NewWithT(t)
+	operatorKey, _ := nkeys.CreateOperator()
+	operatorPublic, _ := operatorKey.PublicKey()
+	accountKey, _ := nkeys.CreateAccount()
+	accountPublic, _ := accountKey.PublicKey()
+	accountJWT, err := jwt.NewAccountClaims(accountPublic).Encode(operatorKey)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	operator := &natsv1alpha1.NatsOperator{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nats", Name: "operator"},
+		Status:     natsv1alpha1.NatsOperatorStatus{PublicKey: operatorPublic},
+	}
+	account := &natsv1alpha1.NatsAccount{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nats", Name: "app"},
+		Spec:       natsv1alpha1.NatsAccountSpec{OperatorRef: corev1.ObjectReference{Name: "operator"}},
+		Status:     natsv1alpha1.NatsAccountStatus{PublicKey: accountPublic, JWT: accountJWT},
+	}
+	user := &natsv1alpha1.NatsUser{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nats", Name: "pending"},
+		Spec:       natsv1alpha1.NatsUserSpec{AccountRef: corev1.ObjectReference{Name: "app"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, account, user).Build()
+
+	stdout := &bytes.Buffer{}
+	err = verifyChain(context.Background(), c, types.NamespacedName{Namespace: "nats", Name: "app"}, stdout)
+	g.Expect(err).To(MatchError("1 of 2 JWTs of account nats/app don't chain to their issuer"))
+	g.Expect(stdout.String()).To(Equal(
+		"OK     NatsAccount nats/app (" + accountPublic + ") signed by " + operatorPublic + "\n" +
+			"BROKEN NatsUser nats/pending (): no JWT issued\n"))
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;patch
+
+// accountDirectoryKey is the key of account in the account directory ConfigMap.
+// ConfigMap keys can't contain a slash, and as namespaces can't contain a dot the first dot separates the namespace.
+func accountDirectoryKey(account types.NamespacedName) string {
+	return account.Namespace + "." + account.Name
+}
+
+// updateAccountDirectory records publicKey for account in the AccountDirectory ConfigMap, an empty publicKey
+// removes the account. The ConfigMap is patched, so accounts reconciled in parallel don't conflict, and
+// created on the first account.
+func (r *NatsAccountReconciler) updateAccountDirectory(ctx context.Context, account types.NamespacedName, publicKey string) error {
+	if r.AccountDirectory == nil {
+		return nil
+	}
+	key := accountDirectoryKey(account)
+	if published, ok := r.directory.Load(key); ok && published == publicKey {
+		return nil
+	}
+
+	// A null value removes the key in a merge patch
+	var value interface{}
+	if publicKey != "" {
+		value = publicKey
+	}
+	patch, err := json.Marshal(map[string]interface{}{"data": map[string]interface{}{key: value}})
+	if err != nil {
+		return err
+	}
+	directory := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Namespace: r.AccountDirectory.Namespace,
+		Name:      r.AccountDirectory.Name,
+	}}
+	err = r.Patch(ctx, directory, client.RawPatch(types.MergePatchType, patch))
+	if errors.IsNotFound(err) && publicKey != "" {
+		directory.Labels = map[string]string{SECRET_MANAGED_BY_LABEL: SECRET_MANAGED_BY}
+		directory.Data = map[string]string{key: publicKey}
+		err = r.Create(ctx, directory)
+	} else if errors.IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	r.directory.Store(key, publicKey)
+	return nil
+}
+
+// pruneAccountDirectory removes the entries of accounts that don't exist anymore from the AccountDirectory ConfigMap,
+// e.g. of accounts deleted while the operator wasn't running, and returns their keys. The ConfigMap is read with
+// reader, as ConfigMaps aren't cached.
+func (r *NatsAccountReconciler) pruneAccountDirectory(ctx context.Context, reader client.Reader) ([]string, error) {
+	if r.AccountDirectory == nil {
+		return nil, nil
+	}
+	directory := &corev1.ConfigMap{}
+	if err := reader.Get(ctx, *r.AccountDirectory, directory); errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(directory.Data))
+	for key := range directory.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pruned := []string{}
+	for _, key := range keys {
+		namespace, name, ok := strings.Cut(key, ".")
+		if !ok {
+			continue
+		}
+		account := types.NamespacedName{Namespace: namespace, Name: name}
+		if err := r.Get(ctx, account, &natsv1alpha1.NatsAccount{}); err == nil {
+			continue
+		} else if !errors.IsNotFound(err) {
+			return pruned, err
+		}
+		log.FromContext(ctx).Info("removing account directory entry of deleted account", "account", account)
+		if err := r.updateAccountDirectory(ctx, account, ""); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, key)
+	}
+	return pruned, nil
+}
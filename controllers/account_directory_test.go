@@ -0,0 +1,92 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestAccountDirectory(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	pinned, _ := nkeys.CreateAccount()
+	pinnedPublic, _ := pinned.PublicKey()
+	pinnedSeed, _ := pinned.Seed()
+	r := newTestAccountReconciler(g, newTestAccount("app"), newTestAccount("billing"), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "app-seed"},
+		Data:       map[string][]byte{OPERATOR_SEED_KEY: pinnedSeed},
+	})
+	r.AccountDirectory = &types.NamespacedName{Namespace: "nats-jwt-operator-system", Name: "nats-accounts"}
+	directory := func() map[string]string {
+		cm := &corev1.ConfigMap{}
+		g.Expect(r.Get(ctx, *r.AccountDirectory, cm)).To(Succeed())
+		return cm.Data
+	}
+
+	app, _ := reconcileAccount(g, r, "app")
+	billing, _ := reconcileAccount(g, r, "billing")
+	g.Expect(directory()).To(Equal(map[string]string{
+		"nats.app":     app.Status.PublicKey,
+		"nats.billing": billing.Status.PublicKey,
+	}))
+
+	// Changing the account key updates its entry
+	app.Spec.SeedSecretRef = &corev1.LocalObjectReference{Name: "app-seed"}
+	g.Expect(r.Update(ctx, app)).To(Succeed())
+	reconcileAccount(g, r, "app")
+	g.Expect(directory()).To(HaveKeyWithValue("nats.app", pinnedPublic))
+
+	// Deleting the account removes its entry once the finalizer runs
+	g.Expect(r.Delete(ctx, app)).To(Succeed())
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(app)})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(directory()).To(Equal(map[string]string{"nats.billing": billing.Status.PublicKey}))
+}
+
+func TestAccountDirectoryPrunesDeletedAccounts(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "nats-jwt-operator-system", Name: "nats-accounts"}
+	r := newTestAccountReconciler(g, newTestAccount("app"), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		// Accounts deleted while the operator wasn't running are still listed
+		Data: map[string]string{"nats.app": "AAPP", "nats.gone": "AGONE", "other.gone": "AOTHER"},
+	})
+	r.AccountDirectory = &key
+
+	pruned, err := r.pruneAccountDirectory(ctx, r.Client)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pruned).To(Equal([]string{"nats.gone", "other.gone"}))
+	directory := &corev1.ConfigMap{}
+	g.Expect(r.Get(ctx, key, directory)).To(Succeed())
+	g.Expect(directory.Data).To(Equal(map[string]string{"nats.app": "AAPP"}))
+
+	// Without a directory there is nothing to prune
+	r.AccountDirectory = &types.NamespacedName{Namespace: key.Namespace, Name: "missing"}
+	pruned, err = r.pruneAccountDirectory(ctx, r.Client)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pruned).To(BeEmpty())
+}
@@ -18,45 +18,252 @@ package controllers
 
 import (
 	"context"
-	"strings"
-	"sync"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/samber/lo"
 )
 
+const CLAIMS_UPDATE_SUBJECT = "$SYS.REQ.CLAIMS.UPDATE"
+const LOOKUP_SUBJECT = "$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP"
+
+// ACCOUNT_INFO_SUBJECT asks a NATS server about the account it holds, including its JWT
+const ACCOUNT_INFO_SUBJECT = "$SYS.REQ.ACCOUNT.%s.INFO"
+
+// Lookups carrying LOOKUP_MODE_HEADER with LOOKUP_MODE_EXISTS only ask whether an account is known.
+// They are answered with LOOKUP_EXISTS_MARKER instead of the JWT, or an empty response for unknown accounts.
+const LOOKUP_MODE_HEADER = "Nats-Jwt-Operator-Lookup"
+const LOOKUP_MODE_EXISTS = "exists"
+const LOOKUP_EXISTS_MARKER = "exists"
+
+// CONFLICT_REQUEUE is the interval in which accounts with a conflicting public key are rechecked
+const CONFLICT_REQUEUE = time.Minute
+
+// DISCONNECTED_REQUEUE is the interval in which accounts are retried while NATS is unreachable in fail closed mode
+const DISCONNECTED_REQUEUE = 10 * time.Second
+
+// PUBLISH_STATUS_REFRESH is the minimum age of the recorded publish time before an unchanged outcome is recorded again
+const PUBLISH_STATUS_REFRESH = 5 * time.Minute
+
 // NatsAccountServer takes NatsAccount and serves them to a nats server (cluster)
 type NatsAccountServer struct {
 	client.Client
-	Scheme     *runtime.Scheme
-	accountMap map[string]string
-	nc         *nats.Conn
-	alive      chan interface{}
-	natsReady  sync.Mutex
+	Scheme *runtime.Scheme
+
+	// PublishRetries is the number of times a failed claims update is retried before giving up
+	PublishRetries int
+	// PublishBackoff is the initial delay between two publish attempts, doubled after every attempt
+	PublishBackoff time.Duration
+	// PublishTimeout is the time to wait for a NATS server to acknowledge a claims update
+	PublishTimeout time.Duration
+	// PublishFailedRequeue is the delay until an account is retried once all publish attempts failed
+	PublishFailedRequeue time.Duration
+	// StaleAfter is the age of the last claims update accepted by NATS from which on an account is reported
+	// as stale. Accounts NATS never accepted a claims update of are always stale, 0 only reports these.
+	StaleAfter time.Duration
+	// PublishBreaker suspends publishing once claims updates keep failing, accounts stay served via lookups meanwhile
+	PublishBreaker *CircuitBreaker
+	// CredentialsWatchInterval is the interval in which mounted credentials are checked for changes, 0 disables it
+	CredentialsWatchInterval time.Duration
+	// ReconnectingTimeout is the time the NATS connection may keep reconnecting before it is closed and a new
+	// connection is dialed from scratch. 0 leaves reconnecting to the NATS client.
+	ReconnectingTimeout time.Duration
+	// RepublishInterval is the interval in which all accounts are pushed to NATS again, regardless of changes,
+	// so resolvers that missed claims updates heal. 0 disables it.
+	RepublishInterval time.Duration
+	// FailClosed makes reconciles requeue instead of succeeding while the NATS connection is lost,
+	// and reports the account server as not ready as long as accounts weren't pushed to NATS.
+	// By default accounts are only served via lookups in that case.
+	FailClosed bool
+	// LookupSizeWarnThreshold is the size in bytes above which lookup responses are logged as warning, 0 disables it
+	LookupSizeWarnThreshold int
+	// LookupExistenceChecks answers lookups asking for the existence of an account only with a marker,
+	// see LOOKUP_MODE_HEADER. Otherwise these are answered with the JWT like any other lookup.
+	LookupExistenceChecks bool
+	// LookupQueueGroup subscribes to lookups in this queue group, so only one of the replicas in it answers
+	// each lookup. Empty subscribes without a queue group, then every replica answers.
+	LookupQueueGroup string
+	// LookupSubject is the subject lookups are subscribed on, for NATS setups expecting lookups on their own subjects.
+	// Its single * token stands for the public key of the account looked up. Defaults to LOOKUP_SUBJECT.
+	LookupSubject string
+	// LookupFromAPI answers lookups of accounts that aren't served yet, e.g. right after the start, with the
+	// NatsAccount of any namespace holding the key in its status, fetched via ACCOUNT_PUBLIC_KEY_INDEX
+	LookupFromAPI bool
+	// MaxConcurrentReconciles is the number of accounts reconciled in parallel
+	MaxConcurrentReconciles int
+	// KeepNewerServerClaims asks NATS for the JWT it holds before every claims update, and skips the update if
+	// that JWT was issued after the one to push or in the same second, e.g. by another tool pushing claims.
+	// Updates are pushed if the server doesn't know the account yet or holds the JWT last pushed by this server.
+	KeepNewerServerClaims bool
+	// DeletionGracePeriod keeps serving the JWT of a deleted account for this long, e.g. while migrating the account
+	// to another NatsAccount. Afterwards the disabled JWT of the account is pushed, so NATS rejects its users.
+	// 0 disables it immediately.
+	DeletionGracePeriod time.Duration
+	// ResolverDir is a directory each served account JWT is written to as <public key>.jwt, for NATS servers
+	// reading accounts from a directory. Files are removed once their account is deleted. Empty disables it.
+	ResolverDir string
+
+	accountMap  map[string]servedAccount
+	accountLock sync.RWMutex
+	// settingsLock guards the settings ApplySettings may change while the account server runs
+	settingsLock sync.RWMutex
+	// staticAccounts are served on lookup without a NatsAccount, keyed by public key
+	staticAccounts map[string]string
+	// systemAccount is the public key of the system account, if known from a seeded or static JWT
+	systemAccount string
+	// diverged tracks the accounts which couldn't be pushed to NATS in fail closed mode
+	diverged map[types.NamespacedName]struct{}
+	// stale tracks the accounts reported with CONDITION_STALE, counted by the stale accounts metric
+	stale map[types.NamespacedName]struct{}
+	// publishes are the claims updates in flight, keyed by public key
+	publishes map[string]*claimsPublish
+	// pushed are the IDs of the JWTs last accepted by NATS, keyed by public key
+	pushed      map[string]string
+	publishLock sync.Mutex
+	// connect dials NATS with the given credentials, it's set by Run
+	connect func(creds NatsCredentialsConfig) (*nats.Conn, error)
+	creds   NatsCredentialsConfig
+	// credsFingerprint identifies the content of the credential files nc was established with
+	credsFingerprint [sha256.Size]byte
+	nc               *nats.Conn
+	sub              *nats.Subscription
+	connLock         sync.RWMutex
+	alive            chan interface{}
+	natsReady        sync.Mutex
+	// warmed is set once WarmCache served the accounts issued before the start
+	warmed atomic.Bool
+}
+
+// servedAccount is a single account JWT served to NATS, together with the object it originates from
+type servedAccount struct {
+	Owner types.NamespacedName
+	JWT   string
+	// Generation is the generation of the owner the JWT was served for
+	Generation int64
+	// RemoveAt is the time the JWT of a deleted owner stops being served, zero while the owner exists
+	RemoveAt time.Time
+	// DisabledJWT is pushed to NATS once the owner is deleted and the JWT stops being served
+	DisabledJWT string
 }
 
 // Configure TLS for Nats client, if required
 type NatsTlsConfig struct {
-	ClientCertPath string
-	ClientKeyPath string
-	CaPath string
+	ClientCertPath string `json:"clientCertPath,omitempty"`
+	ClientKeyPath  string `json:"clientKeyPath,omitempty"`
+	CaPath         string `json:"caPath,omitempty"`
+	// MinVersion is the lowest TLS version accepted from NATS servers, "1.2" or "1.3". Defaults to 1.2.
+	MinVersion string `json:"minVersion,omitempty"`
+	// CipherSuites restricts the TLS 1.2 cipher suites to these, named as by tls.CipherSuites.
+	// TLS 1.3 cipher suites can't be configured.
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+	// InsecureSkipVerify disables verifying the certificates of NATS servers, e.g. for self-signed
+	// certificates in development. Never enable it in production, anyone can impersonate NATS then.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// NatsCredentialsConfig contains the credentials the account server authenticates to NATS with.
+// They can be changed without a restart, see Reconfigure.
+type NatsCredentialsConfig struct {
+	CredsFile     string `json:"credsFile,omitempty"`
+	NatsTlsConfig `json:",inline"`
+}
+
+// NatsConnConfig tunes the behaviour of the NATS client connection
+type NatsConnConfig struct {
+	// ReconnectDelay returns the time to wait before the given reconnect attempt.
+	// Defaults to CappedExponentialReconnectDelay(DEFAULT_RECONNECT_BASE_DELAY, DEFAULT_RECONNECT_MAX_DELAY).
+	ReconnectDelay nats.ReconnectDelayHandler
+	// Dialer is used to open the connections to the NATS servers, e.g. one from NewProxyDialer.
+	// Connections are dialed directly if unset.
+	Dialer nats.CustomDialer
+	// Compression requests compressing the connection, if the server supports it.
+	// NATS only supports this for websocket connections (ws://, wss://).
+	Compression bool
+	// PingInterval is the interval in which the server is pinged, defaults to DEFAULT_PING_INTERVAL
+	PingInterval time.Duration
+	// MaxPingsOutstanding is the number of unanswered pings after which the connection is considered stale
+	// and reconnected, defaults to DEFAULT_MAX_PINGS_OUTSTANDING
+	MaxPingsOutstanding int
+	// FlusherTimeout bounds how long writes to the server may block, defaults to DEFAULT_FLUSHER_TIMEOUT
+	FlusherTimeout time.Duration
+	// UserJWT authenticates the connection with the JWTs it provides, instead of a creds file.
+	// A creds file can't be used at the same time.
+	UserJWT UserJWTProvider
+	// Token authenticates the connection with a token, as used by servers with token authorization.
+	// Neither a creds file nor a user JWT provider can be used at the same time.
+	Token string
+}
+
+const DEFAULT_RECONNECT_BASE_DELAY = 500 * time.Millisecond
+const DEFAULT_RECONNECT_MAX_DELAY = 30 * time.Second
+
+// A silently dropped connection is detected within DEFAULT_PING_INTERVAL * (DEFAULT_MAX_PINGS_OUTSTANDING + 1),
+// instead of the 6 minutes of the NATS client defaults
+const DEFAULT_PING_INTERVAL = 20 * time.Second
+const DEFAULT_MAX_PINGS_OUTSTANDING = 2
+
+// Without a flusher timeout, writes to a server that stopped reading block forever
+const DEFAULT_FLUSHER_TIMEOUT = 10 * time.Second
+
+// CappedExponentialReconnectDelay doubles the delay between reconnect attempts, starting at base, until max is reached
+func CappedExponentialReconnectDelay(base, max time.Duration) nats.ReconnectDelayHandler {
+	return func(attempts int) time.Duration {
+		delay := base
+		for i := 1; i < attempts && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
 }
 
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts/status,verbs=get;update;patch
 
 func NewAccountServer() *NatsAccountServer {
 	server := &NatsAccountServer{
-		accountMap: make(map[string]string),
-		alive: make(chan interface{}),
-		natsReady: sync.Mutex{},
+		PublishRetries:           3,
+		PublishBackoff:           500 * time.Millisecond,
+		PublishTimeout:           5 * time.Second,
+		PublishFailedRequeue:     2 * time.Minute,
+		PublishBreaker:           &CircuitBreaker{Threshold: 5, Cooldown: time.Minute},
+		CredentialsWatchInterval: 30 * time.Second,
+		ReconnectingTimeout:      5 * time.Minute,
+		MaxConcurrentReconciles:  DEFAULT_MAX_CONCURRENT_RECONCILES,
+		// Leave some headroom to the default max payload of 1MiB
+		LookupSizeWarnThreshold: 512 * 1024,
+		accountMap:              make(map[string]servedAccount),
+		diverged:                make(map[types.NamespacedName]struct{}),
+		stale:                   make(map[types.NamespacedName]struct{}),
+		publishes:               make(map[string]*claimsPublish),
+		pushed:                  make(map[string]string),
+		alive:                   make(chan interface{}),
+		natsReady:               sync.Mutex{},
 	}
 
 	// Keep this locked until r.nc is set at which point we can unlock it
@@ -65,9 +272,23 @@ func NewAccountServer() *NatsAccountServer {
 	return server
 }
 
-func connectToNats(url, credsFile string, tlsConf NatsTlsConfig) (*nats.Conn, error) {
-	opts := []nats.Option {
-		nats.UserCredentials(credsFile),
+func connectToNats(url, credsFile string, tlsConf NatsTlsConfig, connConf NatsConnConfig) (*nats.Conn, error) {
+	opts := []nats.Option{}
+
+	if credsFile != "" && connConf.UserJWT != nil {
+		return nil, fmt.Errorf("a creds file and a user JWT provider can't be used together")
+	}
+	if credsFile != "" {
+		opts = append(opts, nats.UserCredentials(credsFile))
+	}
+	if connConf.Token != "" && (credsFile != "" || connConf.UserJWT != nil) {
+		return nil, fmt.Errorf("a token can't be used together with a creds file or a user JWT provider")
+	}
+	if connConf.UserJWT != nil {
+		opts = append(opts, nats.UserJWT(connConf.UserJWT.UserJWT, connConf.UserJWT.Sign))
+	}
+	if connConf.Token != "" {
+		opts = append(opts, nats.Token(connConf.Token))
 	}
 
 	if tlsConf.ClientCertPath != "" && tlsConf.ClientKeyPath != "" {
@@ -78,43 +299,278 @@ func connectToNats(url, credsFile string, tlsConf NatsTlsConfig) (*nats.Conn, er
 		opts = append(opts, nats.RootCAs(tlsConf.CaPath))
 	}
 
+	if tlsConf.MinVersion != "" || len(tlsConf.CipherSuites) > 0 || tlsConf.InsecureSkipVerify {
+		tlsOption, err := tlsConf.constraints()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, tlsOption)
+	}
+
+	reconnectDelay := connConf.ReconnectDelay
+	if reconnectDelay == nil {
+		reconnectDelay = CappedExponentialReconnectDelay(DEFAULT_RECONNECT_BASE_DELAY, DEFAULT_RECONNECT_MAX_DELAY)
+	}
+	opts = append(opts, nats.CustomReconnectDelay(reconnectDelay))
+
+	if connConf.Dialer != nil {
+		opts = append(opts, nats.SetCustomDialer(connConf.Dialer))
+	}
+
+	if connConf.Compression {
+		opts = append(opts, nats.Compression(true))
+	}
+
+	pingInterval := connConf.PingInterval
+	if pingInterval == 0 {
+		pingInterval = DEFAULT_PING_INTERVAL
+	}
+	maxPingsOutstanding := connConf.MaxPingsOutstanding
+	if maxPingsOutstanding == 0 {
+		maxPingsOutstanding = DEFAULT_MAX_PINGS_OUTSTANDING
+	}
+	opts = append(opts, nats.PingInterval(pingInterval), nats.MaxPingsOutstanding(maxPingsOutstanding))
+
+	flusherTimeout := connConf.FlusherTimeout
+	if flusherTimeout == 0 {
+		flusherTimeout = DEFAULT_FLUSHER_TIMEOUT
+	}
+	opts = append(opts, nats.FlusherTimeout(flusherTimeout))
+
 	return nats.Connect(url, opts...)
 }
 
-func (r *NatsAccountServer) Run(ctx context.Context, url string, credsFile string, tlsConf NatsTlsConfig) error {
+func (r *NatsAccountServer) Run(ctx context.Context, url string, credsFile string, tlsConf NatsTlsConfig, connConf NatsConnConfig) error {
 	// Close if the this function exits, as we're probably not alive anymore!
 	defer close(r.alive)
 
 	logger := log.FromContext(ctx)
-	logger.Info("Connecting to nats", "server", url)
-	nc, err := connectToNats(url, credsFile, tlsConf)
-	if err != nil {
+	r.connLock.Lock()
+	r.creds = NatsCredentialsConfig{CredsFile: credsFile, NatsTlsConfig: tlsConf}
+	r.connect = func(creds NatsCredentialsConfig) (*nats.Conn, error) {
+		logger.Info("Connecting to nats", "server", url)
+		if creds.InsecureSkipVerify {
+			logger.Info("WARNING: TLS certificates of NATS servers are not verified, insecureSkipVerify must not be used in production", "server", url)
+		}
+		nc, err := connectToNats(url, creds.CredsFile, creds.NatsTlsConfig, connConf)
+		if err != nil {
+			return nil, err
+		}
+		// Servers may have missed claims updates while the connection was lost
+		nc.SetReconnectHandler(func(nc *nats.Conn) {
+			if err := r.ensureSubscribed(nc, logger); err != nil {
+				logger.Info("WARNING: failed subscribing to account lookups again after reconnecting", "err", err)
+			}
+			r.republishInBackground(ctx, logger)
+		})
+		return nc, nil
+	}
+	r.connLock.Unlock()
+	logger.Info("subscribing to account lookup")
+	if err := r.reconnect(logger); err != nil {
 		return err
 	}
-	r.nc = nc
 	// nc is now visible so we can unlock this and allow health checks
 	r.natsReady.Unlock()
 
-	logger.Info("subscribing to account lookup")
-	sub, err := nc.Subscribe("$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP", func(msg *nats.Msg) {
-		accountId := strings.TrimSuffix(strings.TrimPrefix(msg.Subject, "$SYS.REQ.ACCOUNT."), ".CLAIMS.LOOKUP")
+	if r.CredentialsWatchInterval > 0 {
+		go r.watchCredentials(ctx, logger)
+	}
+	if r.RepublishInterval > 0 {
+		go r.republishPeriodically(ctx, logger)
+	}
+	if r.ReconnectingTimeout > 0 {
+		go r.watchReconnecting(ctx, logger)
+	}
+
+	<-ctx.Done()
+	nc, sub := r.conn()
+	err := sub.Unsubscribe()
+	// Make sure claims updates published right before the shutdown reach the server before closing
+	if flushErr := nc.Flush(); flushErr != nil {
+		logger.Info("failed to flush nats connection on shutdown", "err", flushErr)
+	}
+	nc.Close()
+	return err
+}
+
+// conn returns the current NATS connection and the lookup subscription on it
+func (r *NatsAccountServer) conn() (*nats.Conn, *nats.Subscription) {
+	r.connLock.RLock()
+	defer r.connLock.RUnlock()
+	return r.nc, r.sub
+}
+
+// ensureSubscribed subscribes to lookups on nc again if the lookup subscription on it became invalid after
+// reconnecting, e.g. as it was unsubscribed, so the account server never stays connected without serving lookups.
+// Connections replaced meanwhile are left alone.
+func (r *NatsAccountServer) ensureSubscribed(nc *nats.Conn, logger logr.Logger) error {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+	if r.nc != nc || (r.sub != nil && r.sub.IsValid()) {
+		return nil
+	}
+	logger.Info("lookup subscription was lost, subscribing again")
+	sub, err := r.subscribeLookups(nc, logger)
+	if err != nil {
+		return err
+	}
+	r.sub = sub
+	return nc.Flush()
+}
+
+// credentials returns the configured credentials and the fingerprint of the files the current
+// connection was established with
+func (r *NatsAccountServer) credentials() (NatsCredentialsConfig, [sha256.Size]byte) {
+	r.connLock.RLock()
+	defer r.connLock.RUnlock()
+	return r.creds, r.credsFingerprint
+}
+
+// reconnect establishes a fresh connection, subscribes to lookups on it and only then drains the old
+// connection, so lookups are served throughout. The old connection is kept if the new one fails.
+func (r *NatsAccountServer) reconnect(logger logr.Logger) error {
+	r.connLock.RLock()
+	creds, connect := r.creds, r.connect
+	r.connLock.RUnlock()
+	if connect == nil {
+		return fmt.Errorf("nats connection is not configured yet")
+	}
+
+	// Fingerprint before connecting, so changes while connecting are picked up by the next check
+	fingerprint := fingerprintFiles(credentialFiles(creds))
+	nc, err := connect(creds)
+	if err != nil {
+		return err
+	}
+	sub, err := r.subscribeLookups(nc, logger)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	r.connLock.Lock()
+	old := r.nc
+	r.nc, r.sub, r.credsFingerprint = nc, sub, fingerprint
+	r.connLock.Unlock()
+	if old != nil {
+		// A connection that is reconnecting can't be drained, it would keep reconnecting in the background
+		if old.IsReconnecting() {
+			old.Close()
+		} else if err := old.Drain(); err != nil {
+			logger.Info("failed to drain previous nats connection", "err", err)
+		}
+		r.republishInBackground(context.Background(), logger)
+	}
+	return nil
+}
+
+// subscribeLookups subscribes the lookup handler on nc, in LookupQueueGroup if set
+func (r *NatsAccountServer) subscribeLookups(nc *nats.Conn, logger logr.Logger) (*nats.Subscription, error) {
+	subject := r.lookupSubject()
+	if err := ValidateLookupSubject(subject); err != nil {
+		return nil, err
+	}
+	if r.LookupQueueGroup != "" {
+		return nc.QueueSubscribe(subject, r.LookupQueueGroup, r.lookupHandler(logger))
+	}
+	return nc.Subscribe(subject, r.lookupHandler(logger))
+}
+
+// lookupSubject returns LookupSubject, or LOOKUP_SUBJECT if unset
+func (r *NatsAccountServer) lookupSubject() string {
+	if r.LookupSubject == "" {
+		return LOOKUP_SUBJECT
+	}
+	return r.LookupSubject
+}
+
+// ValidateLookupSubject checks that subject is a legal subject to subscribe lookups on: none of its tokens is
+// empty or contains whitespace, and exactly one is the * wildcard in place of the account public key
+func ValidateLookupSubject(subject string) error {
+	wildcards := 0
+	for _, token := range strings.Split(subject, ".") {
+		switch {
+		case token == "":
+			return fmt.Errorf("lookup subject %q has an empty token", subject)
+		case strings.ContainsAny(token, " \t\r\n"):
+			return fmt.Errorf("lookup subject %q contains whitespace", subject)
+		case token == ">":
+			return fmt.Errorf("lookup subject %q can't use the > wildcard, the account key must be a single * token", subject)
+		case token == "*":
+			wildcards++
+		}
+	}
+	if wildcards != 1 {
+		return fmt.Errorf("lookup subject %q must contain exactly one * token for the account public key, found %d", subject, wildcards)
+	}
+	return nil
+}
+
+// lookupAccountId returns the account public key of a lookup subject matching the lookup subject pattern
+func lookupAccountId(pattern, subject string) (string, error) {
+	tokens := strings.Split(subject, ".")
+	patternTokens := strings.Split(pattern, ".")
+	if len(tokens) != len(patternTokens) {
+		return "", fmt.Errorf("subject doesn't match %s", pattern)
+	}
+	accountId := ""
+	for i, token := range tokens {
+		if patternTokens[i] == "*" {
+			accountId = token
+		} else if token != patternTokens[i] {
+			return "", fmt.Errorf("subject doesn't match %s", pattern)
+		}
+	}
+	if !nkeys.IsValidPublicAccountKey(accountId) {
+		return "", fmt.Errorf("%q is not an account public key", accountId)
+	}
+	return accountId, nil
+}
+
+// lookupHandler answers account lookups of the NATS resolver with the served account JWT
+func (r *NatsAccountServer) lookupHandler(logger logr.Logger) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		accountId, err := lookupAccountId(r.lookupSubject(), msg.Subject)
+		if err != nil {
+			// Never look up whatever the subject left over, but still answer so the requester doesn't wait
+			logger.Info("WARNING: ignoring malformed account lookup", "subject", msg.Subject, "err", err)
+			if err := msg.Respond(nil); err != nil {
+				logger.Info("Failed to respond to NATS with token", "err", err)
+			}
+			return
+		}
 		logger.Info("account lookup", "accountId", accountId)
 
-		accountToken := r.accountMap[accountId]
+		accountToken := r.lookupAccount(accountId).JWT
+		if accountToken == "" {
+			accountToken = r.lookupStaticAccount(accountId)
+		}
+		if accountToken == "" && r.LookupFromAPI {
+			if accountToken, err = r.lookupAccountFromAPI(context.Background(), accountId); err != nil {
+				logger.Info("WARNING: failed looking up account from the API", "accountId", accountId, "err", err)
+			}
+		}
+		r.settingsLock.RLock()
+		existenceChecks, sizeWarnThreshold := r.LookupExistenceChecks, r.LookupSizeWarnThreshold
+		r.settingsLock.RUnlock()
+		if existenceChecks && accountToken != "" && msg.Header.Get(LOOKUP_MODE_HEADER) == LOOKUP_MODE_EXISTS {
+			accountToken = LOOKUP_EXISTS_MARKER
+		}
+
+		lookupResponseBytes.Observe(float64(len(accountToken)))
+		if sizeWarnThreshold > 0 && len(accountToken) > sizeWarnThreshold {
+			logger.Info("account lookup response exceeds size threshold", "accountId", accountId, "size", len(accountToken), "threshold", sizeWarnThreshold)
+		}
 
 		if err := msg.Respond([]byte(accountToken)); err != nil {
-			logger.Info("Failed to respond to NATS with token: %v", err)
+			logger.Info("Failed to respond to NATS with token", "err", err)
 		}
-	})
-	if err != nil {
-		return err
 	}
-	<-ctx.Done()
-	return sub.Unsubscribe()
 }
 
 func (r *NatsAccountServer) Healthy(req *http.Request) error {
-	if _, ok := <- r.alive ; !ok {
+	if _, ok := <-r.alive; !ok {
 		return fmt.Errorf("Not connected to NATs")
 	} else {
 		return nil
@@ -127,9 +583,22 @@ func (r *NatsAccountServer) Ready(req *http.Request) error {
 	}
 
 	r.natsReady.Unlock()
-	if !r.nc.IsConnected() || r.nc.IsReconnecting() {
+	nc, _ := r.conn()
+	if !nc.IsConnected() || nc.IsReconnecting() {
 		return fmt.Errorf("NATs is not connected")
 	}
+	if _, sub := r.conn(); sub == nil || !sub.IsValid() {
+		return fmt.Errorf("Not subscribed to account lookups")
+	}
+	if !r.warmed.Load() {
+		// Lookups would miss accounts whose reconcile didn't come around yet
+		return fmt.Errorf("Account cache not warmed yet")
+	}
+	if r.FailClosed {
+		if n := r.divergedAccounts(); n > 0 {
+			return fmt.Errorf("%d accounts not yet pushed to NATs", n)
+		}
+	}
 
 	// All seems good
 	return nil
@@ -139,42 +608,831 @@ func (r *NatsAccountServer) Ready(req *http.Request) error {
 // move the current state of the cluster closer to the desired state.
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
-func (r *NatsAccountServer) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *NatsAccountServer) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	logger := log.FromContext(ctx)
+	var reason ReconcileReason
+	defer func() { recordOutcome(ctx, ACCOUNT_SERVER_CONTROLLER, result, err, reason) }()
 
 	account := &natsv1alpha1.NatsAccount{}
 	if err := r.Get(ctx, req.NamespacedName, account); err != nil {
 		if errors.IsNotFound(err) {
-			return ctrl.Result{}, nil
+			reason = REASON_DELETED
+			if removeIn := r.retainDeleted(logger, req.NamespacedName); removeIn > 0 {
+				reason = REASON_DELETION_PENDING
+				return ctrl.Result{RequeueAfter: removeIn}, nil
+			}
+			if err := r.disableOwner(ctx, req.NamespacedName); err != nil {
+				logger.Info("failed to disable deleted account", "account", req.NamespacedName, "err", err)
+				reason = REASON_PUBLISH_FAILED
+				return ctrl.Result{RequeueAfter: r.PublishFailedRequeue}, nil
+			}
+			// The deletion may not have been observed before the account vanished
+			return ctrl.Result{}, r.removeResolverFiles(r.removeOwner(req.NamespacedName)...)
 		}
 		return ctrl.Result{}, err
 	}
 
 	if account.DeletionTimestamp != nil {
-		// We're not further processing the deletion here.
-		// TODO: correctly handle account revocation
-		delete(r.accountMap, account.Status.PublicKey)
+		reason = REASON_DELETED
+		if removeIn := r.retainDeleted(logger, req.NamespacedName); removeIn > 0 {
+			reason = REASON_DELETION_PENDING
+			return ctrl.Result{RequeueAfter: removeIn}, nil
+		}
+		if err := r.disableOwner(ctx, req.NamespacedName); err != nil {
+			logger.Info("failed to disable deleted account", "account", account.Name, "err", err)
+			reason = REASON_PUBLISH_FAILED
+			return ctrl.Result{RequeueAfter: r.PublishFailedRequeue}, nil
+		}
+		if r.removeAccount(account.Status.PublicKey, req.NamespacedName) {
+			return ctrl.Result{}, r.removeResolverFiles(account.Status.PublicKey)
+		}
 		return ctrl.Result{}, nil
 	}
 
 	if account.Status.JWT != "" && account.Status.PublicKey != "" {
-		r.accountMap[account.Status.PublicKey] = account.Status.JWT
+		if drift := verifyStatusJWT(account); drift != nil {
+			// Keep serving the JWT served before, the operator restores the status from the key secret,
+			// which triggers another reconcile
+			logger.Info("WARNING: not serving account status that doesn't match the account key", "account", account.Name, "err", drift)
+			reason = REASON_STATUS_DRIFT
+			return ctrl.Result{}, nil
+		}
+		owner, conflict, err := r.conflictingOwner(ctx, account.Status.PublicKey, req.NamespacedName)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if conflict {
+			// Never silently replace the JWT served for another account, make the ambiguity visible instead
+			logger.Info("public key already served for another account", "account", account.Name, "owner", owner)
+			reason = REASON_DUPLICATE_PUBLIC_KEY
+			return ctrl.Result{RequeueAfter: CONFLICT_REQUEUE}, r.updateCondition(ctx, account, metav1.Condition{
+				Type:               CONDITION_CONFLICT,
+				Status:             metav1.ConditionTrue,
+				Reason:             "DuplicatePublicKey",
+				Message:            fmt.Sprintf("public key %s is already served for account %s", account.Status.PublicKey, owner),
+				ObservedGeneration: account.Generation,
+			})
+		}
+		if err := r.updateCondition(ctx, account, metav1.Condition{
+			Type:               CONDITION_CONFLICT,
+			Status:             metav1.ConditionFalse,
+			Reason:             "UniquePublicKey",
+			Message:            "public key is not served for any other account",
+			ObservedGeneration: account.Generation,
+		}); err != nil {
+			// Nothing changed in memory yet, so the requeue starts over from the persisted state
+			return ctrl.Result{}, err
+		}
+
+		if served := r.lookupAccount(account.Status.PublicKey); served.Owner == req.NamespacedName && served.Generation > account.Generation {
+			// A newer generation was served already, never go back to the claims of an outdated cached object
+			logger.Info("skipping outdated account", "account", account.Name, "generation", account.Generation, "served", served.Generation)
+			reason = REASON_OUTDATED_GENERATION
+			return ctrl.Result{}, nil
+		}
+
+		// The status is persisted now, only from here on lookups and NATS see the JWT
+		disabledJWT, err := verifyDisabledJWT(account)
+		if err != nil {
+			// The account is still served, only it can't be disabled once deleted
+			logger.Info("WARNING: ignoring disabled JWT that doesn't match the account", "account", account.Name, "err", err)
+		}
+		if !r.claimAccount(account.Status.PublicKey, owner, servedAccount{
+			Owner:       req.NamespacedName,
+			JWT:         account.Status.JWT,
+			Generation:  account.Generation,
+			DisabledJWT: disabledJWT,
+		}) {
+			// Another account reconciled in parallel took the key meanwhile, recheck to report the conflict
+			reason = REASON_DUPLICATE_PUBLIC_KEY
+			return ctrl.Result{Requeue: true}, nil
+		}
+		if replaced := r.removeReplacedKeys(req.NamespacedName, account.Status.PublicKey); len(replaced) > 0 {
+			logger.Info("account key changed, no longer serving the previous key", "account", account.Name, "publicKey", account.Status.PublicKey, "previous", replaced)
+			if err := r.removeResolverFiles(replaced...); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if r.ResolverDir != "" {
+			if err := writeResolverFile(r.ResolverDir, account.Status.PublicKey, account.Status.JWT); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed writing account jwt to resolver directory: %v", err)
+			}
+		}
 
-		if r.nc != nil {
-			go func() {
-				if err := r.nc.Publish("$SYS.REQ.CLAIMS.UPDATE", []byte(account.Status.JWT)); err != nil {
-					logger.Info("failed to publish claims update", "account", account.Name, "err", err)
+		nc, _ := r.conn()
+		if r.FailClosed && (nc == nil || !nc.IsConnected()) {
+			// Don't report success for an account NATS doesn't know about
+			logger.Info("not connected to NATS, requeueing account", "account", account.Name)
+			reason = REASON_DISCONNECTED
+			r.setDiverged(req.NamespacedName, true)
+			_, err := r.reconcileStale(ctx, account)
+			return ctrl.Result{RequeueAfter: DISCONNECTED_REQUEUE}, err
+		}
+		if nc != nil {
+			if allowed, retryIn := r.PublishBreaker.Allow(); !allowed {
+				// Don't add load to NATS while publishing keeps failing, lookups still serve the account
+				logger.Info("publishing suspended, circuit breaker open", "account", account.Name, "retryIn", retryIn)
+				reason = REASON_CIRCUIT_OPEN
+				r.setDiverged(req.NamespacedName, r.FailClosed)
+				if err := r.updateCondition(ctx, account, metav1.Condition{
+					Type:               CONDITION_PUBLISH_FAILED,
+					Status:             metav1.ConditionTrue,
+					Reason:             "CircuitOpen",
+					Message:            "publishing is suspended after repeated claims update failures",
+					ObservedGeneration: account.Generation,
+				}); err != nil {
+					return ctrl.Result{}, err
 				}
-			}()
+				staleIn, err := r.reconcileStale(ctx, account)
+				return ctrl.Result{RequeueAfter: earliestRequeue(retryIn, staleIn)}, err
+			}
+			// The account stays served via lookups, even if pushing the update fails
+			published := observePhase(ACCOUNT_SERVER_CONTROLLER, "publish")
+			summary, skipped, publishErr := r.publishAccount(ctx, account.Status.PublicKey, account.Status.JWT)
+			published()
+			r.PublishBreaker.Record(publishErr)
+			if publishErr != nil {
+				logger.Info("failed to publish claims update", "account", account.Name, "err", publishErr)
+			}
+			r.setDiverged(req.NamespacedName, r.FailClosed && publishErr != nil)
+			staleIn, err := r.reconcilePublishStatus(ctx, account, summary, skipped, publishErr)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if publishErr != nil {
+				reason = REASON_PUBLISH_FAILED
+				return ctrl.Result{RequeueAfter: earliestRequeue(r.PublishFailedRequeue, staleIn)}, nil
+			}
 		}
 	}
 
+	reason = REASON_SERVED
 	return ctrl.Result{}, nil
 }
 
+// verifyStatusJWT checks the status of account holds a JWT issued for its public key, so a manually edited
+// or corrupted status is neither served nor pushed to NATS
+func verifyStatusJWT(account *natsv1alpha1.NatsAccount) error {
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		return fmt.Errorf("JWT doesn't verify: %v", err)
+	}
+	if claims.Subject != account.Status.PublicKey {
+		return fmt.Errorf("JWT is issued for %s instead of the account key %s", claims.Subject, account.Status.PublicKey)
+	}
+	return nil
+}
+
+// verifyDisabledJWT returns the disabled JWT in the status of account if it is issued for the account key by the
+// issuer of its JWT, so a manually edited status can't disable another account. Empty if the status holds none.
+func verifyDisabledJWT(account *natsv1alpha1.NatsAccount) (string, error) {
+	if account.Status.DisabledJWT == "" {
+		return "", nil
+	}
+	disabled, err := jwt.DecodeAccountClaims(account.Status.DisabledJWT)
+	if err != nil {
+		return "", fmt.Errorf("disabled JWT doesn't verify: %v", err)
+	}
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		return "", fmt.Errorf("JWT doesn't verify: %v", err)
+	}
+	if disabled.Subject != account.Status.PublicKey || disabled.Issuer != claims.Issuer {
+		return "", fmt.Errorf("disabled JWT is issued for %s by %s instead of the account key %s by %s", disabled.Subject, disabled.Issuer, account.Status.PublicKey, claims.Issuer)
+	}
+	return account.Status.DisabledJWT, nil
+}
+
+func (r *NatsAccountServer) lookupAccount(publicKey string) servedAccount {
+	r.accountLock.RLock()
+	defer r.accountLock.RUnlock()
+	return r.accountMap[publicKey]
+}
+
+func (r *NatsAccountServer) lookupStaticAccount(publicKey string) string {
+	r.accountLock.RLock()
+	defer r.accountLock.RUnlock()
+	return r.staticAccounts[publicKey]
+}
+
+// WarmCache serves the JWTs of all accounts issued before the start, without waiting for their reconciles,
+// and only then lets the account server report ready. It reads from the cache of the manager, so it has
+// to run as a runnable of the manager once the cache is synced.
+func (r *NatsAccountServer) WarmCache(ctx context.Context) error {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts); err != nil {
+		return err
+	}
+	warmed := 0
+	r.accountLock.Lock()
+	for _, account := range accounts.Items {
+		if account.DeletionTimestamp != nil || account.Status.PublicKey == "" || account.Status.JWT == "" {
+			continue
+		}
+		if meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_CONFLICT) || verifyStatusJWT(&account) != nil {
+			// The conflict or the drifted status needs to be resolved by a reconcile first
+			continue
+		}
+		if _, ok := r.accountMap[account.Status.PublicKey]; ok {
+			// Already reconciled, or another account with the same key, which its reconcile reports
+			continue
+		}
+		disabledJWT, _ := verifyDisabledJWT(&account)
+		r.accountMap[account.Status.PublicKey] = servedAccount{
+			Owner:       client.ObjectKeyFromObject(&account),
+			JWT:         account.Status.JWT,
+			Generation:  account.Generation,
+			DisabledJWT: disabledJWT,
+		}
+		warmed++
+	}
+	r.accountLock.Unlock()
+	r.warmed.Store(true)
+	log.FromContext(ctx).Info("warmed account cache", "accounts", warmed)
+	return nil
+}
+
+// LoadStaticAccounts serves every JWT in dir on lookup of its subject, even though no NatsAccount exists for it.
+// This is meant for the operator and system account JWTs, which are needed to bootstrap the resolver.
+// The directory is usually a mounted Secret, hidden files and directories are skipped.
+// JWTs of a NatsAccount take precedence over the static ones.
+func (r *NatsAccountServer) LoadStaticAccounts(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	staticAccounts := map[string]string{}
+	systemAccount := ""
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		// Stat follows the symlinks of mounted Secrets
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		token := strings.TrimSpace(string(content))
+		claims, err := jwt.Decode(token)
+		if err != nil {
+			return fmt.Errorf("failed decoding static jwt %s: %v", path, err)
+		}
+		staticAccounts[claims.Claims().Subject] = token
+		if operator, ok := claims.(*jwt.OperatorClaims); ok && operator.SystemAccount != "" {
+			systemAccount = operator.SystemAccount
+		}
+	}
+
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	r.staticAccounts = staticAccounts
+	if systemAccount != "" {
+		r.systemAccount = systemAccount
+	}
+	return nil
+}
+
+// SeedSystemAccount serves the account JWT in the file at path on lookup of its subject, so the system account
+// can be looked up right after startup. Once its NatsAccount is reconciled, the JWT issued for it is served instead.
+func (r *NatsAccountServer) SeedSystemAccount(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(content))
+	claims, err := jwt.DecodeAccountClaims(token)
+	if err != nil {
+		return fmt.Errorf("failed decoding system account jwt %s: %v", path, err)
+	}
+	r.serveAccount(claims.Subject, servedAccount{JWT: token})
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	r.systemAccount = claims.Subject
+	return nil
+}
+
+func (r *NatsAccountServer) serveAccount(publicKey string, account servedAccount) {
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	r.accountMap[publicKey] = account
+}
+
+// claimAccount serves account, unless publicKey got served for another account than previous or account itself
+// since previous was looked up. It reports whether account is served.
+func (r *NatsAccountServer) claimAccount(publicKey string, previous types.NamespacedName, account servedAccount) bool {
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	if owner := r.accountMap[publicKey].Owner; owner != previous && owner != account.Owner {
+		return false
+	}
+	r.accountMap[publicKey] = account
+	return true
+}
+
+// removeReplacedKeys stops serving the public keys served for owner other than publicKey and returns them,
+// so a key the account no longer has, e.g. after its key secret was replaced, isn't served forever
+func (r *NatsAccountServer) removeReplacedKeys(owner types.NamespacedName, publicKey string) []string {
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	removed := []string{}
+	for served, account := range r.accountMap {
+		if served != publicKey && account.Owner == owner {
+			delete(r.accountMap, served)
+			removed = append(removed, served)
+		}
+	}
+	return removed
+}
+
+// retainDeleted marks the public keys served for the deleted owner for removal after DeletionGracePeriod
+// and returns the time left until they are removed, 0 once they are due or if nothing is served for owner.
+func (r *NatsAccountServer) retainDeleted(logger logr.Logger, owner types.NamespacedName) time.Duration {
+	if r.DeletionGracePeriod <= 0 {
+		return 0
+	}
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	now := time.Now()
+	removeIn := time.Duration(0)
+	for publicKey, served := range r.accountMap {
+		if served.Owner != owner {
+			continue
+		}
+		if served.RemoveAt.IsZero() {
+			served.RemoveAt = now.Add(r.DeletionGracePeriod)
+			r.accountMap[publicKey] = served
+			logger.Info("account deleted, serving its jwt until the grace period elapsed", "account", owner, "publicKey", publicKey, "removeAt", served.RemoveAt)
+		}
+		if left := served.RemoveAt.Sub(now); left > removeIn {
+			removeIn = left
+		}
+	}
+	return removeIn
+}
+
+// disableOwner pushes the disabled JWTs of the public keys served for the deleted owner to NATS, so servers already
+// holding these accounts disconnect their users and accept none anymore. Keys without a disabled JWT are skipped.
+func (r *NatsAccountServer) disableOwner(ctx context.Context, owner types.NamespacedName) error {
+	disabled := map[string]string{}
+	r.accountLock.RLock()
+	for publicKey, served := range r.accountMap {
+		if served.Owner == owner && served.DisabledJWT != "" {
+			disabled[publicKey] = served.DisabledJWT
+		}
+	}
+	r.accountLock.RUnlock()
+	if len(disabled) == 0 {
+		return nil
+	}
+	if nc, _ := r.conn(); nc == nil || !nc.IsConnected() {
+		return fmt.Errorf("not connected to NATS")
+	}
+	for publicKey, token := range disabled {
+		// Disabling never yields to a JWT NATS holds, whoever issued it
+		if _, _, err := r.publish(ctx, publicKey, token, false); err != nil {
+			return fmt.Errorf("failed pushing disabled JWT of %s: %v", publicKey, err)
+		}
+		log.FromContext(ctx).Info("disabled deleted account", "account", owner, "publicKey", publicKey)
+	}
+	return nil
+}
+
+// removeAccount stops serving publicKey, unless it is served for another account than owner.
+// It reports whether publicKey was served for owner.
+func (r *NatsAccountServer) removeAccount(publicKey string, owner types.NamespacedName) bool {
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	delete(r.diverged, owner)
+	r.removeStale(owner)
+	if served, ok := r.accountMap[publicKey]; ok && served.Owner == owner {
+		delete(r.accountMap, publicKey)
+		return true
+	}
+	return false
+}
+
+// removeOwner stops serving all public keys served for owner and returns them
+func (r *NatsAccountServer) removeOwner(owner types.NamespacedName) []string {
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	delete(r.diverged, owner)
+	r.removeStale(owner)
+	removed := []string{}
+	for publicKey, served := range r.accountMap {
+		if served.Owner == owner {
+			delete(r.accountMap, publicKey)
+			removed = append(removed, publicKey)
+		}
+	}
+	return removed
+}
+
+// removeResolverFiles deletes the JWTs of the public keys from the resolver directory, if configured
+func (r *NatsAccountServer) removeResolverFiles(publicKeys ...string) error {
+	if r.ResolverDir == "" {
+		return nil
+	}
+	for _, publicKey := range publicKeys {
+		if err := removeResolverFile(r.ResolverDir, publicKey); err != nil {
+			return fmt.Errorf("failed removing account jwt from resolver directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// setDiverged records whether the account isn't known to NATS yet
+func (r *NatsAccountServer) setDiverged(owner types.NamespacedName, diverged bool) {
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	if diverged {
+		r.diverged[owner] = struct{}{}
+	} else {
+		delete(r.diverged, owner)
+	}
+}
+
+// setStale records whether the account is stale and updates the stale accounts metric
+func (r *NatsAccountServer) setStale(owner types.NamespacedName, stale bool) {
+	r.accountLock.Lock()
+	defer r.accountLock.Unlock()
+	if stale {
+		r.stale[owner] = struct{}{}
+		staleAccounts.Set(float64(len(r.stale)))
+	} else {
+		r.removeStale(owner)
+	}
+}
+
+// removeStale stops counting owner as stale, accountLock has to be held
+func (r *NatsAccountServer) removeStale(owner types.NamespacedName) {
+	delete(r.stale, owner)
+	staleAccounts.Set(float64(len(r.stale)))
+}
+
+func (r *NatsAccountServer) staleAccounts() int {
+	r.accountLock.RLock()
+	defer r.accountLock.RUnlock()
+	return len(r.stale)
+}
+
+func (r *NatsAccountServer) divergedAccounts() int {
+	r.accountLock.RLock()
+	defer r.accountLock.RUnlock()
+	return len(r.diverged)
+}
+
+// servedAccounts returns a snapshot of all accounts currently served, keyed by public key
+func (r *NatsAccountServer) servedAccounts() map[string]servedAccount {
+	r.accountLock.RLock()
+	defer r.accountLock.RUnlock()
+	accounts := make(map[string]servedAccount, len(r.accountMap))
+	for k, v := range r.accountMap {
+		accounts[k] = v
+	}
+	return accounts
+}
+
+// claimsUpdateResponse contains the parts of the nats-server response to a claims update we care about
+type claimsUpdateResponse struct {
+	Server struct {
+		Name string `json:"name"`
+	} `json:"server"`
+	Data *struct {
+		Message string `json:"message"`
+	} `json:"data,omitempty"`
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+// summary describes the response in a single line, prefixed with the responding server if known
+func (resp claimsUpdateResponse) summary() string {
+	summary := "claims update accepted"
+	if resp.Error != nil {
+		summary = fmt.Sprintf("claims update rejected (%d): %s", resp.Error.Code, resp.Error.Description)
+	} else if resp.Data != nil && resp.Data.Message != "" {
+		summary = resp.Data.Message
+	}
+	if resp.Server.Name != "" {
+		return resp.Server.Name + ": " + summary
+	}
+	return summary
+}
+
+// publishClaims pushes a single claims update and waits for a NATS server to accept it. With keepNewer the update
+// is skipped as configured by KeepNewerServerClaims, which is reported as skipped. It returns the summary of the
+// server response, if there was any.
+func (r *NatsAccountServer) publishClaims(token string, keepNewer bool) (string, bool, error) {
+	nc, _ := r.conn()
+	claims, decodeErr := jwt.DecodeAccountClaims(token)
+	if nc != nil {
+		// Older servers would reject claims of a newer version, tell why instead
+		if decodeErr == nil && !serverAcceptsClaimsVersion(nc.ConnectedServerVersion(), claims.Version) {
+			return "", false, fmt.Errorf("NATS server %s doesn't accept JWT v%d claims, set claimsVersion of the operator to 1", nc.ConnectedServerVersion(), claims.Version)
+		}
+		r.settingsLock.RLock()
+		keepNewer = keepNewer && r.KeepNewerServerClaims
+		r.settingsLock.RUnlock()
+		if decodeErr == nil && keepNewer {
+			held, err := r.serverClaims(nc, claims.Subject)
+			if err != nil {
+				return "", false, fmt.Errorf("failed looking up the JWT held by NATS: %v", err)
+			}
+			r.publishLock.Lock()
+			ownJWT := held != nil && r.pushed[claims.Subject] == held.ID
+			r.publishLock.Unlock()
+			if held != nil && (held.ID == claims.ID || (held.IssuedAt >= claims.IssuedAt && !ownJWT)) {
+				return fmt.Sprintf("claims update skipped, NATS holds a JWT issued at %s", time.Unix(held.IssuedAt, 0).UTC().Format(time.RFC3339)), true, nil
+			}
+		}
+	}
+	msg, err := nc.Request(CLAIMS_UPDATE_SUBJECT, []byte(token), r.PublishTimeout)
+	if err != nil {
+		return "", false, err
+	}
+	resp := claimsUpdateResponse{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return "", false, fmt.Errorf("failed decoding claims update response: %v", err)
+	}
+	if resp.Error != nil {
+		return resp.summary(), false, fmt.Errorf("claims update rejected (%d): %s", resp.Error.Code, resp.Error.Description)
+	}
+	if decodeErr == nil {
+		r.publishLock.Lock()
+		r.pushed[claims.Subject] = claims.ID
+		r.publishLock.Unlock()
+	}
+	return resp.summary(), false, nil
+}
+
+// accountInfoResponse contains the parts of the nats-server response to an account info request we care about
+type accountInfoResponse struct {
+	Data *struct {
+		JWT string `json:"jwt"`
+	} `json:"data,omitempty"`
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+// serverClaims returns the claims NATS holds for the account publicKey, nil if the responding server doesn't know it
+func (r *NatsAccountServer) serverClaims(nc *nats.Conn, publicKey string) (*jwt.AccountClaims, error) {
+	msg, err := nc.Request(fmt.Sprintf(ACCOUNT_INFO_SUBJECT, publicKey), nil, r.PublishTimeout)
+	if err != nil {
+		return nil, err
+	}
+	resp := accountInfoResponse{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return nil, fmt.Errorf("failed decoding account info response: %v", err)
+	}
+	// Servers answer with an error for accounts they haven't loaded
+	if resp.Error != nil || resp.Data == nil || resp.Data.JWT == "" {
+		return nil, nil
+	}
+	return jwt.DecodeAccountClaims(resp.Data.JWT)
+}
+
+// publishWithRetry publishes the claims, retrying with an exponential backoff.
+// The response summary and error of the last attempt are returned once all retries are exhausted.
+func (r *NatsAccountServer) publishWithRetry(ctx context.Context, token string, keepNewer bool) (string, bool, error) {
+	r.settingsLock.RLock()
+	backoff, retries := r.PublishBackoff, r.PublishRetries
+	r.settingsLock.RUnlock()
+	var summary string
+	var skipped bool
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return summary, false, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if summary, skipped, err = r.publishClaims(token, keepNewer); err == nil {
+			return summary, skipped, nil
+		}
+	}
+	return summary, false, err
+}
+
+// claimsPublish is a claims update in flight, its outcome is set once done is closed
+type claimsPublish struct {
+	jwt     string
+	done    chan struct{}
+	summary string
+	skipped bool
+	err     error
+}
+
+// publishAccount publishes the JWT of the account publicKey with retries, and reports whether the update was
+// skipped as configured by KeepNewerServerClaims. Skipped updates were neither accepted by NATS nor failed.
+// Publishes of the same account are serialized, so an older JWT never overtakes a newer one,
+// and a publish of a JWT already in flight waits for that publish and shares its outcome.
+// This way overlapping reconciles and resyncs push each update only once.
+func (r *NatsAccountServer) publishAccount(ctx context.Context, publicKey, token string) (string, bool, error) {
+	return r.publish(ctx, publicKey, token, true)
+}
+
+// publish is publishAccount, skipping the update as configured by KeepNewerServerClaims only with keepNewer
+func (r *NatsAccountServer) publish(ctx context.Context, publicKey, token string, keepNewer bool) (string, bool, error) {
+	for {
+		r.publishLock.Lock()
+		inFlight, ok := r.publishes[publicKey]
+		if !ok {
+			publish := &claimsPublish{jwt: token, done: make(chan struct{})}
+			r.publishes[publicKey] = publish
+			r.publishLock.Unlock()
+
+			publish.summary, publish.skipped, publish.err = r.publishWithRetry(ctx, token, keepNewer)
+			r.publishLock.Lock()
+			delete(r.publishes, publicKey)
+			r.publishLock.Unlock()
+			close(publish.done)
+			return publish.summary, publish.skipped, publish.err
+		}
+		r.publishLock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case <-inFlight.done:
+		}
+		// A publish given up on by its caller says nothing about the JWT, so don't share that outcome
+		if inFlight.jwt == token && inFlight.err != context.Canceled {
+			return inFlight.summary, inFlight.skipped, inFlight.err
+		}
+	}
+}
+
+// reconcilePublishStatus reflects the outcome of the last publish in the account status and returns the time until
+// the account turns stale, see staleCondition. Skipped publishes aren't acknowledged. The publish time alone is only
+// refreshed after PUBLISH_STATUS_REFRESH, as every status update triggers another reconcile publishing the claims again.
+func (r *NatsAccountServer) reconcilePublishStatus(ctx context.Context, account *natsv1alpha1.NatsAccount, summary string, skipped bool, publishErr error) (time.Duration, error) {
+	condition := metav1.Condition{
+		Type:               CONDITION_PUBLISH_FAILED,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Published",
+		Message:            "claims update accepted by NATS",
+		ObservedGeneration: account.Generation,
+	}
+	publish := &natsv1alpha1.PublishStatus{
+		Time:         metav1.Now(),
+		Acknowledged: publishErr == nil && !skipped,
+		Response:     summary,
+	}
+	if skipped {
+		condition.Reason = "Skipped"
+		condition.Message = "claims update skipped, NATS holds a JWT of the account issued at the same time or later"
+	}
+	if publishErr != nil {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "RetriesExhausted"
+		condition.Message = publishErr.Error()
+		if summary == "" {
+			publish.Response = publishErr.Error()
+		}
+	}
+
+	changed := setCondition(&account.Status.Conditions, condition)
+	if last := account.Status.LastPublish; last == nil || last.Acknowledged != publish.Acknowledged ||
+		last.Response != publish.Response || publish.Time.Sub(last.Time.Time) >= PUBLISH_STATUS_REFRESH {
+		account.Status.LastPublish = publish
+		changed = true
+	}
+	if publish.Acknowledged {
+		// Staleness is measured from it, so it is recorded on every accepted update. It is stored with a precision
+		// of seconds, the reconcile triggered by the update finds it unchanged when publishing within the same second.
+		acknowledged := metav1.NewTime(publish.Time.Truncate(time.Second))
+		if last := account.Status.LastAcknowledged; last == nil || !last.Equal(&acknowledged) {
+			account.Status.LastAcknowledged = &acknowledged
+			changed = true
+		}
+	}
+	stale, staleIn := r.staleCondition(account, publish.Acknowledged, publish.Time.Time)
+	if setCondition(&account.Status.Conditions, stale) {
+		changed = true
+	}
+	if !changed {
+		return staleIn, nil
+	}
+	return staleIn, r.Status().Update(ctx, account)
+}
+
+// reconcileStale reflects in the status whether account is stale while claims updates can't be published,
+// and returns the time until it turns stale
+func (r *NatsAccountServer) reconcileStale(ctx context.Context, account *natsv1alpha1.NatsAccount) (time.Duration, error) {
+	condition, staleIn := r.staleCondition(account, false, time.Now())
+	return staleIn, r.updateCondition(ctx, account, condition)
+}
+
+// staleCondition reports the account as stale at now unless the last claims update was acknowledged, if NATS never
+// accepted a claims update of it or the last one accepted is older than StaleAfter, and counts it in the stale
+// accounts metric. It also returns the time until an account that isn't stale yet turns stale, 0 if it doesn't.
+func (r *NatsAccountServer) staleCondition(account *natsv1alpha1.NatsAccount, acknowledged bool, now time.Time) (metav1.Condition, time.Duration) {
+	condition := metav1.Condition{
+		Type:               CONDITION_STALE,
+		Status:             metav1.ConditionFalse,
+		Reason:             "RecentlyPublished",
+		Message:            "NATS accepted a claims update recently",
+		ObservedGeneration: account.Generation,
+	}
+	var staleIn time.Duration
+	last := account.Status.LastAcknowledged
+	switch {
+	case acknowledged:
+	case last == nil:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "NeverPublished"
+		condition.Message = "NATS never accepted a claims update of the account"
+	case r.StaleAfter > 0 && now.Sub(last.Time) > r.StaleAfter:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "PublishOutdated"
+		condition.Message = fmt.Sprintf("NATS last accepted a claims update of the account at %s", last.UTC().Format(time.RFC3339))
+	case r.StaleAfter > 0:
+		staleIn = last.Add(r.StaleAfter).Sub(now) + time.Second
+	}
+	r.setStale(types.NamespacedName{Namespace: account.Namespace, Name: account.Name}, condition.Status == metav1.ConditionTrue)
+	return condition, staleIn
+}
+
+// earliestRequeue returns the earlier of two requeue delays, ignoring unset ones
+func earliestRequeue(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// updateCondition persists condition in the account status, if it changed
+func (r *NatsAccountServer) updateCondition(ctx context.Context, account *natsv1alpha1.NatsAccount, condition metav1.Condition) error {
+	if !setCondition(&account.Status.Conditions, condition) {
+		return nil
+	}
+	return r.Status().Update(ctx, account)
+}
+
+// conflictingOwner returns the account that publicKey is already served for, if that is another account
+// that still exists and still owns the key.
+func (r *NatsAccountServer) conflictingOwner(ctx context.Context, publicKey string, self types.NamespacedName) (types.NamespacedName, bool, error) {
+	owner := r.lookupAccount(publicKey).Owner
+	if owner.Name == "" || owner == self {
+		return owner, false, nil
+	}
+	other := &natsv1alpha1.NatsAccount{}
+	if err := r.Get(ctx, owner, other); errors.IsNotFound(err) {
+		return owner, false, nil
+	} else if err != nil {
+		return owner, false, err
+	}
+	return owner, other.DeletionTimestamp == nil && other.Status.PublicKey == publicKey, nil
+}
+
+// ACCOUNT_PUBLIC_KEY_INDEX is the field index of NatsAccounts by the public key in their status
+const ACCOUNT_PUBLIC_KEY_INDEX = "status.publicKey"
+
+// indexAccountPublicKey extracts the value of ACCOUNT_PUBLIC_KEY_INDEX from a NatsAccount
+func indexAccountPublicKey(obj client.Object) []string {
+	account, ok := obj.(*natsv1alpha1.NatsAccount)
+	if !ok || account.Status.PublicKey == "" {
+		return nil
+	}
+	return []string{account.Status.PublicKey}
+}
+
+// lookupAccountFromAPI returns the JWT of the NatsAccount holding publicKey in its status, with one indexed list
+// instead of listing all accounts. Nothing is returned for keys held by several accounts, like a conflict isn't served.
+func (r *NatsAccountServer) lookupAccountFromAPI(ctx context.Context, publicKey string) (string, error) {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts, client.MatchingFields{ACCOUNT_PUBLIC_KEY_INDEX: publicKey}); err != nil {
+		return "", err
+	}
+	live := lo.Filter(accounts.Items, func(account natsv1alpha1.NatsAccount, _ int) bool {
+		return account.DeletionTimestamp == nil && account.Status.JWT != ""
+	})
+	if len(live) != 1 {
+		return "", nil
+	}
+	if err := verifyStatusJWT(&live[0]); err != nil {
+		return "", err
+	}
+	return live[0].Status.JWT, nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *NatsAccountServer) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &natsv1alpha1.NatsAccount{}, ACCOUNT_PUBLIC_KEY_INDEX, indexAccountPublicKey); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&natsv1alpha1.NatsAccount{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
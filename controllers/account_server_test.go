@@ -0,0 +1,1845 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllertest"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func runTestNatsServer(t *testing.T) *server.Server {
+	return startTestNatsServer(t, &server.Options{Host: "127.0.0.1", Port: -1})
+}
+
+func startTestNatsServer(t *testing.T, opts *server.Options) *server.Server {
+	opts.NoLog = true
+	opts.NoSigs = true
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func connectTestNats(t *testing.T, s *server.Server) *nats.Conn {
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// newTestAccountServer returns an account server connected to s, serving the given accounts
+func newTestAccountServer(g *WithT, t *testing.T, s *server.Server, objs ...client.Object) *NatsAccountServer {
+	scheme := newTestScheme(g)
+	r := NewAccountServer()
+	r.Scheme = scheme
+	r.Client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	r.PublishBackoff = time.Millisecond
+	r.PublishTimeout = 500 * time.Millisecond
+	r.nc = connectTestNats(t, s)
+	r.natsReady.Unlock()
+	g.Expect(r.WarmCache(context.Background())).To(Succeed())
+	return r
+}
+
+// testOperatorServer is a NATS server in operator mode with a single account users can be issued for
+type testOperatorServer struct {
+	*server.Server
+	account nkeys.KeyPair
+}
+
+func runTestOperatorServer(g *WithT, t *testing.T) *testOperatorServer {
+	operator, _ := nkeys.CreateOperator()
+	operatorPublic, _ := operator.PublicKey()
+	account, _ := nkeys.CreateAccount()
+	accountPublic, _ := account.PublicKey()
+	accountJWT, err := jwt.NewAccountClaims(accountPublic).Encode(operator)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	resolver := &server.MemAccResolver{}
+	g.Expect(resolver.Store(accountPublic, accountJWT)).To(Succeed())
+	s := startTestNatsServer(t, &server.Options{
+		Host:             "127.0.0.1",
+		Port:             -1,
+		TrustedOperators: []*jwt.OperatorClaims{jwt.NewOperatorClaims(operatorPublic)},
+		SystemAccount:    accountPublic,
+		AccountResolver:  resolver,
+	})
+	return &testOperatorServer{Server: s, account: account}
+}
+
+// writeUserCreds issues a new user and writes its credentials to path, returning the user public key
+func (s *testOperatorServer) writeUserCreds(g *WithT, path string) string {
+	user, _ := nkeys.CreateUser()
+	userPublic, _ := user.PublicKey()
+	userSeed, _ := user.Seed()
+	userJWT, err := jwt.NewUserClaims(userPublic).Encode(s.account)
+	g.Expect(err).NotTo(HaveOccurred())
+	creds, err := jwt.FormatUserConfig(userJWT, userSeed)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(os.WriteFile(path, creds, 0600)).To(Succeed())
+	return userPublic
+}
+
+// connectedUsers lists the users of all client connections
+func (s *testOperatorServer) connectedUsers(g *WithT) []string {
+	connz, err := s.Connz(&server.ConnzOptions{Username: true})
+	g.Expect(err).NotTo(HaveOccurred())
+	users := []string{}
+	for _, conn := range connz.Conns {
+		users = append(users, conn.AuthorizedUser)
+	}
+	return users
+}
+
+// testAccountJWT issues a JWT for the account publicKey, the version tells JWTs of the same account apart
+func testAccountJWT(g *WithT, publicKey, version string) string {
+	operator, _ := nkeys.CreateOperator()
+	claims := jwt.NewAccountClaims(publicKey)
+	claims.Name = version
+	token, err := claims.Encode(operator)
+	g.Expect(err).NotTo(HaveOccurred())
+	return token
+}
+
+// encodeIssuedAt signs claims as issued at the given unix time, jwt.Encode always stamps the current time
+func encodeIssuedAt(g *WithT, claims *jwt.AccountClaims, kp nkeys.KeyPair, issuedAt int64) string {
+	_, err := claims.Encode(kp)
+	g.Expect(err).NotTo(HaveOccurred())
+	claims.IssuedAt = issuedAt
+	claims.ID = ""
+	data, err := json.Marshal(claims.ClaimsData)
+	g.Expect(err).NotTo(HaveOccurred())
+	hash := sha512.Sum512_256(data)
+	claims.ID = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:])
+	header, err := json.Marshal(jwt.Header{Type: jwt.TokenTypeJwt, Algorithm: jwt.AlgorithmNkey})
+	g.Expect(err).NotTo(HaveOccurred())
+	payload, err := json.Marshal(claims)
+	g.Expect(err).NotTo(HaveOccurred())
+	toSign := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := kp.Sign([]byte(toSign))
+	g.Expect(err).NotTo(HaveOccurred())
+	return toSign + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newServedAccount returns an account issued with a JWT of the given version for publicKey
+func newServedAccount(g *WithT, name, publicKey, version string) *natsv1alpha1.NatsAccount {
+	account := newTestAccount(name)
+	account.Status.PublicKey = publicKey
+	account.Status.JWT = testAccountJWT(g, publicKey, version)
+	return account
+}
+
+func TestAccountServerPublishRetriesExhausted(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	var attempts int32
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		atomic.AddInt32(&attempts, 1)
+		msg.Respond([]byte(`{"error":{"code":500,"description":"resolver unavailable"}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 2
+	r.PublishFailedRequeue = 10 * time.Minute
+
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+	res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(Equal(10 * time.Minute))
+	g.Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(3))
+
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(context.Background(), key, account)).To(Succeed())
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_PUBLISH_FAILED)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Message).To(ContainSubstring("resolver unavailable"))
+
+	// The account must still be served via lookups
+	g.Expect(r.lookupAccount(served.Status.PublicKey).JWT).To(Equal(served.Status.JWT))
+}
+
+func TestAccountServerStaleAccounts(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	var failing int32 = 1
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		if atomic.LoadInt32(&failing) == 1 {
+			msg.Respond([]byte(`{"error":{"code":500,"description":"resolver unavailable"}}`))
+			return
+		}
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 0
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+	account := &natsv1alpha1.NatsAccount{}
+
+	// An account that never got published is stale right away
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.staleAccounts()).To(Equal(1))
+	g.Expect(testutil.ToFloat64(staleAccounts)).To(Equal(1.0))
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	g.Expect(account.Status.LastAcknowledged).To(BeNil())
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_STALE)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Reason).To(Equal("NeverPublished"))
+
+	atomic.StoreInt32(&failing, 0)
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.staleAccounts()).To(BeZero())
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	g.Expect(account.Status.LastAcknowledged).NotTo(BeNil())
+	g.Expect(meta.IsStatusConditionFalse(account.Status.Conditions, CONDITION_STALE)).To(BeTrue())
+
+	// Failing again after a publish got accepted is only stale once that is older than StaleAfter
+	atomic.StoreInt32(&failing, 1)
+	r.StaleAfter = time.Hour
+	r.PublishFailedRequeue = 2 * time.Hour
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.staleAccounts()).To(BeZero())
+	// Requeued in time to report it stale even if nothing else triggers a reconcile
+	g.Expect(res.RequeueAfter).To(BeNumerically("~", time.Hour, time.Minute))
+
+	// Every accepted publish is recorded, even while the publish status itself isn't refreshed
+	atomic.StoreInt32(&failing, 0)
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	account.Status.LastAcknowledged = &metav1.Time{Time: time.Now().Add(-30 * time.Minute)}
+	account.Status.LastPublish = &natsv1alpha1.PublishStatus{Time: metav1.Now(), Acknowledged: true, Response: "claims update accepted"}
+	g.Expect(r.Status().Update(ctx, account)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	g.Expect(account.Status.LastAcknowledged.Time).To(BeTemporally("~", time.Now(), 2*time.Second))
+
+	atomic.StoreInt32(&failing, 1)
+	account.Status.LastAcknowledged = &metav1.Time{Time: time.Now().Add(-2 * time.Hour)}
+	g.Expect(r.Status().Update(ctx, account)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.staleAccounts()).To(Equal(1))
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	condition = meta.FindStatusCondition(account.Status.Conditions, CONDITION_STALE)
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Reason).To(Equal("PublishOutdated"))
+
+	// Deleted accounts aren't counted anymore
+	g.Expect(r.Delete(ctx, account)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.staleAccounts()).To(BeZero())
+	g.Expect(testutil.ToFloat64(staleAccounts)).To(BeZero())
+}
+
+func TestAccountServerPublishStatus(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	var failing int32
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		if atomic.LoadInt32(&failing) == 1 {
+			msg.Respond([]byte(`{"server":{"name":"nats-0"},"error":{"code":500,"description":"resolver unavailable"}}`))
+			return
+		}
+		msg.Respond([]byte(`{"server":{"name":"nats-0"},"data":{"code":200,"message":"jwt updated"}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 0
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+	reconcile := func() *natsv1alpha1.PublishStatus {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		g.Expect(err).NotTo(HaveOccurred())
+		account := &natsv1alpha1.NatsAccount{}
+		g.Expect(r.Get(ctx, key, account)).To(Succeed())
+		return account.Status.LastPublish
+	}
+
+	before := time.Now().Truncate(time.Second)
+	published := reconcile()
+	g.Expect(published).NotTo(BeNil())
+	g.Expect(published.Acknowledged).To(BeTrue())
+	g.Expect(published.Response).To(Equal("nats-0: jwt updated"))
+	g.Expect(published.Time.Time).To(BeTemporally(">=", before))
+
+	// Republishing with the same outcome doesn't update the status again right away
+	g.Expect(reconcile()).To(Equal(published))
+
+	atomic.StoreInt32(&failing, 1)
+	rejected := reconcile()
+	g.Expect(rejected.Acknowledged).To(BeFalse())
+	g.Expect(rejected.Response).To(Equal("nats-0: claims update rejected (500): resolver unavailable"))
+
+	// Without any response the error is recorded instead
+	g.Expect(responder.Drain()).To(Succeed())
+	g.Eventually(responder.IsClosed).Should(BeTrue())
+	unanswered := reconcile()
+	g.Expect(unanswered.Acknowledged).To(BeFalse())
+	g.Expect(unanswered.Response).To(ContainSubstring("no responders"))
+}
+
+func TestAccountServerOverlappingPublishes(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	updates := make(chan string, 10)
+	release := make(chan struct{})
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		updates <- string(msg.Data)
+		<-release
+		msg.Respond([]byte(`{"data":{"code":200,"message":"jwt updated"}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 0
+	r.PublishTimeout = 5 * time.Second
+	a := &AdminServer{AccountServer: r, Token: "secret"}
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+
+	reconciled := make(chan error, 1)
+	go func() {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		reconciled <- err
+	}()
+	g.Eventually(updates, 5*time.Second).Should(Receive(Equal(served.Status.JWT)))
+
+	// A resync while the reconcile is still publishing joins that publish
+	resynced := make(chan int, 1)
+	go func() {
+		resynced <- adminRequest(a, http.MethodPost, "/accounts/"+served.Status.PublicKey+"/resync", "secret").Code
+	}()
+	// A newer JWT is only pushed once the publish in flight is done
+	updated := testAccountJWT(g, served.Status.PublicKey, "v2")
+	published := make(chan error, 1)
+	go func() {
+		_, _, err := r.publishAccount(ctx, served.Status.PublicKey, updated)
+		published <- err
+	}()
+	g.Consistently(updates, 100*time.Millisecond).ShouldNot(Receive())
+
+	close(release)
+	g.Eventually(reconciled, 5*time.Second).Should(Receive(BeNil()))
+	g.Eventually(resynced, 5*time.Second).Should(Receive(Equal(http.StatusNoContent)))
+	g.Eventually(published, 5*time.Second).Should(Receive(BeNil()))
+	g.Expect(updates).To(Receive(Equal(updated)))
+	g.Expect(updates).NotTo(Receive())
+
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	g.Expect(account.Status.LastPublish).NotTo(BeNil())
+	g.Expect(account.Status.LastPublish.Acknowledged).To(BeTrue())
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_PUBLISH_FAILED)).To(BeFalse())
+}
+
+func TestAccountServerSkipsOutdatedGeneration(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	var attempts int32
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		atomic.AddInt32(&attempts, 1)
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	outdated := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	outdated.Generation = 1
+	r := newTestAccountServer(g, t, s, outdated)
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+	current := testAccountJWT(g, outdated.Status.PublicKey, "v2")
+	r.serveAccount(outdated.Status.PublicKey, servedAccount{Owner: key, JWT: current, Generation: 2})
+
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.lookupAccount(outdated.Status.PublicKey).JWT).To(Equal(current))
+	g.Expect(atomic.LoadInt32(&attempts)).To(BeZero())
+}
+
+// signalingInformer is a fake informer closing registered once the controller added its event handler
+type signalingInformer struct {
+	controllertest.FakeInformer
+	registered chan struct{}
+}
+
+func (i *signalingInformer) AddEventHandler(handler toolscache.ResourceEventHandler) (toolscache.ResourceEventHandlerRegistration, error) {
+	registration, err := i.FakeInformer.AddEventHandler(handler)
+	close(i.registered)
+	return registration, err
+}
+
+// startTestManager runs r as controller of a manager using the client of r, without an API server.
+// The returned informer feeds the watch on accounts.
+func startTestManager(g *WithT, t *testing.T, r *NatsAccountServer) *signalingInformer {
+	gvk := natsv1alpha1.GroupVersion.WithKind("NatsAccount")
+	informer := &signalingInformer{registered: make(chan struct{})}
+	informers := &informertest.FakeInformers{
+		Scheme:         r.Scheme,
+		InformersByGVK: map[schema.GroupVersionKind]toolscache.SharedIndexInformer{gvk: informer},
+	}
+	mgr, err := ctrl.NewManager(&rest.Config{Host: "127.0.0.1:1"}, ctrl.Options{
+		Scheme:             r.Scheme,
+		MetricsBindAddress: "0",
+		MapperProvider: func(*rest.Config) (meta.RESTMapper, error) {
+			mapper := meta.NewDefaultRESTMapper(nil)
+			mapper.Add(gvk, meta.RESTScopeNamespace)
+			return mapper, nil
+		},
+		NewCache: func(*rest.Config, cache.Options) (cache.Cache, error) {
+			return informers, nil
+		},
+		NewClient: func(cache.Cache, *rest.Config, client.Options, ...client.Object) (client.Client, error) {
+			return r.Client, nil
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.SetupWithManager(mgr)).To(Succeed())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mgr.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	g.Eventually(informer.registered, 5*time.Second).Should(BeClosed())
+	return informer
+}
+
+func TestAccountServerConcurrentReconciles(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		// Respond asynchronously, so that the publishes of all accounts can be in flight together
+		go func() {
+			current := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&inFlight, -1)
+			msg.Respond([]byte(`{"data":{"code":200}}`))
+		}()
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	accounts := []*natsv1alpha1.NatsAccount{}
+	objs := []client.Object{}
+	for i := 0; i < 5; i++ {
+		account := newServedAccount(g, fmt.Sprintf("app-%d", i), newTestAccountKey(g), "v1")
+		accounts = append(accounts, account)
+		objs = append(objs, account)
+	}
+	r := newTestAccountServer(g, t, s, objs...)
+	r.PublishRetries = 0
+	r.PublishTimeout = 5 * time.Second
+	r.MaxConcurrentReconciles = 3
+	informer := startTestManager(g, t, r)
+	for _, account := range accounts {
+		informer.Add(account)
+	}
+
+	// Only as many accounts as configured are reconciled at once
+	g.Eventually(func() int32 { return atomic.LoadInt32(&inFlight) }, 5*time.Second).Should(BeEquivalentTo(3))
+	g.Consistently(func() int32 { return atomic.LoadInt32(&inFlight) }, 200*time.Millisecond).Should(BeEquivalentTo(3))
+	close(release)
+
+	g.Eventually(func() int { return len(r.servedAccounts()) }, 5*time.Second).Should(Equal(5))
+	for _, account := range accounts {
+		g.Expect(r.lookupAccount(account.Status.PublicKey).JWT).To(Equal(account.Status.JWT))
+		g.Eventually(func() *natsv1alpha1.PublishStatus {
+			issued := &natsv1alpha1.NatsAccount{}
+			g.Expect(r.Get(context.Background(), client.ObjectKeyFromObject(account), issued)).To(Succeed())
+			return issued.Status.LastPublish
+		}, 5*time.Second).ShouldNot(BeNil())
+	}
+	g.Expect(atomic.LoadInt32(&maxInFlight)).To(BeEquivalentTo(3))
+}
+
+func TestClaimAccountKeepsOwnerTakingKeyMeanwhile(t *testing.T) {
+	g := NewWithT(t)
+	r := NewAccountServer()
+	first := types.NamespacedName{Namespace: testNamespace, Name: "first"}
+	second := types.NamespacedName{Namespace: testNamespace, Name: "second"}
+
+	// Both saw the key unserved, only the first one claiming it gets it
+	g.Expect(r.claimAccount("APUBKEY", types.NamespacedName{}, servedAccount{Owner: first, JWT: "first"})).To(BeTrue())
+	g.Expect(r.claimAccount("APUBKEY", types.NamespacedName{}, servedAccount{Owner: second, JWT: "second"})).To(BeFalse())
+	g.Expect(r.lookupAccount("APUBKEY").JWT).To(Equal("first"))
+
+	// Reissuing for the owner itself, or taking over from the owner that was checked, succeeds
+	g.Expect(r.claimAccount("APUBKEY", types.NamespacedName{}, servedAccount{Owner: first, JWT: "first-v2"})).To(BeTrue())
+	g.Expect(r.claimAccount("APUBKEY", first, servedAccount{Owner: second, JWT: "second"})).To(BeTrue())
+	g.Expect(r.lookupAccount("APUBKEY").Owner).To(Equal(second))
+}
+
+func TestAccountServerPublishCircuitBreaker(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	var attempts int32
+	var failing int32 = 1
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		atomic.AddInt32(&attempts, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			msg.Respond([]byte(`{"error":{"code":500,"description":"overloaded"}}`))
+			return
+		}
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	now := time.Now()
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 0
+	r.PublishBreaker = &CircuitBreaker{Threshold: 2, Cooldown: time.Minute, now: func() time.Time { return now }}
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+	reconcile := func() (ctrl.Result, *metav1.Condition) {
+		res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		g.Expect(err).NotTo(HaveOccurred())
+		account := &natsv1alpha1.NatsAccount{}
+		g.Expect(r.Get(ctx, key, account)).To(Succeed())
+		return res, meta.FindStatusCondition(account.Status.Conditions, CONDITION_PUBLISH_FAILED)
+	}
+
+	reconcile()
+	reconcile()
+	g.Expect(r.PublishBreaker.IsOpen()).To(BeTrue())
+
+	// While open, reconciles don't publish and report the suspension
+	res, condition := reconcile()
+	g.Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(2))
+	g.Expect(res.RequeueAfter).To(Equal(time.Minute))
+	g.Expect(condition.Reason).To(Equal("CircuitOpen"))
+	g.Expect(r.lookupAccount(served.Status.PublicKey).JWT).To(Equal(served.Status.JWT))
+
+	// After the cooldown a trial publish closes the breaker again
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(time.Minute)
+	res, condition = reconcile()
+	g.Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(3))
+	g.Expect(res.RequeueAfter).To(BeZero())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(r.PublishBreaker.IsOpen()).To(BeFalse())
+}
+
+func TestAccountServerDuplicatePublicKey(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	accountKey := newTestAccountKey(g)
+	firstAccount := newServedAccount(g, "first", accountKey, "first")
+	r := newTestAccountServer(g, t, s, firstAccount, newServedAccount(g, "second", accountKey, "second"))
+	ctx := context.Background()
+	first := client.ObjectKey{Namespace: testNamespace, Name: "first"}
+	second := client.ObjectKey{Namespace: testNamespace, Name: "second"}
+
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: first})
+	g.Expect(err).NotTo(HaveOccurred())
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: second})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(Equal(CONFLICT_REQUEUE))
+
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, second, account)).To(Succeed())
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_CONFLICT)).To(BeTrue())
+	g.Expect(r.Get(ctx, first, account)).To(Succeed())
+	g.Expect(meta.FindStatusCondition(account.Status.Conditions, CONDITION_CONFLICT)).To(BeNil())
+
+	// The first account keeps being served
+	g.Expect(r.lookupAccount(accountKey)).To(Equal(servedAccount{Owner: first, JWT: firstAccount.Status.JWT}))
+}
+
+func TestAccountServerDeletionGracePeriod(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.DeletionGracePeriod = 200 * time.Millisecond
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(served)}
+	_, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Within the grace period the deleted account is still served, marked for removal
+	g.Expect(r.Delete(ctx, served)).To(Succeed())
+	res, err := r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(BeNumerically("~", r.DeletionGracePeriod, 50*time.Millisecond))
+	g.Expect(r.lookupAccount(served.Status.PublicKey).JWT).To(Equal(served.Status.JWT))
+	g.Expect(r.lookupAccount(served.Status.PublicKey).RemoveAt).NotTo(BeZero())
+
+	// Reconciling again doesn't extend the grace period
+	time.Sleep(100 * time.Millisecond)
+	res, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(BeNumerically("<=", 100*time.Millisecond))
+	g.Expect(r.lookupAccount(served.Status.PublicKey).JWT).To(Equal(served.Status.JWT))
+
+	time.Sleep(res.RequeueAfter)
+	res, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(BeZero())
+	g.Expect(r.lookupAccount(served.Status.PublicKey).JWT).To(BeEmpty())
+}
+
+// issueTestUser returns the JWT and seed of a new user of account
+func issueTestUser(g *WithT, account nkeys.KeyPair) (string, string) {
+	user, _ := nkeys.CreateUser()
+	userPublic, _ := user.PublicKey()
+	userSeed, _ := user.Seed()
+	userJWT, err := jwt.NewUserClaims(userPublic).Encode(account)
+	g.Expect(err).NotTo(HaveOccurred())
+	return userJWT, string(userSeed)
+}
+
+func TestAccountServerDisablesDeletedAccounts(t *testing.T) {
+	g := NewWithT(t)
+	operator, _ := nkeys.CreateOperator()
+	operatorPublic, _ := operator.PublicKey()
+	system, _ := nkeys.CreateAccount()
+	systemPublic, _ := system.PublicKey()
+	systemJWT, err := jwt.NewAccountClaims(systemPublic).Encode(operator)
+	g.Expect(err).NotTo(HaveOccurred())
+	// A full resolver, which stores the claims updates pushed by the account server
+	resolver, err := server.NewDirAccResolver(t.TempDir(), 0, time.Minute, server.NoDelete)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(resolver.Store(systemPublic, systemJWT)).To(Succeed())
+	s := startTestNatsServer(t, &server.Options{
+		Host:             "127.0.0.1",
+		Port:             -1,
+		TrustedOperators: []*jwt.OperatorClaims{jwt.NewOperatorClaims(operatorPublic)},
+		SystemAccount:    systemPublic,
+		AccountResolver:  resolver,
+	})
+
+	app, _ := nkeys.CreateAccount()
+	appPublic, _ := app.PublicKey()
+	claims := jwt.NewAccountClaims(appPublic)
+	account := newTestAccount("app")
+	account.Status.PublicKey = appPublic
+	account.Status.JWT, err = encodeAccountClaims(claims, operator, 2)
+	g.Expect(err).NotTo(HaveOccurred())
+	account.Status.DisabledJWT, err = encodeAccountClaims(disabledAccountClaims(claims), operator, 2)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	scheme := newTestScheme(g)
+	r := NewAccountServer()
+	r.Scheme = scheme
+	r.Client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(account).Build()
+	r.PublishBackoff = time.Millisecond
+	r.DeletionGracePeriod = 200 * time.Millisecond
+	systemUserJWT, systemUserSeed := issueTestUser(g, system)
+	r.nc, err = nats.Connect(s.ClientURL(), nats.UserJWTAndSeed(systemUserJWT, systemUserSeed))
+	g.Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(r.nc.Close)
+	r.natsReady.Unlock()
+	g.Expect(r.WarmCache(context.Background())).To(Succeed())
+	g.Expect(r.lookupAccount(appPublic).DisabledJWT).To(Equal(account.Status.DisabledJWT))
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)}
+	_, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	userJWT, userSeed := issueTestUser(g, app)
+	connectUser := func() (*nats.Conn, error) {
+		return nats.Connect(s.ClientURL(), nats.UserJWTAndSeed(userJWT, userSeed), nats.NoReconnect())
+	}
+	user, err := connectUser()
+	g.Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(user.Close)
+
+	// Users of the account are accepted during the grace period
+	g.Expect(r.Delete(ctx, account)).To(Succeed())
+	res, err := r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(BeNumerically(">", 0))
+	g.Expect(user.Flush()).To(Succeed())
+
+	// Afterwards the account is disabled, NATS disconnects its users and rejects new ones
+	time.Sleep(res.RequeueAfter)
+	res, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(BeZero())
+	g.Expect(r.lookupAccount(appPublic).JWT).To(BeEmpty())
+	g.Eventually(user.IsClosed).Should(BeTrue())
+	_, err = connectUser()
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestAccountServerServesOnlyPersistedStatus(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	var published int32
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		atomic.AddInt32(&published, 1)
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	// A conflict reported earlier needs to be cleared in the status before serving
+	account := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	account.Status.Conditions = []metav1.Condition{{
+		Type:               CONDITION_CONFLICT,
+		Status:             metav1.ConditionTrue,
+		Reason:             "DuplicatePublicKey",
+		Message:            "public key " + account.Status.PublicKey + " is already served for account nats/other",
+		LastTransitionTime: metav1.Now(),
+	}}
+	r := newTestAccountServer(g, t, s, account)
+	r.Client = &conflictingStatusClient{Client: r.Client, conflicts: 1}
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "app"}}
+	_, err = r.Reconcile(ctx, req)
+	g.Expect(errors.IsConflict(err)).To(BeTrue())
+	g.Expect(r.lookupAccount(account.Status.PublicKey).JWT).To(BeEmpty())
+	g.Expect(atomic.LoadInt32(&published)).To(BeZero())
+
+	_, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.lookupAccount(account.Status.PublicKey).JWT).To(Equal(account.Status.JWT))
+	g.Expect(atomic.LoadInt32(&published)).To(BeEquivalentTo(1))
+	persisted := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, req.NamespacedName, persisted)).To(Succeed())
+	g.Expect(meta.IsStatusConditionTrue(persisted.Status.Conditions, CONDITION_CONFLICT)).To(BeFalse())
+}
+
+func TestAccountServerSkipsJWTFailingVerification(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	ar := newTestAccountReconciler(g, newTestAccount("app"))
+	issued, _ := reconcileAccount(g, ar, "app")
+
+	// Signing with a key the operator doesn't know issues a JWT that doesn't chain to it
+	stranger, _ := nkeys.CreateOperator()
+	strangerSeed, _ := stranger.Seed()
+	operatorSecret := &corev1.Secret{}
+	g.Expect(ar.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	operatorSecret.Data[OPERATOR_SEED_KEY] = strangerSeed
+	g.Expect(ar.Update(ctx, operatorSecret)).To(Succeed())
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "app"}}
+	_, err := ar.Reconcile(ctx, req)
+	g.Expect(err).To(HaveOccurred())
+	persisted := &natsv1alpha1.NatsAccount{}
+	g.Expect(ar.Get(ctx, req.NamespacedName, persisted)).To(Succeed())
+	g.Expect(persisted.Status.JWT).To(Equal(issued.Status.JWT))
+
+	// The account server keeps serving the JWT verified before
+	s := runTestNatsServer(t)
+	var published []string
+	var mu sync.Mutex
+	responder := connectTestNats(t, s)
+	_, err = responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		mu.Lock()
+		published = append(published, string(msg.Data))
+		mu.Unlock()
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+	persisted.ResourceVersion = ""
+	r := newTestAccountServer(g, t, s, persisted)
+	_, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.lookupAccount(issued.Status.PublicKey).JWT).To(Equal(issued.Status.JWT))
+	mu.Lock()
+	defer mu.Unlock()
+	g.Expect(published).To(ConsistOf(issued.Status.JWT))
+}
+
+func TestAccountServerFailClosed(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	port := s.Addr().(*net.TCPAddr).Port
+	respond := func(nc *nats.Conn) {
+		_, err := nc.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+			msg.Respond([]byte(`{"data":{"code":200}}`))
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(nc.Flush()).To(Succeed())
+	}
+	respond(connectTestNats(t, s))
+
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 0
+	sub, err := r.subscribeLookups(r.nc, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+	r.sub = sub
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "app"}}
+
+	r.FailClosed = true
+	res, err := r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.Requeue || res.RequeueAfter > 0).To(BeFalse())
+	g.Expect(r.Ready(nil)).To(Succeed())
+
+	s.Shutdown()
+	g.Eventually(r.nc.IsConnected).Should(BeFalse())
+
+	// Best effort keeps serving the account and only retries the publish later
+	r.FailClosed = false
+	res, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(Equal(r.PublishFailedRequeue))
+	g.Expect(r.divergedAccounts()).To(BeZero())
+
+	r.FailClosed = true
+	res, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(Equal(DISCONNECTED_REQUEUE))
+	g.Expect(r.lookupAccount(served.Status.PublicKey).JWT).To(Equal(served.Status.JWT))
+
+	// Readiness reflects the divergence even once NATS is back, until the account got pushed
+	s = startTestNatsServer(t, &server.Options{Host: "127.0.0.1", Port: port})
+	respond(connectTestNats(t, s))
+	g.Eventually(r.nc.IsConnected, 5*time.Second).Should(BeTrue())
+	g.Expect(r.Ready(nil)).To(MatchError(ContainSubstring("not yet pushed")))
+
+	res, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.RequeueAfter).To(BeZero())
+	g.Expect(r.Ready(nil)).To(Succeed())
+}
+
+func TestCappedExponentialReconnectDelay(t *testing.T) {
+	g := NewWithT(t)
+	delay := CappedExponentialReconnectDelay(time.Second, 5*time.Second)
+	g.Expect(delay(1)).To(Equal(time.Second))
+	g.Expect(delay(2)).To(Equal(2 * time.Second))
+	g.Expect(delay(3)).To(Equal(4 * time.Second))
+	g.Expect(delay(4)).To(Equal(5 * time.Second))
+	g.Expect(delay(100)).To(Equal(5 * time.Second))
+}
+
+func TestConnectToNatsCustomReconnectDelay(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	port := s.Addr().(*net.TCPAddr).Port
+
+	attempts := make(chan int, 100)
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{
+		ReconnectDelay: func(attempt int) time.Duration {
+			attempts <- attempt
+			return 10 * time.Millisecond
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer nc.Close()
+
+	s.Shutdown()
+	g.Eventually(attempts).Should(Receive(Equal(1)))
+	g.Eventually(attempts).Should(Receive(Equal(2)))
+	g.Eventually(attempts).Should(Receive(Equal(3)))
+
+	startTestNatsServer(t, &server.Options{Host: "127.0.0.1", Port: port})
+	g.Eventually(nc.IsConnected, 5*time.Second).Should(BeTrue())
+}
+
+// stallingDialer dials connections which drop everything received once stalled, like a silently dead link
+type stallingDialer struct {
+	net.Dialer
+	stalled int32
+}
+
+func (d *stallingDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	return &stallingConn{Conn: conn, stalled: &d.stalled}, err
+}
+
+type stallingConn struct {
+	net.Conn
+	stalled *int32
+}
+
+func (c *stallingConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil || atomic.LoadInt32(c.stalled) == 0 {
+			return n, err
+		}
+	}
+}
+
+func TestConnectToNatsPingOptions(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(nc.Opts.PingInterval).To(Equal(DEFAULT_PING_INTERVAL))
+	g.Expect(nc.Opts.MaxPingsOut).To(Equal(DEFAULT_MAX_PINGS_OUTSTANDING))
+	nc.Close()
+
+	dialer := &stallingDialer{}
+	nc, err = connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{
+		Dialer:              dialer,
+		PingInterval:        50 * time.Millisecond,
+		MaxPingsOutstanding: 2,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer nc.Close()
+	g.Expect(nc.Opts.PingInterval).To(Equal(50 * time.Millisecond))
+	g.Expect(nc.Opts.MaxPingsOut).To(Equal(2))
+	disconnects := make(chan error, 10)
+	nc.SetDisconnectErrHandler(func(_ *nats.Conn, err error) {
+		disconnects <- err
+	})
+
+	r := newTestAccountServer(g, t, s)
+	r.nc = nc
+	r.sub, err = r.subscribeLookups(nc, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Consistently(func() error { return r.Ready(nil) }, 200*time.Millisecond).Should(Succeed())
+
+	// Three unanswered pings in, the connection is given up on and readiness flips
+	atomic.StoreInt32(&dialer.stalled, 1)
+	stalled := time.Now()
+	g.Eventually(disconnects, time.Second).Should(Receive(Equal(nats.ErrStaleConnection)))
+	g.Expect(time.Since(stalled)).To(BeNumerically("<", 500*time.Millisecond))
+	g.Expect(r.Ready(nil)).NotTo(Succeed())
+}
+
+func TestConnectToNatsToken(t *testing.T) {
+	g := NewWithT(t)
+	s := startTestNatsServer(t, &server.Options{Host: "127.0.0.1", Port: -1, Authorization: "s3cret"})
+
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{Token: "s3cret"})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer nc.Close()
+	g.Expect(nc.IsConnected()).To(BeTrue())
+
+	_, err = connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{Token: "wrong"})
+	g.Expect(err).To(MatchError(nats.ErrAuthorization))
+	_, err = connectToNats(s.ClientURL(), "/creds/user.creds", NatsTlsConfig{}, NatsConnConfig{Token: "s3cret"})
+	g.Expect(err).To(MatchError("a token can't be used together with a creds file or a user JWT provider"))
+}
+
+func TestAccountServerFlushesOnShutdown(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	subscriber := connectTestNats(t, s)
+	sub, err := subscriber.SubscribeSync(CLAIMS_UPDATE_SUBJECT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(subscriber.Flush()).To(Succeed())
+
+	r := NewAccountServer()
+	r.CredentialsWatchInterval = 0
+	r.warmed.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx, s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{}) }()
+	g.Eventually(func() bool { return r.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+	nc, _ := r.conn()
+	g.Expect(nc.Opts.FlusherTimeout).To(Equal(DEFAULT_FLUSHER_TIMEOUT))
+
+	// A claims update published right before the shutdown still reaches the server
+	g.Expect(nc.Publish(CLAIMS_UPDATE_SUBJECT, []byte("token"))).To(Succeed())
+	cancel()
+	g.Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+	g.Expect(nc.IsClosed()).To(BeTrue())
+	msg, err := sub.NextMsg(time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal("token"))
+}
+
+func TestLookupSubscriptionSurvivesReconnect(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	port := s.Addr().(*net.TCPAddr).Port
+	account := newTestAccountKey(g)
+
+	r := NewAccountServer()
+	r.CredentialsWatchInterval = 0
+	r.warmed.Store(true)
+	r.serveAccount(account, servedAccount{JWT: "token"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{
+		ReconnectDelay: func(int) time.Duration { return 10 * time.Millisecond },
+	})
+	g.Eventually(func() bool { return r.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+	// bounce restarts the NATS server and waits for the account server to be ready again
+	bounce := func() {
+		s.Shutdown()
+		g.Eventually(func() bool { return r.Ready(nil) == nil }).Should(BeFalse())
+		s = startTestNatsServer(t, &server.Options{Host: "127.0.0.1", Port: port})
+		g.Eventually(func() bool { return r.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+	}
+	lookup := func() string {
+		msg, err := connectTestNats(t, s).Request("$SYS.REQ.ACCOUNT."+account+".CLAIMS.LOOKUP", nil, time.Second)
+		g.Expect(err).NotTo(HaveOccurred())
+		return string(msg.Data)
+	}
+
+	bounce()
+	g.Expect(lookup()).To(Equal("token"))
+
+	// A subscription lost meanwhile fails readiness, and is established again on reconnect
+	_, sub := r.conn()
+	g.Expect(sub.Unsubscribe()).To(Succeed())
+	g.Expect(r.Ready(nil)).To(MatchError(ContainSubstring("Not subscribed to account lookups")))
+	bounce()
+	g.Expect(lookup()).To(Equal("token"))
+}
+
+// recordingDialer records everything read from the connections it dials
+type recordingDialer struct {
+	net.Dialer
+	read chan []byte
+}
+
+func (d *recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	return &recordingConn{Conn: conn, read: d.read}, err
+}
+
+type recordingConn struct {
+	net.Conn
+	read chan []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		select {
+		case c.read <- append([]byte{}, b[:n]...):
+		default:
+		}
+	}
+	return n, err
+}
+
+// natsWebsocketCompressionWorks reports whether nats.go can compress websocket frames with this Go version.
+// It drops the last four bytes written when closing the flate writer, expecting them to be a sync marker,
+// which newer Go versions don't write anymore.
+func natsWebsocketCompressionWorks() bool {
+	buf := &bytes.Buffer{}
+	w, _ := flate.NewWriter(buf, flate.BestSpeed)
+	w.Write([]byte("PING\r\n"))
+	w.Close()
+	return bytes.HasSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+}
+
+func TestConnectToNatsCompression(t *testing.T) {
+	g := NewWithT(t)
+	s := startTestNatsServer(t, &server.Options{
+		Host: "127.0.0.1",
+		Port: -1,
+		Websocket: server.WebsocketOpts{
+			Host:        "127.0.0.1",
+			Port:        -1,
+			NoTLS:       true,
+			Compression: true,
+		},
+	})
+	ports := s.PortsInfo(5 * time.Second)
+	g.Expect(ports).NotTo(BeNil())
+	g.Expect(ports.WebSocket).To(HaveLen(1))
+
+	for _, compression := range []bool{false, true} {
+		dialer := &recordingDialer{read: make(chan []byte, 100)}
+		nc, err := connectToNats(ports.WebSocket[0], "", NatsTlsConfig{}, NatsConnConfig{Dialer: dialer, Compression: compression})
+
+		// The server only agrees to compress in the websocket handshake response if the client asked for it
+		var handshake []byte
+		g.Expect(dialer.read).To(Receive(&handshake))
+		g.Expect(string(handshake)).To(HavePrefix("HTTP/1.1 101"))
+		if compression {
+			g.Expect(string(handshake)).To(ContainSubstring("permessage-deflate"))
+		} else {
+			g.Expect(string(handshake)).NotTo(ContainSubstring("permessage-deflate"))
+		}
+		if compression && !natsWebsocketCompressionWorks() {
+			t.Log("skipping compressed messages, nats.go can't compress with this Go version")
+			continue
+		}
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(nc.Opts.Compression).To(Equal(compression))
+		sub, err := nc.SubscribeSync("greeting")
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(nc.Publish("greeting", []byte("hello"))).To(Succeed())
+		msg, err := sub.NextMsg(time.Second)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(msg.Data)).To(Equal("hello"))
+		nc.Close()
+	}
+}
+
+func TestAccountServerReconnectsOnCredentialsChange(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestOperatorServer(g, t)
+	credsFile := filepath.Join(t.TempDir(), "nats.creds")
+	firstUser := s.writeUserCreds(g, credsFile)
+
+	accountPublic := newTestAccountKey(g)
+	r := NewAccountServer()
+	r.CredentialsWatchInterval = 10 * time.Millisecond
+	r.serveAccount(accountPublic, servedAccount{JWT: "token"})
+	// There are no accounts to warm the cache with
+	r.warmed.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, s.ClientURL(), credsFile, NatsTlsConfig{}, NatsConnConfig{})
+	g.Eventually(func() bool { return r.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+	g.Expect(s.connectedUsers(g)).To(ConsistOf(firstUser))
+	first, _ := r.conn()
+
+	secondUser := s.writeUserCreds(g, credsFile)
+	g.Eventually(func() []string { return s.connectedUsers(g) }, 5*time.Second).Should(ConsistOf(secondUser))
+	second, _ := r.conn()
+	g.Expect(second).NotTo(BeIdenticalTo(first))
+	g.Expect(first.IsClosed()).To(BeTrue())
+
+	// Lookups are answered on the new connection
+	requester, err := nats.Connect(s.ClientURL(), nats.UserCredentials(credsFile))
+	g.Expect(err).NotTo(HaveOccurred())
+	defer requester.Close()
+	msg, err := requester.Request("$SYS.REQ.ACCOUNT."+accountPublic+".CLAIMS.LOOKUP", nil, time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal("token"))
+}
+
+func TestAccountServerReloadsConfigOnSignal(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestOperatorServer(g, t)
+	dir := t.TempDir()
+	firstUser := s.writeUserCreds(g, filepath.Join(dir, "first.creds"))
+	secondUser := s.writeUserCreds(g, filepath.Join(dir, "second.creds"))
+	configFile := filepath.Join(dir, "nats.yaml")
+	g.Expect(os.WriteFile(configFile, []byte("credsFile: "+filepath.Join(dir, "first.creds")), 0600)).To(Succeed())
+
+	// Keep an own handler registered, so the signal never hits the default handler terminating the test
+	signals := make(chan os.Signal, 10)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	r := NewAccountServer()
+	r.CredentialsWatchInterval = 0
+	r.warmed.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	creds, err := LoadNatsCredentialsConfig(configFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	go r.Run(ctx, s.ClientURL(), creds.CredsFile, creds.NatsTlsConfig, NatsConnConfig{})
+	g.Eventually(func() bool { return r.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+	g.Expect(s.connectedUsers(g)).To(ConsistOf(firstUser))
+	go r.ReloadOnSignal(ctx, configFile, syscall.SIGHUP)
+
+	g.Expect(os.WriteFile(configFile, []byte("credsFile: "+filepath.Join(dir, "second.creds")), 0600)).To(Succeed())
+	g.Eventually(func() []string {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		return s.connectedUsers(g)
+	}, 5*time.Second, 50*time.Millisecond).Should(ConsistOf(secondUser))
+	creds, _ = r.credentials()
+	g.Expect(creds.CredsFile).To(Equal(filepath.Join(dir, "second.creds")))
+
+	// A broken config keeps the current connection
+	g.Expect(r.Reconfigure(logr.Discard(), NatsCredentialsConfig{CredsFile: filepath.Join(dir, "missing.creds")})).NotTo(Succeed())
+	creds, _ = r.credentials()
+	g.Expect(creds.CredsFile).To(Equal(filepath.Join(dir, "second.creds")))
+	g.Expect(s.connectedUsers(g)).To(ConsistOf(secondUser))
+}
+
+func TestLookupServesStaticAccounts(t *testing.T) {
+	g := NewWithT(t)
+	operator, _ := nkeys.CreateOperator()
+	systemAccount, _ := nkeys.CreateAccount()
+	systemPublic, _ := systemAccount.PublicKey()
+	systemJWT, err := jwt.NewAccountClaims(systemPublic).Encode(operator)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	dir := t.TempDir()
+	g.Expect(os.WriteFile(filepath.Join(dir, "system.jwt"), []byte(systemJWT+"\n"), 0600)).To(Succeed())
+	g.Expect(os.Mkdir(filepath.Join(dir, "..data"), 0700)).To(Succeed())
+
+	s := runTestNatsServer(t)
+	r := newTestAccountServer(g, t, s)
+	g.Expect(r.LoadStaticAccounts(dir)).To(Succeed())
+	_, err = r.nc.Subscribe(LOOKUP_SUBJECT, r.lookupHandler(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.nc.Flush()).To(Succeed())
+
+	requester := connectTestNats(t, s)
+	msg, err := requester.Request("$SYS.REQ.ACCOUNT."+systemPublic+".CLAIMS.LOOKUP", nil, time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal(systemJWT))
+
+	// A NatsAccount for the same key takes precedence
+	r.serveAccount(systemPublic, servedAccount{JWT: "managed"})
+	msg, err = requester.Request("$SYS.REQ.ACCOUNT."+systemPublic+".CLAIMS.LOOKUP", nil, time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal("managed"))
+
+	g.Expect(os.WriteFile(filepath.Join(dir, "broken.jwt"), []byte("garbage"), 0600)).To(Succeed())
+	g.Expect(r.LoadStaticAccounts(dir)).NotTo(Succeed())
+}
+
+func TestLookupServesSeededSystemAccount(t *testing.T) {
+	g := NewWithT(t)
+	const systemPublic = "ACEIQEPXYLWISJ7HAH7O3POS376HGCXWZ6RRG725I5RK653WAF6POFJ6"
+	content, err := os.ReadFile("testdata/system-account.jwt")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	s := runTestNatsServer(t)
+	r := newTestAccountServer(g, t, s)
+	g.Expect(r.SeedSystemAccount("testdata/system-account.jwt")).To(Succeed())
+	g.Expect(r.systemAccount).To(Equal(systemPublic))
+	_, err = r.nc.Subscribe(LOOKUP_SUBJECT, r.lookupHandler(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.nc.Flush()).To(Succeed())
+
+	requester := connectTestNats(t, s)
+	msg, err := requester.Request("$SYS.REQ.ACCOUNT."+systemPublic+".CLAIMS.LOOKUP", nil, time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal(strings.TrimSpace(string(content))))
+
+	// Only account JWTs are accepted
+	user, _ := nkeys.CreateUser()
+	userPublic, _ := user.PublicKey()
+	account, _ := nkeys.CreateAccount()
+	userJWT, err := jwt.NewUserClaims(userPublic).Encode(account)
+	g.Expect(err).NotTo(HaveOccurred())
+	userFile := filepath.Join(t.TempDir(), "user.jwt")
+	g.Expect(os.WriteFile(userFile, []byte(userJWT), 0600)).To(Succeed())
+	g.Expect(r.SeedSystemAccount(userFile)).NotTo(Succeed())
+	g.Expect(r.SeedSystemAccount(filepath.Join(t.TempDir(), "missing.jwt"))).NotTo(Succeed())
+}
+
+// newTestAccountKey returns the public key of a new account key pair
+func newTestAccountKey(g *WithT) string {
+	account, err := nkeys.CreateAccount()
+	g.Expect(err).NotTo(HaveOccurred())
+	public, err := account.PublicKey()
+	g.Expect(err).NotTo(HaveOccurred())
+	return public
+}
+
+// histogramBuckets returns the cumulative count per upper bound of h
+func histogramBuckets(g *WithT, h prometheus.Histogram) map[float64]uint64 {
+	m := &dto.Metric{}
+	g.Expect(h.Write(m)).To(Succeed())
+	buckets := map[float64]uint64{}
+	for _, b := range m.Histogram.Bucket {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return buckets
+}
+
+func TestLookupExistenceChecks(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	r := newTestAccountServer(g, t, s)
+	known, static, unknown := newTestAccountKey(g), newTestAccountKey(g), newTestAccountKey(g)
+	r.serveAccount(known, servedAccount{JWT: "token"})
+	r.staticAccounts = map[string]string{static: "static-token"}
+	_, err := r.nc.Subscribe(LOOKUP_SUBJECT, r.lookupHandler(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.nc.Flush()).To(Succeed())
+
+	requester := connectTestNats(t, s)
+	lookup := func(account string, existence bool) string {
+		req := nats.NewMsg("$SYS.REQ.ACCOUNT." + account + ".CLAIMS.LOOKUP")
+		if existence {
+			req.Header.Set(LOOKUP_MODE_HEADER, LOOKUP_MODE_EXISTS)
+		}
+		msg, err := requester.RequestMsg(req, time.Second)
+		g.Expect(err).NotTo(HaveOccurred())
+		return string(msg.Data)
+	}
+
+	// Existence checks are answered with the JWT unless enabled
+	g.Expect(lookup(known, true)).To(Equal("token"))
+
+	r.LookupExistenceChecks = true
+	g.Expect(lookup(known, true)).To(Equal(LOOKUP_EXISTS_MARKER))
+	g.Expect(lookup(static, true)).To(Equal(LOOKUP_EXISTS_MARKER))
+	g.Expect(lookup(unknown, true)).To(BeEmpty())
+	g.Expect(lookup(known, false)).To(Equal("token"))
+	g.Expect(lookup(static, false)).To(Equal("static-token"))
+	g.Expect(lookup(unknown, false)).To(BeEmpty())
+}
+
+func TestLookupFromAPI(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	tenant, duplicate := newTestAccountKey(g), newTestAccountKey(g)
+	// Accounts of any namespace are found by their key
+	tenantAccount := newServedAccount(g, "app", tenant, "v1")
+	tenantAccount.Namespace = "tenant"
+	scheme := newTestScheme(g)
+	r := NewAccountServer()
+	r.Scheme = scheme
+	r.Client = fake.NewClientBuilder().WithScheme(scheme).
+		WithIndex(&natsv1alpha1.NatsAccount{}, ACCOUNT_PUBLIC_KEY_INDEX, indexAccountPublicKey).
+		WithObjects(tenantAccount, newServedAccount(g, "first", duplicate, "v1"), newServedAccount(g, "second", duplicate, "v1")).
+		Build()
+	r.nc = connectTestNats(t, s)
+	_, err := r.nc.Subscribe(LOOKUP_SUBJECT, r.lookupHandler(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.nc.Flush()).To(Succeed())
+
+	ctx := context.Background()
+	g.Expect(r.lookupAccountFromAPI(ctx, tenant)).To(Equal(tenantAccount.Status.JWT))
+	g.Expect(r.lookupAccountFromAPI(ctx, duplicate)).To(BeEmpty())
+	g.Expect(r.lookupAccountFromAPI(ctx, newTestAccountKey(g))).To(BeEmpty())
+
+	requester := connectTestNats(t, s)
+	lookup := func(account string) string {
+		msg, err := requester.Request("$SYS.REQ.ACCOUNT."+account+".CLAIMS.LOOKUP", nil, time.Second)
+		g.Expect(err).NotTo(HaveOccurred())
+		return string(msg.Data)
+	}
+	// Only served accounts are answered unless enabled
+	g.Expect(lookup(tenant)).To(BeEmpty())
+	r.LookupFromAPI = true
+	g.Expect(lookup(tenant)).To(Equal(tenantAccount.Status.JWT))
+	g.Expect(lookup(duplicate)).To(BeEmpty())
+}
+
+func TestLookupMalformedSubjects(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccountKey(g)
+	user, _ := nkeys.CreateUser()
+	userPublic, _ := user.PublicKey()
+	for subject, valid := range map[string]bool{
+		"$SYS.REQ.ACCOUNT." + account + ".CLAIMS.LOOKUP":       true,
+		"$SYS.REQ.ACCOUNT..CLAIMS.LOOKUP":                      false,
+		"$SYS.REQ.ACCOUNT.garbage.CLAIMS.LOOKUP":               false,
+		"$SYS.REQ.ACCOUNT." + userPublic + ".CLAIMS.LOOKUP":    false,
+		"$SYS.REQ.ACCOUNT." + account + ".CLAIMS.UPDATE":       false,
+		"$SYS.REQ.ACCOUNT." + account + ".CLAIMS.LOOKUP.extra": false,
+		"$SYS.REQ.ACCOUNT." + account:                          false,
+		"":                                                     false,
+	} {
+		id, err := lookupAccountId(LOOKUP_SUBJECT, subject)
+		if valid {
+			g.Expect(err).NotTo(HaveOccurred(), subject)
+			g.Expect(id).To(Equal(account))
+		} else {
+			g.Expect(err).To(HaveOccurred(), subject)
+		}
+	}
+
+	s := runTestNatsServer(t)
+	r := newTestAccountServer(g, t, s)
+	r.serveAccount(account, servedAccount{JWT: "token"})
+	var logged []string
+	var logLock sync.Mutex
+	logger := funcr.New(func(prefix, args string) {
+		logLock.Lock()
+		defer logLock.Unlock()
+		logged = append(logged, args)
+	}, funcr.Options{})
+	handler := r.lookupHandler(logger)
+	_, err := r.nc.Subscribe(LOOKUP_SUBJECT, handler)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.nc.Flush()).To(Succeed())
+
+	// Malformed lookups are answered empty instead of looking up what's left of the subject
+	requester := connectTestNats(t, s)
+	msg, err := requester.Request("$SYS.REQ.ACCOUNT.garbage.CLAIMS.LOOKUP", nil, time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(msg.Data).To(BeEmpty())
+	msg, err = requester.Request("$SYS.REQ.ACCOUNT."+account+".CLAIMS.LOOKUP", nil, time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal("token"))
+
+	// Subjects the subscription can't deliver don't panic either
+	g.Expect(func() { handler(&nats.Msg{Subject: "$SYS.REQ.ACCOUNT"}) }).NotTo(Panic())
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	g.Expect(logged).To(ContainElement(And(ContainSubstring("ignoring malformed account lookup"), ContainSubstring(`"subject"="$SYS.REQ.ACCOUNT.garbage.CLAIMS.LOOKUP"`))))
+	g.Expect(logged).To(ContainElement(And(ContainSubstring("ignoring malformed account lookup"), ContainSubstring(`"subject"="$SYS.REQ.ACCOUNT"`))))
+}
+
+func TestLookupQueueGroup(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	account := newTestAccountKey(g)
+	requester := connectTestNats(t, s)
+	// replies counts the responses to a single lookup of account
+	replies := func() int {
+		inbox := nats.NewInbox()
+		sub, err := requester.SubscribeSync(inbox)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer sub.Unsubscribe()
+		g.Expect(requester.PublishRequest("$SYS.REQ.ACCOUNT."+account+".CLAIMS.LOOKUP", inbox, nil)).To(Succeed())
+		count := 0
+		for {
+			msg, err := sub.NextMsg(200 * time.Millisecond)
+			if err != nil {
+				return count
+			}
+			g.Expect(string(msg.Data)).To(Equal("token"))
+			count++
+		}
+	}
+
+	for _, tc := range []struct {
+		queueGroup string
+		replies    int
+	}{{"", 2}, {"account-server", 1}} {
+		servers := []*NatsAccountServer{}
+		subs := []*nats.Subscription{}
+		for i := 0; i < 2; i++ {
+			r := newTestAccountServer(g, t, s)
+			r.LookupQueueGroup = tc.queueGroup
+			r.serveAccount(account, servedAccount{JWT: "token"})
+			sub, err := r.subscribeLookups(r.nc, logr.Discard())
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(sub.Queue).To(Equal(tc.queueGroup))
+			g.Expect(r.nc.Flush()).To(Succeed())
+			servers, subs = append(servers, r), append(subs, sub)
+		}
+		for i := 0; i < 5; i++ {
+			g.Expect(replies()).To(Equal(tc.replies), "queue group %q", tc.queueGroup)
+		}
+		for i, sub := range subs {
+			g.Expect(sub.Unsubscribe()).To(Succeed())
+			g.Expect(servers[i].nc.Flush()).To(Succeed())
+		}
+	}
+}
+
+func TestCustomLookupSubject(t *testing.T) {
+	g := NewWithT(t)
+	for subject, valid := range map[string]bool{
+		LOOKUP_SUBJECT:             true,
+		"_INBOX.resolver.*.lookup": true,
+		"resolver.*":               true,
+		"resolver.lookup":          false,
+		"resolver.*.*":             false,
+		"resolver.>":               false,
+		"resolver..*":              false,
+		"resolver.*.":              false,
+		"resolver.* lookup":        false,
+		"":                         false,
+	} {
+		if valid {
+			g.Expect(ValidateLookupSubject(subject)).To(Succeed(), subject)
+		} else {
+			g.Expect(ValidateLookupSubject(subject)).NotTo(Succeed(), subject)
+		}
+	}
+
+	s := runTestNatsServer(t)
+	r := newTestAccountServer(g, t, s)
+	account := newTestAccountKey(g)
+	r.serveAccount(account, servedAccount{JWT: "token"})
+	r.LookupSubject = "_INBOX.resolver.*.lookup"
+	_, err := r.subscribeLookups(r.nc, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.nc.Flush()).To(Succeed())
+
+	requester := connectTestNats(t, s)
+	msg, err := requester.Request("_INBOX.resolver."+account+".lookup", nil, time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal("token"))
+	// Nothing answers on the default subject anymore
+	_, err = requester.Request("$SYS.REQ.ACCOUNT."+account+".CLAIMS.LOOKUP", nil, 200*time.Millisecond)
+	g.Expect(err).To(HaveOccurred())
+
+	r.LookupSubject = "resolver.>"
+	_, err = r.subscribeLookups(r.nc, logr.Discard())
+	g.Expect(err).To(MatchError(ContainSubstring("can't use the > wildcard")))
+}
+
+func TestLookupResponseSizes(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	r := newTestAccountServer(g, t, s)
+	small, large := newTestAccountKey(g), newTestAccountKey(g)
+	r.serveAccount(small, servedAccount{JWT: strings.Repeat("s", 100)})
+	r.serveAccount(large, servedAccount{JWT: strings.Repeat("l", 100*1024)})
+
+	_, err := r.nc.Subscribe(LOOKUP_SUBJECT, r.lookupHandler(logr.Discard()))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.nc.Flush()).To(Succeed())
+
+	before := histogramBuckets(g, lookupResponseBytes)
+	requester := connectTestNats(t, s)
+	for _, account := range []string{small, large} {
+		_, err := requester.Request("$SYS.REQ.ACCOUNT."+account+".CLAIMS.LOOKUP", nil, time.Second)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	after := histogramBuckets(g, lookupResponseBytes)
+
+	// The small response lands in the lowest bucket, the large one only in the buckets above 100KiB
+	g.Expect(after[256] - before[256]).To(BeEquivalentTo(1))
+	g.Expect(after[64*1024] - before[64*1024]).To(BeEquivalentTo(1))
+	g.Expect(after[256*1024] - before[256*1024]).To(BeEquivalentTo(2))
+}
+
+func TestAccountServerReadyAfterCacheWarm(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	scheme := newTestScheme(g)
+	conflicting := newServedAccount(g, "conflicting", newTestAccountKey(g), "v1")
+	conflicting.Status.Conditions = []metav1.Condition{{
+		Type:               CONDITION_CONFLICT,
+		Status:             metav1.ConditionTrue,
+		Reason:             "DuplicatePublicKey",
+		LastTransitionTime: metav1.Now(),
+	}}
+	app := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	reconciled := newServedAccount(g, "reconciled", newTestAccountKey(g), "v1")
+	current := testAccountJWT(g, reconciled.Status.PublicKey, "v2")
+	drifted := newServedAccount(g, "drifted", newTestAccountKey(g), "v1")
+	drifted.Status.JWT = app.Status.JWT
+	r := NewAccountServer()
+	r.Scheme = scheme
+	r.Client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		app,
+		reconciled,
+		drifted,
+		newTestAccount("unissued"),
+		conflicting,
+	).Build()
+	r.nc = connectTestNats(t, s)
+	r.natsReady.Unlock()
+	sub, err := r.subscribeLookups(r.nc, logr.Discard())
+	g.Expect(err).NotTo(HaveOccurred())
+	r.sub = sub
+	r.serveAccount(reconciled.Status.PublicKey, servedAccount{Owner: client.ObjectKeyFromObject(reconciled), JWT: current})
+
+	// Connected, but lookups would still miss the account
+	g.Expect(r.Ready(nil)).To(MatchError(ContainSubstring("not warmed")))
+	g.Expect(r.lookupAccount(app.Status.PublicKey).JWT).To(BeEmpty())
+
+	g.Expect(r.WarmCache(context.Background())).To(Succeed())
+	g.Expect(r.Ready(nil)).To(Succeed())
+	g.Expect(r.lookupAccount(app.Status.PublicKey)).To(Equal(servedAccount{Owner: client.ObjectKeyFromObject(app), JWT: app.Status.JWT}))
+	// Accounts reconciled meanwhile keep their JWT, conflicting and drifted ones wait for their reconcile
+	g.Expect(r.lookupAccount(reconciled.Status.PublicKey).JWT).To(Equal(current))
+	g.Expect(r.lookupAccount(conflicting.Status.PublicKey).JWT).To(BeEmpty())
+	g.Expect(r.lookupAccount(drifted.Status.PublicKey).JWT).To(BeEmpty())
+	g.Expect(r.servedAccounts()).To(HaveLen(2))
+}
+
+func TestAccountServerResolverDir(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	dir := t.TempDir()
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 0
+	r.ResolverDir = dir
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+	path := filepath.Join(dir, served.Status.PublicKey+".jwt")
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(os.ReadFile(path)).To(BeEquivalentTo(served.Status.JWT))
+	written, err := os.Stat(path)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// An update replaces the file by renaming a new one over it, instead of rewriting it in place
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	updated := testAccountJWT(g, served.Status.PublicKey, "v2")
+	account.Status.JWT = updated
+	g.Expect(r.Status().Update(ctx, account)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(os.ReadFile(path)).To(BeEquivalentTo(updated))
+	replaced, err := os.Stat(path)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(os.SameFile(written, replaced)).To(BeFalse())
+	entries, err := os.ReadDir(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(entries).To(HaveLen(1), "no temporary files are left behind")
+
+	g.Expect(r.Delete(ctx, account)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(path).NotTo(BeAnExistingFile())
+	g.Expect(r.lookupAccount(served.Status.PublicKey).JWT).To(BeEmpty())
+}
+
+func TestAccountServerKeyChange(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	dir := t.TempDir()
+	served := newServedAccount(g, "app", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, served)
+	r.PublishRetries = 0
+	r.ResolverDir = dir
+	ctx := context.Background()
+	key := client.ObjectKeyFromObject(served)
+	previous := served.Status.PublicKey
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.lookupAccount(previous).Owner).To(Equal(key))
+
+	// Replacing the key secret issues the account for another key, the previous one is no longer served
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	account.Status.PublicKey = newTestAccountKey(g)
+	account.Status.JWT = testAccountJWT(g, account.Status.PublicKey, "v2")
+	g.Expect(r.Status().Update(ctx, account)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(r.lookupAccount(account.Status.PublicKey).JWT).To(Equal(account.Status.JWT))
+	g.Expect(r.servedAccounts()).NotTo(HaveKey(previous))
+	g.Expect(filepath.Join(dir, previous+".jwt")).NotTo(BeAnExistingFile())
+	g.Expect(filepath.Join(dir, account.Status.PublicKey+".jwt")).To(BeAnExistingFile())
+}
+
+func TestAccountStatusDriftRepaired(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	published := make(chan string, 10)
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		published <- string(msg.Data)
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	ar := newTestAccountReconciler(g, newTestAccount("app"))
+	account, _ := reconcileAccount(g, ar, "app")
+	issued := account.Status.JWT
+	r := NewAccountServer()
+	r.Scheme = ar.Scheme
+	r.Client = ar.Client
+	r.PublishRetries = 0
+	r.nc = connectTestNats(t, s)
+	r.natsReady.Unlock()
+	g.Expect(r.WarmCache(context.Background())).To(Succeed())
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)}
+	_, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(published).To(Receive(Equal(issued)))
+
+	for _, drifted := range []string{issued[:len(issued)-10], testAccountJWT(g, newTestAccountKey(g), "other")} {
+		// A corrupted or foreign JWT in the status is neither served nor pushed
+		g.Expect(ar.Get(ctx, req.NamespacedName, account)).To(Succeed())
+		account.Status.JWT = drifted
+		g.Expect(ar.Status().Update(ctx, account)).To(Succeed())
+		_, err = r.Reconcile(ctx, req)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(r.lookupAccount(account.Status.PublicKey).JWT).To(Equal(issued))
+		g.Expect(published).NotTo(Receive())
+
+		// The operator restores the status from the key secret, which the account server serves again
+		account, _ = reconcileAccount(g, ar, "app")
+		g.Expect(account.Status.JWT).To(Equal(issued))
+		_, err = r.Reconcile(ctx, req)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(r.lookupAccount(account.Status.PublicKey).JWT).To(Equal(issued))
+		g.Expect(published).To(Receive(Equal(issued)))
+	}
+
+	// A drifted served JWT is replaced by the one of the status
+	r.serveAccount(account.Status.PublicKey, servedAccount{Owner: req.NamespacedName, JWT: testAccountJWT(g, account.Status.PublicKey, "stale")})
+	_, err = r.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.lookupAccount(account.Status.PublicKey).JWT).To(Equal(issued))
+}
+
+func TestAccountServerKeepsNewerServerClaims(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	h := runResolverHarness(g, t)
+	h.AccountServer.KeepNewerServerClaims = true
+	account := newTestAccount("app")
+	account.Spec.Limits.NatsLimits = natsv1alpha1.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: byteLimit("-1")}
+	account.Spec.Limits.Conn = jwt.NoLimit
+	account = h.createAccount(g, account)
+	// The server only holds accounts it looked up for a connection
+	h.connectUser(g, t, newUnlimitedTestUser("backend", "app"))
+	issued, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Another tool pushes a JWT of the account issued in the same second
+	operatorSecret := &corev1.Secret{}
+	g.Expect(h.Accounts.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	operator, err := nkeys.FromSeed(operatorSecret.Data[OPERATOR_SEED_KEY])
+	g.Expect(err).NotTo(HaveOccurred())
+	pushExternal := func(issuedAt int64) string {
+		external := jwt.NewAccountClaims(account.Status.PublicKey)
+		external.Name = "external"
+		externalJWT := encodeIssuedAt(g, external, operator, issuedAt)
+		nc, _ := h.AccountServer.conn()
+		_, err := nc.Request(CLAIMS_UPDATE_SUBJECT, []byte(externalJWT), time.Second)
+		g.Expect(err).NotTo(HaveOccurred())
+		return externalJWT
+	}
+	externalJWT := pushExternal(issued.IssuedAt)
+	// A failed publish before, false conditions are only recorded in place of an existing one
+	g.Expect(h.Accounts.Get(ctx, client.ObjectKeyFromObject(account), account)).To(Succeed())
+	acknowledged := account.Status.LastAcknowledged
+	meta.SetStatusCondition(&account.Status.Conditions, metav1.Condition{
+		Type:    CONDITION_PUBLISH_FAILED,
+		Status:  metav1.ConditionTrue,
+		Reason:  "RetriesExhausted",
+		Message: "resolver unavailable",
+	})
+	g.Expect(h.Accounts.Status().Update(ctx, account)).To(Succeed())
+
+	// Publishing the JWT of the operator is skipped, which isn't reported as accepted by NATS
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)}
+	_, err = h.AccountServer.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(h.Accounts.Get(ctx, req.NamespacedName, account)).To(Succeed())
+	g.Expect(account.Status.LastPublish.Response).To(HavePrefix("claims update skipped, NATS holds a JWT issued at"))
+	g.Expect(account.Status.LastPublish.Acknowledged).To(BeFalse())
+	g.Expect(account.Status.LastAcknowledged).To(Equal(acknowledged))
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_PUBLISH_FAILED)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(condition.Reason).To(Equal("Skipped"))
+	held, err := h.AccountResolver().Fetch(account.Status.PublicKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(held).To(Equal(externalJWT))
+
+	// So is publishing it if the JWT held by NATS was issued later
+	externalJWT = pushExternal(issued.IssuedAt + 1)
+	_, err = h.AccountServer.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	held, err = h.AccountResolver().Fetch(account.Status.PublicKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(held).To(Equal(externalJWT))
+
+	// Without the guard the JWT of the operator wins
+	h.AccountServer.KeepNewerServerClaims = false
+	_, err = h.AccountServer.Reconcile(ctx, req)
+	g.Expect(err).NotTo(HaveOccurred())
+	held, err = h.AccountResolver().Fetch(account.Status.PublicKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(held).To(Equal(account.Status.JWT))
+}
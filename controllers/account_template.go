@@ -0,0 +1,54 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// templatedSpec returns the spec of account with the NatsAccountTemplate it references applied.
+// If the template can't be read, the spec of the account is returned as is together with the error.
+func templatedSpec(ctx context.Context, c client.Reader, account *natsv1alpha1.NatsAccount) (natsv1alpha1.NatsAccountSpec, error) {
+	if account.Spec.TemplateRef == nil {
+		return account.Spec, nil
+	}
+	template := &natsv1alpha1.NatsAccountTemplate{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: account.Namespace, Name: account.Spec.TemplateRef.Name}, template); err != nil {
+		return account.Spec, err
+	}
+	return template.Apply(account.Spec)
+}
+
+// templateAccounts maps a NatsAccountTemplate to the accounts referencing it, so they are issued again once it changed
+func (r *NatsAccountReconciler) templateAccounts(obj client.Object) []reconcile.Request {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(context.Background(), accounts, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, account := range accounts.Items {
+		if ref := account.Spec.TemplateRef; ref != nil && ref.Name == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&account)})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestAccountTemplate(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	template := &natsv1alpha1.NatsAccountTemplate{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "base"},
+		Spec: natsv1alpha1.NatsAccountTemplateSpec{
+			DefaultPermissions: natsv1alpha1.Permissions{
+				Pub: natsv1alpha1.Permission{Allow: jwt.StringList{"app.>"}},
+			},
+		},
+	}
+	template.Spec.Limits.Subs = 100
+	template.Spec.Limits.Conn = 10
+	template.Spec.Limits.Payload = byteLimit("1Mi")
+	account := newTestAccount("app")
+	account.Spec.TemplateRef = &corev1.LocalObjectReference{Name: "base"}
+	account.Spec.Limits.Subs = 500
+	missing := newTestAccount("missing")
+	missing.Spec.TemplateRef = &corev1.LocalObjectReference{Name: "absent"}
+	r := newTestAccountReconciler(g, template, account, missing)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Subs).To(BeEquivalentTo(500))
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(10))
+	g.Expect(claims.Limits.Payload).To(BeEquivalentTo(1048576))
+	g.Expect(claims.DefaultPermissions.Pub.Allow).To(ConsistOf("app.>"))
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_PENDING_CHANGES)).To(BeFalse())
+
+	// Changing the template changes the accounts referencing it
+	g.Expect(r.templateAccounts(template)).To(HaveLen(1))
+	template.Spec.Limits.Conn = 20
+	g.Expect(r.Update(ctx, template)).To(Succeed())
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err = jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(20))
+	g.Expect(claims.Limits.Subs).To(BeEquivalentTo(500))
+
+	missing, _ = reconcileAccount(g, r, "missing")
+	g.Expect(missing.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(missing.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(Equal("template absent not found"))
+}
+
+func TestAccountTemplateExportLimit(t *testing.T) {
+	g := NewWithT(t)
+	template := &natsv1alpha1.NatsAccountTemplate{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "base"}}
+	template.Spec.Limits.Exports = countLimit(1)
+	template.Spec.Limits.WildcardExports = true
+	account := newTestAccount("app")
+	account.Spec.TemplateRef = &corev1.LocalObjectReference{Name: "base"}
+	account.Spec.Exports = []natsv1alpha1.Export{{Subject: "events.>", Type: jwt.Stream}}
+	exceeding := newTestAccount("exceeding")
+	exceeding.Spec.TemplateRef = &corev1.LocalObjectReference{Name: "base"}
+	exceeding.Spec.Exports = []natsv1alpha1.Export{{Subject: "events.>", Type: jwt.Stream}, {Subject: "audit.>", Type: jwt.Stream}}
+	r := newTestAccountReconciler(g, template, account, exceeding)
+
+	// The template only passes on limits, the JWT carries exactly the exports of the account
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Exports).To(HaveLen(1))
+	g.Expect(claims.Imports).To(BeEmpty())
+	g.Expect(claims.Limits.Exports).To(BeEquivalentTo(1))
+
+	// The limit taken from the template applies to the exports of the account
+	exceeding, _ = reconcileAccount(g, r, "exceeding")
+	g.Expect(exceeding.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(exceeding.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("declares 2 exports, but its limits allow 1"))
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const ADMIN_ACCOUNTS_PATH = "/accounts/"
+
+// ADMIN_SETTINGS_RELOAD_PATH reloads the settings file of the account server
+const ADMIN_SETTINGS_RELOAD_PATH = "/settings/reload"
+
+// AdminServer exposes the state of a NatsAccountServer over HTTP for platform tooling.
+// It allows listing the served accounts, fetching a single account JWT with its decoded claims
+// and triggering a resync of a single or all accounts towards NATS, as well as reloading its settings.
+// All requests need to carry the configured token as bearer token.
+type AdminServer struct {
+	AccountServer *NatsAccountServer
+	Token         string
+	// SettingsFile holds the ReloadableSettings applied on reload, reloading is disabled if empty
+	SettingsFile string
+	// LogLevel is changed by the log level of the settings, if set
+	LogLevel *zap.AtomicLevel
+}
+
+// AdminSettingsReload is the response to reloading the settings, listing the settings that changed
+type AdminSettingsReload struct {
+	Changed []string `json:"changed"`
+}
+
+// AdminAccount is the representation of a served account in the admin API
+type AdminAccount struct {
+	PublicKey string             `json:"publicKey"`
+	Namespace string             `json:"namespace"`
+	Name      string             `json:"name"`
+	JWT       string             `json:"jwt,omitempty"`
+	Claims    *jwt.AccountClaims `json:"claims,omitempty"`
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case path == "/accounts" && req.Method == http.MethodGet:
+		a.listAccounts(w)
+	case path == ADMIN_ACCOUNTS_PATH+"resync":
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.resyncAccounts(w, req)
+	case strings.HasPrefix(path, ADMIN_ACCOUNTS_PATH) && strings.HasSuffix(path, "/resync"):
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.resyncAccount(w, req, strings.TrimSuffix(strings.TrimPrefix(path, ADMIN_ACCOUNTS_PATH), "/resync"))
+	case path == ADMIN_SETTINGS_RELOAD_PATH:
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.reloadSettings(w, req)
+	case strings.HasPrefix(path, ADMIN_ACCOUNTS_PATH) && req.Method == http.MethodGet:
+		a.getAccount(w, strings.TrimPrefix(path, ADMIN_ACCOUNTS_PATH))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (a *AdminServer) authorized(req *http.Request) bool {
+	if a.Token == "" {
+		// Never expose the API without a token configured
+		return false
+	}
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+func (a *AdminServer) listAccounts(w http.ResponseWriter) {
+	accounts := []AdminAccount{}
+	for publicKey, served := range a.AccountServer.servedAccounts() {
+		accounts = append(accounts, AdminAccount{
+			PublicKey: publicKey,
+			Namespace: served.Owner.Namespace,
+			Name:      served.Owner.Name,
+		})
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].PublicKey < accounts[j].PublicKey
+	})
+	writeJSON(w, http.StatusOK, accounts)
+}
+
+func (a *AdminServer) getAccount(w http.ResponseWriter, publicKey string) {
+	served := a.AccountServer.lookupAccount(publicKey)
+	if served.JWT == "" {
+		http.NotFound(w, nil)
+		return
+	}
+	account := AdminAccount{
+		PublicKey: publicKey,
+		Namespace: served.Owner.Namespace,
+		Name:      served.Owner.Name,
+		JWT:       served.JWT,
+	}
+	if claims, err := jwt.DecodeAccountClaims(served.JWT); err == nil {
+		account.Claims = claims
+	}
+	writeJSON(w, http.StatusOK, account)
+}
+
+func (a *AdminServer) resyncAccount(w http.ResponseWriter, req *http.Request, publicKey string) {
+	logger := log.FromContext(req.Context())
+	served := a.AccountServer.lookupAccount(publicKey)
+	if served.JWT == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if nc, _ := a.AccountServer.conn(); nc == nil {
+		http.Error(w, "not connected to NATS", http.StatusServiceUnavailable)
+		return
+	}
+	logger.Info("resync triggered via admin api", "account", served.Owner, "publicKey", publicKey)
+	if _, _, err := a.AccountServer.publishAccount(req.Context(), publicKey, served.JWT); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) resyncAccounts(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
+	if nc, _ := a.AccountServer.conn(); nc == nil {
+		http.Error(w, "not connected to NATS", http.StatusServiceUnavailable)
+		return
+	}
+	logger.Info("resync of all accounts triggered via admin api")
+	if err := a.AccountServer.RepublishAccounts(req.Context(), logger); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) reloadSettings(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
+	if a.SettingsFile == "" {
+		http.Error(w, "no settings file configured", http.StatusNotFound)
+		return
+	}
+	settings, err := LoadReloadableSettings(a.SettingsFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changed, err := a.AccountServer.ApplySettings(settings, a.LogLevel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info("settings reloaded via admin api", "settings", a.SettingsFile, "changed", changed)
+	writeJSON(w, http.StatusOK, AdminSettingsReload{Changed: changed})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Start serves the admin API on addr until ctx is cancelled, so that it can be added as manager runnable
+func (a *AdminServer) Start(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           a,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
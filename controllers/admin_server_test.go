@@ -0,0 +1,157 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func adminRequest(a *AdminServer, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminServerQueries(t *testing.T) {
+	g := NewWithT(t)
+	operator, _ := nkeys.CreateOperator()
+	accountKp, _ := nkeys.CreateAccount()
+	public, _ := accountKp.PublicKey()
+	token, err := jwt.NewAccountClaims(public).Encode(operator)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	r := NewAccountServer()
+	r.serveAccount(public, servedAccount{Owner: types.NamespacedName{Namespace: testNamespace, Name: "app"}, JWT: token})
+	a := &AdminServer{AccountServer: r, Token: "secret"}
+
+	g.Expect(adminRequest(a, http.MethodGet, "/accounts", "").Code).To(Equal(http.StatusUnauthorized))
+	g.Expect(adminRequest(a, http.MethodGet, "/accounts", "wrong").Code).To(Equal(http.StatusUnauthorized))
+	// The token is only accepted as bearer token
+	req := httptest.NewRequest(http.MethodGet, "/accounts", nil)
+	req.Header.Set("Authorization", "secret")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	g.Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+
+	rec = adminRequest(a, http.MethodGet, "/accounts", "secret")
+	g.Expect(rec.Code).To(Equal(http.StatusOK))
+	accounts := []AdminAccount{}
+	g.Expect(json.Unmarshal(rec.Body.Bytes(), &accounts)).To(Succeed())
+	g.Expect(accounts).To(ConsistOf(AdminAccount{PublicKey: public, Namespace: testNamespace, Name: "app"}))
+
+	rec = adminRequest(a, http.MethodGet, "/accounts/"+public, "secret")
+	g.Expect(rec.Code).To(Equal(http.StatusOK))
+	account := AdminAccount{}
+	g.Expect(json.Unmarshal(rec.Body.Bytes(), &account)).To(Succeed())
+	g.Expect(account.JWT).To(Equal(token))
+	g.Expect(account.Claims.Subject).To(Equal(public))
+
+	g.Expect(adminRequest(a, http.MethodGet, "/accounts/AUNKNOWN", "secret").Code).To(Equal(http.StatusNotFound))
+}
+
+func TestAdminServerResync(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	updates := make(chan string, 1)
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		updates <- string(msg.Data)
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	r := newTestAccountServer(g, t, s)
+	r.serveAccount("APUBKEY", servedAccount{JWT: "token"})
+	a := &AdminServer{AccountServer: r, Token: "secret"}
+
+	g.Expect(adminRequest(a, http.MethodPost, "/accounts/APUBKEY/resync", "").Code).To(Equal(http.StatusUnauthorized))
+	g.Expect(updates).NotTo(Receive())
+
+	g.Expect(adminRequest(a, http.MethodGet, "/accounts/APUBKEY/resync", "secret").Code).To(Equal(http.StatusMethodNotAllowed))
+	g.Expect(adminRequest(a, http.MethodPost, "/accounts/APUBKEY/resync", "secret").Code).To(Equal(http.StatusNoContent))
+	g.Expect(updates).To(Receive(Equal("token")))
+}
+
+func TestAdminServerReloadSettings(t *testing.T) {
+	g := NewWithT(t)
+	settingsFile := filepath.Join(t.TempDir(), "settings.yaml")
+	g.Expect(os.WriteFile(settingsFile, []byte("publishRetries: 3\n"), 0600)).To(Succeed())
+	r := NewAccountServer()
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	a := &AdminServer{AccountServer: r, Token: "secret", SettingsFile: settingsFile, LogLevel: &level}
+	reload := func() []string {
+		rec := adminRequest(a, http.MethodPost, ADMIN_SETTINGS_RELOAD_PATH, "secret")
+		g.ExpectWithOffset(1, rec.Code).To(Equal(http.StatusOK), rec.Body.String())
+		response := AdminSettingsReload{}
+		g.ExpectWithOffset(1, json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+		return response.Changed
+	}
+
+	g.Expect(adminRequest(a, http.MethodPost, ADMIN_SETTINGS_RELOAD_PATH, "").Code).To(Equal(http.StatusUnauthorized))
+	g.Expect(adminRequest(a, http.MethodGet, ADMIN_SETTINGS_RELOAD_PATH, "secret").Code).To(Equal(http.StatusMethodNotAllowed))
+	// Settings equal to the running ones aren't reported as changed
+	g.Expect(reload()).To(BeEmpty())
+
+	g.Expect(os.WriteFile(settingsFile, []byte(`logLevel: debug
+publishRetries: 5
+publishBackoff: 2s
+lookupExistenceChecks: true
+`), 0600)).To(Succeed())
+	g.Expect(reload()).To(Equal([]string{"logLevel", "publishRetries", "publishBackoff", "lookupExistenceChecks"}))
+	g.Expect(level.Level()).To(Equal(zapcore.DebugLevel))
+	g.Expect(r.PublishRetries).To(Equal(5))
+	g.Expect(r.PublishBackoff).To(Equal(2 * time.Second))
+	g.Expect(r.LookupExistenceChecks).To(BeTrue())
+	// Settings missing from the file are kept
+	g.Expect(r.PublishTimeout).To(Equal(NewAccountServer().PublishTimeout))
+
+	// Invalid or unknown settings aren't applied at all
+	for _, invalid := range []string{"logLevel: info\npublishRetries: -1\n", "logLevel: loud\n", "natsUrl: nats://other:4222\n"} {
+		g.Expect(os.WriteFile(settingsFile, []byte(invalid), 0600)).To(Succeed())
+		g.Expect(adminRequest(a, http.MethodPost, ADMIN_SETTINGS_RELOAD_PATH, "secret").Code).To(Equal(http.StatusBadRequest), invalid)
+	}
+	g.Expect(level.Level()).To(Equal(zapcore.DebugLevel))
+	g.Expect(r.PublishRetries).To(Equal(5))
+
+	// Verbosities are accepted like with --zap-log-level
+	g.Expect(os.WriteFile(settingsFile, []byte("logLevel: \"3\"\n"), 0600)).To(Succeed())
+	g.Expect(reload()).To(Equal([]string{"logLevel"}))
+	g.Expect(level.Level()).To(Equal(zapcore.Level(-3)))
+
+	a.SettingsFile = ""
+	g.Expect(adminRequest(a, http.MethodPost, ADMIN_SETTINGS_RELOAD_PATH, "secret").Code).To(Equal(http.StatusNotFound))
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nats-io/nats.go"
+)
+
+// CheckConnection connects to NATS the way the account server does and prints the server connected to and
+// the round trip time to it. With subscribeLookup it also subscribes to LOOKUP_SUBJECT, so missing
+// permissions of the account server show up before deploying it.
+func CheckConnection(url string, creds NatsCredentialsConfig, connConf NatsConnConfig, subscribeLookup bool, stdout io.Writer) error {
+	nc, err := connectToNats(url, creds.CredsFile, creds.NatsTlsConfig, connConf)
+	if err != nil {
+		return fmt.Errorf("failed connecting to %s: %w", url, err)
+	}
+	defer nc.Close()
+	fmt.Fprintf(stdout, "connected to %s (server %s, version %s, cluster %q)\n",
+		nc.ConnectedUrlRedacted(), nc.ConnectedServerName(), nc.ConnectedServerVersion(), nc.ConnectedClusterName())
+
+	rtt, err := nc.RTT()
+	if err != nil {
+		return fmt.Errorf("failed measuring the round trip time: %w", err)
+	}
+	fmt.Fprintf(stdout, "rtt %s\n", rtt)
+
+	if subscribeLookup {
+		if _, err := nc.Subscribe(LOOKUP_SUBJECT, func(*nats.Msg) {}); err != nil {
+			return fmt.Errorf("failed subscribing to %s: %w", LOOKUP_SUBJECT, err)
+		}
+		// Permission violations are reported asynchronously, they arrive before the server answers the flush
+		if err := nc.Flush(); err != nil {
+			return fmt.Errorf("failed subscribing to %s: %w", LOOKUP_SUBJECT, err)
+		}
+		if err := nc.LastError(); err != nil {
+			return fmt.Errorf("failed subscribing to %s: %w", LOOKUP_SUBJECT, err)
+		}
+		fmt.Fprintf(stdout, "subscribed to %s\n", LOOKUP_SUBJECT)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	. "github.com/onsi/gomega"
+)
+
+func TestCheckConnection(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	stdout := &bytes.Buffer{}
+	g.Expect(CheckConnection(s.ClientURL(), NatsCredentialsConfig{}, NatsConnConfig{}, true, stdout)).To(Succeed())
+	g.Expect(stdout.String()).To(ContainSubstring("connected to " + s.ClientURL()))
+	g.Expect(stdout.String()).To(ContainSubstring("version " + server.VERSION))
+	g.Expect(stdout.String()).To(MatchRegexp(`rtt \d`))
+	g.Expect(stdout.String()).To(ContainSubstring("subscribed to " + LOOKUP_SUBJECT))
+
+	// Nothing listens on a port that was just released
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred())
+	closed := fmt.Sprintf("nats://%s", l.Addr())
+	g.Expect(l.Close()).To(Succeed())
+	g.Expect(CheckConnection(closed, NatsCredentialsConfig{}, NatsConnConfig{}, false, &bytes.Buffer{})).
+		To(MatchError(ContainSubstring("failed connecting to " + closed)))
+}
+
+func TestCheckConnectionLookupPermissions(t *testing.T) {
+	g := NewWithT(t)
+	s := startTestNatsServer(t, &server.Options{Host: "127.0.0.1", Port: -1, Users: []*server.User{{
+		Username:    "restricted",
+		Password:    "secret",
+		Permissions: &server.Permissions{Subscribe: &server.SubjectPermission{Deny: []string{">"}}},
+	}}})
+	url := fmt.Sprintf("nats://restricted:secret@%s", s.Addr())
+
+	g.Expect(CheckConnection(url, NatsCredentialsConfig{}, NatsConnConfig{}, false, &bytes.Buffer{})).To(Succeed())
+	g.Expect(CheckConnection(url, NatsCredentialsConfig{}, NatsConnConfig{}, true, &bytes.Buffer{})).
+		To(MatchError(ContainSubstring("Permissions Violation for Subscription")))
+}
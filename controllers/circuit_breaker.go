@@ -0,0 +1,91 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker stops calls to a failing dependency for a while, so that retries don't amplify its load.
+// After Threshold consecutive failures it opens for Cooldown, then lets a single trial call through.
+// The breaker closes again once the trial succeeds and reopens if it fails.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures opening the breaker, 0 disables the breaker
+	Threshold int
+	// Cooldown is the time the breaker stays open before a trial call is allowed
+	Cooldown time.Duration
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+	// now is replaceable for tests
+	now func() time.Time
+}
+
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+func (b *CircuitBreaker) open() bool {
+	return b.Threshold > 0 && b.failures >= b.Threshold
+}
+
+// Allow reports whether a call may be made. If not, it returns the time until the next trial is allowed.
+func (b *CircuitBreaker) Allow() (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.open() {
+		return true, 0
+	}
+	remaining := b.Cooldown - b.clock().Sub(b.openedAt)
+	if remaining > 0 {
+		return false, remaining
+	}
+	if b.trial {
+		// Another trial is in flight, check again after another cooldown
+		return false, b.Cooldown
+	}
+	b.trial = true
+	return true, 0
+}
+
+// Record reports the outcome of an allowed call
+func (b *CircuitBreaker) Record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.open() {
+		b.openedAt = b.clock()
+	}
+}
+
+// IsOpen reports whether calls are currently blocked
+func (b *CircuitBreaker) IsOpen() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.open()
+}
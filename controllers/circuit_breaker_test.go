@@ -0,0 +1,62 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	g := NewWithT(t)
+	now := time.Now()
+	b := &CircuitBreaker{Threshold: 2, Cooldown: time.Minute, now: func() time.Time { return now }}
+	failure := fmt.Errorf("timeout")
+
+	b.Record(failure)
+	g.Expect(b.Allow()).To(BeTrue())
+	b.Record(failure)
+	g.Expect(b.IsOpen()).To(BeTrue())
+	allowed, retryIn := b.Allow()
+	g.Expect(allowed).To(BeFalse())
+	g.Expect(retryIn).To(Equal(time.Minute))
+
+	// Half open: a single trial is let through, a failing trial reopens the breaker
+	now = now.Add(time.Minute)
+	g.Expect(b.Allow()).To(BeTrue())
+	allowed, _ = b.Allow()
+	g.Expect(allowed).To(BeFalse())
+	b.Record(failure)
+	allowed, retryIn = b.Allow()
+	g.Expect(allowed).To(BeFalse())
+	g.Expect(retryIn).To(Equal(time.Minute))
+
+	now = now.Add(time.Minute)
+	g.Expect(b.Allow()).To(BeTrue())
+	b.Record(nil)
+	g.Expect(b.IsOpen()).To(BeFalse())
+	g.Expect(b.Allow()).To(BeTrue())
+
+	disabled := &CircuitBreaker{}
+	for i := 0; i < 10; i++ {
+		disabled.Record(failure)
+	}
+	g.Expect(disabled.Allow()).To(BeTrue())
+}
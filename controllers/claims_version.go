@@ -0,0 +1,188 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// legacyAccountClaims is the layout of account claims before JWT v2, the jwt library only decodes it.
+// The claim type is named at the top level and there is no version field.
+type legacyAccountClaims struct {
+	jwt.ClaimsData
+	Type jwt.ClaimType `json:"type"`
+	Tags jwt.TagList   `json:"tags,omitempty"`
+	Nats legacyAccount `json:"nats,omitempty"`
+}
+
+type legacyAccount struct {
+	Imports jwt.Imports `json:"imports,omitempty"`
+	Exports jwt.Exports `json:"exports,omitempty"`
+	Limits  struct {
+		jwt.NatsLimits
+		jwt.AccountLimits
+	} `json:"limits,omitempty"`
+	SigningKeys []string           `json:"signing_keys,omitempty"`
+	Revocations jwt.RevocationList `json:"revocations,omitempty"`
+}
+
+// legacyIncompatibility returns an error naming the first claim of account JWT v1 can't express
+func legacyIncompatibility(account jwt.Account) error {
+	switch {
+	case account.Limits.JetStreamLimits != (jwt.JetStreamLimits{}) || len(account.Limits.JetStreamTieredLimits) > 0:
+		return fmt.Errorf("JetStream limits require JWT v2 claims")
+	case account.Limits.DisallowBearer:
+		return fmt.Errorf("disallowing bearer tokens requires JWT v2 claims")
+	case !account.DefaultPermissions.Pub.Empty() || !account.DefaultPermissions.Sub.Empty() || account.DefaultPermissions.Resp != nil:
+		return fmt.Errorf("default permissions require JWT v2 claims")
+	case len(account.Mappings) > 0:
+		return fmt.Errorf("subject mappings require JWT v2 claims")
+	case account.Authorization.IsEnabled():
+		return fmt.Errorf("external authorization requires JWT v2 claims")
+	case account.Description != "" || account.InfoURL != "":
+		return fmt.Errorf("account info requires JWT v2 claims")
+	}
+	for key, scope := range account.SigningKeys {
+		if scope != nil {
+			return fmt.Errorf("scoped signing key %s requires JWT v2 claims", key)
+		}
+	}
+	for _, i := range account.Imports {
+		switch {
+		case i.LocalSubject != "":
+			return fmt.Errorf("local subject of import %s requires JWT v2 claims", i.Subject)
+		case i.Share:
+			return fmt.Errorf("sharing the latency of import %s requires JWT v2 claims", i.Subject)
+		}
+	}
+	for _, e := range account.Exports {
+		switch {
+		case e.Advertise:
+			return fmt.Errorf("advertising export %s requires JWT v2 claims", e.Subject)
+		case e.Description != "" || e.InfoURL != "":
+			return fmt.Errorf("info of export %s requires JWT v2 claims", e.Subject)
+		case e.ResponseThreshold != 0:
+			return fmt.Errorf("response threshold of export %s requires JWT v2 claims", e.Subject)
+		case e.AccountTokenPosition != 0:
+			return fmt.Errorf("account token position of export %s requires JWT v2 claims", e.Subject)
+		}
+	}
+	return nil
+}
+
+// ACCOUNT_ENCODE_VERSION is the revision of how the operator encodes account JWTs, recorded in their status.
+// Bump it whenever a change to the encoding should reach the accounts issued before, they are encoded again.
+const ACCOUNT_ENCODE_VERSION = 1
+
+// encodeAlgorithm returns the algorithm JWTs of the given claims version are signed with
+func encodeAlgorithm(version int) string {
+	if version == 1 {
+		return jwt.AlgorithmNkeyOld
+	}
+	return jwt.AlgorithmNkey
+}
+
+// validateClaimsVersion checks that account can be issued in the given JWT version
+func validateClaimsVersion(account jwt.Account, version int) error {
+	switch version {
+	case 1:
+		return legacyIncompatibility(account)
+	case 2:
+		return nil
+	default:
+		return fmt.Errorf("unsupported JWT claims version %d", version)
+	}
+}
+
+// encodeAccountClaims signs claims with signer as JWT of the given version.
+// Version 2 is encoded by the jwt library, version 1 the way the v1 library did.
+func encodeAccountClaims(claims *jwt.AccountClaims, signer nkeys.KeyPair, version int) (string, error) {
+	if err := validateClaimsVersion(claims.Account, version); err != nil {
+		return "", err
+	}
+	if version == 2 {
+		return claims.Encode(signer)
+	}
+
+	if !nkeys.IsValidPublicAccountKey(claims.Subject) {
+		return "", fmt.Errorf("expected subject to be account public key")
+	}
+	issuer, err := signer.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	if !nkeys.IsValidPublicOperatorKey(issuer) {
+		return "", fmt.Errorf("account claims need to be signed by an operator key")
+	}
+	sort.Sort(claims.Exports)
+	sort.Sort(claims.Imports)
+	legacy := legacyAccountClaims{ClaimsData: claims.ClaimsData, Type: jwt.AccountClaim, Tags: claims.Tags}
+	legacy.Nats.Imports = claims.Imports
+	legacy.Nats.Exports = claims.Exports
+	legacy.Nats.Limits.NatsLimits = claims.Limits.NatsLimits
+	legacy.Nats.Limits.AccountLimits = claims.Limits.AccountLimits
+	legacy.Nats.SigningKeys = claims.SigningKeys.Keys()
+	sort.Strings(legacy.Nats.SigningKeys)
+	legacy.Nats.Revocations = claims.Revocations
+
+	legacy.Issuer = issuer
+	legacy.IssuedAt = time.Now().UTC().Unix()
+	// Same as in v2, the ID is the hash of the claims data without ID
+	legacy.ID = ""
+	data, err := json.Marshal(legacy.ClaimsData)
+	if err != nil {
+		return "", err
+	}
+	hash := sha512.Sum512_256(data)
+	legacy.ID = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:])
+
+	header, err := json.Marshal(jwt.Header{Type: "jwt", Algorithm: jwt.AlgorithmNkeyOld})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(legacy)
+	if err != nil {
+		return "", err
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	// v1 signatures only cover the payload, not the header
+	sig, err := signer.Sign([]byte(encodedPayload))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(header) + "." + encodedPayload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// serverAcceptsClaimsVersion reports whether a NATS server of serverVersion accepts JWT claims of version.
+// Servers before 2.2 only know v1 claims, newer ones accept both. Unknown server versions are assumed to
+// accept any claims.
+func serverAcceptsClaimsVersion(serverVersion string, version int) bool {
+	var major, minor int
+	if _, err := fmt.Sscanf(serverVersion, "%d.%d", &major, &minor); err != nil {
+		return true
+	}
+	return version < 2 || major > 2 || (major == 2 && minor >= 2)
+}
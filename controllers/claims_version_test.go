@@ -0,0 +1,144 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// setClaimsVersion switches the test operator to issue its accounts in version
+func setClaimsVersion(g *WithT, c client.Client, version int) {
+	operator := &natsv1alpha1.NatsOperator{}
+	g.Expect(c.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operator)).To(Succeed())
+	operator.Spec.ClaimsVersion = version
+	g.Expect(c.Update(context.Background(), operator)).To(Succeed())
+}
+
+func TestAccountClaimsVersions(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			g := NewWithT(t)
+			h := runResolverHarness(g, t)
+			setClaimsVersion(g, h.Accounts.Client, version)
+
+			account := newTestAccount("app")
+			account.Spec.Limits.NatsLimits = natsv1alpha1.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: byteLimit("-1")}
+			account.Spec.Limits.Conn = jwt.NoLimit
+			account.Spec.Limits.WildcardExports = true
+			account.Spec.Exports = []natsv1alpha1.Export{{Name: "events", Subject: "events.>", Type: jwt.Stream}}
+			account = h.createAccount(g, account)
+			claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(claims.Version).To(Equal(version))
+			g.Expect(claims.Exports).To(HaveLen(1))
+			g.Expect(account.Status.LastPublish).NotTo(BeNil())
+			g.Expect(account.Status.LastPublish.Acknowledged).To(BeTrue())
+
+			// The server resolved the account from the claims and applies them
+			nc := h.connectUser(g, t, newUnlimitedTestUser("publisher", "app"))
+			sub, err := nc.SubscribeSync("events.created")
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(nc.Publish("events.created", []byte("hello"))).To(Succeed())
+			msg, err := sub.NextMsg(5 * time.Second)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(string(msg.Data)).To(Equal("hello"))
+		})
+	}
+}
+
+func TestAccountReissuedOnClaimsVersionChange(t *testing.T) {
+	g := NewWithT(t)
+	r := newTestAccountReconciler(g, newTestAccount("app"))
+	account, _ := reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Version).To(Equal(2))
+
+	setClaimsVersion(g, r.Client, 1)
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err = jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Version).To(Equal(1))
+
+	// Reconciling again doesn't reissue the legacy claims
+	issued := account.Status.JWT
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(account.Status.JWT).To(Equal(issued))
+}
+
+func TestAccountLegacyClaimsRejectJetStream(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Limits.JetStreamLimits = natsv1alpha1.JetStreamLimits{MemoryStorage: byteLimit("-1"), DiskStorage: byteLimit("-1")}
+	r := newTestAccountReconciler(g, account)
+	setClaimsVersion(g, r.Client, 1)
+
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(account.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("JetStream"))
+}
+
+func TestLegacyIncompatibleImportsExports(t *testing.T) {
+	g := NewWithT(t)
+	exporter := newTestAccountKey(g)
+	for _, tc := range []struct {
+		account jwt.Account
+		message string
+	}{
+		{jwt.Account{Imports: jwt.Imports{{Subject: "orders.>", Account: exporter, Type: jwt.Stream, LocalSubject: "in.orders.>"}}}, "local subject of import orders.>"},
+		{jwt.Account{Imports: jwt.Imports{{Subject: "billing", Account: exporter, Type: jwt.Service, Share: true}}}, "sharing the latency of import billing"},
+		{jwt.Account{Exports: jwt.Exports{{Subject: "events.>", Type: jwt.Stream, Advertise: true}}}, "advertising export events.>"},
+		{jwt.Account{Exports: jwt.Exports{{Subject: "events.>", Type: jwt.Stream, Info: jwt.Info{Description: "all events"}}}}, "info of export events.>"},
+		{jwt.Account{Exports: jwt.Exports{{Subject: "events.>", Type: jwt.Stream, Info: jwt.Info{InfoURL: "https://example.com"}}}}, "info of export events.>"},
+		{jwt.Account{Exports: jwt.Exports{{Subject: "billing", Type: jwt.Service, ResponseThreshold: time.Second}}}, "response threshold of export billing"},
+		{jwt.Account{Exports: jwt.Exports{{Subject: "billing.*", Type: jwt.Service, AccountTokenPosition: 2}}}, "account token position of export billing.*"},
+	} {
+		err := legacyIncompatibility(tc.account)
+		g.Expect(err).To(HaveOccurred(), tc.message)
+		g.Expect(err.Error()).To(Equal(tc.message + " requires JWT v2 claims"))
+		g.Expect(validateClaimsVersion(tc.account, 2)).To(Succeed())
+	}
+
+	// Imports and exports v1 knows pass
+	g.Expect(legacyIncompatibility(jwt.Account{
+		Imports: jwt.Imports{{Subject: "orders.>", Account: exporter, Type: jwt.Stream}},
+		Exports: jwt.Exports{{Subject: "billing", Type: jwt.Service, ResponseType: jwt.ResponseTypeStream}},
+	})).To(Succeed())
+}
+
+func TestServerAcceptsClaimsVersion(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(serverAcceptsClaimsVersion("2.1.9", 1)).To(BeTrue())
+	g.Expect(serverAcceptsClaimsVersion("2.1.9", 2)).To(BeFalse())
+	g.Expect(serverAcceptsClaimsVersion("2.2.0", 2)).To(BeTrue())
+	g.Expect(serverAcceptsClaimsVersion("2.10.0-beta.1", 2)).To(BeTrue())
+	g.Expect(serverAcceptsClaimsVersion("2.9.16", 1)).To(BeTrue())
+	// Without a known server version the claims are published anyway
+	g.Expect(serverAcceptsClaimsVersion("", 2)).To(BeTrue())
+}
@@ -1,10 +1,126 @@
 package controllers
 
 import (
+	"reflect"
+	"sync"
+
 	"github.com/nats-io/nkeys"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
 )
 
+// CONDITION_PUBLISH_FAILED is set on accounts whose claims could not be pushed to NATS
+const CONDITION_PUBLISH_FAILED = "PublishFailed"
+
+// CONDITION_STALE is set on accounts which NATS never accepted a claims update of, or not for too long
+const CONDITION_STALE = "Stale"
+
+// CONDITION_CONFLICT is set on accounts whose public key is already served for another account
+const CONDITION_CONFLICT = "Conflict"
+
+// CONDITION_INVALID is set on accounts whose spec can't be issued
+const CONDITION_INVALID = "Invalid"
+
+// CONDITION_PENDING_CHANGES is set on accounts whose spec changed, but the changes aren't issued in their JWT yet
+const CONDITION_PENDING_CHANGES = "PendingChanges"
+
+// CONDITION_EXPIRING is set on operators whose JWT expired or is about to expire
+const CONDITION_EXPIRING = "Expiring"
+
+// CONDITION_UNRESOLVED_IMPORTS is set on accounts importing from accounts neither managed nor allowlisted
+const CONDITION_UNRESOLVED_IMPORTS = "UnresolvedImports"
+
+// CONDITION_SELF_IMPORT is set on accounts importing a subject from themselves which they also export
+const CONDITION_SELF_IMPORT = "SelfImport"
+
+// CONDITION_KEY_UNAVAILABLE is set on accounts that can't be signed, as the seed of their operator is missing
+const CONDITION_KEY_UNAVAILABLE = "KeyUnavailable"
+
+// CONDITION_USER_LIMITS_EXCEEDED is set on accounts with users whose limits are above the ones of the account,
+// for information only as NATS enforces the lower account limits
+const CONDITION_USER_LIMITS_EXCEEDED = "UserLimitsExceeded"
+
+// DEFAULT_USER_SUFFIX is appended to the account name to name the default user of an account
+const DEFAULT_USER_SUFFIX = "-default"
+
+// DEFAULT_MAX_CONCURRENT_RECONCILES is the default number of objects a controller reconciles in parallel
+const DEFAULT_MAX_CONCURRENT_RECONCILES = 4
+
+// SECRET_MANAGED_BY_LABEL and SECRET_COMPONENT_LABEL are set by the operator on the secrets it generates,
+// on top of the labels of the secret template of the account or user
+const SECRET_MANAGED_BY_LABEL = "app.kubernetes.io/managed-by"
+const SECRET_COMPONENT_LABEL = "app.kubernetes.io/component"
+
+// SECRET_MANAGED_BY is the value of SECRET_MANAGED_BY_LABEL
+const SECRET_MANAGED_BY = "nats-jwt-operator"
+
+// ACCOUNT_SECRET_COMPONENT and USER_SECRET_COMPONENT are the values of SECRET_COMPONENT_LABEL
+const ACCOUNT_SECRET_COMPONENT = "account-keys"
+const USER_SECRET_COMPONENT = "user-credentials"
+
+// applySecretTemplate merges the labels and annotations of template and the operator managed labels into
+// secret and reports whether it changed. The managed labels take precedence over the template.
+func applySecretTemplate(secret *corev1.Secret, template natsv1alpha1.SecretTemplate, component string) bool {
+	labels := map[string]string{}
+	for k, v := range template.Labels {
+		labels[k] = v
+	}
+	labels[SECRET_MANAGED_BY_LABEL] = SECRET_MANAGED_BY
+	labels[SECRET_COMPONENT_LABEL] = component
+	labelsChanged := mergeMetadata(&secret.Labels, labels)
+	annotationsChanged := mergeMetadata(&secret.Annotations, template.Annotations)
+	return labelsChanged || annotationsChanged
+}
+
+// mergeMetadata sets the entries of values in target and reports whether any of them changed
+func mergeMetadata(target *map[string]string, values map[string]string) bool {
+	changed := false
+	for k, v := range values {
+		if existing, ok := (*target)[k]; ok && existing == v {
+			continue
+		}
+		if *target == nil {
+			*target = map[string]string{}
+		}
+		(*target)[k] = v
+		changed = true
+	}
+	return changed
+}
+
+// setCondition records condition if it differs from the existing one and reports whether it changed.
+// Conditions with status False are only recorded to clear a previously reported problem, so the status
+// isn't cluttered with problems that never occurred.
+func setCondition(conditions *[]metav1.Condition, condition metav1.Condition) bool {
+	existing := meta.FindStatusCondition(*conditions, condition.Type)
+	if existing == nil && condition.Status == metav1.ConditionFalse {
+		return false
+	}
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+		return false
+	}
+	meta.SetStatusCondition(conditions, condition)
+	return true
+}
+
+// adoptSecret adds owner to the owner references of an existing secret and reports whether they changed.
+// Key secrets written beforehand, e.g. by the import subcommand, are garbage collected with their owner like
+// the ones created by the controllers.
+func adoptSecret(owner client.Object, secret *corev1.Secret, scheme *runtime.Scheme) (bool, error) {
+	before := append([]metav1.OwnerReference{}, secret.OwnerReferences...)
+	if err := controllerutil.SetOwnerReference(owner, secret, scheme); err != nil {
+		return false, err
+	}
+	return !reflect.DeepEqual(before, secret.OwnerReferences), nil
+}
+
 func extractOrCreateKeys(secret *corev1.Secret, generator func() (nkeys.KeyPair, error)) (nkeys.KeyPair, bool, error) {
 	var keys nkeys.KeyPair
 	needsKeyUpdate := true
@@ -25,3 +141,16 @@ func extractOrCreateKeys(secret *corev1.Secret, generator func() (nkeys.KeyPair,
 	}
 	return keys, needsKeyUpdate, nil
 }
+
+// keyedMutex serializes work per object name. The mutex of a name is kept after use, which is fine for the
+// number of accounts of a cluster.
+type keyedMutex struct {
+	locks sync.Map
+}
+
+// lock locks name and returns the func unlocking it again
+func (m *keyedMutex) lock(name types.NamespacedName) func() {
+	mu, _ := m.locks.LoadOrStore(name, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+// credentialFiles returns all files the NATS connection reads its credentials from
+func credentialFiles(creds NatsCredentialsConfig) []string {
+	files := []string{}
+	for _, f := range []string{creds.CredsFile, creds.ClientCertPath, creds.ClientKeyPath, creds.CaPath} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// fingerprintFiles hashes the content of all files. Files that can't be read are hashed as empty,
+// so a vanishing file is detected as change as well.
+func fingerprintFiles(files []string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, f := range files {
+		content, _ := os.ReadFile(f)
+		h.Write([]byte(f))
+		h.Write(content)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// watchCredentials polls the credential files, which are usually mounted from Secrets, and reconnects
+// to NATS with the new material once they changed.
+// Polling the content is used over file notifications, as Kubernetes swaps mounted Secrets via symlinks.
+func (r *NatsAccountServer) watchCredentials(ctx context.Context, logger logr.Logger) {
+	ticker := time.NewTicker(r.CredentialsWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		creds, connected := r.credentials()
+		files := credentialFiles(creds)
+		if len(files) == 0 || fingerprintFiles(files) == connected {
+			continue
+		}
+		logger.Info("nats credentials changed, reconnecting", "files", files)
+		if err := r.reconnect(logger); err != nil {
+			// The fingerprint is kept, so this is retried with the next tick
+			logger.Error(err, "failed to reconnect with changed credentials")
+		}
+	}
+}
+
+// Reconfigure switches to new credentials by reconnecting with them.
+// If the reconnect fails, the previous credentials and connection are kept.
+func (r *NatsAccountServer) Reconfigure(logger logr.Logger, creds NatsCredentialsConfig) error {
+	r.connLock.Lock()
+	previous := r.creds
+	r.creds = creds
+	r.connLock.Unlock()
+
+	if err := r.reconnect(logger); err != nil {
+		r.connLock.Lock()
+		r.creds = previous
+		r.connLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// LoadNatsCredentialsConfig reads the credentials configuration from a YAML or JSON file, e.g. a mounted ConfigMap
+func LoadNatsCredentialsConfig(path string) (NatsCredentialsConfig, error) {
+	creds := NatsCredentialsConfig{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return creds, err
+	}
+	if err := yaml.UnmarshalStrict(content, &creds); err != nil {
+		return creds, fmt.Errorf("failed decoding nats config %s: %v", path, err)
+	}
+	if err := creds.Validate(); err != nil {
+		return creds, fmt.Errorf("invalid nats config %s: %v", path, err)
+	}
+	return creds, nil
+}
+
+// ReloadOnSignal reloads the credentials configuration from path whenever one of the signals is received,
+// and reconnects to NATS with it. The config can't be reloaded before Run connected.
+func (r *NatsAccountServer) ReloadOnSignal(ctx context.Context, path string, signals ...os.Signal) {
+	logger := log.FromContext(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+		creds, err := LoadNatsCredentialsConfig(path)
+		if err != nil {
+			logger.Error(err, "failed reloading nats config")
+			continue
+		}
+		logger.Info("reloading nats config", "config", path)
+		if err := r.Reconfigure(logger, creds); err != nil {
+			logger.Error(err, "failed to reconnect with reloaded nats config, keeping the previous one")
+		}
+	}
+}
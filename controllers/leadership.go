@@ -0,0 +1,91 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// LeadershipReporter reflects whether this replica is the elected leader in the leader metric and
+// records its identity in the status of all NatsOperators once elected.
+// The manager only starts it after winning the election, stopping it means leadership is lost.
+type LeadershipReporter struct {
+	client.Client
+	// Identity names this replica, see ReplicaIdentity
+	Identity string
+}
+
+// ReplicaIdentity returns the name identifying this replica, the POD_NAME if set or the hostname
+func ReplicaIdentity() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// NewLeadershipReporter reports the replica as standby until it is started
+func NewLeadershipReporter(c client.Client, identity string) *LeadershipReporter {
+	leader.WithLabelValues(identity).Set(0)
+	return &LeadershipReporter{Client: c, Identity: identity}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (l *LeadershipReporter) NeedLeaderElection() bool {
+	return true
+}
+
+// Start reports the leadership until ctx is done
+func (l *LeadershipReporter) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	logger.Info("acquired leadership", "identity", l.Identity)
+	leader.WithLabelValues(l.Identity).Set(1)
+	defer leader.WithLabelValues(l.Identity).Set(0)
+
+	// Failing to record it in the status doesn't affect leading, the metric is set already
+	if err := l.recordActiveReplica(ctx); err != nil {
+		logger.Error(err, "failed recording the active replica in the operator status")
+	}
+	<-ctx.Done()
+	logger.Info("lost leadership", "identity", l.Identity)
+	return nil
+}
+
+// recordActiveReplica sets the active replica in the status of all NatsOperators
+func (l *LeadershipReporter) recordActiveReplica(ctx context.Context) error {
+	operators := &natsv1alpha1.NatsOperatorList{}
+	if err := l.List(ctx, operators); err != nil {
+		return err
+	}
+	for i := range operators.Items {
+		operator := &operators.Items[i]
+		if operator.Status.ActiveReplica == l.Identity {
+			continue
+		}
+		operator.Status.ActiveReplica = l.Identity
+		if err := l.Status().Update(ctx, operator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestLeadershipReporter(t *testing.T) {
+	g := NewWithT(t)
+	operator, secret := newTestOperator(g)
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(operator, secret).Build()
+	activeReplica := func() string {
+		operator := &natsv1alpha1.NatsOperator{}
+		g.Expect(c.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operator)).To(Succeed())
+		return operator.Status.ActiveReplica
+	}
+
+	r := NewLeadershipReporter(c, "operator-0")
+	g.Expect(r.NeedLeaderElection()).To(BeTrue())
+	g.Expect(testutil.ToFloat64(leader.WithLabelValues("operator-0"))).To(BeZero())
+	g.Expect(activeReplica()).To(BeEmpty())
+
+	// The manager starts the reporter once elected and stops it when losing the leadership
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Start(ctx) }()
+	g.Eventually(func() float64 { return testutil.ToFloat64(leader.WithLabelValues("operator-0")) }, 5*time.Second).Should(Equal(1.0))
+	g.Eventually(activeReplica, 5*time.Second).Should(Equal("operator-0"))
+
+	cancel()
+	g.Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+	g.Expect(testutil.ToFloat64(leader.WithLabelValues("operator-0"))).To(BeZero())
+
+	// Another replica taking over replaces the active replica
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go NewLeadershipReporter(c, "operator-1").Start(ctx)
+	g.Eventually(activeReplica, 5*time.Second).Should(Equal("operator-1"))
+	g.Expect(testutil.ToFloat64(leader.WithLabelValues("operator-0"))).To(BeZero())
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/strings/slices"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// Metrics are registered with the controller-runtime registry to be served on the manager's metrics endpoint
+// Controller label values of the reconcile metrics
+const (
+	ACCOUNT_CONTROLLER        = "natsaccount"
+	USER_CONTROLLER           = "natsuser"
+	ACCOUNT_SERVER_CONTROLLER = "accountserver"
+)
+
+var (
+	lookupResponseBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "nats_jwt_operator_lookup_response_bytes",
+		Help: "Size of the responses to account lookups in bytes",
+		// 256B up to 1MiB, the default max payload of NATS
+		Buckets: prometheus.ExponentialBuckets(256, 4, 7),
+	})
+	accountJWTExpiry = newAccountJWTExpiry()
+	leader           = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nats_jwt_operator_leader",
+		Help: "1 if the replica is the elected leader reconciling all objects, 0 while on standby",
+	}, []string{"identity"})
+	reconcilePhaseSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "nats_jwt_operator_reconcile_phase_seconds",
+		Help: "Duration of the phases of a reconcile: resolve_key, sign, verify and publish",
+		// 1ms up to 16s, publishing waits for NATS including retries
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"controller", "phase"})
+	reconcileOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nats_jwt_operator_reconcile_outcomes_total",
+		Help: "Number of reconciles by result (success, requeue, error) and the reason for it",
+	}, []string{"controller", "result", "reason"})
+	staleAccounts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nats_jwt_operator_stale_accounts",
+		Help: "Number of served accounts NATS never accepted a claims update of, or not within the stale threshold",
+	})
+	jwtVerifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nats_jwt_operator_jwt_verify_failures_total",
+		Help: "Number of JWTs that didn't chain to their issuer when verified right after signing, by kind (account, user)",
+	}, []string{"kind"})
+)
+
+// MAX_ACCOUNT_METRIC_LABELS bounds the number of NatsAccount labels the per-account metrics carry,
+// as every one of them adds a dimension to every account series
+const MAX_ACCOUNT_METRIC_LABELS = 5
+
+var (
+	// accountMetricLock guards replacing accountJWTExpiry and the labels it carries
+	accountMetricLock sync.Mutex
+	// accountMetricLabels are the NatsAccount labels the per-account metrics carry after the account label
+	accountMetricLabels []string
+	// accountMetricValues are the label values the metrics of each account were last set with
+	accountMetricValues = map[string][]string{}
+)
+
+func newAccountJWTExpiry(labels ...string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nats_jwt_operator_account_jwt_expiry_seconds",
+		Help: "Unix time the currently issued account JWT expires at, +Inf if it doesn't expire",
+	}, append([]string{"account"}, labels...))
+}
+
+var invalidMetricLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// metricLabelName returns the metric label of the NatsAccount label, e.g. team_example_com_name for team.example.com/name
+func metricLabelName(label string) string {
+	return invalidMetricLabelChars.ReplaceAllString(label, "_")
+}
+
+// SetAccountMetricLabels makes the per-account metrics carry the given labels of the NatsAccounts, e.g. to slice
+// them by team. Accounts without one of the labels report it empty. It has to be called before the first reconcile.
+func SetAccountMetricLabels(labels []string) error {
+	if len(labels) > MAX_ACCOUNT_METRIC_LABELS {
+		return fmt.Errorf("at most %d account labels can be added to the metrics, got %d", MAX_ACCOUNT_METRIC_LABELS, len(labels))
+	}
+	names := []string{}
+	for _, label := range labels {
+		name := metricLabelName(label)
+		if name == "account" || slices.Contains(names, name) {
+			return fmt.Errorf("account label %s maps to the metric label %s, which is taken", label, name)
+		}
+		names = append(names, name)
+	}
+
+	accountMetricLock.Lock()
+	defer accountMetricLock.Unlock()
+	accountJWTExpiry = newAccountJWTExpiry(names...)
+	accountMetricLabels = labels
+	accountMetricValues = map[string][]string{}
+	return nil
+}
+
+// accountMetrics collects the per-account metrics with the labels they currently carry. It is registered instead of
+// the metrics themselves, as the registry doesn't allow changing the labels of a metric once it was registered.
+// Describing no metrics registers it unchecked.
+type accountMetrics struct{}
+
+func (accountMetrics) Describe(chan<- *prometheus.Desc) {}
+
+func (accountMetrics) Collect(ch chan<- prometheus.Metric) {
+	accountMetricLock.Lock()
+	defer accountMetricLock.Unlock()
+	accountJWTExpiry.Collect(ch)
+}
+
+// setAccountJWTExpiry sets the JWT expiry of account, replacing its series if its labels changed since
+func setAccountJWTExpiry(account *natsv1alpha1.NatsAccount, expiry float64) {
+	accountMetricLock.Lock()
+	defer accountMetricLock.Unlock()
+	key := account.Namespace + "/" + account.Name
+	values := []string{key}
+	for _, label := range accountMetricLabels {
+		values = append(values, account.Labels[label])
+	}
+	if previous, ok := accountMetricValues[key]; ok && !slices.Equal(previous, values) {
+		accountJWTExpiry.DeleteLabelValues(previous...)
+	}
+	accountMetricValues[key] = values
+	accountJWTExpiry.WithLabelValues(values...).Set(expiry)
+}
+
+// deleteAccountJWTExpiry stops reporting the JWT expiry of the account with key
+func deleteAccountJWTExpiry(key string) {
+	accountMetricLock.Lock()
+	defer accountMetricLock.Unlock()
+	delete(accountMetricValues, key)
+	accountJWTExpiry.DeletePartialMatch(prometheus.Labels{"account": key})
+}
+
+// observePhase starts timing phase of a reconcile of controller, the returned func records its duration
+func observePhase(controller, phase string) func() {
+	start := time.Now()
+	return func() {
+		reconcilePhaseSeconds.WithLabelValues(controller, phase).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ReconcileReason is why a reconcile completed or requeued, it is the reason label of the reconcile outcome metric
+type ReconcileReason string
+
+// Reasons of the reconcile outcomes of all controllers
+const (
+	REASON_RECONCILED            ReconcileReason = "Reconciled"
+	REASON_DELETED               ReconcileReason = "Deleted"
+	REASON_DELETION_PENDING      ReconcileReason = "DeletionPending"
+	REASON_INVALID_SPEC          ReconcileReason = "InvalidSpec"
+	REASON_UNRESOLVED_IMPORTS    ReconcileReason = "UnresolvedImports"
+	REASON_RENEWAL_SCHEDULED     ReconcileReason = "RenewalScheduled"
+	REASON_NAMESPACE_NOT_ALLOWED ReconcileReason = "NamespaceNotAllowed"
+	REASON_BEARER_DISALLOWED     ReconcileReason = "BearerDisallowed"
+	REASON_SERVED                ReconcileReason = "Served"
+	REASON_STATUS_DRIFT          ReconcileReason = "StatusDrift"
+	REASON_DUPLICATE_PUBLIC_KEY  ReconcileReason = "DuplicatePublicKey"
+	REASON_OUTDATED_GENERATION   ReconcileReason = "OutdatedGeneration"
+	REASON_DISCONNECTED          ReconcileReason = "Disconnected"
+	REASON_CIRCUIT_OPEN          ReconcileReason = "CircuitOpen"
+	REASON_PUBLISH_FAILED        ReconcileReason = "PublishFailed"
+	REASON_VERIFICATION_FAILED   ReconcileReason = "VerificationFailed"
+	REASON_KEY_UNAVAILABLE       ReconcileReason = "KeyUnavailable"
+	REASON_UNKNOWN               ReconcileReason = "Unknown"
+)
+
+// OUTCOME_VERBOSITY is the log verbosity at which the outcome of every reconcile is logged
+const OUTCOME_VERBOSITY = 1
+
+// recordOutcome counts the outcome of a reconcile of controller and logs it. Failed reconciles without a reason are
+// counted with the reason of the API error, or Unknown.
+func recordOutcome(ctx context.Context, controller string, result ctrl.Result, err error, reason ReconcileReason) {
+	outcome := "success"
+	switch {
+	case err != nil:
+		outcome = "error"
+		if reason == "" {
+			reason = ReconcileReason(errors.ReasonForError(err))
+		}
+		if reason == "" {
+			reason = REASON_UNKNOWN
+		}
+	case result.Requeue || result.RequeueAfter > 0:
+		outcome = "requeue"
+	}
+	reconcileOutcomes.WithLabelValues(controller, outcome, string(reason)).Inc()
+	log.FromContext(ctx).V(OUTCOME_VERBOSITY).Info("reconcile finished", "result", outcome, "reason", reason, "requeueAfter", result.RequeueAfter)
+}
+
+func init() {
+	metrics.Registry.MustRegister(lookupResponseBytes, accountMetrics{}, leader, reconcilePhaseSeconds, reconcileOutcomes, jwtVerifyFailures, staleAccounts)
+}
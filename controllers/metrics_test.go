@@ -0,0 +1,362 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// phaseObservations returns the number of durations observed for phase of controller
+func phaseObservations(g *WithT, controller, phase string) uint64 {
+	metric := &dto.Metric{}
+	g.Expect(reconcilePhaseSeconds.WithLabelValues(controller, phase).(prometheus.Histogram).Write(metric)).To(Succeed())
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	g := NewWithT(t)
+	outcomes := func(result, reason string) float64 {
+		return testutil.ToFloat64(reconcileOutcomes.WithLabelValues(ACCOUNT_CONTROLLER, result, reason))
+	}
+	// The metrics are global, so only the increase caused by this test is checked
+	resolved := phaseObservations(g, ACCOUNT_CONTROLLER, "resolve_key")
+	signed := phaseObservations(g, ACCOUNT_CONTROLLER, "sign")
+	verified := phaseObservations(g, ACCOUNT_CONTROLLER, "verify")
+	reconciled := outcomes("success", "Reconciled")
+	renewals := outcomes("requeue", "RenewalScheduled")
+	invalidSpecs := outcomes("success", "InvalidSpec")
+	deleted := outcomes("success", "Deleted")
+
+	expiring := newTestAccount("expiring")
+	expiring.Spec.Expiry = &metav1.Duration{Duration: 24 * time.Hour}
+	notBefore := metav1.NewTime(time.Now().Add(time.Hour))
+	invalid := newTestAccount("invalid")
+	invalid.Spec.NotBefore = &notBefore
+	invalid.Spec.Expiry = &metav1.Duration{Duration: time.Minute}
+	r := newTestAccountReconciler(g, newTestAccount("app"), newTestAccount("other"), expiring, invalid)
+	for _, name := range []string{"app", "other", "expiring", "invalid"} {
+		reconcileAccount(g, r, name)
+	}
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: testNamespace, Name: "missing"}})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Each issued account resolved its key, got signed and its JWT verified
+	g.Expect(phaseObservations(g, ACCOUNT_CONTROLLER, "resolve_key") - resolved).To(BeEquivalentTo(3))
+	g.Expect(phaseObservations(g, ACCOUNT_CONTROLLER, "sign") - signed).To(BeEquivalentTo(3))
+	g.Expect(phaseObservations(g, ACCOUNT_CONTROLLER, "verify") - verified).To(BeEquivalentTo(3))
+	g.Expect(outcomes("success", "Reconciled") - reconciled).To(Equal(2.0))
+	g.Expect(outcomes("requeue", "RenewalScheduled") - renewals).To(Equal(1.0))
+	g.Expect(outcomes("success", "InvalidSpec") - invalidSpecs).To(Equal(1.0))
+	g.Expect(outcomes("success", "Deleted") - deleted).To(Equal(1.0))
+}
+
+func TestRecordOutcomeErrorReason(t *testing.T) {
+	g := NewWithT(t)
+	outcomes := func(reason string) float64 {
+		return testutil.ToFloat64(reconcileOutcomes.WithLabelValues("test", "error", reason))
+	}
+
+	recordOutcome(context.Background(), "test", ctrl.Result{}, fmt.Errorf("failed"), "")
+	g.Expect(outcomes("Unknown")).To(Equal(1.0))
+	recordOutcome(context.Background(), "test", ctrl.Result{}, fmt.Errorf("failed"), REASON_PUBLISH_FAILED)
+	g.Expect(outcomes("PublishFailed")).To(Equal(1.0))
+}
+
+// expectOutcome expects reconcile to record exactly one outcome of controller with result and reason
+func expectOutcome(g *WithT, controller, result string, reason ReconcileReason, reconcile func() (ctrl.Result, error)) {
+	counter := reconcileOutcomes.WithLabelValues(controller, result, string(reason))
+	before := testutil.ToFloat64(counter)
+	_, err := reconcile()
+	if result != "error" {
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.ExpectWithOffset(1, testutil.ToFloat64(counter)-before).To(Equal(1.0), "%s %s %s", controller, result, reason)
+}
+
+func TestAccountReconcileReasons(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	unknown := newTestAccountKey(g)
+	importer := newTestAccount("importer")
+	importer.Spec.Imports = []natsv1alpha1.Import{{Subject: "unknown", Account: natsv1alpha1.AccountPublicKey(unknown), Type: jwt.Stream}}
+	expiring := newTestAccount("expiring")
+	expiring.Spec.Expiry = &metav1.Duration{Duration: 24 * time.Hour}
+	invalid := newTestAccount("invalid")
+	invalid.Spec.Limits.Conn = 10
+	invalid.Spec.Limits.ConnPerUser = 1
+	r := newTestAccountReconciler(g, newTestAccount("app"), newTestAccount("conflicted"), importer, expiring, invalid)
+	r.ValidateImports = true
+	r.ReportReconcileReason = true
+	reconcile := func(name string) func() (ctrl.Result, error) {
+		return func() (ctrl.Result, error) {
+			return r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: testNamespace, Name: name}})
+		}
+	}
+
+	for _, outcome := range []struct {
+		account string
+		result  string
+		reason  ReconcileReason
+	}{
+		{"app", "success", REASON_RECONCILED},
+		{"importer", "requeue", REASON_UNRESOLVED_IMPORTS},
+		{"expiring", "requeue", REASON_RENEWAL_SCHEDULED},
+		{"invalid", "success", REASON_INVALID_SPEC},
+	} {
+		expectOutcome(g, ACCOUNT_CONTROLLER, outcome.result, outcome.reason, reconcile(outcome.account))
+		account := &natsv1alpha1.NatsAccount{}
+		g.Expect(r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: outcome.account}, account)).To(Succeed())
+		g.Expect(account.Status.ReconcileReason).To(BeEquivalentTo(outcome.reason))
+	}
+
+	app := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "app"}, app)).To(Succeed())
+	g.Expect(r.Delete(ctx, app)).To(Succeed())
+	expectOutcome(g, ACCOUNT_CONTROLLER, "success", REASON_DELETED, reconcile("app"))
+	expectOutcome(g, ACCOUNT_CONTROLLER, "success", REASON_DELETED, reconcile("app"))
+
+	// Failed reconciles carry the reason of the API error, also when failing after the account was issued
+	base := r.Client
+	r.Client = &conflictingStatusClient{Client: base, conflicts: 1}
+	expectOutcome(g, ACCOUNT_CONTROLLER, "error", "Conflict", reconcile("conflicted"))
+	r.Client = &failingAccountListClient{Client: base}
+	expectOutcome(g, ACCOUNT_CONTROLLER, "error", "ServiceUnavailable", reconcile("importer"))
+}
+
+// failingAccountListClient fails listing NatsAccounts, e.g. when validating imports
+type failingAccountListClient struct {
+	client.Client
+}
+
+func (c *failingAccountListClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*natsv1alpha1.NatsAccountList); ok {
+		return errors.NewServiceUnavailable("listing accounts failed")
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestUserReconcileReasons(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	bearerless := newTestAccount("bearerless")
+	bearerless.Spec.Limits.DisallowBearer = true
+	bearer := newTestUser("bearer", "bearerless")
+	bearer.Spec.BearerToken = true
+	elsewhere := newTestUser("elsewhere", "app")
+	elsewhere.Namespace = "other"
+	ambiguous := newTestUser("ambiguous", "app")
+	ambiguous.Spec.AccountPublicKey = newTestAccountKey(g)
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app"), bearerless},
+		newTestUser("user", "app"), bearer, elsewhere, ambiguous)
+	reconcile := func(namespace, name string) func() (ctrl.Result, error) {
+		return func() (ctrl.Result, error) {
+			return r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}})
+		}
+	}
+
+	expectOutcome(g, USER_CONTROLLER, "success", REASON_RECONCILED, reconcile(testNamespace, "user"))
+	expectOutcome(g, USER_CONTROLLER, "success", REASON_BEARER_DISALLOWED, reconcile(testNamespace, "bearer"))
+	expectOutcome(g, USER_CONTROLLER, "success", REASON_NAMESPACE_NOT_ALLOWED, reconcile("other", "elsewhere"))
+	expectOutcome(g, USER_CONTROLLER, "success", REASON_INVALID_SPEC, reconcile(testNamespace, "ambiguous"))
+	expectOutcome(g, USER_CONTROLLER, "success", REASON_DELETED, reconcile(testNamespace, "missing"))
+}
+
+func TestAccountServerReconcileReasons(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	s := runTestNatsServer(t)
+	var failing int32
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		if atomic.LoadInt32(&failing) == 1 {
+			msg.Respond([]byte(`{"error":{"code":500,"description":"overloaded"}}`))
+			return
+		}
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	appKey := newTestAccountKey(g)
+	drifted := newServedAccount(g, "drifted", newTestAccountKey(g), "v1")
+	drifted.Status.JWT = testAccountJWT(g, newTestAccountKey(g), "other")
+	outdated := newServedAccount(g, "outdated", newTestAccountKey(g), "v1")
+	r := newTestAccountServer(g, t, s, newServedAccount(g, "app", appKey, "v1"), newServedAccount(g, "duplicate", appKey, "v1"), drifted, outdated)
+	r.PublishRetries = 0
+	r.PublishBreaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Minute, now: time.Now}
+	reconcile := func(name string) func() (ctrl.Result, error) {
+		return func() (ctrl.Result, error) {
+			return r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: testNamespace, Name: name}})
+		}
+	}
+
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "success", REASON_SERVED, reconcile("app"))
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "requeue", REASON_DUPLICATE_PUBLIC_KEY, reconcile("duplicate"))
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "success", REASON_STATUS_DRIFT, reconcile("drifted"))
+	r.serveAccount(outdated.Status.PublicKey, servedAccount{Owner: client.ObjectKeyFromObject(outdated), JWT: outdated.Status.JWT, Generation: outdated.Generation + 1})
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "success", REASON_OUTDATED_GENERATION, reconcile("outdated"))
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "success", REASON_DELETED, reconcile("missing"))
+
+	atomic.StoreInt32(&failing, 1)
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "requeue", REASON_PUBLISH_FAILED, reconcile("app"))
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "requeue", REASON_CIRCUIT_OPEN, reconcile("app"))
+
+	r.FailClosed = true
+	s.Shutdown()
+	g.Eventually(r.nc.IsConnected).Should(BeFalse())
+	expectOutcome(g, ACCOUNT_SERVER_CONTROLLER, "requeue", REASON_DISCONNECTED, reconcile("app"))
+}
+
+func TestJWTVerifyFailures(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")}, newTestUser("user", "app"))
+
+	// Signing with a key the operator doesn't know issues a JWT that doesn't chain to it
+	stranger, _ := nkeys.CreateOperator()
+	strangerSeed, _ := stranger.Seed()
+	operatorSecret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	operatorSecret.Data[OPERATOR_SEED_KEY] = strangerSeed
+	g.Expect(r.Update(ctx, operatorSecret)).To(Succeed())
+	ar := &NatsAccountReconciler{Client: r.Client, Scheme: r.Scheme}
+	g.Expect(r.Create(ctx, newTestAccount("broken"))).To(Succeed())
+
+	failures := testutil.ToFloat64(jwtVerifyFailures.WithLabelValues("account"))
+	expectOutcome(g, ACCOUNT_CONTROLLER, "error", REASON_VERIFICATION_FAILED, func() (ctrl.Result, error) {
+		return ar.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: testNamespace, Name: "broken"}})
+	})
+	g.Expect(testutil.ToFloat64(jwtVerifyFailures.WithLabelValues("account")) - failures).To(Equal(1.0))
+	broken := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "broken"}, broken)).To(Succeed())
+	condition := meta.FindStatusCondition(broken.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Reason).To(Equal("VerificationFailed"))
+	// Nothing failing verification is stored
+	g.Expect(broken.Status.JWT).To(BeEmpty())
+	err := r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "broken"}, &corev1.Secret{})
+	g.Expect(errors.IsNotFound(err)).To(BeTrue())
+
+	// Users signed with a seed that isn't the one of their account fail the same way
+	stray, _ := nkeys.CreateAccount()
+	straySeed, _ := stray.Seed()
+	accountSecret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "app"}, accountSecret)).To(Succeed())
+	accountSecret.Data[OPERATOR_SEED_KEY] = straySeed
+	g.Expect(r.Update(ctx, accountSecret)).To(Succeed())
+
+	failures = testutil.ToFloat64(jwtVerifyFailures.WithLabelValues("user"))
+	expectOutcome(g, USER_CONTROLLER, "error", REASON_VERIFICATION_FAILED, func() (ctrl.Result, error) {
+		return r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: testNamespace, Name: "user"}})
+	})
+	g.Expect(testutil.ToFloat64(jwtVerifyFailures.WithLabelValues("user")) - failures).To(Equal(1.0))
+	user := &natsv1alpha1.NatsUser{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "user"}, user)).To(Succeed())
+	g.Expect(user.Status.JWT).To(BeEmpty())
+	err = r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "user"}, &corev1.Secret{})
+	g.Expect(errors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestSkipVerification(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newTestAccountReconciler(g, newTestAccount("app"))
+	stranger, _ := nkeys.CreateOperator()
+	strangerSeed, _ := stranger.Seed()
+	operatorSecret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	operatorSecret.Data[OPERATOR_SEED_KEY] = strangerSeed
+	g.Expect(r.Update(ctx, operatorSecret)).To(Succeed())
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: testNamespace, Name: "app"}}
+
+	// Verification runs by default
+	failures := testutil.ToFloat64(jwtVerifyFailures.WithLabelValues("account"))
+	_, err := r.Reconcile(ctx, req)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(testutil.ToFloat64(jwtVerifyFailures.WithLabelValues("account")) - failures).To(Equal(1.0))
+
+	// Skipping it issues the account regardless
+	r.SkipVerification = true
+	account, _ := reconcileAccount(g, r, "app")
+	g.Expect(testutil.ToFloat64(jwtVerifyFailures.WithLabelValues("account")) - failures).To(Equal(1.0))
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_INVALID)).To(BeFalse())
+}
+
+func TestAccountMetricLabels(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	g.Expect(SetAccountMetricLabels([]string{"team", "example.com/env"})).To(Succeed())
+	t.Cleanup(func() { g.Expect(SetAccountMetricLabels(nil)).To(Succeed()) })
+	account := newTestAccount("labeled")
+	account.Labels = map[string]string{"team": "payments", "example.com/env": "prod", "unrelated": "ignored"}
+	r := newTestAccountReconciler(g, account, newTestAccount("unlabeled"))
+	labels := func(m *dto.Metric) map[string]string {
+		labels := map[string]string{}
+		for _, label := range m.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		return labels
+	}
+
+	account, _ = reconcileAccount(g, r, "labeled")
+	series := accountExpiryMetrics(g, "nats/labeled")
+	g.Expect(series).To(HaveLen(1))
+	g.Expect(labels(series[0])).To(Equal(map[string]string{"account": "nats/labeled", "team": "payments", "example_com_env": "prod"}))
+	reconcileAccount(g, r, "unlabeled")
+	series = accountExpiryMetrics(g, "nats/unlabeled")
+	g.Expect(series).To(HaveLen(1))
+	g.Expect(labels(series[0])).To(Equal(map[string]string{"account": "nats/unlabeled", "team": "", "example_com_env": ""}))
+
+	// Relabeling the account replaces its series instead of adding another one
+	account.Labels["team"] = "billing"
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+	reconcileAccount(g, r, "labeled")
+	series = accountExpiryMetrics(g, "nats/labeled")
+	g.Expect(series).To(HaveLen(1))
+	g.Expect(labels(series[0])).To(HaveKeyWithValue("team", "billing"))
+	// The series are served on the metrics endpoint with the labels they carry
+	count, err := testutil.GatherAndCount(metrics.Registry, "nats_jwt_operator_account_jwt_expiry_seconds")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(count).To(BeNumerically(">=", 2))
+
+	g.Expect(SetAccountMetricLabels([]string{"a", "b", "c", "d", "e", "f"})).To(MatchError("at most 5 account labels can be added to the metrics, got 6"))
+	g.Expect(SetAccountMetricLabels([]string{"team/name", "team.name"})).To(MatchError("account label team.name maps to the metric label team_name, which is taken"))
+	g.Expect(SetAccountMetricLabels([]string{"account"})).To(MatchError("account label account maps to the metric label account, which is taken"))
+}
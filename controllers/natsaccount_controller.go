@@ -17,18 +17,32 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
 	"github.com/nats-io/jwt/v2"
@@ -39,11 +53,51 @@ import (
 type NatsAccountReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// MaxConcurrentReconciles is the number of accounts reconciled in parallel, defaults to 1
+	MaxConcurrentReconciles int
+	// ValidateImports warns about imports from accounts which are neither a NatsAccount nor in ExternalAccounts,
+	// as NATS can never resolve them
+	ValidateImports bool
+	// ExternalAccounts are the public keys of accounts managed outside of the operator
+	ExternalAccounts []string
+	// AccountDirectory is a ConfigMap the public keys of all accounts are published to, so import authors can
+	// look them up by account name. Disabled if nil.
+	AccountDirectory *types.NamespacedName
+	// ReportReconcileReason reports the reason of the last reconcile in the account status, next to the metric
+	ReportReconcileReason bool
+	// SkipVerification doesn't verify that issued JWTs chain to the operator, for deployments trusting their signing
+	// path where verifying adds measurable latency. The JWT is still decoded, which checks its signature.
+	SkipVerification bool
+	// RevocationRetention prunes the revocations of deleted users from the account JWT once the user JWT they revoke
+	// expired longer than it ago. Revocations of JWTs without expiry and of the spec are kept forever, all are if 0.
+	RevocationRetention time.Duration
+
+	// directory caches the public keys published to AccountDirectory by key
+	directory sync.Map
+	// keyLocks serializes resolving and creating the key of an account per account name, so an account
+	// recreated under the same name while its previous reconcile is still running gets a single key
+	keyLocks keyedMutex
 }
 
+// UNRESOLVED_IMPORTS_REQUEUE is the interval in which accounts with unresolved imports are rechecked,
+// as the account they import from isn't watched
+const UNRESOLVED_IMPORTS_REQUEUE = time.Minute
+
+// KEY_UNAVAILABLE_REQUEUE is the interval in which accounts whose operator has no usable signing key are rechecked
+const KEY_UNAVAILABLE_REQUEUE = 30 * time.Second
+
+// ACCOUNT_DISABLED_JWT is the key of the account secret holding the disabled JWT of the account, see disabledAccountClaims
+const ACCOUNT_DISABLED_JWT = "disabled.jwt"
+
+// CLAIMS_SUMMARY_VERBOSITY is the log verbosity at which a summary of the issued claims is logged on every reconcile,
+// enabled with --zap-log-level=debug
+const CLAIMS_SUMMARY_VERBOSITY = 1
+
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts/finalizers,verbs=update
+//+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounttemplates,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -54,13 +108,29 @@ type NatsAccountReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
-func (r *NatsAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *NatsAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	logger := log.FromContext(ctx)
+	var reason ReconcileReason
+	defer func() {
+		if err == nil && reason != REASON_DELETED {
+			err = r.reconcilePendingChanges(ctx, req.NamespacedName)
+		}
+		if r.ReportReconcileReason && err == nil && reason != REASON_DELETED {
+			err = r.reportReconcileReason(ctx, req.NamespacedName, reason)
+		}
+		if err != nil && reason == REASON_RECONCILED {
+			// Reporting failed after the account was reconciled
+			reason = ""
+		}
+		recordOutcome(ctx, ACCOUNT_CONTROLLER, result, err, reason)
+	}()
 
 	account := &natsv1alpha1.NatsAccount{}
 	if err := r.Get(ctx, req.NamespacedName, account); err != nil {
 		if errors.IsNotFound(err) {
-			return ctrl.Result{}, nil
+			reason = REASON_DELETED
+			deleteAccountJWTExpiry(req.NamespacedName.String())
+			return ctrl.Result{}, r.updateAccountDirectory(ctx, req.NamespacedName, "")
 		}
 		return ctrl.Result{}, err
 	}
@@ -68,6 +138,11 @@ func (r *NatsAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	if account.DeletionTimestamp != nil {
 		// TODO: Check if deletion is ok.
 		logger.Info("Processing deletion of account")
+		reason = REASON_DELETED
+		deleteAccountJWTExpiry(req.NamespacedName.String())
+		if err := r.updateAccountDirectory(ctx, req.NamespacedName, ""); err != nil {
+			return ctrl.Result{}, err
+		}
 		if controllerutil.RemoveFinalizer(account, JWT_OPERATOR_FINALIZER) {
 			if err := r.Update(ctx, account); err != nil {
 				return ctrl.Result{}, err
@@ -84,6 +159,7 @@ func (r *NatsAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 	issuer := &natsv1alpha1.NatsOperator{}
 	signerSecret := &corev1.Secret{}
+	var keyUnavailable error
 	for {
 		if err := r.Get(ctx, client.ObjectKey{
 			Namespace: req.Namespace,
@@ -102,17 +178,585 @@ func (r *NatsAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			Namespace: issuer.Namespace,
 			Name:      issuer.Status.OperatorSecretName,
 		}, signerSecret); err != nil {
-			return ctrl.Result{}, err
+			if !errors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+			keyUnavailable = fmt.Errorf("secret %s of operator %s not found", issuer.Status.OperatorSecretName, issuer.Name)
+			break
 		}
 		logger.Info("issuing account secret found")
 		break
 	}
+	if keyUnavailable == nil {
+		if _, err := nkeys.FromSeed(signerSecret.Data[OPERATOR_SEED_KEY]); err != nil {
+			keyUnavailable = fmt.Errorf("secret %s of operator %s holds no valid seed: %v", signerSecret.Name, issuer.Name, err)
+		}
+	}
+	if keyUnavailable != nil {
+		// Never sign without the key of the operator, the secret isn't watched so check again later
+		logger.Info("WARNING: signing key of the operator unavailable, not issuing account", "err", keyUnavailable)
+		reason = REASON_KEY_UNAVAILABLE
+		return ctrl.Result{RequeueAfter: KEY_UNAVAILABLE_REQUEUE}, r.updateCondition(ctx, account, metav1.Condition{
+			Type:               CONDITION_KEY_UNAVAILABLE,
+			Status:             metav1.ConditionTrue,
+			Reason:             "KeyUnavailable",
+			Message:            keyUnavailable.Error(),
+			ObservedGeneration: account.Generation,
+		})
+	}
+	if err := r.updateCondition(ctx, account, metav1.Condition{
+		Type:               CONDITION_KEY_UNAVAILABLE,
+		Status:             metav1.ConditionFalse,
+		Reason:             "KeyAvailable",
+		Message:            "signing key of the operator is available",
+		ObservedGeneration: account.Generation,
+	}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The claims version of the operator decides which claims the account may use
+	claimsVersion := issuer.Spec.AccountClaimsVersion()
+	if err := r.pruneRevokedUsers(ctx, account); err != nil {
+		return ctrl.Result{}, err
+	}
+	spec, invalid := templatedSpec(ctx, r.Client, account)
+	if errors.IsNotFound(invalid) {
+		// The template is watched, the account is reconciled again once it is created
+		invalid = fmt.Errorf("template %s not found", account.Spec.TemplateRef.Name)
+	} else if invalid != nil {
+		return ctrl.Result{}, invalid
+	}
+	// The connection shares are validated before they are resolved
+	shares := spec.Limits.AccountLimits
+	spec.Revocations = accountRevocations(account)
+	if invalid == nil {
+		invalid = spec.Validate(time.Now())
+	}
+	if invalid == nil && spec.Limits.ConnPerUser != 0 {
+		users, err := r.countUsers(ctx, account)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		spec.Limits.AccountLimits, invalid = spec.Limits.AccountLimits.ResolvePerUser(users)
+	}
+	if invalid == nil {
+		// The JWT carries absolute limits, shares of the connection pool are resolved when signing
+		spec.Limits.AccountLimits, invalid = spec.Limits.AccountLimits.ResolveShares(issuer.Spec.ConnectionPool)
+	}
+	if invalid == nil {
+		invalid = r.validateConnectionShares(ctx, account, shares, issuer)
+	}
+	if invalid == nil {
+		invalid = validateClaimsVersion(spec.ToJWTAccount(), claimsVersion)
+	}
+	if invalid != nil {
+		// Retrying won't help, the account is reconciled again once the spec changed
+		logger.Info("refusing to issue invalid account", "err", invalid)
+		reason = REASON_INVALID_SPEC
+		return ctrl.Result{}, r.updateCondition(ctx, account, metav1.Condition{
+			Type:               CONDITION_INVALID,
+			Status:             metav1.ConditionTrue,
+			Reason:             "InvalidSpec",
+			Message:            invalid.Error(),
+			ObservedGeneration: account.Generation,
+		})
+	}
+	if err := r.updateCondition(ctx, account, metav1.Condition{
+		Type:               CONDITION_INVALID,
+		Status:             metav1.ConditionFalse,
+		Reason:             "ValidSpec",
+		Message:            "account spec is valid",
+		ObservedGeneration: account.Generation,
+	}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var seed []byte
+	if account.Spec.SeedSecretRef != nil {
+		if seed, err = r.accountSeed(ctx, account); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// The issued JWT is verified before it is stored, the account server never sees a JWT NATS would reject
+	var verifyErr error
+	verify := func(issued *natsv1alpha1.NatsAccount) error {
+		if r.SkipVerification {
+			return nil
+		}
+		verified := observePhase(ACCOUNT_CONTROLLER, "verify")
+		link, _ := verifyAccountLink(issued, issuer)
+		verified()
+		verifyErr = verifyIssued("account", link)
+		return verifyErr
+	}
+	unlock := r.keyLocks.lock(req.NamespacedName)
+	_, err = r.reconcileSecret(ctx, req, account, spec, seed, signerSecret, claimsVersion, verify)
+	unlock()
+	if verifyErr != nil {
+		// The account is issued again once the operator is fixed
+		logger.Info("WARNING: refusing to store account failing verification", "err", verifyErr)
+		reason = REASON_VERIFICATION_FAILED
+		if err := r.updateCondition(ctx, account, metav1.Condition{
+			Type:               CONDITION_INVALID,
+			Status:             metav1.ConditionTrue,
+			Reason:             "VerificationFailed",
+			Message:            verifyErr.Error(),
+			ObservedGeneration: account.Generation,
+		}); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, verifyErr
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if logger := logger.V(CLAIMS_SUMMARY_VERBOSITY); logger.Enabled() {
+		logger.Info("issued account claims", claimsSummary(req.NamespacedName.String(), claims)...)
+	}
+	if claims.Expires == 0 {
+		setAccountJWTExpiry(account, math.Inf(1))
+	} else {
+		setAccountJWTExpiry(account, float64(claims.Expires))
+	}
+
+	if err := r.reconcileSelfImports(ctx, account); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.reconcileUserLimits(ctx, account, spec); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.reconcileDefaultUser(ctx, account); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.updateAccountDirectory(ctx, req.NamespacedName, claims.Subject); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	result = ctrl.Result{}
+	resolved := true
+	if r.ValidateImports {
+		if resolved, err = r.reconcileImports(ctx, account); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// Nothing can fail anymore, failed reconciles carry the reason of their error
+	reason = REASON_RECONCILED
+	if !resolved {
+		reason = REASON_UNRESOLVED_IMPORTS
+		result.RequeueAfter = UNRESOLVED_IMPORTS_REQUEUE
+	}
+	if pruneIn := r.nextPrune(account); pruneIn > 0 && (result.RequeueAfter == 0 || pruneIn < result.RequeueAfter) {
+		// Revoked JWTs expire without the account changing, wake up to leave their revocations out of the JWT
+		result.RequeueAfter = pruneIn
+	}
+	if account.Spec.Expiry == nil {
+		return result, nil
+	}
+
+	// Wake up in time to renew the JWT before it expires
+	renewIn := renewIn(claims.ClaimsData)
+	logger.Info("scheduled jwt renewal", "renewIn", renewIn)
+	if result.RequeueAfter == 0 || renewIn < result.RequeueAfter {
+		reason = REASON_RENEWAL_SCHEDULED
+		result.RequeueAfter = renewIn
+	}
+	return result, nil
+}
+
+// reconcileImports reflects imports from unknown accounts in the account status and reports whether all imports resolve.
+// The account is issued regardless, as the account imported from may just not be created yet.
+func (r *NatsAccountReconciler) reconcileImports(ctx context.Context, account *natsv1alpha1.NatsAccount) (bool, error) {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts); err != nil {
+		return false, err
+	}
+	known := map[string]struct{}{account.Status.PublicKey: {}}
+	for _, other := range accounts.Items {
+		if other.Status.PublicKey != "" {
+			known[other.Status.PublicKey] = struct{}{}
+		}
+	}
+	for _, external := range r.ExternalAccounts {
+		known[external] = struct{}{}
+	}
+
+	unresolved := []string{}
+	for _, imp := range account.Spec.Imports {
+		// Imports carrying the exporter JWT are verified with the spec
+		if _, ok := known[string(imp.Account)]; !ok && imp.Account != "" && imp.ExporterJWT == "" {
+			unresolved = append(unresolved, fmt.Sprintf("%s from %s", imp.Subject, imp.Account))
+		}
+	}
+
+	condition := metav1.Condition{
+		Type:               CONDITION_UNRESOLVED_IMPORTS,
+		Status:             metav1.ConditionFalse,
+		Reason:             "ImportsResolved",
+		Message:            "all imported accounts are known",
+		ObservedGeneration: account.Generation,
+	}
+	if len(unresolved) > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "UnknownAccount"
+		condition.Message = "imports from accounts which are neither managed nor external: " + strings.Join(unresolved, ", ")
+	}
+	return len(unresolved) == 0, r.updateCondition(ctx, account, condition)
+}
+
+// reconcileSelfImports warns about imports from the account itself of subjects it exports, which loop messages back
+// into the account. The account is issued regardless, as NATS accepts such claims.
+func (r *NatsAccountReconciler) reconcileSelfImports(ctx context.Context, account *natsv1alpha1.NatsAccount) error {
+	looping := selfImports(account)
+	condition := metav1.Condition{
+		Type:               CONDITION_SELF_IMPORT,
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoSelfImports",
+		Message:            "no exports of the account are imported by itself",
+		ObservedGeneration: account.Generation,
+	}
+	if len(looping) > 0 {
+		log.FromContext(ctx).Info("WARNING: account imports subjects it exports itself", "imports", looping)
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "ImportsOwnExport"
+		condition.Message = "imports of subjects the account exports itself: " + strings.Join(looping, ", ")
+	}
+	return r.updateCondition(ctx, account, condition)
+}
+
+// reconcileUserLimits informs about users whose limits are above the ones of spec, without affecting their issuing
+func (r *NatsAccountReconciler) reconcileUserLimits(ctx context.Context, account *natsv1alpha1.NatsAccount, spec natsv1alpha1.NatsAccountSpec) error {
+	users := &natsv1alpha1.NatsUserList{}
+	if err := r.List(ctx, users); err != nil {
+		return err
+	}
+	limits := spec.ToJWTAccount().Limits.NatsLimits
+	exceeding := []string{}
+	for i := range users.Items {
+		user := &users.Items[i]
+		if user.DeletionTimestamp != nil || !referencesAccount(user, account) {
+			continue
+		}
+		if exceeded := exceededLimits(user.Spec.Limits.NatsLimits, limits); len(exceeded) > 0 {
+			exceeding = append(exceeding, fmt.Sprintf("%s (%s)", client.ObjectKeyFromObject(user), strings.Join(exceeded, ", ")))
+		}
+	}
+	sort.Strings(exceeding)
+
+	condition := metav1.Condition{
+		Type:               CONDITION_USER_LIMITS_EXCEEDED,
+		Status:             metav1.ConditionFalse,
+		Reason:             "UserLimitsWithinAccount",
+		Message:            "limits of all users are within the account limits",
+		ObservedGeneration: account.Generation,
+	}
+	if len(exceeding) > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "UserLimitsAboveAccount"
+		condition.Message = "users with limits above the account limits, which NATS enforces instead: " + strings.Join(exceeding, "; ")
+	}
+	return r.updateCondition(ctx, account, condition)
+}
+
+// exceededLimits describes the limits of user above account. Users without a limit of their own are bound
+// by the account, so only positive user limits are compared against accounts with a limit.
+func exceededLimits(user, account jwt.NatsLimits) []string {
+	exceeded := []string{}
+	for _, limit := range []struct {
+		name          string
+		user, account int64
+	}{
+		{"subs", user.Subs, account.Subs},
+		{"data", user.Data, account.Data},
+		{"payload", user.Payload, account.Payload},
+	} {
+		if limit.account != jwt.NoLimit && limit.user > limit.account {
+			exceeded = append(exceeded, fmt.Sprintf("%s %d above %d", limit.name, limit.user, limit.account))
+		}
+	}
+	return exceeded
+}
+
+// selfImports lists the imports from account itself overlapping one of its exports of the same type
+func selfImports(account *natsv1alpha1.NatsAccount) []string {
+	looping := []string{}
+	for _, imp := range account.Spec.Imports {
+		if imp.Account == "" || string(imp.Account) != account.Status.PublicKey {
+			continue
+		}
+		for _, exp := range account.Spec.Exports {
+			if exp.Type == imp.Type && (imp.Subject.IsContainedIn(exp.Subject) || exp.Subject.IsContainedIn(imp.Subject)) {
+				looping = append(looping, fmt.Sprintf("%s %s", imp.Type, imp.Subject))
+				break
+			}
+		}
+	}
+	return looping
+}
+
+// defaultUserName returns the name of the NatsUser maintained for accounts with spec.defaultUser
+func defaultUserName(account *natsv1alpha1.NatsAccount) string {
+	return account.Name + DEFAULT_USER_SUFFIX
+}
+
+// isDefaultUser reports whether user is the default user maintained for account
+func isDefaultUser(account *natsv1alpha1.NatsAccount, user *natsv1alpha1.NatsUser) bool {
+	return account.Spec.DefaultUser && user.Namespace == account.Namespace && user.Name == defaultUserName(account) &&
+		metav1.IsControlledBy(user, account)
+}
+
+// reconcileDefaultUser creates or deletes the default user of the account depending on spec.defaultUser.
+// Users of that name not controlled by the account are left alone.
+func (r *NatsAccountReconciler) reconcileDefaultUser(ctx context.Context, account *natsv1alpha1.NatsAccount) error {
+	logger := log.FromContext(ctx)
+	user := &natsv1alpha1.NatsUser{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: account.Namespace, Name: defaultUserName(account)}, user)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if exists && !metav1.IsControlledBy(user, account) {
+		if account.Spec.DefaultUser {
+			logger.Info("not maintaining default user, a user of that name already exists", "user", user.Name)
+		}
+		return nil
+	}
+
+	if !account.Spec.DefaultUser {
+		if !exists {
+			return nil
+		}
+		logger.Info("deleting default user", "user", user.Name)
+		return client.IgnoreNotFound(r.Delete(ctx, user))
+	}
+
+	desired := natsv1alpha1.NatsUserSpec{
+		AccountRef: corev1.ObjectReference{Namespace: account.Namespace, Name: account.Name},
+	}
+	if !exists {
+		user.Namespace = account.Namespace
+		user.Name = defaultUserName(account)
+		user.Spec = desired
+		if err := controllerutil.SetControllerReference(account, user, r.Scheme); err != nil {
+			return err
+		}
+		logger.Info("creating default user", "user", user.Name)
+		return r.Create(ctx, user)
+	}
+	if reflect.DeepEqual(user.Spec, desired) {
+		return nil
+	}
+	user.Spec = desired
+	return r.Update(ctx, user)
+}
+
+func (r *NatsAccountReconciler) updateCondition(ctx context.Context, account *natsv1alpha1.NatsAccount, condition metav1.Condition) error {
+	if !setCondition(&account.Status.Conditions, condition) {
+		return nil
+	}
+	return r.Status().Update(ctx, account)
+}
+
+// reportReconcileReason sets the reconcile reason in the status of account, if it changed
+func (r *NatsAccountReconciler) reportReconcileReason(ctx context.Context, key types.NamespacedName, reason ReconcileReason) error {
+	account := &natsv1alpha1.NatsAccount{}
+	if err := r.Get(ctx, key, account); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if account.Status.ReconcileReason == string(reason) {
+		return nil
+	}
+	patch := client.MergeFrom(account.DeepCopy())
+	account.Status.ReconcileReason = string(reason)
+	return r.Status().Patch(ctx, account, patch)
+}
+
+// renewalTime returns the point in time at which an expiring JWT needs to be renewed,
+// which is after two thirds of its validity elapsed.
+func renewalTime(claims jwt.ClaimsData) time.Time {
+	validity := claims.Expires - claims.IssuedAt
+	return time.Unix(claims.Expires-validity/3, 0)
+}
+
+// renewIn returns the time until an expiring JWT needs to be renewed, at least a second
+func renewIn(claims jwt.ClaimsData) time.Duration {
+	renewIn := time.Until(renewalTime(claims))
+	if renewIn < time.Second {
+		renewIn = time.Second
+	}
+	return renewIn
+}
+
+// needsRenewal checks whether the expiry of an issued JWT doesn't match the desired validity anymore
+func needsRenewal(claims jwt.ClaimsData, expiry *metav1.Duration, now time.Time) bool {
+	if expiry == nil {
+		return claims.Expires != 0
+	}
+	// Encoding stamps the issue time itself, so allow for a second of difference to the desired validity
+	validityDiff := claims.Expires - claims.IssuedAt - int64(expiry.Seconds())
+	if claims.Expires == 0 || validityDiff > 1 || validityDiff < -1 {
+		return true
+	}
+	return !now.Before(renewalTime(claims))
+}
+
+// validateConnectionShares rejects account, templated to limits, if the pool of issuer is enforced and its connection percentages,
+// added to the ones of the accounts of issuer created before it, exceed the pool.
+// Accounts are ordered by creation, so accounts issued within the pool stay valid.
+func (r *NatsAccountReconciler) validateConnectionShares(ctx context.Context, account *natsv1alpha1.NatsAccount, limits natsv1alpha1.AccountLimits, issuer *natsv1alpha1.NatsOperator) error {
+	pool := issuer.Spec.ConnectionPool
+	if pool == nil || !pool.Enforce || (limits.ConnPercent == 0 && limits.LeafNodeConnPercent == 0) {
+		return nil
+	}
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts, client.InNamespace(account.Namespace)); err != nil {
+		return err
+	}
+	conn, leaf := limits.ConnPercent, limits.LeafNodeConnPercent
+	for _, other := range accounts.Items {
+		if other.Name == account.Name || other.Spec.OperatorRef.Name != issuer.Name || other.DeletionTimestamp != nil {
+			continue
+		}
+		if !createdBefore(&other, account) {
+			continue
+		}
+		otherSpec, err := templatedSpec(ctx, r.Client, &other)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if _, resolveErr := otherSpec.Limits.AccountLimits.ResolveShares(pool); err != nil || resolveErr != nil {
+			// Not issued, so it doesn't take up any of the pool
+			continue
+		}
+		conn += otherSpec.Limits.ConnPercent
+		leaf += otherSpec.Limits.LeafNodeConnPercent
+	}
+	if limits.ConnPercent != 0 && conn > 100 {
+		return fmt.Errorf("conn_percent of the accounts of operator %s adds up to %d%%, more than the connection pool", issuer.Name, conn)
+	}
+	if limits.LeafNodeConnPercent != 0 && leaf > 100 {
+		return fmt.Errorf("leaf_percent of the accounts of operator %s adds up to %d%%, more than the connection pool", issuer.Name, leaf)
+	}
+	return nil
+}
+
+// countUsers returns the number of NatsUsers issued for account
+func (r *NatsAccountReconciler) countUsers(ctx context.Context, account *natsv1alpha1.NatsAccount) (int64, error) {
+	users := &natsv1alpha1.NatsUserList{}
+	if err := r.List(ctx, users); err != nil {
+		return 0, err
+	}
+	count := int64(0)
+	for i := range users.Items {
+		if user := &users.Items[i]; user.DeletionTimestamp == nil && referencesAccount(user, account) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// usersAccount maps a NatsUser to the account it references, for accounts deriving their limits from their users
+// and for accounts whose limits are below the ones of the user, or were before
+func (r *NatsAccountReconciler) usersAccount(obj client.Object) []reconcile.Request {
+	user, ok := obj.(*natsv1alpha1.NatsUser)
+	if !ok || user.Spec.AccountPublicKey != "" {
+		return nil
+	}
+	key := client.ObjectKey{Namespace: user.Spec.AccountRef.Namespace, Name: user.Spec.AccountRef.Name}
+	if key.Namespace == "" {
+		key.Namespace = user.Namespace
+	}
+	account := &natsv1alpha1.NatsAccount{}
+	if err := r.Get(context.Background(), key, account); err != nil {
+		return nil
+	}
+	// Without its template the account isn't issued, so its own spec is as good as any
+	spec, _ := templatedSpec(context.Background(), r.Client, account)
+	if spec.Limits.ConnPerUser == 0 &&
+		len(exceededLimits(user.Spec.Limits.NatsLimits, spec.ToJWTAccount().Limits.NatsLimits)) == 0 &&
+		meta.FindStatusCondition(account.Status.Conditions, CONDITION_USER_LIMITS_EXCEEDED) == nil {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: key}}
+}
+
+// claimsSummary returns the key value pairs describing the claims issued for account for audit logs.
+// It only contains public information, neither the JWT nor any key material besides public keys.
+func claimsSummary(account string, claims *jwt.AccountClaims) []interface{} {
+	expires := "never"
+	if claims.Expires != 0 {
+		expires = time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339)
+	}
+	limits := claims.Limits
+	return []interface{}{
+		"account", account,
+		"publicKey", claims.Subject,
+		"issuer", claims.Issuer,
+		"version", claims.Version,
+		"issuedAt", time.Unix(claims.IssuedAt, 0).UTC().Format(time.RFC3339),
+		"expires", expires,
+		"imports", len(claims.Imports),
+		"exports", len(claims.Exports),
+		"signingKeys", len(claims.SigningKeys),
+		"revocations", len(claims.Revocations),
+		"conn", limits.Conn,
+		"leaf", limits.LeafNodeConn,
+		"subs", limits.Subs,
+		"data", limits.Data,
+		"payload", limits.Payload,
+		"jetstream", limits.IsJSEnabled(),
+	}
+}
 
-	_, err := r.reconcileSecret(ctx, req, account, signerSecret)
-	return ctrl.Result{}, err
+// accountRevocations returns the revocations of the spec, together with the ones of deleted users.
+// A user revoked in both is revoked at the later time.
+func accountRevocations(account *natsv1alpha1.NatsAccount) jwt.RevocationList {
+	if len(account.Status.RevokedUsers) == 0 {
+		return account.Spec.Revocations
+	}
+	revocations := jwt.RevocationList{}
+	for key, at := range account.Spec.Revocations {
+		revocations[key] = at
+	}
+	for key, at := range account.Status.RevokedUsers {
+		if at > revocations[key] {
+			revocations[key] = at
+		}
+	}
+	return revocations
 }
 
-func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, account *natsv1alpha1.NatsAccount, signerSecret *corev1.Secret) (*corev1.Secret, error) {
+// createdBefore orders accounts by creation, equally old accounts by name
+func createdBefore(a, b *natsv1alpha1.NatsAccount) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
+
+// accountSeed returns the account seed stored in the secret referenced by seedSecretRef
+func (r *NatsAccountReconciler) accountSeed(ctx context.Context, account *natsv1alpha1.NatsAccount) ([]byte, error) {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: account.Namespace, Name: account.Spec.SeedSecretRef.Name}, secret); err != nil {
+		return nil, err
+	}
+	seed := secret.Data[OPERATOR_SEED_KEY]
+	kp, err := nkeys.FromSeed(seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding seed of secret %s: %v", secret.Name, err)
+	}
+	if public, _ := kp.PublicKey(); !nkeys.IsValidPublicAccountKey(public) {
+		return nil, fmt.Errorf("secret %s doesn't contain an account seed", secret.Name)
+	}
+	return seed, nil
+}
+
+// reconcileSecret issues the account into its key secret. The account key is taken from seed if set.
+// Nothing is stored unless verify accepts the account as it would be stored.
+func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, account *natsv1alpha1.NatsAccount, spec natsv1alpha1.NatsAccountSpec, seed []byte, signerSecret *corev1.Secret, claimsVersion int, verify func(issued *natsv1alpha1.NatsAccount) error) (*corev1.Secret, error) {
 	// Try reconcile the secret containing the seed key for the operator
 	logger := log.FromContext(ctx)
 	keySecret := &corev1.Secret{}
@@ -121,7 +765,7 @@ func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Re
 	if err := r.Get(ctx, req.NamespacedName, keySecret); errors.IsNotFound(err) {
 		keySecret.Namespace = req.Namespace
 		keySecret.Name = req.Name
-		keySecret.Type = "deinstapel.de/nats-account"
+		keySecret.Type = ACCOUNT_SECRET_TYPE
 		hasSecret = false
 		if err := controllerutil.SetOwnerReference(account, keySecret, r.Scheme); err != nil {
 			return nil, err
@@ -131,10 +775,28 @@ func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Re
 	}
 
 	logger.Info("reconciling account keys")
-	hasChanges, err := r.reconcileKey(ctx, keySecret, account, signerSecret.Data[OPERATOR_SEED_KEY])
+	// Accounts encoded by an older revision of the operator are encoded again
+	reencode := account.Status.EncodeVersion < ACCOUNT_ENCODE_VERSION
+	hasChanges, err := r.reconcileKey(ctx, keySecret, spec, seed, signerSecret.Data[OPERATOR_SEED_KEY], claimsVersion, reencode)
 	if err != nil {
 		return nil, err
 	}
+	if applySecretTemplate(keySecret, account.Spec.SecretTemplate, ACCOUNT_SECRET_COMPONENT) {
+		hasChanges = true
+	}
+	if hasSecret {
+		adopted, err := adoptSecret(account, keySecret, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		hasChanges = hasChanges || adopted
+	}
+	issued := account.DeepCopy()
+	issued.Status.PublicKey = string(keySecret.Data[OPERATOR_PUBLIC_KEY])
+	issued.Status.JWT = string(keySecret.Data[OPERATOR_JWT])
+	if err := verify(issued); err != nil {
+		return nil, err
+	}
 
 	if !hasSecret {
 		if err := r.Create(ctx, keySecret); err != nil {
@@ -146,11 +808,23 @@ func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Re
 		}
 	}
 
-	if !hasSecret || hasChanges {
+	// The secret is written first, so also catch up with it if only updating the status failed before
+	if !hasSecret || hasChanges || statusOutdated(account, keySecret) {
 		// Update operator status if we encountered changes
 		account.Status.AccountSecretName = keySecret.Name
 		account.Status.PublicKey = string(keySecret.Data[OPERATOR_PUBLIC_KEY])
 		account.Status.JWT = string(keySecret.Data[OPERATOR_JWT])
+		account.Status.DisabledJWT = string(keySecret.Data[ACCOUNT_DISABLED_JWT])
+		account.Status.EncodeAlgorithm = encodeAlgorithm(claimsVersion)
+		account.Status.EncodeVersion = ACCOUNT_ENCODE_VERSION
+		// Users are always issued with the account identity key, additional signing keys are
+		// only listed so that rotations can be observed without decoding the JWT.
+		account.Status.ActiveSigningKey = account.Status.PublicKey
+		account.Status.SigningKeys = nil
+		if claims, err := jwt.DecodeAccountClaims(account.Status.JWT); err == nil {
+			account.Status.SigningKeys = claims.SigningKeys.Keys()
+			sort.Strings(account.Status.SigningKeys)
+		}
 		if err := r.Status().Update(ctx, account); err != nil {
 			return nil, err
 		}
@@ -158,9 +832,30 @@ func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Re
 	return keySecret, nil
 }
 
-func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, account *natsv1alpha1.NatsAccount, signer []byte) (bool, error) {
+// statusOutdated reports whether the account status doesn't reflect the keys and JWT stored in secret
+func statusOutdated(account *natsv1alpha1.NatsAccount, secret *corev1.Secret) bool {
+	return account.Status.AccountSecretName != secret.Name ||
+		account.Status.PublicKey != string(secret.Data[OPERATOR_PUBLIC_KEY]) ||
+		account.Status.JWT != string(secret.Data[OPERATOR_JWT]) ||
+		account.Status.DisabledJWT != string(secret.Data[ACCOUNT_DISABLED_JWT])
+}
+
+// reconcileKey issues the JWT of spec, the account spec with the connection shares resolved, and the disabled JWT
+// along with it. The account key is pinned to pinnedSeed if set, otherwise the stored key is kept or a new one
+// generated. With reencode the JWT is issued again even if the claims didn't change.
+func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, spec natsv1alpha1.NatsAccountSpec, pinnedSeed []byte, signer []byte, claimsVersion int, reencode bool) (bool, error) {
 	logger := log.FromContext(ctx)
-	keys, needsKeyUpdate, err := extractOrCreateKeys(secret, nkeys.CreateAccount)
+	resolved := observePhase(ACCOUNT_CONTROLLER, "resolve_key")
+	var keys nkeys.KeyPair
+	var needsKeyUpdate bool
+	var err error
+	if pinnedSeed != nil {
+		keys, err = nkeys.FromSeed(pinnedSeed)
+		needsKeyUpdate = !bytes.Equal(secret.Data[OPERATOR_SEED_KEY], pinnedSeed)
+	} else {
+		keys, needsKeyUpdate, err = extractOrCreateKeys(secret, nkeys.CreateAccount)
+	}
+	resolved()
 	if err != nil {
 		return false, err
 	}
@@ -168,20 +863,24 @@ func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1
 	seed, _ := keys.Seed()
 	public, _ := keys.PublicKey()
 
-	token := jwt.NewAccountClaims(public)
-	token.Account = account.Spec.ToJWTAccount()
-	needsClaimsUpdate := secret.Data == nil
+	now := time.Now()
+	token := AccountClaims(public, spec, now)
+	needsClaimsUpdate := secret.Data == nil || reencode
 	signerKp, err := nkeys.FromSeed(signer)
 	if err != nil {
-		return false, fmt.Errorf("failed decoding seed: %v, signer: %v", err, signer)
+		return false, fmt.Errorf("failed decoding signing key seed: %v", err)
 	}
+	signerPublic, _ := signerKp.PublicKey()
 
 	if secret.Data != nil {
 		oldToken, err := jwt.DecodeAccountClaims(string(secret.Data[OPERATOR_JWT]))
 		if err == nil {
-			needsClaimsUpdate = needsClaimsUpdate || !reflect.DeepEqual(token.Account, oldToken.Account)
+			needsClaimsUpdate = needsClaimsUpdate || accountClaimsChanged(token.Account, oldToken.Account)
+			needsClaimsUpdate = needsClaimsUpdate || oldToken.Version != claimsVersion
 			// Check if the signing keys changed
-			needsClaimsUpdate = needsClaimsUpdate || oldToken.Issuer != token.Issuer
+			needsClaimsUpdate = needsClaimsUpdate || oldToken.Issuer != signerPublic
+			needsClaimsUpdate = needsClaimsUpdate || oldToken.NotBefore != token.NotBefore
+			needsClaimsUpdate = needsClaimsUpdate || needsRenewal(oldToken.ClaimsData, spec.Expiry, now)
 		} else {
 			// Claims could not be decoded, need update.
 			needsClaimsUpdate = true
@@ -197,19 +896,113 @@ func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1
 		secret.Data[OPERATOR_SEED_KEY] = seed
 		secret.Data[OPERATOR_PUBLIC_KEY] = []byte(public)
 	}
+	// Accounts issued before disabled JWTs were issued get one without changing their JWT
+	needsDisabledUpdate := len(secret.Data[ACCOUNT_DISABLED_JWT]) == 0
 	if needsKeyUpdate || needsClaimsUpdate {
-		jwt, err := token.Encode(signerKp)
+		signed := observePhase(ACCOUNT_CONTROLLER, "sign")
+		jwt, err := encodeAccountClaims(token, signerKp, claimsVersion)
+		signed()
 		if err != nil {
 			return false, err
 		}
 		secret.Data[OPERATOR_JWT] = []byte(jwt)
+		needsDisabledUpdate = true
 	}
-	return needsKeyUpdate || needsClaimsUpdate, nil
+	if needsDisabledUpdate {
+		disabled, err := encodeAccountClaims(disabledAccountClaims(token), signerKp, claimsVersion)
+		if err != nil {
+			return false, err
+		}
+		secret.Data[ACCOUNT_DISABLED_JWT] = []byte(disabled)
+	}
+	return needsKeyUpdate || needsClaimsUpdate || needsDisabledUpdate, nil
+}
+
+// disabledAccountClaims returns the claims pushed to NATS once the account of token is deleted. Like NATS does for
+// accounts removed from its resolver, they allow no connections, subscriptions or payload and disable JetStream,
+// so servers holding the account disconnect its users and accept none anymore. They never expire.
+func disabledAccountClaims(token *jwt.AccountClaims) *jwt.AccountClaims {
+	disabled := jwt.NewAccountClaims(token.Subject)
+	disabled.Name = token.Name
+	disabled.Limits = jwt.OperatorLimits{}
+	return disabled
+}
+
+// accountClaimsChanged compares the desired account claims to the issued ones by their encoding,
+// as decoding yields nil for empty lists and encoding stamps the claim type and version.
+func accountClaimsChanged(desired, issued jwt.Account) bool {
+	desired.GenericFields = issued.GenericFields
+	desiredJSON, err := json.Marshal(desired)
+	if err != nil {
+		return true
+	}
+	issuedJSON, err := json.Marshal(issued)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(desiredJSON, issuedJSON)
+}
+
+// AccountClaims builds the claims of the account identified by public as described by spec
+func AccountClaims(public string, spec natsv1alpha1.NatsAccountSpec, now time.Time) *jwt.AccountClaims {
+	token := jwt.NewAccountClaims(public)
+	token.Account = spec.ToJWTAccount()
+	if spec.Expiry != nil {
+		token.Expires = now.Add(spec.Expiry.Duration).Unix()
+	}
+	if spec.NotBefore != nil {
+		token.NotBefore = spec.NotBefore.Unix()
+	}
+	return token
+}
+
+// SignAccount issues the JWT for the account key as described by spec, signed by signer in the
+// given claims version. This is the same signing the reconciler does, usable without a cluster.
+func SignAccount(spec natsv1alpha1.NatsAccountSpec, account nkeys.KeyPair, signer nkeys.KeyPair, claimsVersion int) (string, error) {
+	public, err := account.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if err := spec.Validate(now); err != nil {
+		return "", err
+	}
+	if spec.Limits.ConnPerUser != 0 {
+		return "", fmt.Errorf("conn_per_user can't be resolved without the NatsUsers of the cluster, set conn instead")
+	}
+	if spec.TemplateRef != nil {
+		return "", fmt.Errorf("templateRef can't be resolved without the NatsAccountTemplates of the cluster")
+	}
+	// Without an operator there is no connection pool to resolve shares against
+	spec.Limits.AccountLimits, err = spec.Limits.AccountLimits.ResolveShares(nil)
+	if err != nil {
+		return "", err
+	}
+	return encodeAccountClaims(AccountClaims(public, spec, now), signer, claimsVersion)
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// The initial list of the informer reconciles every account on startup, which schedules the renewal
+// of all expiring accounts.
 func (r *NatsAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.AccountDirectory != nil {
+		// Accounts deleted while the operator wasn't running never had their entry removed, only the leader prunes
+		reader := mgr.GetAPIReader()
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			if _, err := r.pruneAccountDirectory(ctx, reader); err != nil {
+				log.FromContext(ctx).Error(err, "failed pruning the account directory")
+			}
+			return nil
+		})); err != nil {
+			return err
+		}
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&natsv1alpha1.NatsAccount{}).
+		Owns(&natsv1alpha1.NatsUser{}).
+		// The connections of accounts with conn_per_user follow their users
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsUser{}}, handler.EnqueueRequestsFromMapFunc(r.usersAccount)).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsAccountTemplate{}}, handler.EnqueueRequestsFromMapFunc(r.templateAccounts)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
@@ -0,0 +1,1275 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+const testNamespace = "nats"
+
+func newTestScheme(g *WithT) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(natsv1alpha1.AddToScheme(scheme)).To(Succeed())
+	return scheme
+}
+
+// newTestOperator returns a NatsOperator that already went through reconciliation,
+// together with the secret holding its keys.
+func newTestOperator(g *WithT) (*natsv1alpha1.NatsOperator, *corev1.Secret) {
+	kp, err := nkeys.CreateOperator()
+	g.Expect(err).NotTo(HaveOccurred())
+	seed, _ := kp.Seed()
+	public, _ := kp.PublicKey()
+
+	operator := &natsv1alpha1.NatsOperator{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "operator"},
+		Status: natsv1alpha1.NatsOperatorStatus{
+			OperatorSecretName: "operator",
+			PublicKey:          public,
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "operator"},
+		Data: map[string][]byte{
+			OPERATOR_SEED_KEY:   seed,
+			OPERATOR_PUBLIC_KEY: []byte(public),
+		},
+	}
+	return operator, secret
+}
+
+func newTestAccount(name string) *natsv1alpha1.NatsAccount {
+	return &natsv1alpha1.NatsAccount{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec: natsv1alpha1.NatsAccountSpec{
+			OperatorRef: corev1.ObjectReference{Name: "operator"},
+		},
+	}
+}
+
+// countLimit returns the limit of n imports or exports
+func countLimit(n int64) *int64 {
+	return &n
+}
+
+// byteLimit returns the byte limit of quantity, e.g. a JetStream storage or payload limit
+func byteLimit(quantity string) *resource.Quantity {
+	q := resource.MustParse(quantity)
+	return &q
+}
+
+func newTestAccountReconciler(g *WithT, objs ...client.Object) *NatsAccountReconciler {
+	scheme := newTestScheme(g)
+	operator, operatorSecret := newTestOperator(g)
+	objs = append(objs, operator, operatorSecret)
+	return &NatsAccountReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme: scheme,
+	}
+}
+
+func reconcileAccount(g *WithT, r *NatsAccountReconciler, name string) (*natsv1alpha1.NatsAccount, ctrl.Result) {
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: name}
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	return account, res
+}
+
+// conflictingStatusClient fails the given number of status updates with a conflict
+type conflictingStatusClient struct {
+	client.Client
+	conflicts int
+}
+
+func (c *conflictingStatusClient) Status() client.StatusWriter {
+	return &conflictingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type conflictingStatusWriter struct {
+	client.StatusWriter
+	client *conflictingStatusClient
+}
+
+func (w *conflictingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+	if w.client.conflicts > 0 {
+		w.client.conflicts--
+		return errors.NewConflict(natsv1alpha1.GroupVersion.WithResource("status").GroupResource(), obj.GetName(), fmt.Errorf("object was modified"))
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func TestAccountStatusListsSigningKeys(t *testing.T) {
+	g := NewWithT(t)
+
+	signer, err := nkeys.CreateAccount()
+	g.Expect(err).NotTo(HaveOccurred())
+	signerPublic, _ := signer.PublicKey()
+
+	account := newTestAccount("app")
+	account.Spec.SigningKeys = []natsv1alpha1.AccountPublicKey{natsv1alpha1.AccountPublicKey(signerPublic)}
+	r := newTestAccountReconciler(g, account)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(claims.SigningKeys.Keys()).To(ConsistOf(signerPublic))
+	g.Expect(account.Status.SigningKeys).To(ConsistOf(signerPublic))
+	g.Expect(account.Status.ActiveSigningKey).To(Equal(claims.Subject))
+}
+
+func TestAccountRequeuedBeforeExpiry(t *testing.T) {
+	g := NewWithT(t)
+
+	account := newTestAccount("app")
+	account.Spec.Expiry = &metav1.Duration{Duration: time.Hour}
+	r := newTestAccountReconciler(g, account)
+
+	account, res := reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Expires).NotTo(BeZero())
+
+	expiresIn := time.Until(time.Unix(claims.Expires, 0))
+	g.Expect(res.RequeueAfter).To(BeNumerically(">", 0))
+	g.Expect(res.RequeueAfter).To(BeNumerically("<", expiresIn))
+
+	// Another reconcile before the renewal is due keeps the issued JWT
+	renewed, _ := reconcileAccount(g, r, "app")
+	g.Expect(renewed.Status.JWT).To(Equal(account.Status.JWT))
+}
+
+func TestAccountNotResignedWithoutChanges(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	r := newTestAccountReconciler(g, account)
+	account, _ = reconcileAccount(g, r, "app")
+
+	secret := &corev1.Secret{}
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "app"}, secret)).To(Succeed())
+	operatorSecret := &corev1.Secret{}
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	changed, err := r.reconcileKey(context.Background(), secret, account.Spec, nil, operatorSecret.Data[OPERATOR_SEED_KEY], 2, false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(changed).To(BeFalse())
+}
+
+func TestAccountDisabledJWT(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	account := newTestAccount("app")
+	account.Spec.Limits.Conn = 10
+	r := newTestAccountReconciler(g, account)
+	account, _ = reconcileAccount(g, r, "app")
+
+	// Issued along with the JWT by the same issuer, allowing nothing
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	disabled, err := jwt.DecodeAccountClaims(account.Status.DisabledJWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(disabled.Subject).To(Equal(account.Status.PublicKey))
+	g.Expect(disabled.Issuer).To(Equal(claims.Issuer))
+	g.Expect(disabled.Limits.Conn).To(BeZero())
+	g.Expect(disabled.Limits.LeafNodeConn).To(BeZero())
+	g.Expect(disabled.Limits.Subs).To(BeZero())
+	g.Expect(disabled.Limits.IsJSEnabled()).To(BeFalse())
+	g.Expect(disabled.Expires).To(BeZero())
+	secret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "app"}, secret)).To(Succeed())
+	g.Expect(string(secret.Data[ACCOUNT_DISABLED_JWT])).To(Equal(account.Status.DisabledJWT))
+
+	// Accounts issued without one get it without being signed again
+	delete(secret.Data, ACCOUNT_DISABLED_JWT)
+	g.Expect(r.Update(ctx, secret)).To(Succeed())
+	issued := account.Status.JWT
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(account.Status.JWT).To(Equal(issued))
+	g.Expect(account.Status.DisabledJWT).NotTo(BeEmpty())
+}
+
+func TestAccountReencodedFromOlderEncodeVersion(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newTestAccountReconciler(g, newTestAccount("app"))
+	account, _ := reconcileAccount(g, r, "app")
+	g.Expect(account.Status.EncodeVersion).To(Equal(ACCOUNT_ENCODE_VERSION))
+	g.Expect(account.Status.EncodeAlgorithm).To(Equal(jwt.AlgorithmNkey))
+
+	// Unchanged accounts of the current revision aren't signed again
+	signs := phaseObservations(g, ACCOUNT_CONTROLLER, "sign")
+	reconcileAccount(g, r, "app")
+	g.Expect(phaseObservations(g, ACCOUNT_CONTROLLER, "sign")).To(Equal(signs))
+
+	// Accounts encoded by an older operator are
+	account.Status.EncodeVersion = ACCOUNT_ENCODE_VERSION - 1
+	account.Status.EncodeAlgorithm = ""
+	g.Expect(r.Status().Update(ctx, account)).To(Succeed())
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(phaseObservations(g, ACCOUNT_CONTROLLER, "sign")).To(Equal(signs + 1))
+	g.Expect(account.Status.EncodeVersion).To(Equal(ACCOUNT_ENCODE_VERSION))
+	g.Expect(account.Status.EncodeAlgorithm).To(Equal(jwt.AlgorithmNkey))
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	g := NewWithT(t)
+	now := time.Now()
+	hour := &metav1.Duration{Duration: time.Hour}
+	issued := jwt.ClaimsData{IssuedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()}
+
+	g.Expect(needsRenewal(issued, hour, now)).To(BeFalse())
+	g.Expect(needsRenewal(issued, hour, now.Add(41*time.Minute))).To(BeTrue())
+	g.Expect(needsRenewal(issued, nil, now)).To(BeTrue())
+	g.Expect(needsRenewal(issued, &metav1.Duration{Duration: 2 * time.Hour}, now)).To(BeTrue())
+	g.Expect(needsRenewal(jwt.ClaimsData{IssuedAt: now.Unix()}, nil, now)).To(BeFalse())
+}
+
+func TestAccountDisallowBearer(t *testing.T) {
+	g := NewWithT(t)
+
+	account := newTestAccount("app")
+	account.Spec.Limits.DisallowBearer = true
+	r := newTestAccountReconciler(g, account)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.DisallowBearer).To(BeTrue())
+}
+
+func TestAccountNotBefore(t *testing.T) {
+	g := NewWithT(t)
+	notBefore := metav1.NewTime(time.Now().Add(time.Hour).Truncate(time.Second))
+
+	account := newTestAccount("app")
+	account.Spec.NotBefore = &notBefore
+	account.Spec.Expiry = &metav1.Duration{Duration: 24 * time.Hour}
+	invalid := newTestAccount("invalid")
+	invalid.Spec.NotBefore = &notBefore
+	invalid.Spec.Expiry = &metav1.Duration{Duration: time.Minute}
+	r := newTestAccountReconciler(g, account, invalid)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.NotBefore).To(Equal(notBefore.Unix()))
+
+	invalid, _ = reconcileAccount(g, r, "invalid")
+	g.Expect(invalid.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(invalid.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Message).To(ContainSubstring("notBefore"))
+}
+
+func TestAccountRejectsNegativeDefaultResponsePermission(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.DefaultPermissions.Resp = &natsv1alpha1.ResponsePermission{MaxMsgs: -1}
+	r := newTestAccountReconciler(g, account)
+
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(account.Status.JWT).To(BeEmpty())
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_INVALID)).To(BeTrue())
+}
+
+func TestAccountStorageQuantities(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Limits.JetStreamLimits = natsv1alpha1.JetStreamLimits{MemoryStorage: byteLimit("10Gi"), DiskStorage: byteLimit("-1")}
+	tiered := newTestAccount("tiered")
+	tiered.Spec.Limits.JetStreamTieredLimits = map[string]natsv1alpha1.JetStreamLimits{
+		"R3": {DiskStorage: byteLimit("1.5Ki")},
+	}
+	negative := newTestAccount("negative")
+	negative.Spec.Limits.DiskStorage = byteLimit("-2Gi")
+	fraction := newTestAccount("fraction")
+	fraction.Spec.Limits.JetStreamTieredLimits = map[string]natsv1alpha1.JetStreamLimits{
+		"R1": {MemoryStorage: byteLimit("500m")},
+	}
+	r := newTestAccountReconciler(g, account, tiered, negative, fraction)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.MemoryStorage).To(BeEquivalentTo(10 * 1024 * 1024 * 1024))
+	g.Expect(claims.Limits.DiskStorage).To(BeEquivalentTo(jwt.NoLimit))
+
+	tiered, _ = reconcileAccount(g, r, "tiered")
+	claims, err = jwt.DecodeAccountClaims(tiered.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.JetStreamTieredLimits["R3"].DiskStorage).To(BeEquivalentTo(1536))
+
+	for name, message := range map[string]string{
+		"negative": "disk_storage -2Gi needs to be non negative, or -1 for no limit",
+		"fraction": "tier R1: mem_storage 500m is not a whole number of bytes",
+	} {
+		invalid, _ := reconcileAccount(g, r, name)
+		g.Expect(invalid.Status.JWT).To(BeEmpty())
+		condition := meta.FindStatusCondition(invalid.Status.Conditions, CONDITION_INVALID)
+		g.Expect(condition).NotTo(BeNil())
+		g.Expect(condition.Message).To(Equal(message))
+	}
+
+	// Byte counts of manifests written before quantities were supported still apply
+	limits := natsv1alpha1.JetStreamLimits{}
+	g.Expect(json.Unmarshal([]byte(`{"mem_storage": 1073741824, "disk_storage": -1}`), &limits)).To(Succeed())
+	g.Expect(limits.MemoryStorage.Value()).To(BeEquivalentTo(1024 * 1024 * 1024))
+	g.Expect(limits.DiskStorage.Value()).To(BeEquivalentTo(jwt.NoLimit))
+}
+
+func TestAccountPayloadQuantity(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Limits.Payload = byteLimit("1Mi")
+	unlimited := newTestAccount("unlimited")
+	unlimited.Spec.Limits.Payload = byteLimit("-1")
+	oversized := newTestAccount("oversized")
+	oversized.Spec.Limits.Payload = byteLimit("128Mi")
+	r := newTestAccountReconciler(g, account, unlimited, oversized)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Payload).To(BeEquivalentTo(1048576))
+
+	unlimited, _ = reconcileAccount(g, r, "unlimited")
+	claims, err = jwt.DecodeAccountClaims(unlimited.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Payload).To(BeEquivalentTo(jwt.NoLimit))
+
+	oversized, _ = reconcileAccount(g, r, "oversized")
+	g.Expect(oversized.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(oversized.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(Equal("payload 128Mi exceeds the maximum payload of NATS of 64Mi"))
+
+	// Byte counts of manifests written before quantities were supported still apply
+	limits := natsv1alpha1.NatsLimits{}
+	g.Expect(json.Unmarshal([]byte(`{"payload": 1024}`), &limits)).To(Succeed())
+	g.Expect(limits.Payload.Value()).To(BeEquivalentTo(1024))
+}
+
+func TestAccountJetStreamTiers(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Limits.JetStreamTieredLimits = map[string]natsv1alpha1.JetStreamLimits{
+		"R1": {MemoryStorage: byteLimit("1Gi"), DiskStorage: byteLimit("10Gi"), Streams: 10, Consumer: -1},
+		"R3": {DiskStorage: byteLimit("-1"), Streams: 5, Consumer: 20},
+	}
+	unknown := newTestAccount("unknown")
+	unknown.Spec.Limits.JetStreamTieredLimits = map[string]natsv1alpha1.JetStreamLimits{
+		"R1": {DiskStorage: byteLimit("-1")},
+		"R7": {DiskStorage: byteLimit("-1")},
+	}
+	mixed := newTestAccount("mixed")
+	mixed.Spec.Limits.DiskStorage = byteLimit("1Gi")
+	mixed.Spec.Limits.JetStreamTieredLimits = map[string]natsv1alpha1.JetStreamLimits{
+		"R3": {DiskStorage: byteLimit("-1")},
+	}
+	r := newTestAccountReconciler(g, account, unknown, mixed)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.JetStreamLimits).To(Equal(jwt.JetStreamLimits{}))
+	g.Expect(claims.Limits.JetStreamTieredLimits).To(Equal(jwt.JetStreamTieredLimits{
+		"R1": {MemoryStorage: 1024 * 1024 * 1024, DiskStorage: 10 * 1024 * 1024 * 1024, Streams: 10, Consumer: -1},
+		"R3": {DiskStorage: jwt.NoLimit, Streams: 5, Consumer: 20},
+	}))
+	g.Expect(claims.Limits.IsJSEnabled()).To(BeTrue())
+
+	for name, message := range map[string]string{
+		"unknown": `tier "R7" is not a replication tier, NATS only applies the tiers R1 to R5`,
+		"mixed":   "JetStream limits and tiered_limits are mutually exclusive, only max_ack_pending is inherited by the tiers",
+	} {
+		invalid, _ := reconcileAccount(g, r, name)
+		g.Expect(invalid.Status.JWT).To(BeEmpty())
+		condition := meta.FindStatusCondition(invalid.Status.Conditions, CONDITION_INVALID)
+		g.Expect(condition).NotTo(BeNil())
+		g.Expect(condition.Message).To(Equal(message))
+	}
+}
+
+func TestAccountMaxAckPending(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Limits.JetStreamLimits = natsv1alpha1.JetStreamLimits{DiskStorage: byteLimit("-1"), MaxAckPending: 1000}
+	tiered := newTestAccount("tiered")
+	tiered.Spec.Limits.MaxAckPending = 1000
+	tiered.Spec.Limits.JetStreamTieredLimits = map[string]natsv1alpha1.JetStreamLimits{
+		"R1": {DiskStorage: byteLimit("-1")},
+		"R3": {DiskStorage: byteLimit("-1"), MaxAckPending: 50},
+	}
+	disabled := newTestAccount("disabled")
+	disabled.Spec.Limits.MaxAckPending = 1000
+	r := newTestAccountReconciler(g, account, tiered, disabled)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.JetStreamLimits.MaxAckPending).To(BeEquivalentTo(1000))
+
+	// Tiers without their own inherit it, as NATS ignores the untiered limits next to tiers
+	tiered, _ = reconcileAccount(g, r, "tiered")
+	claims, err = jwt.DecodeAccountClaims(tiered.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.JetStreamTieredLimits["R1"].MaxAckPending).To(BeEquivalentTo(1000))
+	g.Expect(claims.Limits.JetStreamTieredLimits["R3"].MaxAckPending).To(BeEquivalentTo(50))
+	vr := jwt.ValidationResults{}
+	claims.Validate(&vr)
+	g.Expect(vr.Errors()).To(BeEmpty())
+
+	disabled, _ = reconcileAccount(g, r, "disabled")
+	g.Expect(disabled.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(disabled.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("max_ack_pending"))
+}
+
+func TestAccountImportShare(t *testing.T) {
+	g := NewWithT(t)
+	exporter, _ := nkeys.CreateAccount()
+	exporterPublic, _ := exporter.PublicKey()
+
+	account := newTestAccount("app")
+	account.Spec.Imports = []natsv1alpha1.Import{{
+		Subject: "svc.latency",
+		Account: natsv1alpha1.AccountPublicKey(exporterPublic),
+		Type:    jwt.Service,
+		Share:   true,
+	}}
+	stream := newTestAccount("stream")
+	stream.Spec.Imports = []natsv1alpha1.Import{{
+		Subject: "events",
+		Account: natsv1alpha1.AccountPublicKey(exporterPublic),
+		Type:    jwt.Stream,
+		Share:   true,
+	}}
+	r := newTestAccountReconciler(g, account, stream)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Imports).To(HaveLen(1))
+	g.Expect(claims.Imports[0].Share).To(BeTrue())
+	g.Expect(claims.Imports[0].IsService()).To(BeTrue())
+
+	stream, _ = reconcileAccount(g, r, "stream")
+	g.Expect(stream.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(stream.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("service import"))
+}
+
+func TestAccountExportResponseType(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Exports = []natsv1alpha1.Export{
+		{Subject: "svc.chunked", Type: jwt.Service, ResponseType: jwt.ResponseTypeChunked},
+		{Subject: "svc.single", Type: jwt.Service},
+	}
+	stream := newTestAccount("stream")
+	stream.Spec.Exports = []natsv1alpha1.Export{{Subject: "events", Type: jwt.Stream, ResponseType: jwt.ResponseTypeStream}}
+	unknown := newTestAccount("unknown")
+	unknown.Spec.Exports = []natsv1alpha1.Export{{Subject: "svc", Type: jwt.Service, ResponseType: "Batched"}}
+	r := newTestAccountReconciler(g, account, stream, unknown)
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Exports).To(HaveLen(2))
+	g.Expect(claims.Exports[0].Subject).To(BeEquivalentTo("svc.chunked"))
+	g.Expect(claims.Exports[0].ResponseType).To(BeEquivalentTo(jwt.ResponseTypeChunked))
+	g.Expect(claims.Exports[1].IsSingleResponse()).To(BeTrue())
+
+	for name, message := range map[string]string{
+		"stream":  "only applies to service exports",
+		"unknown": "none of Singleton, Stream or Chunked",
+	} {
+		invalid, _ := reconcileAccount(g, r, name)
+		g.Expect(invalid.Status.JWT).To(BeEmpty(), name)
+		condition := meta.FindStatusCondition(invalid.Status.Conditions, CONDITION_INVALID)
+		g.Expect(condition).NotTo(BeNil(), name)
+		g.Expect(condition.Message).To(ContainSubstring(message), name)
+	}
+}
+
+func TestAccountImportLocalSubject(t *testing.T) {
+	exporter, _ := nkeys.CreateAccount()
+	exporterPublic, _ := exporter.PublicKey()
+	for _, tc := range []struct {
+		subject      jwt.Subject
+		localSubject jwt.RenamingSubject
+		to           jwt.Subject
+		invalid      string
+	}{
+		{subject: "orders.created", localSubject: "shop.orders.created"},
+		{subject: "orders.*", localSubject: "shop.orders.*"},
+		{subject: "orders.*.*", localSubject: "shop.$2.$1"},
+		{subject: "orders.*.created", localSubject: "shop.*.created"},
+		{subject: "orders.*.created", localSubject: "shop.$1.*", invalid: "wildcards"},
+		{subject: "orders.>", localSubject: "shop.orders.>"},
+		{subject: "orders.*.>", localSubject: "shop.$1.>"},
+		{subject: "orders.*", localSubject: "shop.orders", invalid: "wildcards"},
+		{subject: "orders", localSubject: "shop.*", invalid: "wildcards"},
+		{subject: "orders.*", localSubject: "shop.$2", invalid: "do not exist"},
+		{subject: "orders.*.*", localSubject: "shop.$1", invalid: "wildcards"},
+		{subject: "orders.>", localSubject: "shop.orders", invalid: "end in >"},
+		{subject: "orders", localSubject: "shop.>", invalid: "end in >"},
+		{subject: "orders", localSubject: "shop.orders", to: "shop.orders", invalid: "replaces to"},
+	} {
+		t.Run(fmt.Sprintf("%s to %s", tc.subject, tc.localSubject), func(t *testing.T) {
+			g := NewWithT(t)
+			account := newTestAccount("app")
+			account.Spec.Imports = []natsv1alpha1.Import{{
+				Subject:      tc.subject,
+				LocalSubject: tc.localSubject,
+				To:           tc.to,
+				Account:      natsv1alpha1.AccountPublicKey(exporterPublic),
+				Type:         jwt.Service,
+			}}
+			r := newTestAccountReconciler(g, account)
+
+			account, _ = reconcileAccount(g, r, "app")
+			if tc.invalid != "" {
+				g.Expect(account.Status.JWT).To(BeEmpty())
+				condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_INVALID)
+				g.Expect(condition).NotTo(BeNil())
+				g.Expect(condition.Message).To(ContainSubstring(tc.invalid))
+				return
+			}
+			claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(claims.Imports[0].LocalSubject).To(Equal(tc.localSubject))
+			vr := jwt.ValidationResults{}
+			claims.Validate(&vr)
+			g.Expect(vr.Errors()).To(BeEmpty())
+		})
+	}
+}
+
+func TestAccountImportExportLimits(t *testing.T) {
+	g := NewWithT(t)
+	exporter, _ := nkeys.CreateAccount()
+	exporterPublic, _ := exporter.PublicKey()
+	imports := []natsv1alpha1.Import{
+		{Subject: "a", Account: natsv1alpha1.AccountPublicKey(exporterPublic), Type: jwt.Stream},
+		{Subject: "b", Account: natsv1alpha1.AccountPublicKey(exporterPublic), Type: jwt.Stream},
+	}
+	exports := []natsv1alpha1.Export{{Subject: "events.>", Type: jwt.Stream}}
+
+	account := newTestAccount("app")
+	account.Spec.Imports = imports
+	account.Spec.Exports = exports
+	account.Spec.Limits.AccountLimits = natsv1alpha1.AccountLimits{Imports: countLimit(2), Exports: countLimit(1), WildcardExports: true, Conn: jwt.NoLimit}
+	unlimited := newTestAccount("unlimited")
+	unlimited.Spec.Imports = imports
+	unlimited.Spec.Exports = exports
+	unlimited.Spec.Limits.WildcardExports = true
+	tooManyImports := newTestAccount("imports")
+	tooManyImports.Spec.Imports = imports
+	tooManyImports.Spec.Limits.AccountLimits = natsv1alpha1.AccountLimits{Imports: countLimit(1)}
+	tooManyExports := newTestAccount("exports")
+	tooManyExports.Spec.Exports = exports
+	tooManyExports.Spec.Limits.Exports = countLimit(0)
+	wildcards := newTestAccount("wildcards")
+	wildcards.Spec.Exports = exports
+	wildcards.Spec.Limits.Exports = countLimit(1)
+	r := newTestAccountReconciler(g, account, unlimited, tooManyImports, tooManyExports, wildcards)
+
+	// Positive limits cap the imports and exports
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Imports).To(BeEquivalentTo(2))
+	g.Expect(claims.Limits.Exports).To(BeEquivalentTo(1))
+	g.Expect(claims.Limits.WildcardExports).To(BeTrue())
+
+	// Unset limits don't limit them
+	account, _ = reconcileAccount(g, r, "unlimited")
+	claims, err = jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Imports).To(BeEquivalentTo(jwt.NoLimit))
+	g.Expect(claims.Limits.Exports).To(BeEquivalentTo(jwt.NoLimit))
+
+	// A limit of 0 allows none
+
+	for name, message := range map[string]string{
+		"imports":   "declares 2 imports, but its limits allow 1",
+		"exports":   "declares 1 exports, but its limits allow 0",
+		"wildcards": "limits don't allow wildcard exports",
+	} {
+		rejected, _ := reconcileAccount(g, r, name)
+		g.Expect(rejected.Status.JWT).To(BeEmpty(), name)
+		condition := meta.FindStatusCondition(rejected.Status.Conditions, CONDITION_INVALID)
+		g.Expect(condition).NotTo(BeNil(), name)
+		g.Expect(condition.Message).To(ContainSubstring(message), name)
+	}
+}
+
+func TestAccountStatusCatchesUpAfterConflict(t *testing.T) {
+	g := NewWithT(t)
+	r := newTestAccountReconciler(g, newTestAccount("app"))
+	conflicting := &conflictingStatusClient{Client: r.Client, conflicts: 1}
+	r.Client = conflicting
+
+	// The secret is already written when the status update fails
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "app"}})
+	g.Expect(errors.IsConflict(err)).To(BeTrue())
+	secret := &corev1.Secret{}
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "app"}, secret)).To(Succeed())
+	g.Expect(secret.Data[OPERATOR_JWT]).NotTo(BeEmpty())
+
+	account, _ := reconcileAccount(g, r, "app")
+	g.Expect(account.Status.JWT).To(Equal(string(secret.Data[OPERATOR_JWT])))
+	g.Expect(account.Status.PublicKey).To(Equal(string(secret.Data[OPERATOR_PUBLIC_KEY])))
+}
+
+// accountExpiryMetrics returns the JWT expiry series exported for account
+func accountExpiryMetrics(g *WithT, account string) []*dto.Metric {
+	metrics := make(chan prometheus.Metric, 100)
+	accountJWTExpiry.Collect(metrics)
+	close(metrics)
+	series := []*dto.Metric{}
+	for metric := range metrics {
+		m := &dto.Metric{}
+		g.Expect(metric.Write(m)).To(Succeed())
+		for _, label := range m.Label {
+			if label.GetName() == "account" && label.GetValue() == account {
+				series = append(series, m)
+			}
+		}
+	}
+	return series
+}
+
+// accountExpiryMetric returns the value of the JWT expiry gauge for account, if it is exported
+func accountExpiryMetric(g *WithT, account string) (float64, bool) {
+	series := accountExpiryMetrics(g, account)
+	if len(series) == 0 {
+		return 0, false
+	}
+	return series[0].Gauge.GetValue(), true
+}
+
+func TestAccountJWTExpiryMetric(t *testing.T) {
+	g := NewWithT(t)
+	expiring := newTestAccount("expiring")
+	expiring.Spec.Expiry = &metav1.Duration{Duration: time.Hour}
+	r := newTestAccountReconciler(g, expiring, newTestAccount("forever"))
+
+	expiring, _ = reconcileAccount(g, r, "expiring")
+	claims, err := jwt.DecodeAccountClaims(expiring.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	value, ok := accountExpiryMetric(g, "nats/expiring")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(value).To(Equal(float64(claims.Expires)))
+
+	reconcileAccount(g, r, "forever")
+	value, ok = accountExpiryMetric(g, "nats/forever")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(math.IsInf(value, 1)).To(BeTrue())
+
+	// The finalizer keeps the account around until it was reconciled once more
+	g.Expect(r.Delete(context.Background(), expiring)).To(Succeed())
+	_, err = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "expiring"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, ok = accountExpiryMetric(g, "nats/expiring")
+	g.Expect(ok).To(BeFalse())
+	_, ok = accountExpiryMetric(g, "nats/forever")
+	g.Expect(ok).To(BeTrue())
+}
+
+func TestAccountImportsFromUnknownAccount(t *testing.T) {
+	g := NewWithT(t)
+	unknown, _ := nkeys.CreateAccount()
+	unknownPublic, _ := unknown.PublicKey()
+	external, _ := nkeys.CreateAccount()
+	externalPublic, _ := external.PublicKey()
+
+	exporter := newTestAccount("exporter")
+	importer := newTestAccount("importer")
+	r := newTestAccountReconciler(g, exporter, importer)
+	r.ValidateImports = true
+	r.ExternalAccounts = []string{externalPublic}
+	exporter, _ = reconcileAccount(g, r, "exporter")
+
+	ctx := context.Background()
+	importer.Spec.Imports = []natsv1alpha1.Import{
+		{Subject: "managed", Account: natsv1alpha1.AccountPublicKey(exporter.Status.PublicKey), Type: jwt.Stream},
+		{Subject: "external", Account: natsv1alpha1.AccountPublicKey(externalPublic), Type: jwt.Stream},
+		{Subject: "unknown", Account: natsv1alpha1.AccountPublicKey(unknownPublic), Type: jwt.Stream},
+	}
+	current := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, client.ObjectKeyFromObject(importer), current)).To(Succeed())
+	current.Spec.Imports = importer.Spec.Imports
+	g.Expect(r.Update(ctx, current)).To(Succeed())
+
+	// Only the import from the unknown account is reported, the account is issued nonetheless
+	importer, res := reconcileAccount(g, r, "importer")
+	g.Expect(importer.Status.JWT).NotTo(BeEmpty())
+	g.Expect(res.RequeueAfter).To(Equal(UNRESOLVED_IMPORTS_REQUEUE))
+	condition := meta.FindStatusCondition(importer.Status.Conditions, CONDITION_UNRESOLVED_IMPORTS)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Message).To(ContainSubstring("unknown from " + unknownPublic))
+	g.Expect(condition.Message).NotTo(ContainSubstring(externalPublic))
+	g.Expect(condition.Message).NotTo(ContainSubstring(exporter.Status.PublicKey))
+
+	// Once the account is allowlisted, the warning is cleared
+	r.ExternalAccounts = append(r.ExternalAccounts, unknownPublic)
+	importer, res = reconcileAccount(g, r, "importer")
+	g.Expect(res.RequeueAfter).To(BeZero())
+	g.Expect(meta.IsStatusConditionFalse(importer.Status.Conditions, CONDITION_UNRESOLVED_IMPORTS)).To(BeTrue())
+}
+
+func TestAccountUserLimitsExceeded(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	account := newTestAccount("app")
+	account.Spec.Limits.NatsLimits = natsv1alpha1.NatsLimits{Subs: 100, Data: jwt.NoLimit, Payload: byteLimit("1Mi")}
+	big := newTestUser("big", "app")
+	big.Spec.Limits.NatsLimits = jwt.NatsLimits{Subs: 10, Data: 1 << 30, Payload: 2 << 20}
+	unlimited := newTestUser("unlimited", "app")
+	unlimited.Spec.Limits.NatsLimits = jwt.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: jwt.NoLimit}
+	r := newTestAccountReconciler(g, account, big, unlimited)
+
+	// Only the payload of big is above the account, which is still issued
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(account.Status.JWT).NotTo(BeEmpty())
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_USER_LIMITS_EXCEEDED)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Reason).To(Equal("UserLimitsAboveAccount"))
+	g.Expect(condition.Message).To(HaveSuffix(": nats/big (payload 2097152 above 1048576)"))
+	g.Expect(r.usersAccount(big)).To(Equal([]reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(account)}}))
+
+	// Lowering the limit of the user clears the condition
+	g.Expect(r.Get(ctx, client.ObjectKeyFromObject(big), big)).To(Succeed())
+	big.Spec.Limits.Payload = 1 << 20
+	g.Expect(r.Update(ctx, big)).To(Succeed())
+	g.Expect(r.usersAccount(big)).To(HaveLen(1))
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(meta.IsStatusConditionFalse(account.Status.Conditions, CONDITION_USER_LIMITS_EXCEEDED)).To(BeTrue())
+}
+
+func TestAccountSigningKeyUnavailable(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newTestAccountReconciler(g, newTestAccount("app"))
+	operatorSecret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	g.Expect(r.Delete(ctx, operatorSecret)).To(Succeed())
+
+	// Without the secret of the operator the account isn't signed, but checked again later
+	account, res := reconcileAccount(g, r, "app")
+	g.Expect(res.RequeueAfter).To(Equal(KEY_UNAVAILABLE_REQUEUE))
+	g.Expect(account.Status.JWT).To(BeEmpty())
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "app"}, &corev1.Secret{})).NotTo(Succeed())
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_KEY_UNAVAILABLE)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Reason).To(Equal("KeyUnavailable"))
+	g.Expect(condition.Message).To(ContainSubstring("not found"))
+
+	// Neither is it with a secret that lost its seed
+	seed := operatorSecret.Data[OPERATOR_SEED_KEY]
+	operatorSecret.ResourceVersion = ""
+	delete(operatorSecret.Data, OPERATOR_SEED_KEY)
+	g.Expect(r.Create(ctx, operatorSecret)).To(Succeed())
+	account, res = reconcileAccount(g, r, "app")
+	g.Expect(res.RequeueAfter).To(Equal(KEY_UNAVAILABLE_REQUEUE))
+	g.Expect(account.Status.JWT).To(BeEmpty())
+	g.Expect(meta.FindStatusCondition(account.Status.Conditions, CONDITION_KEY_UNAVAILABLE).Message).To(ContainSubstring("no valid seed"))
+
+	// Once the seed is back, the account is issued and the condition cleared
+	operatorSecret.Data[OPERATOR_SEED_KEY] = seed
+	g.Expect(r.Update(ctx, operatorSecret)).To(Succeed())
+	account, res = reconcileAccount(g, r, "app")
+	g.Expect(res.RequeueAfter).To(BeZero())
+	g.Expect(account.Status.JWT).NotTo(BeEmpty())
+	g.Expect(meta.IsStatusConditionFalse(account.Status.Conditions, CONDITION_KEY_UNAVAILABLE)).To(BeTrue())
+}
+
+func TestAccountSelfImport(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Exports = []natsv1alpha1.Export{{Subject: "orders.>", Type: jwt.Stream}}
+	r := newTestAccountReconciler(g, account)
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_SELF_IMPORT)).To(BeFalse())
+
+	// Importing its own export loops messages back into the account, which is warned about but issued
+	ctx := context.Background()
+	self := natsv1alpha1.AccountPublicKey(account.Status.PublicKey)
+	account.Spec.Imports = []natsv1alpha1.Import{
+		{Subject: "orders.created", Account: self, Type: jwt.Stream},
+		{Subject: "invoices", Account: self, Type: jwt.Stream},
+	}
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(account.Status.JWT).NotTo(BeEmpty())
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_SELF_IMPORT)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Reason).To(Equal("ImportsOwnExport"))
+	g.Expect(condition.Message).To(ContainSubstring("stream orders.created"))
+	g.Expect(condition.Message).NotTo(ContainSubstring("invoices"))
+
+	// Once the import is gone, the warning is cleared
+	account.Spec.Imports = account.Spec.Imports[1:]
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_SELF_IMPORT)).To(BeFalse())
+}
+
+func TestAccountCrossOperatorImport(t *testing.T) {
+	g := NewWithT(t)
+	// The exporter belongs to an operator the NATS servers trust next to the one of the operator
+	externalOperator, _ := nkeys.CreateOperator()
+	externalOperatorPublic, _ := externalOperator.PublicKey()
+	signingKey, _ := nkeys.CreateOperator()
+	signingKeyPublic, _ := signingKey.PublicKey()
+	operatorClaims := jwt.NewOperatorClaims(externalOperatorPublic)
+	operatorClaims.SigningKeys.Add(signingKeyPublic)
+	operatorJWT, err := operatorClaims.Encode(externalOperator)
+	g.Expect(err).NotTo(HaveOccurred())
+	exporterPublic := newTestAccountKey(g)
+	exporterClaims := jwt.NewAccountClaims(exporterPublic)
+	exporterClaims.Exports.Add(&jwt.Export{Subject: "orders.>", Type: jwt.Stream})
+	exporterJWT, err := exporterClaims.Encode(signingKey)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	importer := newTestAccount("importer")
+	importer.Spec.Imports = []natsv1alpha1.Import{{
+		Subject:             "orders.created",
+		Account:             natsv1alpha1.AccountPublicKey(exporterPublic),
+		Type:                jwt.Stream,
+		ExporterJWT:         exporterJWT,
+		ExternalOperatorJWT: operatorJWT,
+	}}
+	unexported := importer.DeepCopy()
+	unexported.Name = "unexported"
+	unexported.Spec.Imports[0].Subject = "invoices"
+	otherOperator := importer.DeepCopy()
+	otherOperator.Name = "other-operator"
+	otherOperator.Spec.Imports[0].ExternalOperatorJWT, err = jwt.NewOperatorClaims(externalOperatorPublic).Encode(externalOperator)
+	g.Expect(err).NotTo(HaveOccurred())
+	r := newTestAccountReconciler(g, importer, unexported, otherOperator)
+	r.ValidateImports = true
+
+	// The import resolves through the exporter JWT, the claim only references the exporting account as NATS import
+	// claims can't carry the exporter or operator JWT
+	importer, res := reconcileAccount(g, r, "importer")
+	g.Expect(res.RequeueAfter).To(BeZero())
+	g.Expect(meta.IsStatusConditionTrue(importer.Status.Conditions, CONDITION_UNRESOLVED_IMPORTS)).To(BeFalse())
+	claims, err := jwt.DecodeAccountClaims(importer.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Imports).To(HaveLen(1))
+	g.Expect(claims.Imports[0].Account).To(Equal(exporterPublic))
+	g.Expect(claims.Imports[0].Subject).To(BeEquivalentTo("orders.created"))
+	g.Expect(claims.Imports[0].Token).To(BeEmpty())
+
+	for name, message := range map[string]string{
+		"unexported":     "doesn't export stream \"invoices\"",
+		"other-operator": "neither the external operator " + externalOperatorPublic + " nor one of its signing keys",
+	} {
+		rejected, _ := reconcileAccount(g, r, name)
+		g.Expect(rejected.Status.JWT).To(BeEmpty(), name)
+		condition := meta.FindStatusCondition(rejected.Status.Conditions, CONDITION_INVALID)
+		g.Expect(condition).NotTo(BeNil(), name)
+		g.Expect(condition.Message).To(ContainSubstring(message), name)
+	}
+}
+
+func TestAccountDefaultUser(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	account := newTestAccount("app")
+	account.Spec.DefaultUser = true
+	account.Spec.DefaultPermissions.Pub.Allow = jwt.StringList{"app.>"}
+	r := newTestAccountReconciler(g, account)
+	ur := &NatsUserReconciler{Client: r.Client, Scheme: r.Scheme}
+	userKey := client.ObjectKey{Namespace: testNamespace, Name: "app-default"}
+
+	account, _ = reconcileAccount(g, r, "app")
+	user := &natsv1alpha1.NatsUser{}
+	g.Expect(r.Get(ctx, userKey, user)).To(Succeed())
+	g.Expect(metav1.IsControlledBy(user, account)).To(BeTrue())
+	g.Expect(user.Spec.AccountRef).To(Equal(corev1.ObjectReference{Namespace: testNamespace, Name: "app"}))
+
+	// The account doesn't allow users in its own namespace, which doesn't apply to its default user
+	user = reconcileUser(g, ur, "app-default")
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Issuer).To(Equal(account.Status.PublicKey))
+	g.Expect(claims.Permissions.Pub.Allow).To(BeEmpty())
+	secret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, userKey, secret)).To(Succeed())
+	g.Expect(string(secret.Data[OPERATOR_CREDS])).To(ContainSubstring(user.Status.JWT))
+	g.Expect(secret.OwnerReferences).To(ContainElement(HaveField("UID", user.UID)))
+
+	// Changes to the default user are reverted
+	user.Spec.BearerToken = true
+	g.Expect(r.Update(ctx, user)).To(Succeed())
+	reconcileAccount(g, r, "app")
+	g.Expect(r.Get(ctx, userKey, user)).To(Succeed())
+	g.Expect(user.Spec.BearerToken).To(BeFalse())
+
+	// Unsetting deletes the user, its secret is garbage collected through the owner reference
+	account.Spec.DefaultUser = false
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+	reconcileAccount(g, r, "app")
+	_, err = ur.Reconcile(ctx, ctrl.Request{NamespacedName: userKey})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(errors.IsNotFound(r.Get(ctx, userKey, user))).To(BeTrue())
+}
+
+func TestAccountDefaultUserKeepsForeignUser(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	account := newTestAccount("app")
+	account.Spec.DefaultUser = true
+	existing := newTestUser("app-default", "other")
+	r := newTestAccountReconciler(g, account, existing)
+
+	account, _ = reconcileAccount(g, r, "app")
+	user := &natsv1alpha1.NatsUser{}
+	g.Expect(r.Get(ctx, client.ObjectKeyFromObject(existing), user)).To(Succeed())
+	g.Expect(user.Spec.AccountRef.Name).To(Equal("other"))
+	g.Expect(user.OwnerReferences).To(BeEmpty())
+
+	account.Spec.DefaultUser = false
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+	reconcileAccount(g, r, "app")
+	g.Expect(r.Get(ctx, client.ObjectKeyFromObject(existing), user)).To(Succeed())
+}
+
+func TestAccountConnectionShares(t *testing.T) {
+	g := NewWithT(t)
+	tenant := newTestAccount("tenant")
+	tenant.Spec.Limits.ConnPercent = 10
+	tenant.Spec.Limits.LeafNode = true
+	tenant.Spec.Limits.LeafNodeConnPercent = 50
+	large := newTestAccount("tenant-large")
+	large.Spec.Limits.ConnPercent = 95
+	both := newTestAccount("both")
+	both.Spec.Limits.Conn = 100
+	both.Spec.Limits.ConnPercent = 10
+	r := newTestAccountReconciler(g, tenant, large, both)
+
+	// Without a pool there is nothing to resolve the percentage against
+	tenant, _ = reconcileAccount(g, r, "tenant")
+	g.Expect(tenant.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(tenant.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("connectionPool.conn"))
+
+	operator := &natsv1alpha1.NatsOperator{}
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operator)).To(Succeed())
+	operator.Spec.ConnectionPool = &natsv1alpha1.ConnectionPool{Conn: 1000, LeafNodeConn: 3}
+	g.Expect(r.Update(context.Background(), operator)).To(Succeed())
+
+	tenant, _ = reconcileAccount(g, r, "tenant")
+	claims, err := jwt.DecodeAccountClaims(tenant.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(100))
+	g.Expect(claims.Limits.LeafNodeConn).To(BeEquivalentTo(1))
+
+	both, _ = reconcileAccount(g, r, "both")
+	condition = meta.FindStatusCondition(both.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("mutually exclusive"))
+
+	// Shares may exceed the pool unless enforced, then only the account exceeding it is rejected
+	large, _ = reconcileAccount(g, r, "tenant-large")
+	g.Expect(large.Status.JWT).NotTo(BeEmpty())
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operator)).To(Succeed())
+	operator.Spec.ConnectionPool.Enforce = true
+	g.Expect(r.Update(context.Background(), operator)).To(Succeed())
+
+	tenant, _ = reconcileAccount(g, r, "tenant")
+	g.Expect(meta.IsStatusConditionTrue(tenant.Status.Conditions, CONDITION_INVALID)).To(BeFalse())
+	large, _ = reconcileAccount(g, r, "tenant-large")
+	condition = meta.FindStatusCondition(large.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Message).To(ContainSubstring("adds up to 105%"))
+}
+
+func TestAccountLeafNodeConnections(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	unset := newTestAccount("unset")
+	unset.Spec.Limits.Conn = jwt.NoLimit
+	raised := newTestAccount("raised")
+	raised.Spec.Limits.LeafNodeConn = 5
+	r := newTestAccountReconciler(g, unset, raised)
+
+	// Accounts accept no leaf node connections unless enabled
+	unset, _ = reconcileAccount(g, r, "unset")
+	claims, err := jwt.DecodeAccountClaims(unset.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.LeafNodeConn).To(BeZero())
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(jwt.NoLimit))
+
+	raised, _ = reconcileAccount(g, r, "raised")
+	g.Expect(raised.Status.JWT).To(BeEmpty())
+	condition := meta.FindStatusCondition(raised.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("leafnode enabled"))
+
+	raised.Spec.Limits.LeafNode = true
+	g.Expect(r.Update(ctx, raised)).To(Succeed())
+	raised, _ = reconcileAccount(g, r, "raised")
+	claims, err = jwt.DecodeAccountClaims(raised.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.LeafNodeConn).To(BeEquivalentTo(5))
+	g.Expect(meta.IsStatusConditionTrue(raised.Status.Conditions, CONDITION_INVALID)).To(BeFalse())
+}
+
+func TestAccountConnectionsPerUser(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	account := newTestAccount("app")
+	account.Spec.Limits.ConnPerUser = 5
+	both := newTestAccount("both")
+	both.Spec.Limits.Conn = 10
+	both.Spec.Limits.ConnPerUser = 5
+	first, second := newTestUser("first", "app"), newTestUser("second", "app")
+	r := newTestAccountReconciler(g, account, both, newTestAccount("plain"), first, second, newTestUser("other", "both"))
+
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(10))
+
+	// Users of accounts with conn_per_user enqueue their account, other accounts aren't touched
+	g.Expect(r.usersAccount(first)).To(Equal([]reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(account)}}))
+	g.Expect(r.usersAccount(newTestUser("other", "plain"))).To(BeEmpty())
+
+	g.Expect(r.Delete(ctx, second)).To(Succeed())
+	account, _ = reconcileAccount(g, r, "app")
+	claims, err = jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Conn).To(BeEquivalentTo(5))
+
+	both, _ = reconcileAccount(g, r, "both")
+	condition := meta.FindStatusCondition(both.Status.Conditions, CONDITION_INVALID)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Message).To(ContainSubstring("conn and conn_per_user are mutually exclusive"))
+}
+
+func TestAccountRecreatedConcurrentlyKeepsOneKey(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newTestAccountReconciler(g, newTestAccount("app"))
+	key := client.ObjectKey{Namespace: testNamespace, Name: "app"}
+	reconcileConcurrently := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Reconciles losing the race fail on the stale object and are retried
+				if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil && !errors.IsConflict(err) {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	for round := 0; round < 5; round++ {
+		reconcileConcurrently()
+		account, _ := reconcileAccount(g, r, "app")
+		secret := &corev1.Secret{}
+		g.Expect(r.Get(ctx, key, secret)).To(Succeed())
+		g.Expect(account.Status.PublicKey).To(Equal(string(secret.Data[OPERATOR_PUBLIC_KEY])))
+		claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(claims.Subject).To(Equal(account.Status.PublicKey))
+
+		// Recreate the account under the same name, with its secret garbage collected
+		g.Expect(r.Delete(ctx, account)).To(Succeed())
+		_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(r.Delete(ctx, secret)).To(Succeed())
+		g.Expect(r.Create(ctx, newTestAccount("app"))).To(Succeed())
+	}
+}
+
+func TestAccountClaimsSummaryLog(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Limits.Conn = 10
+	account.Spec.Expiry = &metav1.Duration{Duration: time.Hour}
+	account.Spec.Exports = []natsv1alpha1.Export{{Subject: "orders", Type: jwt.Stream}}
+	r := newTestAccountReconciler(g, account)
+	reconcileWithLogs := func(verbosity int) string {
+		logs := &strings.Builder{}
+		logger := funcr.New(func(prefix, args string) {
+			logs.WriteString(args + "\n")
+		}, funcr.Options{Verbosity: verbosity})
+		ctx := log.IntoContext(context.Background(), logger)
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "app"}})
+		g.Expect(err).NotTo(HaveOccurred())
+		return logs.String()
+	}
+
+	// Only logged when enabled
+	issuing := reconcileWithLogs(0)
+	g.Expect(issuing).NotTo(ContainSubstring("issued account claims"))
+	logs := reconcileWithLogs(CLAIMS_SUMMARY_VERBOSITY)
+	g.Expect(r.Get(context.Background(), client.ObjectKeyFromObject(account), account)).To(Succeed())
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(logs).To(ContainSubstring(`"msg"="issued account claims"`))
+	for _, field := range []string{
+		`"account"="nats/app"`,
+		`"publicKey"="` + account.Status.PublicKey + `"`,
+		`"issuer"="` + claims.Issuer + `"`,
+		`"expires"="` + time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339) + `"`,
+		`"imports"=0`,
+		`"exports"=1`,
+		`"conn"=10`,
+		`"jetstream"=false`,
+	} {
+		g.Expect(logs).To(ContainSubstring(field))
+	}
+
+	// Neither seeds nor the JWT end up in the logs, also not while issuing the account
+	logs += issuing
+	accountSecret := &corev1.Secret{}
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: account.Status.AccountSecretName}, accountSecret)).To(Succeed())
+	operatorSecret := &corev1.Secret{}
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	g.Expect(logs).NotTo(ContainSubstring(string(accountSecret.Data[OPERATOR_SEED_KEY])))
+	g.Expect(logs).NotTo(ContainSubstring(string(operatorSecret.Data[OPERATOR_SEED_KEY])))
+	g.Expect(logs).NotTo(ContainSubstring(account.Status.JWT))
+	g.Expect(logs).NotTo(MatchRegexp(`S[AO][A-Z2-7]{56}`))
+}
+
+func TestAccountPinnedSeed(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	pinned, _ := nkeys.CreateAccount()
+	pinnedPublic, _ := pinned.PublicKey()
+	pinnedSeed, _ := pinned.Seed()
+	operator, _ := nkeys.CreateOperator()
+	operatorSeed, _ := operator.Seed()
+	seedSecret := func(name string, seed []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+			Data:       map[string][]byte{OPERATOR_SEED_KEY: seed},
+		}
+	}
+	r := newTestAccountReconciler(g, newTestAccount("app"), seedSecret("app-seed", pinnedSeed), seedSecret("operator-seed", operatorSeed))
+
+	// Pinning an account that was issued with a generated key switches it to the key of the seed
+	account, _ := reconcileAccount(g, r, "app")
+	g.Expect(account.Status.PublicKey).NotTo(Equal(pinnedPublic))
+	account.Spec.SeedSecretRef = &corev1.LocalObjectReference{Name: "app-seed"}
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+
+	// Repeated reconciles, also after losing the key secret, keep the key of the seed
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			g.Expect(r.Delete(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "app"}})).To(Succeed())
+		}
+		account, _ = reconcileAccount(g, r, "app")
+		g.Expect(account.Status.PublicKey).To(Equal(pinnedPublic))
+		claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(claims.Subject).To(Equal(pinnedPublic))
+	}
+
+	// Only account seeds can be pinned
+	account.Spec.SeedSecretRef = &corev1.LocalObjectReference{Name: "operator-seed"}
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)})
+	g.Expect(err).To(MatchError("secret operator-seed doesn't contain an account seed"))
+}
+
+func TestImportedKeySecretsAdopted(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	imported := func(name, secretType string, kp nkeys.KeyPair) *corev1.Secret {
+		seed, _ := kp.Seed()
+		public, _ := kp.PublicKey()
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+			Type:       corev1.SecretType(secretType),
+			Data:       map[string][]byte{OPERATOR_SEED_KEY: seed, OPERATOR_PUBLIC_KEY: []byte(public)},
+		}
+	}
+	accountKp, _ := nkeys.CreateAccount()
+	accountPublic, _ := accountKp.PublicKey()
+	userKp, _ := nkeys.CreateUser()
+	userPublic, _ := userKp.PublicKey()
+	// Written by the import subcommand, without any owner
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")},
+		imported("app", ACCOUNT_SECRET_TYPE, accountKp), imported("user", USER_SECRET_TYPE, userKp), newTestUser("user", "app"))
+	user := reconcileUser(g, r, "user")
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "app"}, account)).To(Succeed())
+
+	for _, owner := range []client.Object{account, user} {
+		secret := &corev1.Secret{}
+		g.Expect(r.Get(ctx, client.ObjectKeyFromObject(owner), secret)).To(Succeed())
+		g.Expect(secret.OwnerReferences).To(HaveLen(1))
+		g.Expect(secret.OwnerReferences[0].Name).To(Equal(owner.GetName()))
+		g.Expect(secret.OwnerReferences[0].Kind).To(Equal(owner.GetObjectKind().GroupVersionKind().Kind))
+	}
+	// The keys of the import are kept
+	g.Expect(account.Status.PublicKey).To(Equal(accountPublic))
+	g.Expect(user.Status.PublicKey).To(Equal(userPublic))
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// validateCRD validates obj against the schema of the generated CRD in file, like the API server does on create.
+// Only the OpenAPI schema is checked, the CRDs carry no CEL rules.
+func validateCRD(g *WithT, file string, obj runtime.Object) field.ErrorList {
+	content, err := os.ReadFile(filepath.Join("..", "config", "crd", "bases", file))
+	g.Expect(err).NotTo(HaveOccurred())
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	g.Expect(yaml.Unmarshal(content, crd)).To(Succeed())
+	schema := &apiextensions.JSONSchemaProps{}
+	g.Expect(apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(crd.Spec.Versions[0].Schema.OpenAPIV3Schema, schema, nil)).To(Succeed())
+	validator, _, err := validation.NewSchemaValidator(&apiextensions.CustomResourceValidation{OpenAPIV3Schema: schema})
+	g.Expect(err).NotTo(HaveOccurred())
+	// Encoded as JSON like by the client, e.g. export types are strings instead of their Go value
+	content, err = json.Marshal(obj)
+	g.Expect(err).NotTo(HaveOccurred())
+	unstructured := map[string]interface{}{}
+	g.Expect(json.Unmarshal(content, &unstructured)).To(Succeed())
+	return validation.ValidateCustomResource(nil, unstructured, validator)
+}
+
+func TestAccountCRDValidation(t *testing.T) {
+	g := NewWithT(t)
+	validate := func(spec natsv1alpha1.NatsAccountSpec) field.ErrorList {
+		account := newTestAccount("app")
+		account.Spec = spec
+		return validateCRD(g, "nats.deinstapel.de_natsaccounts.yaml", account)
+	}
+	kp, _ := nkeys.CreateAccount()
+	public, _ := kp.PublicKey()
+	user, _ := nkeys.CreateUser()
+	userPublic, _ := user.PublicKey()
+
+	g.Expect(validate(natsv1alpha1.NatsAccountSpec{
+		Imports: []natsv1alpha1.Import{{
+			Subject: "orders.>",
+			Account: natsv1alpha1.AccountPublicKey(public),
+			Type:    jwt.Stream,
+		}},
+		Exports: []natsv1alpha1.Export{{Subject: "billing.*", Type: jwt.Service}},
+		Limits: natsv1alpha1.OperatorLimits{
+			NatsLimits:    natsv1alpha1.NatsLimits{Subs: -1, Payload: byteLimit("1Mi")},
+			AccountLimits: natsv1alpha1.AccountLimits{Conn: -1},
+		},
+		SigningKeys:        []natsv1alpha1.AccountPublicKey{natsv1alpha1.AccountPublicKey(public)},
+		DefaultPermissions: natsv1alpha1.Permissions{Resp: &natsv1alpha1.ResponsePermission{MaxMsgs: 1, Expires: -1}},
+	})).To(BeEmpty())
+
+	// Limits below the no limit sentinel
+	g.Expect(validate(natsv1alpha1.NatsAccountSpec{
+		Limits: natsv1alpha1.OperatorLimits{AccountLimits: natsv1alpha1.AccountLimits{Conn: -2}},
+	})).NotTo(BeEmpty())
+	g.Expect(validate(natsv1alpha1.NatsAccountSpec{
+		Limits: natsv1alpha1.OperatorLimits{JetStreamTieredLimits: map[string]natsv1alpha1.JetStreamLimits{
+			"R1": {Streams: -5},
+		}},
+	})).NotTo(BeEmpty())
+
+	// Malformed public keys
+	g.Expect(validate(natsv1alpha1.NatsAccountSpec{
+		SigningKeys: []natsv1alpha1.AccountPublicKey{"not-a-key"},
+	})).NotTo(BeEmpty())
+	g.Expect(validate(natsv1alpha1.NatsAccountSpec{
+		Imports: []natsv1alpha1.Import{{Subject: "orders", Account: natsv1alpha1.AccountPublicKey(userPublic), Type: jwt.Stream}},
+	})).NotTo(BeEmpty())
+
+	// Subjects containing whitespace
+	g.Expect(validate(natsv1alpha1.NatsAccountSpec{
+		Exports: []natsv1alpha1.Export{{Subject: "billing invoices", Type: jwt.Service}},
+	})).NotTo(BeEmpty())
+}
+
+func TestUserCRDValidation(t *testing.T) {
+	g := NewWithT(t)
+	// Like the system user of the operator, responses without expiry
+	user := &natsv1alpha1.NatsUser{}
+	user.Name = "system-jwt"
+	user.Namespace = testNamespace
+	user.Spec.AccountRef.Name = "system"
+	user.Spec.Permissions.Resp = &natsv1alpha1.ResponsePermission{MaxMsgs: 1, Expires: -1}
+	g.Expect(validateCRD(g, "nats.deinstapel.de_natsusers.yaml", user)).To(BeEmpty())
+
+	user.Spec.Permissions.Resp.Expires = -2
+	g.Expect(validateCRD(g, "nats.deinstapel.de_natsusers.yaml", user)).NotTo(BeEmpty())
+}
+
+func TestAccountSpecFieldsInCRD(t *testing.T) {
+	g := NewWithT(t)
+	content, err := os.ReadFile(filepath.Join("..", "config", "crd", "bases", "nats.deinstapel.de_natsaccounts.yaml"))
+	g.Expect(err).NotTo(HaveOccurred())
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	g.Expect(yaml.Unmarshal(content, crd)).To(Succeed())
+	properties := crd.Spec.Versions[0].Schema.OpenAPIV3Schema.Properties["spec"].Properties
+
+	// The schema doesn't reject unknown fields, so fields named differently than in the CRD would be silently dropped
+	kp, _ := nkeys.CreateAccount()
+	public, _ := kp.PublicKey()
+	spec := natsv1alpha1.NatsAccountSpec{
+		DefaultPermissions: natsv1alpha1.Permissions{Pub: natsv1alpha1.Permission{Allow: jwt.StringList{"app.>"}}},
+		SigningKeys:        []natsv1alpha1.AccountPublicKey{natsv1alpha1.AccountPublicKey(public)},
+		ScopedSigningKeys:  []natsv1alpha1.ScopedSigningKey{{Key: natsv1alpha1.AccountPublicKey(public)}},
+	}
+	content, err = json.Marshal(spec)
+	g.Expect(err).NotTo(HaveOccurred())
+	fields := map[string]interface{}{}
+	g.Expect(json.Unmarshal(content, &fields)).To(Succeed())
+	g.Expect(fields).To(HaveKey("defaultPermissions"))
+	for name := range fields {
+		g.Expect(properties).To(HaveKey(name))
+	}
+}
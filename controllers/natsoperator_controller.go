@@ -19,11 +19,18 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -39,8 +46,15 @@ import (
 type NatsOperatorReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	expiryLock sync.Mutex
+	// expiring holds the problem description of all operators whose JWT expired or is about to expire
+	expiring map[types.NamespacedName]string
 }
 
+// OPERATOR_EXPIRY_WARNING is how long before its expiry an operator JWT is reported as expiring
+const OPERATOR_EXPIRY_WARNING = 7 * 24 * time.Hour
+
 const JWT_OPERATOR_FINALIZER = "nats.deinstapel.de/jwt-operator"
 const OPERATOR_SEED_KEY = "seed.nk"
 const OPERATOR_PUBLIC_KEY = "key.pub"
@@ -76,6 +90,8 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	operator := &natsv1alpha1.NatsOperator{}
 	if err := r.Get(ctx, req.NamespacedName, operator); err != nil {
 		if errors.IsNotFound(err) {
+			// A deleted operator no longer fails readiness
+			r.setExpiring(req.NamespacedName, metav1.Condition{})
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
@@ -84,6 +100,7 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	if operator.DeletionTimestamp != nil {
 		// TODO: Check if deletion is ok.
 		logger.Info("Processing deletion of operator")
+		r.setExpiring(req.NamespacedName, metav1.Condition{})
 		if controllerutil.RemoveFinalizer(operator, JWT_OPERATOR_FINALIZER) {
 			if err := r.Update(ctx, operator); err != nil {
 				return ctrl.Result{}, err
@@ -101,13 +118,14 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	recheckExpiry, err := r.reconcileExpiry(ctx, req, operator, time.Now())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 
 	// Create / reconcile system account
 	systemAccount := &natsv1alpha1.NatsAccount{}
-	systemAccountName := client.ObjectKey{
-		Namespace: req.Namespace,
-		Name:      fmt.Sprintf("%v-system", req.Name),
-	}
+	systemAccountName := SystemAccountName(req.NamespacedName)
 	for {
 		if err := r.Get(ctx, systemAccountName, systemAccount); errors.IsNotFound(err) {
 			logger.Info("creating system account")
@@ -124,12 +142,12 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 					Name:      req.Name,
 				},
 				Limits: natsv1alpha1.OperatorLimits{
-					NatsLimits: jwt.NatsLimits{
+					NatsLimits: natsv1alpha1.NatsLimits{
 						Subs:    -1,
-						Payload: -1,
+						Payload: resource.NewQuantity(-1, resource.DecimalSI),
 						Data:    -1,
 					},
-					AccountLimits: jwt.AccountLimits{
+					AccountLimits: natsv1alpha1.AccountLimits{
 						Conn:           -1,
 						DisallowBearer: true,
 					},
@@ -177,12 +195,12 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 				},
 				Permissions: natsv1alpha1.Permissions{
 					Pub: natsv1alpha1.Permission{
-						Allow: []string{"$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP", "$SYS.REQ.CLAIMS.UPDATE"},
+						Allow: []string{"$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP", "$SYS.REQ.CLAIMS.UPDATE", "$SYS.REQ.ACCOUNT.*.INFO"},
 					},
 					Sub: natsv1alpha1.Permission{
 						Allow: []string{"$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP"},
 					},
-					Resp: &jwt.ResponsePermission{
+					Resp: &natsv1alpha1.ResponsePermission{
 						MaxMsgs: 1,
 						Expires: -1,
 					},
@@ -215,7 +233,85 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 		}
 	}
 
-	return ctrl.Result{}, r.reconcileServerConfigSnipped(ctx, req, operator, systemAccount, needsRewriteConfig)
+	return ctrl.Result{RequeueAfter: recheckExpiry}, r.reconcileServerConfigSnipped(ctx, req, operator, systemAccount, needsRewriteConfig)
+}
+
+// reconcileExpiry records whether the operator JWT expired or expires within OPERATOR_EXPIRY_WARNING,
+// as all accounts signed by this operator will be rejected by NATS then.
+// It returns when the expiry needs to be checked again, zero if the JWT doesn't expire or already expired.
+func (r *NatsOperatorReconciler) reconcileExpiry(ctx context.Context, req ctrl.Request, operator *natsv1alpha1.NatsOperator, now time.Time) (time.Duration, error) {
+	claims, err := jwt.DecodeOperatorClaims(operator.Status.JWT)
+	if err != nil {
+		return 0, err
+	}
+	condition := metav1.Condition{
+		Type:    CONDITION_EXPIRING,
+		Status:  metav1.ConditionFalse,
+		Reason:  "Valid",
+		Message: "operator JWT is valid",
+	}
+	var recheck time.Duration
+	if claims.Expires != 0 {
+		expires := time.Unix(claims.Expires, 0)
+		warnAt := expires.Add(-OPERATOR_EXPIRY_WARNING)
+		switch {
+		case !now.Before(expires):
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = "Expired"
+			condition.Message = fmt.Sprintf("operator JWT expired at %s, accounts signed by it are rejected", expires.UTC().Format(time.RFC3339))
+		case !now.Before(warnAt):
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = "ExpiringSoon"
+			condition.Message = fmt.Sprintf("operator JWT expires at %s", expires.UTC().Format(time.RFC3339))
+			recheck = expires.Sub(now)
+		default:
+			recheck = warnAt.Sub(now)
+		}
+	}
+	r.setExpiring(req.NamespacedName, condition)
+
+	if !setCondition(&operator.Status.Conditions, condition) {
+		return recheck, nil
+	}
+	return recheck, r.Status().Update(ctx, operator)
+}
+
+func (r *NatsOperatorReconciler) setExpiring(operator types.NamespacedName, condition metav1.Condition) {
+	r.expiryLock.Lock()
+	defer r.expiryLock.Unlock()
+	if r.expiring == nil {
+		r.expiring = map[types.NamespacedName]string{}
+	}
+	if condition.Status == metav1.ConditionTrue {
+		r.expiring[operator] = condition.Message
+	} else {
+		delete(r.expiring, operator)
+	}
+}
+
+// Ready fails while any operator JWT expired or is about to expire, so it can be used as readiness check
+func (r *NatsOperatorReconciler) Ready(req *http.Request) error {
+	r.expiryLock.Lock()
+	defer r.expiryLock.Unlock()
+	problems := []string{}
+	for operator, message := range r.expiring {
+		problems = append(problems, fmt.Sprintf("operator %s: %s", operator, message))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// SystemAccountName returns the name of the system account the operator creates for the NatsOperator operator
+func SystemAccountName(operator types.NamespacedName) types.NamespacedName {
+	return types.NamespacedName{Namespace: operator.Namespace, Name: fmt.Sprintf("%v-system", operator.Name)}
+}
+
+// ServerConfig renders the auth.conf of NATS servers trusting operator, with the claims of its system account preloaded
+func ServerConfig(operator *natsv1alpha1.NatsOperator, sysacc *natsv1alpha1.NatsAccount) string {
+	return fmt.Sprintf(AUTH_CONFIG_TEMPLATE, operator.Status.JWT, sysacc.Status.PublicKey, sysacc.Status.PublicKey, sysacc.Status.JWT)
 }
 
 func (r *NatsOperatorReconciler) reconcileServerConfigSnipped(ctx context.Context, req ctrl.Request, operator *natsv1alpha1.NatsOperator, sysacc *natsv1alpha1.NatsAccount, needsRefresh bool) error {
@@ -236,7 +332,7 @@ func (r *NatsOperatorReconciler) reconcileServerConfigSnipped(ctx context.Contex
 	} else if err != nil {
 		return err
 	}
-	text := fmt.Sprintf(AUTH_CONFIG_TEMPLATE, operator.Status.JWT, sysacc.Status.PublicKey, sysacc.Status.PublicKey, sysacc.Status.JWT)
+	text := ServerConfig(operator, sysacc)
 	if !needsRefresh && serverConfig.Data != nil {
 		needsRefresh = needsRefresh || text != string(serverConfig.Data[OPERATOR_CONFIG_FILE])
 	}
@@ -0,0 +1,144 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// newExpiringTestOperatorReconciler returns a reconciler for an operator whose JWT expires at expires
+func newExpiringTestOperatorReconciler(g *WithT, expires time.Time) *NatsOperatorReconciler {
+	scheme := newTestScheme(g)
+	operator, secret := newTestOperator(g)
+	kp, err := nkeys.FromSeed(secret.Data[OPERATOR_SEED_KEY])
+	g.Expect(err).NotTo(HaveOccurred())
+	claims := jwt.NewOperatorClaims(operator.Status.PublicKey)
+	claims.Expires = expires.Unix()
+	token, err := claims.Encode(kp)
+	g.Expect(err).NotTo(HaveOccurred())
+	secret.Data[OPERATOR_JWT] = []byte(token)
+	operator.Status.JWT = token
+
+	return &NatsOperatorReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, secret).Build(),
+		Scheme: scheme,
+	}
+}
+
+func reconcileOperator(g *WithT, r *NatsOperatorReconciler) (*natsv1alpha1.NatsOperator, ctrl.Result) {
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: "operator"}
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	operator := &natsv1alpha1.NatsOperator{}
+	g.Expect(r.Get(ctx, key, operator)).To(Succeed())
+	return operator, res
+}
+
+func TestOperatorExpiredJWTFailsReadiness(t *testing.T) {
+	g := NewWithT(t)
+	r := newExpiringTestOperatorReconciler(g, time.Now().Add(-time.Hour))
+	g.Expect(r.Ready(nil)).To(Succeed())
+
+	operator, _ := reconcileOperator(g, r)
+	condition := meta.FindStatusCondition(operator.Status.Conditions, CONDITION_EXPIRING)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Reason).To(Equal("Expired"))
+
+	err := r.Ready(nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("operator nats/operator: operator JWT expired at"))
+}
+
+func TestDeletedOperatorPassesReadiness(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newExpiringTestOperatorReconciler(g, time.Now().Add(-time.Hour))
+	operator, _ := reconcileOperator(g, r)
+	g.Expect(r.Ready(nil)).NotTo(Succeed())
+
+	// The finalizer holds the operator back, it is gone once the deletion was processed
+	g.Expect(r.Delete(ctx, operator)).To(Succeed())
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(operator)})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(errors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(operator), operator))).To(BeTrue())
+	g.Expect(r.Ready(nil)).To(Succeed())
+
+	// An operator vanishing without its deletion observed is forgotten as well
+	r = newExpiringTestOperatorReconciler(g, time.Now().Add(-time.Hour))
+	operator, _ = reconcileOperator(g, r)
+	g.Expect(r.Ready(nil)).NotTo(Succeed())
+	controllerutil.RemoveFinalizer(operator, JWT_OPERATOR_FINALIZER)
+	g.Expect(r.Update(ctx, operator)).To(Succeed())
+	g.Expect(r.Delete(ctx, operator)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(operator)})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.Ready(nil)).To(Succeed())
+}
+
+func TestOperatorExpiryWarning(t *testing.T) {
+	g := NewWithT(t)
+	now := time.Now()
+	key := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "operator"}}
+	expires := now.Add(OPERATOR_EXPIRY_WARNING + time.Hour)
+	r := newExpiringTestOperatorReconciler(g, expires)
+	operator := &natsv1alpha1.NatsOperator{}
+	g.Expect(r.Get(context.Background(), key.NamespacedName, operator)).To(Succeed())
+
+	// Check again once the warning is due
+	recheck, err := r.reconcileExpiry(context.Background(), key, operator, now)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(recheck).To(BeNumerically("~", time.Hour, time.Second))
+	g.Expect(operator.Status.Conditions).To(BeEmpty())
+	g.Expect(r.Ready(nil)).To(Succeed())
+
+	recheck, err = r.reconcileExpiry(context.Background(), key, operator, now.Add(2*time.Hour))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(recheck).To(BeNumerically("~", OPERATOR_EXPIRY_WARNING-time.Hour, time.Second))
+	g.Expect(meta.IsStatusConditionTrue(operator.Status.Conditions, CONDITION_EXPIRING)).To(BeTrue())
+	g.Expect(r.Ready(nil)).To(MatchError(ContainSubstring("operator JWT expires at")))
+
+	// Renewing the JWT clears the problem again
+	secret := &corev1.Secret{}
+	g.Expect(r.Get(context.Background(), key.NamespacedName, secret)).To(Succeed())
+	kp, err := nkeys.FromSeed(secret.Data[OPERATOR_SEED_KEY])
+	g.Expect(err).NotTo(HaveOccurred())
+	operator.Status.JWT, err = jwt.NewOperatorClaims(operator.Status.PublicKey).Encode(kp)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = r.reconcileExpiry(context.Background(), key, operator, now.Add(2*time.Hour))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(meta.IsStatusConditionTrue(operator.Status.Conditions, CONDITION_EXPIRING)).To(BeFalse())
+	g.Expect(r.Ready(nil)).To(Succeed())
+}
@@ -28,6 +28,7 @@ import (
 	"k8s.io/utils/strings/slices"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
@@ -49,6 +50,11 @@ const ACCOUNT_TEMPLATE = `-----BEGIN NATS USER JWT-----
 type NatsUserReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// MaxConcurrentReconciles is the number of users reconciled in parallel, defaults to 1
+	MaxConcurrentReconciles int
+	// SkipVerification doesn't verify that issued JWTs chain to their account, see NatsAccountReconciler
+	SkipVerification bool
 }
 
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsusers,verbs=get;list;watch;create;update;patch;delete
@@ -64,12 +70,15 @@ type NatsUserReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
-func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	logger := log.FromContext(ctx)
+	var reason ReconcileReason
+	defer func() { recordOutcome(ctx, USER_CONTROLLER, result, err, reason) }()
 
 	user := &natsv1alpha1.NatsUser{}
 	if err := r.Get(ctx, req.NamespacedName, user); err != nil {
 		if errors.IsNotFound(err) {
+			reason = REASON_DELETED
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
@@ -78,6 +87,12 @@ func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	if user.DeletionTimestamp != nil {
 		// TODO: Check if deletion is ok.
 		logger.Info("Processing deletion of user")
+		reason = REASON_DELETED
+		if controllerutil.ContainsFinalizer(user, JWT_OPERATOR_FINALIZER) {
+			if err := r.revokeUser(ctx, user); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 		if controllerutil.RemoveFinalizer(user, JWT_OPERATOR_FINALIZER) {
 			if err := r.Update(ctx, user); err != nil {
 				return ctrl.Result{}, err
@@ -92,6 +107,41 @@ func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
+	if err := user.Spec.Validate(); err != nil {
+		// TODO: post event to apiserver
+		logger.Info("refusing to issue invalid user", "err", err)
+		reason = REASON_INVALID_SPEC
+		return ctrl.Result{}, nil
+	}
+
+	if user.Spec.AccountPublicKey != "" {
+		if user.Spec.AccountRef.Name != "" {
+			// TODO: post event to apiserver
+			logger.Info("refusing to issue user referencing both an account and an account public key")
+			reason = REASON_INVALID_SPEC
+			return ctrl.Result{}, nil
+		}
+		signer, err := r.externalSigner(ctx, user)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		// The signing keys of accounts managed outside of the cluster aren't known, only the one handed over is trusted
+		external := jwt.NewAccountClaims(user.Spec.AccountPublicKey)
+		signerKp, _ := nkeys.FromSeed(signer)
+		signerPublic, _ := signerKp.PublicKey()
+		external.SigningKeys.Add(signerPublic)
+		verify, verifyErr := r.verifier(user.Spec.AccountPublicKey, external)
+		keySecret, err := r.reconcileSecret(ctx, req, user, nil, user.Spec.AccountPublicKey, signer, verify)
+		if err != nil {
+			if *verifyErr != nil {
+				reason = REASON_VERIFICATION_FAILED
+			}
+			return ctrl.Result{}, err
+		}
+		result, reason = userRenewal(user, keySecret)
+		return result, nil
+	}
+
 	issuingAccount := &natsv1alpha1.NatsAccount{}
 	signerSecret := &corev1.Secret{}
 	for {
@@ -108,8 +158,20 @@ func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			continue
 		}
 
-		if !slices.Contains(issuingAccount.Spec.AllowUserNamespaces, req.Namespace) {
+		if !slices.Contains(issuingAccount.Spec.AllowUserNamespaces, req.Namespace) && !isDefaultUser(issuingAccount, user) {
+			// TODO: post event to apiserver
+			reason = REASON_NAMESPACE_NOT_ALLOWED
+			return ctrl.Result{}, nil
+		}
+
+		accountSpec, err := templatedSpec(ctx, r.Client, issuingAccount)
+		if err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		if user.Spec.BearerToken && accountSpec.Limits.DisallowBearer {
 			// TODO: post event to apiserver
+			logger.Info("refusing to issue bearer token user for account disallowing bearer users", "account", issuingAccount.Name)
+			reason = REASON_BEARER_DISALLOWED
 			return ctrl.Result{}, nil
 		}
 
@@ -122,10 +184,135 @@ func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		break
 	}
 
-	_, err := r.reconcileSecret(ctx, req, user, signerSecret)
-	return ctrl.Result{}, err
+	signer := signerSecret.Data[OPERATOR_SEED_KEY]
+	if user.Spec.SigningKeySecretRef != nil {
+		seed, err := r.accountSigningKey(ctx, user, issuingAccount)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		signer = seed
+	}
+	accountClaims, _ := jwt.DecodeAccountClaims(issuingAccount.Status.JWT)
+	verify, verifyErr := r.verifier(issuingAccount.Status.PublicKey, accountClaims)
+	keySecret, err := r.reconcileSecret(ctx, req, user, issuingAccount, issuingAccount.Status.PublicKey, signer, verify)
+	if err != nil {
+		if *verifyErr != nil {
+			reason = REASON_VERIFICATION_FAILED
+		}
+		return ctrl.Result{}, err
+	}
+	result, reason = userRenewal(user, keySecret)
+	return result, nil
+}
+
+// userRenewal returns the result of issuing user, requeued in time to renew its JWT in keySecret before it expires
+func userRenewal(user *natsv1alpha1.NatsUser, keySecret *corev1.Secret) (ctrl.Result, ReconcileReason) {
+	claims, err := jwt.DecodeUserClaims(string(keySecret.Data[OPERATOR_JWT]))
+	if user.Spec.Expiry == nil || err != nil || claims.Expires == 0 {
+		return ctrl.Result{}, REASON_RECONCILED
+	}
+	return ctrl.Result{RequeueAfter: renewIn(claims.ClaimsData)}, REASON_RENEWAL_SCHEDULED
+}
+
+// verifier returns the check reconcileSecret runs on the user about to be stored, that its JWT chains to accountKey
+// or one of the signing keys of accountClaims. A failure is also kept in the returned error.
+func (r *NatsUserReconciler) verifier(accountKey string, accountClaims *jwt.AccountClaims) (func(*natsv1alpha1.NatsUser) error, *error) {
+	var failed error
+	return func(issued *natsv1alpha1.NatsUser) error {
+		if r.SkipVerification {
+			return nil
+		}
+		failed = verifyIssued("user", verifyUserLink(issued, accountKey, accountClaims))
+		return failed
+	}, &failed
 }
-func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, user *natsv1alpha1.NatsUser, signerSecret *corev1.Secret) (*corev1.Secret, error) {
+
+// revokeUser adds the key of a deleted user to the revoked users of its account, so the account is reissued
+// and republished with it revoked and NATS rejects the JWTs of the user still around.
+// Users of accounts managed outside of the cluster can't be revoked by the operator.
+func (r *NatsUserReconciler) revokeUser(ctx context.Context, user *natsv1alpha1.NatsUser) error {
+	if user.Status.PublicKey == "" || user.Spec.AccountPublicKey != "" {
+		return nil
+	}
+	account := &natsv1alpha1.NatsAccount{}
+	if err := r.Get(ctx, client.ObjectKey{
+		Namespace: user.Spec.AccountRef.Namespace,
+		Name:      user.Spec.AccountRef.Name,
+	}, account); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if account.DeletionTimestamp != nil || account.Status.PublicKey == "" {
+		// The account vanishes anyway, or never issued the user
+		return nil
+	}
+	if _, revoked := account.Status.RevokedUsers[user.Status.PublicKey]; revoked {
+		return nil
+	}
+	log.FromContext(ctx).Info("revoking deleted user in its account", "account", account.Name, "publicKey", user.Status.PublicKey)
+	if account.Status.RevokedUsers == nil {
+		account.Status.RevokedUsers = jwt.RevocationList{}
+	}
+	account.Status.RevokedUsers.Revoke(user.Status.PublicKey, time.Now())
+	// The revocation may only be pruned once the JWT it revokes expired, JWTs that can't be decoded never do
+	if claims, err := jwt.DecodeUserClaims(user.Status.JWT); err == nil && claims.Expires != 0 {
+		if account.Status.RevokedUserExpiries == nil {
+			account.Status.RevokedUserExpiries = map[string]int64{}
+		}
+		account.Status.RevokedUserExpiries[user.Status.PublicKey] = claims.Expires
+	}
+	return r.Status().Update(ctx, account)
+}
+
+// accountSigningKey returns the seed of signingKeySecretRef for users of a NatsAccount,
+// after checking it is one of the signing keys of the issued account
+func (r *NatsUserReconciler) accountSigningKey(ctx context.Context, user *natsv1alpha1.NatsUser, issuingAccount *natsv1alpha1.NatsAccount) ([]byte, error) {
+	seed, err := r.signingKeySeed(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	kp, _ := nkeys.FromSeed(seed)
+	public, _ := kp.PublicKey()
+	if public == issuingAccount.Status.PublicKey || slices.Contains(issuingAccount.Status.SigningKeys, public) {
+		return seed, nil
+	}
+	return nil, fmt.Errorf("%s is not a signing key of account %s", public, issuingAccount.Name)
+}
+
+// externalSigner returns the seed users of an account managed outside of the cluster are signed with
+func (r *NatsUserReconciler) externalSigner(ctx context.Context, user *natsv1alpha1.NatsUser) ([]byte, error) {
+	if !nkeys.IsValidPublicAccountKey(user.Spec.AccountPublicKey) {
+		return nil, fmt.Errorf("invalid account public key %q", user.Spec.AccountPublicKey)
+	}
+	if user.Spec.SigningKeySecretRef == nil {
+		return nil, fmt.Errorf("signingKeySecretRef is required for users of account %s", user.Spec.AccountPublicKey)
+	}
+	return r.signingKeySeed(ctx, user)
+}
+
+// signingKeySeed returns the account seed stored in the secret referenced by signingKeySecretRef
+func (r *NatsUserReconciler) signingKeySeed(ctx context.Context, user *natsv1alpha1.NatsUser) ([]byte, error) {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: user.Namespace, Name: user.Spec.SigningKeySecretRef.Name}, secret); err != nil {
+		return nil, err
+	}
+	seed := secret.Data[OPERATOR_SEED_KEY]
+	kp, err := nkeys.FromSeed(seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding seed of secret %s: %v", secret.Name, err)
+	}
+	if public, _ := kp.PublicKey(); !nkeys.IsValidPublicAccountKey(public) {
+		return nil, fmt.Errorf("secret %s doesn't contain an account seed", secret.Name)
+	}
+	return seed, nil
+}
+
+// reconcileSecret issues the user for the account accountPublicKey, signed with the seed signer.
+// issuingAccount is nil for accounts managed outside of the cluster.
+// Nothing is stored unless verify accepts the user as it would be stored.
+func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, user *natsv1alpha1.NatsUser, issuingAccount *natsv1alpha1.NatsAccount, accountPublicKey string, signer []byte, verify func(issued *natsv1alpha1.NatsUser) error) (*corev1.Secret, error) {
 	// Try reconcile the secret containing the seed key for the operator
 	logger := log.FromContext(ctx)
 	keySecret := &corev1.Secret{}
@@ -134,7 +321,7 @@ func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Reque
 	if err := r.Get(ctx, req.NamespacedName, keySecret); errors.IsNotFound(err) {
 		keySecret.Namespace = req.Namespace
 		keySecret.Name = req.Name
-		keySecret.Type = "deinstapel.de/nats-user"
+		keySecret.Type = USER_SECRET_TYPE
 		hasSecret = false
 		if err := controllerutil.SetOwnerReference(user, keySecret, r.Scheme); err != nil {
 			return nil, err
@@ -144,10 +331,26 @@ func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Reque
 	}
 
 	logger.Info("reconciling user keys")
-	hasChanges, err := r.reconcileKey(ctx, keySecret, user, signerSecret.Data[OPERATOR_SEED_KEY])
+	hasChanges, err := r.reconcileKey(ctx, keySecret, user, issuingAccount, accountPublicKey, signer)
 	if err != nil {
 		return nil, err
 	}
+	if applySecretTemplate(keySecret, user.Spec.SecretTemplate, USER_SECRET_COMPONENT) {
+		hasChanges = true
+	}
+	if hasSecret {
+		adopted, err := adoptSecret(user, keySecret, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		hasChanges = hasChanges || adopted
+	}
+	issued := user.DeepCopy()
+	issued.Status.PublicKey = string(keySecret.Data[OPERATOR_PUBLIC_KEY])
+	issued.Status.JWT = string(keySecret.Data[OPERATOR_JWT])
+	if err := verify(issued); err != nil {
+		return nil, err
+	}
 
 	if !hasSecret {
 		if err := r.Create(ctx, keySecret); err != nil {
@@ -171,9 +374,11 @@ func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Reque
 	return keySecret, nil
 }
 
-func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, account *natsv1alpha1.NatsUser, signer []byte) (bool, error) {
+func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, account *natsv1alpha1.NatsUser, issuingAccount *natsv1alpha1.NatsAccount, accountPublicKey string, signer []byte) (bool, error) {
 	logger := log.FromContext(ctx)
+	resolved := observePhase(USER_CONTROLLER, "resolve_key")
 	keys, needsKeyUpdate, err := extractOrCreateKeys(secret, nkeys.CreateUser)
+	resolved()
 	if err != nil {
 		return false, err
 	}
@@ -181,12 +386,29 @@ func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Se
 	seed, _ := keys.Seed()
 	public, _ := keys.PublicKey()
 
+	now := time.Now()
 	token := jwt.NewUserClaims(public)
 	token.User = account.Spec.ToNatsJWT()
+	if account.Spec.Expiry != nil {
+		token.Expires = now.Add(account.Spec.Expiry.Duration).Unix()
+	}
+	if token.Resp == nil && issuingAccount != nil {
+		// Carry the default of the account, as the defaults only apply to users without any permissions
+		token.Resp = issuingAccount.Spec.ToJWTAccount().DefaultPermissions.Resp
+	}
 	needsClaimsUpdate := secret.Data == nil
 	signerKp, err := nkeys.FromSeed(signer)
 	if err != nil {
-		return false, fmt.Errorf("failed decoding seed: %v, signer: %v", err, signer)
+		return false, fmt.Errorf("failed decoding signing key seed: %v", err)
+	}
+	if signerPublic, _ := signerKp.PublicKey(); signerPublic != accountPublicKey {
+		// Signed with a signing key, NATS needs to know which account it belongs to
+		token.IssuerAccount = accountPublicKey
+		if issuingAccount != nil && isScopedSigner(issuingAccount, signerPublic) {
+			// NATS applies the template of the scope and rejects scoped users with permissions or limits of their own
+			logger.Info("issuing user without permissions and limits of its own for scoped signing key", "signingKey", signerPublic)
+			token.UserPermissionLimits = jwt.UserPermissionLimits{}
+		}
 	}
 
 	if secret.Data != nil {
@@ -195,6 +417,8 @@ func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Se
 			needsClaimsUpdate = needsClaimsUpdate || !reflect.DeepEqual(token.User, oldToken.User)
 			// Check if the signing keys changed
 			needsClaimsUpdate = needsClaimsUpdate || oldToken.Issuer != token.Issuer
+			needsClaimsUpdate = needsClaimsUpdate || oldToken.IssuerAccount != token.IssuerAccount
+			needsClaimsUpdate = needsClaimsUpdate || needsRenewal(oldToken.ClaimsData, account.Spec.Expiry, now)
 		} else {
 			// Claims could not be decoded, need update.
 			needsClaimsUpdate = true
@@ -211,7 +435,9 @@ func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Se
 		secret.Data[OPERATOR_PUBLIC_KEY] = []byte(public)
 	}
 	if needsKeyUpdate || needsClaimsUpdate {
+		signed := observePhase(USER_CONTROLLER, "sign")
 		jwt, err := token.Encode(signerKp)
+		signed()
 		if err != nil {
 			logger.Info("token encode error", "pubkey", token.Subject, "public", public)
 			return false, err
@@ -222,9 +448,20 @@ func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Se
 	return needsKeyUpdate || needsClaimsUpdate, nil
 }
 
+// isScopedSigner reports whether signingKey is a scoped signing key in the issued JWT of account
+func isScopedSigner(account *natsv1alpha1.NatsAccount, signingKey string) bool {
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		return false
+	}
+	scope, _ := claims.SigningKeys.GetScope(signingKey)
+	return scope != nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *NatsUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&natsv1alpha1.NatsUser{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
@@ -0,0 +1,386 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func newTestUser(name, account string) *natsv1alpha1.NatsUser {
+	return &natsv1alpha1.NatsUser{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec: natsv1alpha1.NatsUserSpec{
+			AccountRef: corev1.ObjectReference{Namespace: testNamespace, Name: account},
+		},
+	}
+}
+
+// newTestUserReconciler returns a user reconciler sharing the client of an account reconciler,
+// which already issued the given accounts.
+func newTestUserReconciler(g *WithT, accounts []*natsv1alpha1.NatsAccount, objs ...client.Object) *NatsUserReconciler {
+	for _, account := range accounts {
+		account.Spec.AllowUserNamespaces = []string{testNamespace}
+		objs = append(objs, account)
+	}
+	ar := newTestAccountReconciler(g, objs...)
+	for _, account := range accounts {
+		reconcileAccount(g, ar, account.Name)
+	}
+	return &NatsUserReconciler{Client: ar.Client, Scheme: ar.Scheme}
+}
+
+func reconcileUser(g *WithT, r *NatsUserReconciler, name string) *natsv1alpha1.NatsUser {
+	ctx := context.Background()
+	key := client.ObjectKey{Namespace: testNamespace, Name: name}
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	user := &natsv1alpha1.NatsUser{}
+	g.Expect(r.Get(ctx, key, user)).To(Succeed())
+	return user
+}
+
+func TestBearerUserRejectedForDisallowingAccount(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.Limits.DisallowBearer = true
+	bearer := newTestUser("bearer", "app")
+	bearer.Spec.BearerToken = true
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{account}, bearer, newTestUser("regular", "app"))
+
+	user := reconcileUser(g, r, "bearer")
+	g.Expect(user.Status.JWT).To(BeEmpty())
+	err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "bearer"}, &corev1.Secret{})
+	g.Expect(errors.IsNotFound(err)).To(BeTrue())
+
+	user = reconcileUser(g, r, "regular")
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.BearerToken).To(BeFalse())
+}
+
+func TestUserInheritsDefaultResponsePermission(t *testing.T) {
+	g := NewWithT(t)
+	account := newTestAccount("app")
+	account.Spec.DefaultPermissions.Resp = &natsv1alpha1.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}
+	explicit := newTestUser("explicit", "app")
+	explicit.Spec.Permissions.Resp = &natsv1alpha1.ResponsePermission{MaxMsgs: 5}
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{account, newTestAccount("plain")},
+		newTestUser("inheriting", "app"), explicit, newTestUser("none", "plain"))
+
+	issued := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "app"}, issued)).To(Succeed())
+	accountClaims, err := jwt.DecodeAccountClaims(issued.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(accountClaims.DefaultPermissions.Resp).To(Equal(&jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}))
+
+	user := reconcileUser(g, r, "inheriting")
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Resp).To(Equal(&jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}))
+
+	user = reconcileUser(g, r, "explicit")
+	claims, err = jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Resp).To(Equal(&jwt.ResponsePermission{MaxMsgs: 5}))
+
+	// Without a default of the account, users without a response permission don't get one
+	user = reconcileUser(g, r, "none")
+	claims, err = jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Resp).To(BeNil())
+}
+
+func TestUserSubscriptionLimit(t *testing.T) {
+	g := NewWithT(t)
+	limited := newTestUser("limited", "app")
+	limited.Spec.Limits.Subs = 5
+	unlimited := newTestUser("unlimited", "app")
+	unlimited.Spec.Limits.Subs = jwt.NoLimit
+	invalid := newTestUser("invalid", "app")
+	invalid.Spec.Limits.Subs = -2
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")}, limited, unlimited, invalid)
+
+	user := reconcileUser(g, r, "limited")
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Subs).To(BeEquivalentTo(5))
+
+	user = reconcileUser(g, r, "unlimited")
+	claims, err = jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Limits.Subs).To(BeEquivalentTo(jwt.NoLimit))
+
+	// Limits below -1 aren't issued
+	user = reconcileUser(g, r, "invalid")
+	g.Expect(user.Status.JWT).To(BeEmpty())
+}
+
+func TestSecretTemplate(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	account := newTestAccount("app")
+	account.Spec.SecretTemplate.Labels = map[string]string{"team": "platform"}
+	user := newTestUser("backend", "app")
+	user.Spec.SecretTemplate = natsv1alpha1.SecretTemplate{
+		Labels: map[string]string{
+			"team":                  "platform",
+			SECRET_MANAGED_BY_LABEL: "someone-else",
+		},
+		Annotations: map[string]string{"reflector.example.com/allowed-namespaces": "apps"},
+	}
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{account}, user)
+
+	secret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "app"}, secret)).To(Succeed())
+	g.Expect(secret.Labels).To(Equal(map[string]string{
+		"team":                  "platform",
+		SECRET_MANAGED_BY_LABEL: SECRET_MANAGED_BY,
+		SECRET_COMPONENT_LABEL:  ACCOUNT_SECRET_COMPONENT,
+	}))
+
+	user = reconcileUser(g, r, "backend")
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: user.Status.UserSecretName}, secret)).To(Succeed())
+	g.Expect(secret.Labels).To(Equal(map[string]string{
+		"team":                  "platform",
+		SECRET_MANAGED_BY_LABEL: SECRET_MANAGED_BY,
+		SECRET_COMPONENT_LABEL:  USER_SECRET_COMPONENT,
+	}))
+	g.Expect(secret.Annotations).To(HaveKeyWithValue("reflector.example.com/allowed-namespaces", "apps"))
+
+	// Changes of the template are applied to the existing secret
+	user.Spec.SecretTemplate.Labels["team"] = "payments"
+	g.Expect(r.Update(ctx, user)).To(Succeed())
+	reconcileUser(g, r, "backend")
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: user.Status.UserSecretName}, secret)).To(Succeed())
+	g.Expect(secret.Labels).To(HaveKeyWithValue("team", "payments"))
+}
+
+func TestUserAccountReference(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	external, _ := nkeys.CreateAccount()
+	externalPublic, _ := external.PublicKey()
+	externalSeed, _ := external.Seed()
+	signingKey, _ := nkeys.CreateAccount()
+	signingPublic, _ := signingKey.PublicKey()
+	signingSeed, _ := signingKey.Seed()
+	userKey, _ := nkeys.CreateUser()
+	userSeed, _ := userKey.Seed()
+	seedSecret := func(name string, seed []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+			Data:       map[string][]byte{OPERATOR_SEED_KEY: seed},
+		}
+	}
+	externalUser := func(name, secret string) *natsv1alpha1.NatsUser {
+		user := newTestUser(name, "")
+		user.Spec.AccountPublicKey = externalPublic
+		if secret != "" {
+			user.Spec.SigningKeySecretRef = &corev1.LocalObjectReference{Name: secret}
+		}
+		return user
+	}
+
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")},
+		newTestUser("by-name", "app"),
+		seedSecret("external-account", externalSeed),
+		seedSecret("external-signing-key", signingSeed),
+		seedSecret("user-seed", userSeed),
+		externalUser("by-account-seed", "external-account"),
+		externalUser("by-signing-key", "external-signing-key"),
+		externalUser("without-secret", ""),
+		externalUser("by-user-seed", "user-seed"),
+	)
+
+	// By name, the user is signed with the key of the referenced account
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "app"}, account)).To(Succeed())
+	claims, err := jwt.DecodeUserClaims(reconcileUser(g, r, "by-name").Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Issuer).To(Equal(account.Status.PublicKey))
+	g.Expect(claims.IssuerAccount).To(BeEmpty())
+
+	// By public key, the user is signed with the provided seed
+	claims, err = jwt.DecodeUserClaims(reconcileUser(g, r, "by-account-seed").Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Issuer).To(Equal(externalPublic))
+	g.Expect(claims.IssuerAccount).To(BeEmpty())
+
+	claims, err = jwt.DecodeUserClaims(reconcileUser(g, r, "by-signing-key").Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Issuer).To(Equal(signingPublic))
+	g.Expect(claims.IssuerAccount).To(Equal(externalPublic))
+
+	for _, name := range []string{"without-secret", "by-user-seed"} {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: name}})
+		g.Expect(err).To(HaveOccurred(), name)
+		err = r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: name}, &corev1.Secret{})
+		g.Expect(errors.IsNotFound(err)).To(BeTrue(), name)
+	}
+}
+
+func TestUserSignedWithScopedSigningKey(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	h := runResolverHarness(g, t)
+	scoped, _ := nkeys.CreateAccount()
+	scopedPublic, _ := scoped.PublicKey()
+	scopedSeed, _ := scoped.Seed()
+
+	account := newTestAccount("app")
+	account.Spec.Limits.NatsLimits = natsv1alpha1.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: byteLimit("-1")}
+	account.Spec.Limits.Conn = jwt.NoLimit
+	account.Spec.ScopedSigningKeys = []natsv1alpha1.ScopedSigningKey{{
+		Key:  natsv1alpha1.AccountPublicKey(scopedPublic),
+		Role: "limited",
+		Template: natsv1alpha1.UserTemplate{
+			Limits:                 natsv1alpha1.Limits{NatsLimits: jwt.NatsLimits{Subs: 2, Data: jwt.NoLimit, Payload: jwt.NoLimit}},
+			AllowedConnectionTypes: []natsv1alpha1.ConnectionType{jwt.ConnectionTypeStandard},
+		},
+	}}
+	account = h.createAccount(g, account)
+	g.Expect(account.Status.SigningKeys).To(ContainElement(scopedPublic))
+
+	g.Expect(h.Users.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "scoped-key"},
+		Data:       map[string][]byte{OPERATOR_SEED_KEY: scopedSeed},
+	})).To(Succeed())
+	user := newUnlimitedTestUser("scoped", "app")
+	user.Spec.SigningKeySecretRef = &corev1.LocalObjectReference{Name: "scoped-key"}
+	nc := h.connectUser(g, t, user)
+
+	g.Expect(h.Users.Get(ctx, client.ObjectKeyFromObject(user), user)).To(Succeed())
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Issuer).To(Equal(scopedPublic))
+	g.Expect(claims.IssuerAccount).To(Equal(account.Status.PublicKey))
+	g.Expect(claims.HasEmptyPermissions()).To(BeTrue())
+
+	// The limits of the scope apply to the connection instead of the unlimited ones of the user
+	for _, subject := range []string{"a", "b"} {
+		_, err := nc.SubscribeSync(subject)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.Expect(nc.Flush()).To(Succeed())
+	_, err = nc.SubscribeSync("c")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(nc.Flush()).NotTo(Succeed())
+	g.Expect(nc.LastError()).To(MatchError(ContainSubstring("maximum subscriptions exceeded")))
+}
+
+func TestUserRejectsUnknownSigningKey(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	other, _ := nkeys.CreateAccount()
+	otherSeed, _ := other.Seed()
+	user := newTestUser("user", "app")
+	user.Spec.SigningKeySecretRef = &corev1.LocalObjectReference{Name: "other-key"}
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")}, user, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "other-key"},
+		Data:       map[string][]byte{OPERATOR_SEED_KEY: otherSeed},
+	})
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(user)})
+	g.Expect(err).To(MatchError(ContainSubstring("is not a signing key of account app")))
+}
+
+func TestUserExpiry(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	user := newTestUser("expiring", "app")
+	user.Spec.Expiry = &metav1.Duration{Duration: time.Hour}
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")}, user)
+	key := client.ObjectKey{Namespace: testNamespace, Name: "expiring"}
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.Get(ctx, key, user)).To(Succeed())
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Expires).To(BeNumerically("~", time.Now().Add(time.Hour).Unix(), 2))
+	// Requeued to renew the JWT once two thirds of its validity elapsed
+	g.Expect(res.RequeueAfter).To(BeNumerically("~", 40*time.Minute, time.Minute))
+
+	// Unchanged users aren't signed again before then
+	renewed := reconcileUser(g, r, "expiring")
+	g.Expect(renewed.Status.JWT).To(Equal(user.Status.JWT))
+
+	user.Spec.Expiry.Duration = -time.Hour
+	g.Expect(user.Spec.Validate()).NotTo(Succeed())
+}
+
+func TestUserDeletionRevokesUser(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	h := runResolverHarness(g, t)
+	account := newTestAccount("app")
+	account.Spec.Limits.NatsLimits = natsv1alpha1.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: byteLimit("-1")}
+	account.Spec.Limits.Conn = jwt.NoLimit
+	h.createAccount(g, account)
+	h.connectUser(g, t, newUnlimitedTestUser("staying", "app"))
+	h.connectUser(g, t, newUnlimitedTestUser("leaving", "app"))
+
+	key := client.ObjectKey{Namespace: testNamespace, Name: "leaving"}
+	leaving := &natsv1alpha1.NatsUser{}
+	g.Expect(h.Users.Get(ctx, key, leaving)).To(Succeed())
+	secret := &corev1.Secret{}
+	g.Expect(h.Users.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: leaving.Status.UserSecretName}, secret)).To(Succeed())
+
+	// The finalizer revokes the user in its account before letting it go
+	g.Expect(h.Users.Delete(ctx, leaving)).To(Succeed())
+	_, err := h.Users.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(errors.IsNotFound(h.Users.Get(ctx, key, leaving))).To(BeTrue())
+
+	account, _ = reconcileAccount(g, h.Accounts, "app")
+	g.Expect(account.Status.RevokedUsers).To(HaveKey(leaving.Status.PublicKey))
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Revocations).To(HaveKey(leaving.Status.PublicKey))
+
+	_, err = h.AccountServer.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(h.AccountServer.lookupAccount(account.Status.PublicKey).JWT).To(Equal(account.Status.JWT))
+
+	// NATS got the republished account, so the credentials that are still around are rejected
+	_, err = nats.Connect(h.ClientURL(), nats.UserJWTAndSeed(string(secret.Data[OPERATOR_JWT]), string(secret.Data[OPERATOR_SEED_KEY])))
+	g.Expect(err).To(HaveOccurred())
+	connz, err := h.Connz(&server.ConnzOptions{Account: account.Status.PublicKey})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(connz.Conns).To(HaveLen(1))
+
+	// Deleting the user again doesn't revoke it anew
+	revokedAt := account.Status.RevokedUsers[leaving.Status.PublicKey]
+	g.Expect(h.Users.revokeUser(ctx, leaving)).To(Succeed())
+	g.Expect(h.Accounts.Get(ctx, client.ObjectKeyFromObject(account), account)).To(Succeed())
+	g.Expect(account.Status.RevokedUsers[leaving.Status.PublicKey]).To(Equal(revokedAt))
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+//+kubebuilder:webhook:path=/validate-nats-deinstapel-de-v1alpha1-natsuser,mutating=false,failurePolicy=fail,sideEffects=None,groups=nats.deinstapel.de,resources=natsusers,verbs=create;update,versions=v1alpha1,name=vnatsuser.kb.io,admissionReviewVersions=v1
+
+// NatsUserValidator rejects NatsUsers at admission that the user reconciler would refuse to issue,
+// so the author gets the error right away instead of a user that is never issued.
+type NatsUserValidator struct {
+	Client client.Reader
+}
+
+var _ webhook.CustomValidator = &NatsUserValidator{}
+
+// SetupWebhookWithManager registers the validating webhook for NatsUsers with the webhook server of mgr
+func (v *NatsUserValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&natsv1alpha1.NatsUser{}).
+		WithValidator(v).
+		Complete()
+}
+
+func (v *NatsUserValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	return v.validate(ctx, obj.(*natsv1alpha1.NatsUser))
+}
+
+func (v *NatsUserValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	return v.validate(ctx, newObj.(*natsv1alpha1.NatsUser))
+}
+
+func (v *NatsUserValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+// validate rejects invalid limits and bearer token users of accounts disallowing bearer tokens.
+// Users of accounts that don't exist yet are admitted, the reconciler checks them once the account is created.
+func (v *NatsUserValidator) validate(ctx context.Context, user *natsv1alpha1.NatsUser) error {
+	if err := user.Spec.Validate(); err != nil {
+		return err
+	}
+	if !user.Spec.BearerToken || user.Spec.AccountPublicKey != "" {
+		return nil
+	}
+	account := &natsv1alpha1.NatsAccount{}
+	if err := v.Client.Get(ctx, client.ObjectKey{
+		Namespace: user.Spec.AccountRef.Namespace,
+		Name:      user.Spec.AccountRef.Name,
+	}, account); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	spec, err := templatedSpec(ctx, v.Client, account)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if spec.Limits.DisallowBearer {
+		return fmt.Errorf("account %s/%s disallows bearer tokens, bearer_token can't be set for its users", account.Namespace, account.Name)
+	}
+	return nil
+}
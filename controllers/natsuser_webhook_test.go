@@ -0,0 +1,61 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestNatsUserValidatorBearerToken(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	strict := newTestAccount("strict")
+	strict.Spec.Limits.DisallowBearer = true
+	v := &NatsUserValidator{
+		Client: fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(strict, newTestAccount("open")).Build(),
+	}
+	bearerUser := func(account string) *natsv1alpha1.NatsUser {
+		user := newTestUser("user", account)
+		user.Spec.BearerToken = true
+		return user
+	}
+
+	g.Expect(v.ValidateCreate(ctx, bearerUser("strict"))).To(MatchError("account nats/strict disallows bearer tokens, bearer_token can't be set for its users"))
+	g.Expect(v.ValidateUpdate(ctx, newTestUser("user", "strict"), bearerUser("strict"))).To(HaveOccurred())
+
+	g.Expect(v.ValidateCreate(ctx, newTestUser("user", "strict"))).To(Succeed())
+	g.Expect(v.ValidateCreate(ctx, bearerUser("open"))).To(Succeed())
+	// The reconciler checks users of accounts created later
+	g.Expect(v.ValidateCreate(ctx, bearerUser("missing"))).To(Succeed())
+	g.Expect(v.ValidateDelete(ctx, bearerUser("strict"))).To(Succeed())
+}
+
+func TestNatsUserValidatorSubscriptionLimit(t *testing.T) {
+	g := NewWithT(t)
+	v := &NatsUserValidator{Client: fake.NewClientBuilder().WithScheme(newTestScheme(g)).Build()}
+	user := newTestUser("user", "app")
+	user.Spec.Limits.Subs = -2
+	g.Expect(v.ValidateCreate(context.Background(), user)).To(MatchError("limits.subs -2 needs to be non negative, or -1 for no limit"))
+	user.Spec.Limits.Subs = -1
+	g.Expect(v.ValidateCreate(context.Background(), user)).To(Succeed())
+}
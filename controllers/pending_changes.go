@@ -0,0 +1,147 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// reconcilePendingChanges reflects the changes of the spec of the account that its issued JWT doesn't carry yet
+// in the account status, e.g. as the spec is invalid or the key of the operator is unavailable.
+// Accounts without an issued JWT have nothing to compare against and are left alone.
+func (r *NatsAccountReconciler) reconcilePendingChanges(ctx context.Context, key types.NamespacedName) error {
+	account := &natsv1alpha1.NatsAccount{}
+	if err := r.Get(ctx, key, account); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	issued, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		return nil
+	}
+	spec, err := templatedSpec(ctx, r.Client, account)
+	if err != nil {
+		// Without its template the desired claims are unknown, the Invalid condition explains why
+		return client.IgnoreNotFound(err)
+	}
+	condition := metav1.Condition{
+		Type:               CONDITION_PENDING_CHANGES,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Issued",
+		Message:            "the issued JWT matches the spec",
+		ObservedGeneration: account.Generation,
+	}
+	spec.Revocations = accountRevocations(account)
+	if changes := pendingChanges(spec, issued); len(changes) > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "SpecChanged"
+		condition.Message = "spec changes not issued yet: " + strings.Join(changes, ", ")
+	}
+	return r.updateCondition(ctx, account, condition)
+}
+
+// pendingChanges summarizes how spec, the templated spec of an account with the revocations to issue, differs from
+// the issued claims, e.g. "exports 1 -> 2". Connection limits derived from the connection pool or the users of the
+// account aren't compared, as the spec doesn't hold their resolved value.
+func pendingChanges(spec natsv1alpha1.NatsAccountSpec, issued *jwt.AccountClaims) []string {
+	desired := spec.ToJWTAccount()
+	// Encoding sorts the imports and exports, so the issued ones are in that order
+	sort.Sort(desired.Imports)
+	sort.Sort(desired.Exports)
+
+	changes := []string{}
+	add := func(name string, desired, issued interface{}, desiredLen, issuedLen int) {
+		switch {
+		case desiredLen != issuedLen:
+			changes = append(changes, fmt.Sprintf("%s %d -> %d", name, issuedLen, desiredLen))
+		case desiredLen > 0 && !jsonEqual(desired, issued):
+			changes = append(changes, name+" changed")
+		}
+	}
+	add("imports", desired.Imports, issued.Imports, len(desired.Imports), len(issued.Imports))
+	add("exports", desired.Exports, issued.Exports, len(desired.Exports), len(issued.Exports))
+	add("signing keys", desired.SigningKeys, issued.SigningKeys, len(desired.SigningKeys), len(issued.SigningKeys))
+	add("revocations", desired.Revocations, issued.Revocations, len(desired.Revocations), len(issued.Revocations))
+	if !jsonEqual(desired.DefaultPermissions, issued.DefaultPermissions) {
+		changes = append(changes, "default permissions changed")
+	}
+
+	skip := map[string]bool{
+		"conn": spec.Limits.ConnPercent != 0 || spec.Limits.ConnPerUser != 0,
+		"leaf": spec.Limits.LeafNodeConnPercent != 0,
+	}
+	return append(changes, limitChanges(desired.Limits, issued.Limits, skip)...)
+}
+
+// limitChanges lists the limits that differ between desired and issued by their JSON name, e.g. "subs 10 -> 20".
+// Limits omitted from the JSON, as they are zero, are shown as unset.
+func limitChanges(desired, issued jwt.OperatorLimits, skip map[string]bool) []string {
+	desiredFields, issuedFields := jsonFields(desired), jsonFields(issued)
+	names := []string{}
+	for name := range desiredFields {
+		names = append(names, name)
+	}
+	for name := range issuedFields {
+		if _, ok := desiredFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []string{}
+	for _, name := range names {
+		want, have := desiredFields[name], issuedFields[name]
+		if skip[name] || bytes.Equal(want, have) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s %s -> %s", name, jsonValue(have), jsonValue(want)))
+	}
+	return changes
+}
+
+// jsonFields splits the JSON encoding of v into its fields
+func jsonFields(v interface{}) map[string]json.RawMessage {
+	fields := map[string]json.RawMessage{}
+	if encoded, err := json.Marshal(v); err == nil {
+		_ = json.Unmarshal(encoded, &fields)
+	}
+	return fields
+}
+
+func jsonValue(value json.RawMessage) string {
+	if value == nil {
+		return "unset"
+	}
+	return string(value)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
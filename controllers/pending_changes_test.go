@@ -0,0 +1,63 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestAccountPendingChanges(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	account := newTestAccount("app")
+	account.Spec.Exports = []natsv1alpha1.Export{{Subject: "orders.>", Type: jwt.Stream}}
+	account.Spec.Limits.Subs = 100
+	account.Spec.Limits.DiskStorage = byteLimit("1Gi")
+	r := newTestAccountReconciler(g, account)
+
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_PENDING_CHANGES)).To(BeFalse())
+
+	// Without the key of the operator the changed spec can't be issued, which is shown until it is
+	operatorSecret := &corev1.Secret{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	g.Expect(r.Delete(ctx, operatorSecret)).To(Succeed())
+	account.Spec.Exports = append(account.Spec.Exports, natsv1alpha1.Export{Subject: "billing.>", Type: jwt.Service})
+	account.Spec.Limits.Subs = 200
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+
+	account, _ = reconcileAccount(g, r, "app")
+	condition := meta.FindStatusCondition(account.Status.Conditions, CONDITION_PENDING_CHANGES)
+	g.Expect(condition).NotTo(BeNil())
+	g.Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(condition.Message).To(Equal("spec changes not issued yet: exports 1 -> 2, subs 100 -> 200"))
+
+	operatorSecret.ResourceVersion = ""
+	g.Expect(r.Create(ctx, operatorSecret)).To(Succeed())
+	account, _ = reconcileAccount(g, r, "app")
+	g.Expect(meta.IsStatusConditionFalse(account.Status.Conditions, CONDITION_PENDING_CHANGES)).To(BeTrue())
+}
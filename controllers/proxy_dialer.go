@@ -0,0 +1,105 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"golang.org/x/net/proxy"
+)
+
+// NewProxyDialer returns a dialer connecting to NATS through the proxy at rawURL.
+// Supported are SOCKS5 proxies (socks5://, socks5h://) and HTTP proxies allowing CONNECT (http://),
+// credentials are taken from the user info of the URL.
+func NewProxyDialer(rawURL string) (nats.CustomDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy url %q needs a host and port", u.Redacted())
+	}
+	forward := &net.Dialer{Timeout: nats.DefaultTimeout}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return proxy.FromURL(u, forward)
+	case "http":
+		return &httpConnectDialer{proxy: u, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use socks5, socks5h or http", u.Scheme)
+	}
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with the CONNECT method
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward *net.Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	// Don't hang on a proxy accepting the connection but never answering
+	conn.SetDeadline(time.Now().Add(d.forward.Timeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	// The NATS server greets right away, so its INFO may already be buffered
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads from reader first, which wraps the connection itself
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
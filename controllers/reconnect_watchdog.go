@@ -0,0 +1,61 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/nats-io/nats.go"
+)
+
+// watchReconnecting replaces the NATS connection with a freshly dialed one once it keeps reconnecting for longer
+// than ReconnectingTimeout, e.g. as the client got stuck in its reconnect loop. It checks four times per timeout.
+// A failed dial keeps the reconnecting connection, and is retried with the next check.
+func (r *NatsAccountServer) watchReconnecting(ctx context.Context, logger logr.Logger) {
+	ticker := time.NewTicker(r.ReconnectingTimeout / 4)
+	defer ticker.Stop()
+
+	var watched *nats.Conn
+	var since time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		nc, _ := r.conn()
+		if nc != watched || !nc.IsReconnecting() {
+			watched = nc
+			since = time.Time{}
+		}
+		if !nc.IsReconnecting() {
+			continue
+		}
+		if since.IsZero() {
+			since = time.Now()
+		}
+		if time.Since(since) < r.ReconnectingTimeout {
+			continue
+		}
+		logger.Info("WARNING: nats connection keeps reconnecting, dialing a new connection", "since", since)
+		if err := r.reconnect(logger); err != nil {
+			logger.Error(err, "failed to dial a new nats connection")
+		}
+	}
+}
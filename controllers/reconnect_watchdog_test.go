@@ -0,0 +1,59 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/gomega"
+)
+
+func TestAccountServerRedialsStuckConnection(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+	port := s.Addr().(*net.TCPAddr).Port
+
+	r := NewAccountServer()
+	r.CredentialsWatchInterval = 0
+	r.ReconnectingTimeout = 200 * time.Millisecond
+	r.warmed.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The client won't retry on its own before the test ends, so only a new connection recovers
+	stuck := NatsConnConfig{ReconnectDelay: func(int) time.Duration { return time.Hour }}
+	go r.Run(ctx, s.ClientURL(), "", NatsTlsConfig{}, stuck)
+	g.Eventually(func() bool { return r.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+	first, _ := r.conn()
+
+	s.Shutdown()
+	g.Eventually(first.IsReconnecting, 5*time.Second).Should(BeTrue())
+	startTestNatsServer(t, &server.Options{Host: "127.0.0.1", Port: port})
+
+	g.Eventually(func() *nats.Conn {
+		nc, _ := r.conn()
+		return nc
+	}, 5*time.Second).ShouldNot(BeIdenticalTo(first))
+	second, _ := r.conn()
+	g.Expect(second.IsConnected()).To(BeTrue())
+	g.Expect(first.IsClosed()).To(BeTrue())
+	g.Eventually(func() bool { return r.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+}
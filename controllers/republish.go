@@ -0,0 +1,152 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/nats-io/jwt/v2"
+)
+
+// publishOrder sorts the public keys of accounts for pushing them all to NATS.
+// The system account goes first, followed by all other accounts with every exporter before the accounts
+// importing from it. Accounts are ordered by public key otherwise, including those in import cycles.
+func publishOrder(accounts map[string]servedAccount, system string) []string {
+	// importers maps every account to the accounts importing from it, pending counts the exporters not published yet
+	importers := map[string][]string{}
+	pending := map[string]int{}
+	for publicKey, account := range accounts {
+		pending[publicKey] = 0
+		claims, err := jwt.DecodeAccountClaims(account.JWT)
+		if err != nil {
+			continue
+		}
+		exporters := map[string]struct{}{}
+		for _, imp := range claims.Imports {
+			if _, ok := accounts[imp.Account]; ok && imp.Account != publicKey {
+				exporters[imp.Account] = struct{}{}
+			}
+		}
+		for exporter := range exporters {
+			importers[exporter] = append(importers[exporter], publicKey)
+		}
+		pending[publicKey] = len(exporters)
+	}
+
+	order := make([]string, 0, len(accounts))
+	publish := func(publicKey string) {
+		order = append(order, publicKey)
+		delete(pending, publicKey)
+		for _, importer := range importers[publicKey] {
+			if _, ok := pending[importer]; ok {
+				pending[importer]--
+			}
+		}
+	}
+	if _, ok := pending[system]; ok {
+		publish(system)
+	}
+	for len(pending) > 0 {
+		ready := []string{}
+		for publicKey, exporters := range pending {
+			if exporters == 0 {
+				ready = append(ready, publicKey)
+			}
+		}
+		if len(ready) == 0 {
+			// Only cycles are left, break them up by public key
+			for publicKey := range pending {
+				ready = append(ready, publicKey)
+			}
+			sort.Strings(ready)
+			ready = ready[:1]
+		}
+		sort.Strings(ready)
+		for _, publicKey := range ready {
+			publish(publicKey)
+		}
+	}
+	return order
+}
+
+// republishInBackground republishes all accounts without blocking the caller, e.g. a NATS connection callback
+func (r *NatsAccountServer) republishInBackground(ctx context.Context, logger logr.Logger) {
+	go func() {
+		if err := r.RepublishAccounts(ctx, logger); err != nil {
+			logger.Error(err, "failed to republish accounts")
+		}
+	}()
+}
+
+// republishPeriodically republishes all accounts every RepublishInterval, unless publishing is suspended
+// by the circuit breaker. A republish taking longer than the interval skips the ticks missed meanwhile.
+func (r *NatsAccountServer) republishPeriodically(ctx context.Context, logger logr.Logger) {
+	ticker := time.NewTicker(r.RepublishInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if r.PublishBreaker.IsOpen() {
+			logger.Info("skipping periodic republish, publishing is suspended")
+			continue
+		}
+		if err := r.RepublishAccounts(ctx, logger); err != nil {
+			logger.Error(err, "failed to republish accounts periodically")
+		}
+	}
+}
+
+// RepublishAccounts pushes the claims of all served accounts to NATS again, in the order of publishOrder.
+// Static account JWTs are included, unless a NatsAccount is served for them.
+// Accounts failing to publish don't stop the others, the returned error summarizes the failures.
+func (r *NatsAccountServer) RepublishAccounts(ctx context.Context, logger logr.Logger) error {
+	accounts := r.servedAccounts()
+	r.accountLock.RLock()
+	system := r.systemAccount
+	for publicKey, token := range r.staticAccounts {
+		if _, ok := accounts[publicKey]; ok {
+			continue
+		}
+		// Static JWTs may be operator JWTs as well, which aren't published
+		if _, err := jwt.DecodeAccountClaims(token); err == nil {
+			accounts[publicKey] = servedAccount{JWT: token}
+		}
+	}
+	r.accountLock.RUnlock()
+
+	failed := 0
+	var lastErr error
+	for _, publicKey := range publishOrder(accounts, system) {
+		if _, _, err := r.publishAccount(ctx, publicKey, accounts[publicKey].JWT); err != nil {
+			logger.Info("failed to republish claims", "account", accounts[publicKey].Owner, "publicKey", publicKey, "err", err)
+			failed++
+			lastErr = err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to republish %d of %d accounts, last error: %v", failed, len(accounts), lastErr)
+	}
+	return nil
+}
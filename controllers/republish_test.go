@@ -0,0 +1,153 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+)
+
+// newSortedAccountKeys returns the public keys of n new accounts in ascending order
+func newSortedAccountKeys(n int) []string {
+	keys := []string{}
+	for i := 0; i < n; i++ {
+		kp, _ := nkeys.CreateAccount()
+		public, _ := kp.PublicKey()
+		keys = append(keys, public)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// importingAccountJWT issues an account JWT for publicKey importing a stream from each of the exporters
+func importingAccountJWT(g *WithT, publicKey string, exporters ...string) string {
+	operator, _ := nkeys.CreateOperator()
+	claims := jwt.NewAccountClaims(publicKey)
+	for _, exporter := range exporters {
+		claims.Imports.Add(&jwt.Import{Account: exporter, Subject: jwt.Subject("events." + exporter), Type: jwt.Stream})
+	}
+	token, err := claims.Encode(operator)
+	g.Expect(err).NotTo(HaveOccurred())
+	return token
+}
+
+func TestPublishOrder(t *testing.T) {
+	g := NewWithT(t)
+	// Ordered by public key, the importer comes before its exporter and the system account last
+	keys := newSortedAccountKeys(6)
+	importer, exporter, cycleA, cycleB, unrelated, system := keys[0], keys[1], keys[2], keys[3], keys[4], keys[5]
+	accounts := map[string]servedAccount{
+		importer:  {JWT: importingAccountJWT(g, importer, exporter, unrelated)},
+		exporter:  {JWT: importingAccountJWT(g, exporter)},
+		cycleA:    {JWT: importingAccountJWT(g, cycleA, cycleB)},
+		cycleB:    {JWT: importingAccountJWT(g, cycleB, cycleA)},
+		unrelated: {JWT: "invalid"},
+		system:    {JWT: importingAccountJWT(g, system)},
+	}
+
+	g.Expect(publishOrder(accounts, system)).To(Equal([]string{system, exporter, unrelated, importer, cycleA, cycleB}))
+	// Without a known system account it is ordered like any other account
+	g.Expect(publishOrder(accounts, "")).To(Equal([]string{exporter, unrelated, system, importer, cycleA, cycleB}))
+}
+
+func TestRepublishAccountsExporterFirst(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	updates := make(chan string, 10)
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		claims, err := jwt.DecodeAccountClaims(string(msg.Data))
+		if err == nil {
+			updates <- claims.Subject
+		}
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	keys := newSortedAccountKeys(3)
+	importer, exporter, system := keys[0], keys[1], keys[2]
+	r := newTestAccountServer(g, t, s)
+	r.serveAccount(importer, servedAccount{JWT: importingAccountJWT(g, importer, exporter)})
+	r.serveAccount(exporter, servedAccount{JWT: importingAccountJWT(g, exporter)})
+	r.staticAccounts = map[string]string{system: importingAccountJWT(g, system)}
+	r.systemAccount = system
+
+	a := &AdminServer{AccountServer: r, Token: "secret"}
+	g.Expect(adminRequest(a, http.MethodGet, "/accounts/resync", "secret").Code).To(Equal(http.StatusMethodNotAllowed))
+	g.Expect(adminRequest(a, http.MethodPost, "/accounts/resync", "secret").Code).To(Equal(http.StatusNoContent))
+	g.Expect(updates).To(HaveLen(3))
+	g.Expect([]string{<-updates, <-updates, <-updates}).To(Equal([]string{system, exporter, importer}))
+}
+
+func TestRepublishPeriodically(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestNatsServer(t)
+
+	updates := make(chan string, 100)
+	responder := connectTestNats(t, s)
+	_, err := responder.Subscribe(CLAIMS_UPDATE_SUBJECT, func(msg *nats.Msg) {
+		claims, err := jwt.DecodeAccountClaims(string(msg.Data))
+		if err == nil {
+			updates <- claims.Subject
+		}
+		msg.Respond([]byte(`{"data":{"code":200}}`))
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(responder.Flush()).To(Succeed())
+
+	keys := newSortedAccountKeys(2)
+	importer, exporter := keys[0], keys[1]
+	r := NewAccountServer()
+	r.CredentialsWatchInterval = 0
+	r.RepublishInterval = 100 * time.Millisecond
+	r.serveAccount(importer, servedAccount{JWT: importingAccountJWT(g, importer, exporter)})
+	r.serveAccount(exporter, servedAccount{JWT: importingAccountJWT(g, exporter)})
+	r.warmed.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{})
+
+	// Without any change, every interval pushes all accounts in dependency order
+	started := time.Now()
+	for i := 0; i < 2; i++ {
+		g.Eventually(updates, 5*time.Second).Should(Receive(Equal(exporter)))
+		g.Eventually(updates, 5*time.Second).Should(Receive(Equal(importer)))
+	}
+	g.Expect(time.Since(started)).To(BeNumerically(">=", 100*time.Millisecond))
+
+	// While publishing is suspended, the periodic republish is skipped
+	for i := 0; i < r.PublishBreaker.Threshold; i++ {
+		r.PublishBreaker.Record(fmt.Errorf("overloaded"))
+	}
+	// Let a round in flight finish
+	time.Sleep(2 * r.RepublishInterval)
+	for len(updates) > 0 {
+		<-updates
+	}
+	g.Consistently(updates, 3*r.RepublishInterval).ShouldNot(Receive())
+}
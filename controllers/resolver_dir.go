@@ -0,0 +1,74 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// resolverFile returns the path the JWT of publicKey is stored at in a resolver directory
+func resolverFile(dir, publicKey string) string {
+	return filepath.Join(dir, publicKey+".jwt")
+}
+
+// writeResolverFile stores token as <dir>/<publicKey>.jwt. The JWT is written to a temporary file in
+// the same directory first and renamed afterwards, so NATS never reads a partially written JWT.
+func writeResolverFile(dir, publicKey, token string) error {
+	tmp, err := os.CreateTemp(dir, "."+publicKey+".jwt-*")
+	if err != nil {
+		return err
+	}
+	// Removing fails once the file got renamed, which is fine
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(token); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), resolverFile(dir, publicKey))
+}
+
+// removeResolverFile deletes the JWT of publicKey from the resolver directory, if it exists
+func removeResolverFile(dir, publicKey string) error {
+	if err := os.Remove(resolverFile(dir, publicKey)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CheckResolverDir verifies that dir is a directory the JWTs of the accounts can be written to
+func CheckResolverDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// resolverHarness is an embedded NATS server in operator mode, which resolves all accounts
+// besides the system account by asking the account server, like a deployed cluster does.
+// Accounts and users are issued by the reconcilers on a shared fake client.
+type resolverHarness struct {
+	*server.Server
+	Accounts      *NatsAccountReconciler
+	Users         *NatsUserReconciler
+	AccountServer *NatsAccountServer
+}
+
+func runResolverHarness(g *WithT, t *testing.T) *resolverHarness {
+	accounts := newTestAccountReconciler(g)
+	ctx := context.Background()
+	operatorSecret := &corev1.Secret{}
+	g.Expect(accounts.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operatorSecret)).To(Succeed())
+	operator, err := nkeys.FromSeed(operatorSecret.Data[OPERATOR_SEED_KEY])
+	g.Expect(err).NotTo(HaveOccurred())
+	operatorPublic, _ := operator.PublicKey()
+
+	// The system account is required to start the server, so it can't be looked up from the account server
+	system, _ := nkeys.CreateAccount()
+	systemPublic, _ := system.PublicKey()
+	systemJWT, err := jwt.NewAccountClaims(systemPublic).Encode(operator)
+	g.Expect(err).NotTo(HaveOccurred())
+	resolver, err := server.NewCacheDirAccResolver(t.TempDir(), 0, time.Hour)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(resolver.Store(systemPublic, systemJWT)).To(Succeed())
+
+	s := startTestNatsServer(t, &server.Options{
+		Host:             "127.0.0.1",
+		Port:             -1,
+		TrustedOperators: []*jwt.OperatorClaims{jwt.NewOperatorClaims(operatorPublic)},
+		SystemAccount:    systemPublic,
+		AccountResolver:  resolver,
+	})
+	h := &resolverHarness{
+		Server:   s,
+		Accounts: accounts,
+		Users:    &NatsUserReconciler{Client: accounts.Client, Scheme: accounts.Scheme},
+	}
+
+	systemUser := &testOperatorServer{Server: s, account: system}
+	credsFile := filepath.Join(t.TempDir(), "sys.creds")
+	systemUser.writeUserCreds(g, credsFile)
+	h.AccountServer = NewAccountServer()
+	h.AccountServer.Client = accounts.Client
+	h.AccountServer.Scheme = accounts.Scheme
+	h.AccountServer.PublishBackoff = time.Millisecond
+	h.AccountServer.PublishTimeout = 500 * time.Millisecond
+	g.Expect(h.AccountServer.WarmCache(ctx)).To(Succeed())
+	runCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	go h.AccountServer.Run(runCtx, s.ClientURL(), credsFile, NatsTlsConfig{}, NatsConnConfig{})
+	g.Eventually(func() bool { return h.AccountServer.Ready(nil) == nil }, 5*time.Second).Should(BeTrue())
+	return h
+}
+
+// createAccount issues account and pushes it to NATS through the account server.
+// Users of the test namespace are allowed to use the account.
+func (h *resolverHarness) createAccount(g *WithT, account *natsv1alpha1.NatsAccount) *natsv1alpha1.NatsAccount {
+	account.Spec.AllowUserNamespaces = append(account.Spec.AllowUserNamespaces, testNamespace)
+	g.Expect(h.Accounts.Create(context.Background(), account)).To(Succeed())
+	reconcileAccount(g, h.Accounts, account.Name)
+
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: account.Name}}
+	_, err := h.AccountServer.Reconcile(context.Background(), req)
+	g.Expect(err).NotTo(HaveOccurred())
+	account = &natsv1alpha1.NatsAccount{}
+	g.Expect(h.Accounts.Get(context.Background(), req.NamespacedName, account)).To(Succeed())
+	return account
+}
+
+// connectUser issues user and connects to NATS with its credentials
+func (h *resolverHarness) connectUser(g *WithT, t *testing.T, user *natsv1alpha1.NatsUser) *nats.Conn {
+	g.Expect(h.Users.Create(context.Background(), user)).To(Succeed())
+	user = reconcileUser(g, h.Users, user.Name)
+	g.Expect(user.Status.JWT).NotTo(BeEmpty())
+
+	secret := &corev1.Secret{}
+	g.Expect(h.Users.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: user.Status.UserSecretName}, secret)).To(Succeed())
+	nc, err := nats.Connect(h.ClientURL(), nats.UserJWTAndSeed(string(secret.Data[OPERATOR_JWT]), string(secret.Data[OPERATOR_SEED_KEY])))
+	g.Expect(err).NotTo(HaveOccurred())
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// newUnlimitedTestUser returns a user which may subscribe and publish, as unset limits are zero in the claims
+func newUnlimitedTestUser(name, account string) *natsv1alpha1.NatsUser {
+	user := newTestUser(name, account)
+	user.Spec.Limits.NatsLimits = jwt.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: jwt.NoLimit}
+	return user
+}
+
+func TestResolverHarnessConnectsIssuedUser(t *testing.T) {
+	g := NewWithT(t)
+	h := runResolverHarness(g, t)
+	// Same as for users, unset account limits don't allow any connections
+	account := newTestAccount("app")
+	account.Spec.Limits.NatsLimits = natsv1alpha1.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: byteLimit("-1")}
+	account.Spec.Limits.Conn = jwt.NoLimit
+	account = h.createAccount(g, account)
+	g.Expect(h.AccountServer.lookupAccount(account.Status.PublicKey).JWT).To(Equal(account.Status.JWT))
+	g.Expect(account.Status.LastPublish).NotTo(BeNil())
+	g.Expect(account.Status.LastPublish.Acknowledged).To(BeTrue())
+
+	subscriber := h.connectUser(g, t, newUnlimitedTestUser("subscriber", "app"))
+	sub, err := subscriber.SubscribeSync("greeting")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(subscriber.Flush()).To(Succeed())
+
+	publisher := h.connectUser(g, t, newUnlimitedTestUser("publisher", "app"))
+	g.Expect(publisher.Publish("greeting", []byte("hello"))).To(Succeed())
+	msg, err := sub.NextMsg(5 * time.Second)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(msg.Data)).To(Equal("hello"))
+
+	// Both users ended up in the account resolved from the account server
+	connz, err := h.Connz(&server.ConnzOptions{Account: account.Status.PublicKey})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(connz.Conns).To(HaveLen(2))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// revocationPrunable reports whether the revocation of a deleted user may be pruned at now, which requires the JWT it
+// revokes to have expired longer than RevocationRetention ago. Revocations of JWTs without expiry never are.
+func (r *NatsAccountReconciler) revocationPrunable(account *natsv1alpha1.NatsAccount, key string, now time.Time) bool {
+	pruneAt, ok := r.pruneAt(account, key)
+	return ok && !now.Before(pruneAt)
+}
+
+// pruneAt returns the time the revocation of the deleted user key may be pruned at, false if it is kept forever
+func (r *NatsAccountReconciler) pruneAt(account *natsv1alpha1.NatsAccount, key string) (time.Time, bool) {
+	expires := account.Status.RevokedUserExpiries[key]
+	if r.RevocationRetention <= 0 || key == jwt.All || expires == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(expires, 0).Add(r.RevocationRetention), true
+}
+
+// pruneRevokedUsers removes the revocations of deleted users from the account status once the JWTs they revoke expired
+// longer than RevocationRetention ago. The revocations of the spec are always kept, the JWTs they revoke aren't known.
+func (r *NatsAccountReconciler) pruneRevokedUsers(ctx context.Context, account *natsv1alpha1.NatsAccount) error {
+	now := time.Now()
+	pruned := 0
+	for key := range account.Status.RevokedUsers {
+		if r.revocationPrunable(account, key, now) {
+			delete(account.Status.RevokedUsers, key)
+			delete(account.Status.RevokedUserExpiries, key)
+			pruned++
+		}
+	}
+	if pruned == 0 {
+		return nil
+	}
+	log.FromContext(ctx).Info("pruned revocations of expired user JWTs", "account", account.Name, "pruned", pruned, "retention", r.RevocationRetention)
+	return r.Status().Update(ctx, account)
+}
+
+// nextPrune returns the time until the first revocation of a deleted user may be pruned, 0 if there is none
+func (r *NatsAccountReconciler) nextPrune(account *natsv1alpha1.NatsAccount) time.Duration {
+	var next time.Time
+	for key := range account.Status.RevokedUsers {
+		if pruneAt, ok := r.pruneAt(account, key); ok && (next.IsZero() || pruneAt.Before(next)) {
+			next = pruneAt
+		}
+	}
+	if next.IsZero() {
+		return 0
+	}
+	pruneIn := time.Until(next)
+	if pruneIn < time.Second {
+		pruneIn = time.Second
+	}
+	return pruneIn
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestAccountPrunesRevocations(t *testing.T) {
+	g := NewWithT(t)
+	userKey := func() string {
+		kp, _ := nkeys.CreateUser()
+		public, _ := kp.PublicKey()
+		return public
+	}
+	now := time.Now()
+	staleSpec, expiredUser, recentlyExpiredUser, nonExpiringUser := userKey(), userKey(), userKey(), userKey()
+	account := newTestAccount("app")
+	account.Spec.Revocations = jwt.RevocationList{
+		staleSpec: now.Add(-48 * time.Hour).Unix(),
+		jwt.All:   now.Add(-48 * time.Hour).Unix(),
+	}
+	account.Status.RevokedUsers = jwt.RevocationList{
+		expiredUser:         now.Add(-72 * time.Hour).Unix(),
+		recentlyExpiredUser: now.Add(-72 * time.Hour).Unix(),
+		nonExpiringUser:     now.Add(-72 * time.Hour).Unix(),
+	}
+	account.Status.RevokedUserExpiries = map[string]int64{
+		expiredUser:         now.Add(-48 * time.Hour).Unix(),
+		recentlyExpiredUser: now.Add(-2 * time.Hour).Unix(),
+	}
+	r := newTestAccountReconciler(g, account)
+	r.RevocationRetention = 24 * time.Hour
+
+	account, res := reconcileAccount(g, r, "app")
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	// The JWTs revoked by the spec aren't known, so neither its revocations nor the wildcard are pruned
+	g.Expect(claims.Revocations).To(HaveLen(4))
+	g.Expect(claims.Revocations).To(HaveKey(staleSpec))
+	g.Expect(claims.Revocations).To(HaveKey(jwt.All))
+	g.Expect(claims.Revocations).To(HaveKey(recentlyExpiredUser))
+	// Revocations of JWTs without expiry are kept regardless of their age
+	g.Expect(claims.Revocations).To(HaveKey(nonExpiringUser))
+	g.Expect(account.Status.RevokedUsers).To(HaveLen(2))
+	g.Expect(account.Status.RevokedUsers).NotTo(HaveKey(expiredUser))
+	g.Expect(account.Status.RevokedUserExpiries).To(HaveLen(1))
+	g.Expect(account.Spec.Revocations).To(HaveLen(2))
+	g.Expect(meta.IsStatusConditionTrue(account.Status.Conditions, CONDITION_PENDING_CHANGES)).To(BeFalse())
+	// The account is reconciled again once the JWT of the remaining revocation expired longer than the retention ago
+	g.Expect(res.RequeueAfter).To(BeNumerically("~", 22*time.Hour, time.Minute))
+
+	// Without a retention revocations are kept forever
+	account = newTestAccount("app")
+	account.Status.RevokedUsers = jwt.RevocationList{expiredUser: now.Add(-72 * time.Hour).Unix()}
+	account.Status.RevokedUserExpiries = map[string]int64{expiredUser: now.Add(-48 * time.Hour).Unix()}
+	r = newTestAccountReconciler(g, account)
+	account, res = reconcileAccount(g, r, "app")
+	claims, err = jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Revocations).To(HaveKey(expiredUser))
+	g.Expect(res.RequeueAfter).To(BeZero())
+}
+
+func TestNonExpiringUserRevocationKept(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")}, newTestUser("leaving", "app"))
+	leaving := reconcileUser(g, r, "leaving")
+	g.Expect(r.Delete(ctx, leaving)).To(Succeed())
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(leaving)})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Users without expiry are issued a JWT that never expires, so their revocation stays however old it gets
+	account := &natsv1alpha1.NatsAccount{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "app"}, account)).To(Succeed())
+	g.Expect(account.Status.RevokedUserExpiries).To(BeEmpty())
+	account.Status.RevokedUsers[leaving.Status.PublicKey] = time.Now().Add(-365 * 24 * time.Hour).Unix()
+	g.Expect(r.Status().Update(ctx, account)).To(Succeed())
+	ar := &NatsAccountReconciler{Client: r.Client, Scheme: r.Scheme, RevocationRetention: time.Hour}
+	account, res := reconcileAccount(g, ar, "app")
+	g.Expect(account.Status.RevokedUsers).To(HaveKey(leaving.Status.PublicKey))
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(claims.Revocations).To(HaveKey(leaving.Status.PublicKey))
+	g.Expect(res.RequeueAfter).To(BeZero())
+}
+
+func TestExpiringUserRevocationPruned(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	leaving := newTestUser("leaving", "app")
+	leaving.Spec.Expiry = &metav1.Duration{Duration: time.Hour}
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{newTestAccount("app")}, leaving)
+	leaving = reconcileUser(g, r, "leaving")
+	claims, err := jwt.DecodeUserClaims(leaving.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.Delete(ctx, leaving)).To(Succeed())
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(leaving)})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Revoking records when the JWT of the user expires, the revocation is pruned the retention after
+	ar := &NatsAccountReconciler{Client: r.Client, Scheme: r.Scheme, RevocationRetention: time.Hour}
+	account, res := reconcileAccount(g, ar, "app")
+	g.Expect(account.Status.RevokedUserExpiries).To(HaveKeyWithValue(leaving.Status.PublicKey, claims.Expires))
+	g.Expect(account.Status.RevokedUsers).To(HaveKey(leaving.Status.PublicKey))
+	g.Expect(res.RequeueAfter).To(BeNumerically("~", 2*time.Hour, time.Minute))
+
+	// Once the retention passed, the account is issued without it
+	account.Status.RevokedUserExpiries[leaving.Status.PublicKey] = time.Now().Add(-2 * time.Hour).Unix()
+	g.Expect(r.Status().Update(ctx, account)).To(Succeed())
+	account, _ = reconcileAccount(g, ar, "app")
+	g.Expect(account.Status.RevokedUsers).NotTo(HaveKey(leaving.Status.PublicKey))
+	issued, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(issued.Revocations).NotTo(HaveKey(leaving.Status.PublicKey))
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// ACCOUNT_SECRET_TYPE and USER_SECRET_TYPE mark the key secrets of accounts and users, which share their name
+const ACCOUNT_SECRET_TYPE = "deinstapel.de/nats-account"
+const USER_SECRET_TYPE = "deinstapel.de/nats-user"
+
+// OrphanedSecretSweeper periodically looks for key secrets of accounts and users that don't exist anymore.
+// Secrets issued before owner references were set aren't garbage collected by Kubernetes, so they remain
+// after their account or user is deleted.
+type OrphanedSecretSweeper struct {
+	client.Client
+	// Interval between two sweeps
+	Interval time.Duration
+	// DeleteOrphans removes the orphaned secrets, otherwise they are only logged
+	DeleteOrphans bool
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, only the leader sweeps
+func (s *OrphanedSecretSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+// Start sweeps every Interval until ctx is done
+func (s *OrphanedSecretSweeper) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Sweep(ctx); err != nil {
+			logger.Error(err, "failed sweeping orphaned key secrets")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep returns the key secrets whose account or user doesn't exist, and deletes them if enabled
+func (s *OrphanedSecretSweeper) Sweep(ctx context.Context) ([]types.NamespacedName, error) {
+	logger := log.FromContext(ctx)
+	secrets := &corev1.SecretList{}
+	if err := s.List(ctx, secrets); err != nil {
+		return nil, err
+	}
+
+	orphans := []types.NamespacedName{}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		var owner client.Object
+		switch secret.Type {
+		case ACCOUNT_SECRET_TYPE:
+			owner = &natsv1alpha1.NatsAccount{}
+		case USER_SECRET_TYPE:
+			owner = &natsv1alpha1.NatsUser{}
+		default:
+			continue
+		}
+		key := client.ObjectKeyFromObject(secret)
+		if err := s.Get(ctx, key, owner); err == nil {
+			continue
+		} else if !errors.IsNotFound(err) {
+			return orphans, err
+		}
+
+		orphans = append(orphans, key)
+		if !s.DeleteOrphans {
+			logger.Info("found orphaned key secret, not deleting it in dry run", "secret", key, "type", secret.Type)
+			continue
+		}
+		logger.Info("deleting orphaned key secret", "secret", key, "type", secret.Type)
+		if err := s.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return orphans, err
+		}
+	}
+	return orphans, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newKeySecret(name, secretType string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Type:       corev1.SecretType(secretType),
+	}
+}
+
+func TestOrphanedSecretSweep(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	r := newTestAccountReconciler(g,
+		newTestAccount("app"), newKeySecret("app", ACCOUNT_SECRET_TYPE),
+		newTestUser("publisher", "app"), newKeySecret("publisher", USER_SECRET_TYPE),
+		newKeySecret("deleted-account", ACCOUNT_SECRET_TYPE),
+		newKeySecret("deleted-user", USER_SECRET_TYPE),
+		// Secrets of other types are none of the sweep's business, even if nothing has their name
+		newKeySecret("tls", string(corev1.SecretTypeTLS)),
+	)
+	orphans := []types.NamespacedName{
+		{Namespace: testNamespace, Name: "deleted-account"},
+		{Namespace: testNamespace, Name: "deleted-user"},
+	}
+	exists := func(name string) bool {
+		err := r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: name}, &corev1.Secret{})
+		g.Expect(err == nil || errors.IsNotFound(err)).To(BeTrue())
+		return err == nil
+	}
+
+	// Dry run by default
+	sweeper := &OrphanedSecretSweeper{Client: r.Client}
+	found, err := sweeper.Sweep(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(ConsistOf(orphans))
+	g.Expect(exists("deleted-account")).To(BeTrue())
+	g.Expect(exists("deleted-user")).To(BeTrue())
+
+	sweeper.DeleteOrphans = true
+	found, err = sweeper.Sweep(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(ConsistOf(orphans))
+	g.Expect(exists("deleted-account")).To(BeFalse())
+	g.Expect(exists("deleted-user")).To(BeFalse())
+	for _, name := range []string{"app", "publisher", "tls", "operator"} {
+		g.Expect(exists(name)).To(BeTrue(), name)
+	}
+
+	found, err = sweeper.Sweep(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(BeEmpty())
+}
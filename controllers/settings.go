@@ -0,0 +1,119 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ReloadableSettings are the settings of the account server that can be changed while it runs.
+// Settings missing from the file keep their current value, connection settings can't be reloaded this way.
+type ReloadableSettings struct {
+	// LogLevel is debug, info, error or a verbosity above 0, like --zap-log-level
+	LogLevel                *string          `json:"logLevel,omitempty"`
+	PublishRetries          *int             `json:"publishRetries,omitempty"`
+	PublishBackoff          *metav1.Duration `json:"publishBackoff,omitempty"`
+	LookupSizeWarnThreshold *int             `json:"lookupSizeWarnThreshold,omitempty"`
+	LookupExistenceChecks   *bool            `json:"lookupExistenceChecks,omitempty"`
+	KeepNewerServerClaims   *bool            `json:"keepNewerServerClaims,omitempty"`
+}
+
+// LoadReloadableSettings reads the settings from the YAML file at path
+func LoadReloadableSettings(path string) (ReloadableSettings, error) {
+	settings := ReloadableSettings{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return settings, err
+	}
+	if err := yaml.UnmarshalStrict(content, &settings); err != nil {
+		return settings, fmt.Errorf("failed decoding settings %s: %v", path, err)
+	}
+	return settings, nil
+}
+
+// parseLogLevel parses level the way --zap-log-level does, verbosities are negative zap levels
+func parseLogLevel(level string) (zapcore.Level, error) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err == nil {
+		return l, nil
+	}
+	verbosity, err := strconv.Atoi(level)
+	if err != nil || verbosity <= 0 {
+		return l, fmt.Errorf("invalid log level %q, expected debug, info, error or a verbosity above 0", level)
+	}
+	return zapcore.Level(-verbosity), nil
+}
+
+// ApplySettings applies settings to the account server and the log level, and returns the names of the settings
+// that changed. Nothing is applied if any of the settings is invalid. level may be nil if the log level can't be changed.
+func (r *NatsAccountServer) ApplySettings(settings ReloadableSettings, level *zap.AtomicLevel) ([]string, error) {
+	var logLevel zapcore.Level
+	if settings.LogLevel != nil {
+		if level == nil {
+			return nil, fmt.Errorf("the log level can't be changed")
+		}
+		var err error
+		if logLevel, err = parseLogLevel(*settings.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+	if settings.PublishRetries != nil && *settings.PublishRetries < 0 {
+		return nil, fmt.Errorf("publishRetries %d needs to be non negative", *settings.PublishRetries)
+	}
+	if settings.PublishBackoff != nil && settings.PublishBackoff.Duration < 0 {
+		return nil, fmt.Errorf("publishBackoff %s needs to be non negative", settings.PublishBackoff.Duration)
+	}
+	if settings.LookupSizeWarnThreshold != nil && *settings.LookupSizeWarnThreshold < 0 {
+		return nil, fmt.Errorf("lookupSizeWarnThreshold %d needs to be non negative", *settings.LookupSizeWarnThreshold)
+	}
+
+	changed := []string{}
+	if settings.LogLevel != nil && level.Level() != logLevel {
+		level.SetLevel(logLevel)
+		changed = append(changed, "logLevel")
+	}
+	r.settingsLock.Lock()
+	defer r.settingsLock.Unlock()
+	if settings.PublishRetries != nil && r.PublishRetries != *settings.PublishRetries {
+		r.PublishRetries = *settings.PublishRetries
+		changed = append(changed, "publishRetries")
+	}
+	if settings.PublishBackoff != nil && r.PublishBackoff != settings.PublishBackoff.Duration {
+		r.PublishBackoff = settings.PublishBackoff.Duration
+		changed = append(changed, "publishBackoff")
+	}
+	if settings.LookupSizeWarnThreshold != nil && r.LookupSizeWarnThreshold != *settings.LookupSizeWarnThreshold {
+		r.LookupSizeWarnThreshold = *settings.LookupSizeWarnThreshold
+		changed = append(changed, "lookupSizeWarnThreshold")
+	}
+	if settings.LookupExistenceChecks != nil && r.LookupExistenceChecks != *settings.LookupExistenceChecks {
+		r.LookupExistenceChecks = *settings.LookupExistenceChecks
+		changed = append(changed, "lookupExistenceChecks")
+	}
+	if settings.KeepNewerServerClaims != nil && r.KeepNewerServerClaims != *settings.KeepNewerServerClaims {
+		r.KeepNewerServerClaims = *settings.KeepNewerServerClaims
+		changed = append(changed, "keepNewerServerClaims")
+	}
+	return changed, nil
+}
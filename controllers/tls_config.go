@@ -0,0 +1,83 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// tlsVersions are the accepted values of NatsTlsConfig.MinVersion, older versions are insecure
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Validate checks the TLS version and cipher suite names
+func (c NatsTlsConfig) Validate() error {
+	_, err := c.constraints()
+	return err
+}
+
+// constraints returns the option applying MinVersion, CipherSuites and InsecureSkipVerify to the TLS config
+// of the connection
+func (c NatsTlsConfig) constraints() (nats.Option, error) {
+	var minVersion uint16
+	if c.MinVersion != "" {
+		var ok bool
+		if minVersion, ok = tlsVersions[c.MinVersion]; !ok {
+			return nil, fmt.Errorf("unsupported TLS min version %q, use 1.2 or 1.3", c.MinVersion)
+		}
+	}
+	cipherSuites := []uint16{}
+	for _, name := range c.CipherSuites {
+		suite := cipherSuite(name)
+		if suite == nil {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite %s can't be configured, all of them are always enabled", name)
+		}
+		cipherSuites = append(cipherSuites, suite.ID)
+	}
+
+	return func(o *nats.Options) error {
+		if o.TLSConfig == nil {
+			o.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if minVersion != 0 {
+			o.TLSConfig.MinVersion = minVersion
+		}
+		if len(cipherSuites) > 0 {
+			o.TLSConfig.CipherSuites = cipherSuites
+		}
+		o.TLSConfig.InsecureSkipVerify = c.InsecureSkipVerify
+		return nil
+	}, nil
+}
+
+// cipherSuite looks up a secure cipher suite by name
+func cipherSuite(name string) *tls.CipherSuite {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
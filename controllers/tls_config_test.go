@@ -0,0 +1,128 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	. "github.com/onsi/gomega"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and its key to dir,
+// the certificate doubles as CA to trust it
+func writeSelfSignedCert(g *WithT, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nats"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	g.Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)).To(Succeed())
+	g.Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+	return certFile, keyFile
+}
+
+// runTLSNatsServer runs a NATS server requiring TLS with a self-signed certificate, returned as certFile
+func runTLSNatsServer(g *WithT, t *testing.T, maxVersion uint16) (*server.Server, string) {
+	certFile, keyFile := writeSelfSignedCert(g, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	s := startTestNatsServer(t, &server.Options{
+		Host:       "127.0.0.1",
+		Port:       -1,
+		TLS:        true,
+		TLSTimeout: 2,
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12, MaxVersion: maxVersion},
+	})
+	return s, certFile
+}
+
+func TestNatsTlsMinVersion(t *testing.T) {
+	g := NewWithT(t)
+	s, caFile := runTLSNatsServer(g, t, tls.VersionTLS12)
+
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{CaPath: caFile}, NatsConnConfig{})
+	g.Expect(err).NotTo(HaveOccurred())
+	nc.Close()
+
+	_, err = connectToNats(s.ClientURL(), "", NatsTlsConfig{CaPath: caFile, MinVersion: "1.3"}, NatsConnConfig{})
+	g.Expect(err).To(MatchError(ContainSubstring("protocol version")))
+}
+
+func TestNatsTlsCipherSuites(t *testing.T) {
+	g := NewWithT(t)
+	s, caFile := runTLSNatsServer(g, t, tls.VersionTLS12)
+
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{CaPath: caFile, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}}, NatsConnConfig{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(nc.TLSConnectionState()).To(HaveField("CipherSuite", tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384))
+	nc.Close()
+
+	// The certificate has an ECDSA key, so the server can't agree on an RSA suite
+	_, err = connectToNats(s.ClientURL(), "", NatsTlsConfig{CaPath: caFile, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, NatsConnConfig{})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestNatsTlsInsecureSkipVerify(t *testing.T) {
+	g := NewWithT(t)
+	s, _ := runTLSNatsServer(g, t, tls.VersionTLS13)
+
+	_, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{})
+	g.Expect(err).To(MatchError(ContainSubstring("certificate")))
+
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{InsecureSkipVerify: true}, NatsConnConfig{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(nc.Flush()).To(Succeed())
+	nc.Close()
+}
+
+func TestNatsTlsConfigValidate(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(NatsTlsConfig{}.Validate()).To(Succeed())
+	g.Expect(NatsTlsConfig{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}.Validate()).To(Succeed())
+	g.Expect(NatsTlsConfig{MinVersion: "1.1"}.Validate()).To(MatchError(ContainSubstring("unsupported TLS min version")))
+	g.Expect(NatsTlsConfig{MinVersion: "TLS13"}.Validate()).To(HaveOccurred())
+	g.Expect(NatsTlsConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}.Validate()).To(MatchError(ContainSubstring("insecure")))
+	g.Expect(NatsTlsConfig{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}.Validate()).To(MatchError(ContainSubstring("TLS 1.3")))
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// UserJWTProvider supplies the user JWT the account server authenticates to NATS with instead of a creds file,
+// e.g. short-lived JWTs issued by an external token service. It is asked for a JWT on every connect and reconnect.
+type UserJWTProvider interface {
+	// UserJWT returns the JWT to connect with
+	UserJWT() (string, error)
+	// Sign signs the nonce of the server with the key of the user the JWT is issued for
+	Sign(nonce []byte) ([]byte, error)
+}
+
+// USER_JWT_COMMAND_TIMEOUT bounds how long the command of a CommandUserJWTProvider may take
+const USER_JWT_COMMAND_TIMEOUT = 10 * time.Second
+
+// NewCommandUserJWTProvider returns a provider which runs command for every connect and connects with the user JWT
+// it prints. The nonce is signed with the user seed in seedFile, which is read on every connect as well.
+func NewCommandUserJWTProvider(command, seedFile string) (UserJWTProvider, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("user JWT command is empty")
+	}
+	if seedFile == "" {
+		return nil, fmt.Errorf("a user seed file is required to sign with the key of the user JWT")
+	}
+	return &commandUserJWTProvider{args: args, seedFile: seedFile}, nil
+}
+
+type commandUserJWTProvider struct {
+	args     []string
+	seedFile string
+}
+
+func (p *commandUserJWTProvider) UserJWT() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), USER_JWT_COMMAND_TIMEOUT)
+	defer cancel()
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, p.args[0], p.args[1:]...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("user JWT command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(string(out))
+	if _, err := jwt.DecodeUserClaims(token); err != nil {
+		return "", fmt.Errorf("user JWT command didn't print a user JWT: %v", err)
+	}
+	return token, nil
+}
+
+func (p *commandUserJWTProvider) Sign(nonce []byte) ([]byte, error) {
+	seed, err := os.ReadFile(p.seedFile)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := nkeys.FromSeed(bytes.TrimSpace(seed))
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding user seed: %v", err)
+	}
+	defer kp.Wipe()
+	return kp.Sign(nonce)
+}
+
+// NewUserJWTProvider returns a provider connecting with userJWT and signing the nonce with seed, both held in memory,
+// e.g. for the JWT and seed of a user stored in separate keys of a Secret instead of a creds file
+func NewUserJWTProvider(userJWT string, seed []byte) (UserJWTProvider, error) {
+	userJWT = strings.TrimSpace(userJWT)
+	seed = bytes.TrimSpace(seed)
+	claims, err := jwt.DecodeUserClaims(userJWT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user JWT: %v", err)
+	}
+	kp, err := nkeys.FromSeed(seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding user seed: %v", err)
+	}
+	defer kp.Wipe()
+	if public, _ := kp.PublicKey(); public != claims.Subject {
+		return nil, fmt.Errorf("user JWT is issued for %s, but the seed is the one of %s", claims.Subject, public)
+	}
+	return &staticUserJWTProvider{jwt: userJWT, seed: seed}, nil
+}
+
+type staticUserJWTProvider struct {
+	jwt  string
+	seed []byte
+}
+
+func (p *staticUserJWTProvider) UserJWT() (string, error) {
+	return p.jwt, nil
+}
+
+func (p *staticUserJWTProvider) Sign(nonce []byte) ([]byte, error) {
+	kp, err := nkeys.FromSeed(p.seed)
+	if err != nil {
+		return nil, err
+	}
+	defer kp.Wipe()
+	return kp.Sign(nonce)
+}
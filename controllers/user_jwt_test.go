@@ -0,0 +1,141 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+)
+
+// rotatingUserJWTProvider issues a new short-lived user for every connect
+type rotatingUserJWTProvider struct {
+	account nkeys.KeyPair
+	expiry  time.Duration
+
+	mu     sync.Mutex
+	user   nkeys.KeyPair
+	issued []string
+}
+
+func (p *rotatingUserJWTProvider) UserJWT() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user, _ = nkeys.CreateUser()
+	public, _ := p.user.PublicKey()
+	claims := jwt.NewUserClaims(public)
+	claims.Expires = time.Now().Add(p.expiry).Unix()
+	p.issued = append(p.issued, public)
+	return claims.Encode(p.account)
+}
+
+func (p *rotatingUserJWTProvider) Sign(nonce []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.user.Sign(nonce)
+}
+
+func (p *rotatingUserJWTProvider) issuedUsers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.issued...)
+}
+
+func TestConnectWithUserJWTProvider(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestOperatorServer(g, t)
+	provider := &rotatingUserJWTProvider{account: s.account, expiry: 2 * time.Second}
+
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{
+		UserJWT:        provider,
+		ReconnectDelay: func(int) time.Duration { return 10 * time.Millisecond },
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer nc.Close()
+	issued := provider.issuedUsers()
+	first := issued[len(issued)-1]
+	g.Expect(s.connectedUsers(g)).To(Equal([]string{first}))
+
+	// The server disconnects the user once its JWT expired, the reconnect fetches a fresh one
+	g.Eventually(func() bool {
+		issued := provider.issuedUsers()
+		latest := issued[len(issued)-1]
+		return latest != first && reflect.DeepEqual(s.connectedUsers(g), []string{latest})
+	}, 5*time.Second).Should(BeTrue())
+
+	_, err = connectToNats(s.ClientURL(), "/creds/user.creds", NatsTlsConfig{}, NatsConnConfig{UserJWT: provider})
+	g.Expect(err).To(MatchError("a creds file and a user JWT provider can't be used together"))
+}
+
+func TestCommandUserJWTProvider(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestOperatorServer(g, t)
+	user, _ := nkeys.CreateUser()
+	userPublic, _ := user.PublicKey()
+	userSeed, _ := user.Seed()
+	userJWT, err := jwt.NewUserClaims(userPublic).Encode(s.account)
+	g.Expect(err).NotTo(HaveOccurred())
+	seedFile := filepath.Join(t.TempDir(), "user.nk")
+	g.Expect(os.WriteFile(seedFile, userSeed, 0600)).To(Succeed())
+
+	provider, err := NewCommandUserJWTProvider("echo "+userJWT, seedFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{UserJWT: provider})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer nc.Close()
+	g.Expect(s.connectedUsers(g)).To(Equal([]string{userPublic}))
+
+	provider, err = NewCommandUserJWTProvider("echo not-a-jwt", seedFile)
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = provider.UserJWT()
+	g.Expect(err).To(MatchError(ContainSubstring("user JWT command didn't print a user JWT")))
+	_, err = NewCommandUserJWTProvider("", seedFile)
+	g.Expect(err).To(MatchError("user JWT command is empty"))
+}
+
+func TestConnectWithUserJWTAndSeed(t *testing.T) {
+	g := NewWithT(t)
+	s := runTestOperatorServer(g, t)
+	user, _ := nkeys.CreateUser()
+	userPublic, _ := user.PublicKey()
+	userSeed, _ := user.Seed()
+	userJWT, err := jwt.NewUserClaims(userPublic).Encode(s.account)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Secret keys often end with a newline
+	provider, err := NewUserJWTProvider(userJWT+"\n", append(userSeed, '\n'))
+	g.Expect(err).NotTo(HaveOccurred())
+	nc, err := connectToNats(s.ClientURL(), "", NatsTlsConfig{}, NatsConnConfig{UserJWT: provider})
+	g.Expect(err).NotTo(HaveOccurred())
+	defer nc.Close()
+	g.Expect(s.connectedUsers(g)).To(Equal([]string{userPublic}))
+
+	other, _ := nkeys.CreateUser()
+	otherSeed, _ := other.Seed()
+	otherPublic, _ := other.PublicKey()
+	_, err = NewUserJWTProvider(userJWT, otherSeed)
+	g.Expect(err).To(MatchError("user JWT is issued for " + userPublic + ", but the seed is the one of " + otherPublic))
+	_, err = NewUserJWTProvider("not-a-jwt", userSeed)
+	g.Expect(err).To(MatchError(ContainSubstring("invalid user JWT")))
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/samber/lo"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// ChainLink is the outcome of verifying the issued JWT of an account or user against its issuer
+type ChainLink struct {
+	Kind      string
+	Name      types.NamespacedName
+	PublicKey string
+	Issuer    string
+	// Error describes why the JWT doesn't chain to its issuer, empty if it does
+	Error string
+}
+
+// VerifyChain verifies that the JWT of the account chains to its operator, and the JWTs of all users
+// referencing the account chain to the account or one of its signing keys.
+// The account link comes first, followed by the users ordered by name.
+func VerifyChain(ctx context.Context, c client.Reader, key types.NamespacedName) ([]ChainLink, error) {
+	account := &natsv1alpha1.NatsAccount{}
+	if err := c.Get(ctx, key, account); err != nil {
+		return nil, err
+	}
+	operator := &natsv1alpha1.NatsOperator{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: account.Namespace, Name: account.Spec.OperatorRef.Name}, operator); err != nil {
+		return nil, err
+	}
+	users := &natsv1alpha1.NatsUserList{}
+	if err := c.List(ctx, users); err != nil {
+		return nil, err
+	}
+
+	link, claims := verifyAccountLink(account, operator)
+	links := []ChainLink{link}
+	userLinks := []ChainLink{}
+	for i := range users.Items {
+		user := &users.Items[i]
+		if !referencesAccount(user, account) {
+			continue
+		}
+		userLinks = append(userLinks, verifyUserLink(user, account.Status.PublicKey, claims))
+	}
+	sort.Slice(userLinks, func(i, j int) bool {
+		return userLinks[i].Name.String() < userLinks[j].Name.String()
+	})
+	return append(links, userLinks...), nil
+}
+
+// referencesAccount reports whether user references account, users without a namespace in their
+// account reference reference an account of their own namespace
+func referencesAccount(user *natsv1alpha1.NatsUser, account *natsv1alpha1.NatsAccount) bool {
+	ref := user.Spec.AccountRef
+	if ref.Namespace == "" {
+		ref.Namespace = user.Namespace
+	}
+	return user.Spec.AccountPublicKey == "" && ref.Name == account.Name && ref.Namespace == account.Namespace
+}
+
+// verifyAccountLink verifies the account JWT, returning its claims if they could be decoded
+func verifyAccountLink(account *natsv1alpha1.NatsAccount, operator *natsv1alpha1.NatsOperator) (ChainLink, *jwt.AccountClaims) {
+	link := ChainLink{Kind: "NatsAccount", Name: client.ObjectKeyFromObject(account), PublicKey: account.Status.PublicKey}
+	if account.Status.JWT == "" {
+		link.Error = "no JWT issued"
+		return link, nil
+	}
+	// Decoding verifies the signature of the JWT against its issuer
+	claims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		link.Error = fmt.Sprintf("JWT doesn't verify: %v", err)
+		return link, nil
+	}
+	link.Issuer = claims.Issuer
+
+	operatorKeys := []string{operator.Status.PublicKey}
+	if operatorClaims, err := jwt.DecodeOperatorClaims(operator.Status.JWT); err == nil {
+		operatorKeys = append(operatorKeys, operatorClaims.SigningKeys...)
+	} else {
+		operatorKeys = append(operatorKeys, operator.Spec.SigningKeys...)
+	}
+	switch {
+	case claims.Subject != account.Status.PublicKey:
+		link.Error = fmt.Sprintf("JWT is issued for %s instead of the account key", claims.Subject)
+	case !lo.Contains(operatorKeys, claims.Issuer):
+		link.Error = fmt.Sprintf("JWT is signed by %s, which is neither the operator %s nor one of its signing keys", claims.Issuer, operator.Status.PublicKey)
+	default:
+		link.Error = validationErrors(claims)
+	}
+	return link, claims
+}
+
+// verifyUserLink verifies the user JWT against the account key and the signing keys of accountClaims
+func verifyUserLink(user *natsv1alpha1.NatsUser, accountKey string, accountClaims *jwt.AccountClaims) ChainLink {
+	link := ChainLink{Kind: "NatsUser", Name: client.ObjectKeyFromObject(user), PublicKey: user.Status.PublicKey}
+	if user.Status.JWT == "" {
+		link.Error = "no JWT issued"
+		return link
+	}
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	if err != nil {
+		link.Error = fmt.Sprintf("JWT doesn't verify: %v", err)
+		return link
+	}
+	link.Issuer = claims.Issuer
+
+	signingKey := accountClaims != nil && accountClaims.SigningKeys.Contains(claims.Issuer)
+	switch {
+	case claims.Subject != user.Status.PublicKey:
+		link.Error = fmt.Sprintf("JWT is issued for %s instead of the user key", claims.Subject)
+	case claims.Issuer != accountKey && !signingKey:
+		link.Error = fmt.Sprintf("JWT is signed by %s, which is neither the account %s nor one of its signing keys", claims.Issuer, accountKey)
+	case claims.Issuer != accountKey && claims.IssuerAccount != accountKey:
+		link.Error = fmt.Sprintf("JWT is signed by the signing key %s, but names %q as issuer account instead of %s", claims.Issuer, claims.IssuerAccount, accountKey)
+	default:
+		link.Error = validationErrors(claims)
+	}
+	return link
+}
+
+// verifyIssued counts link as a verification failure of kind if the JWT just issued doesn't chain to its issuer
+func verifyIssued(kind string, link ChainLink) error {
+	if link.Error == "" {
+		return nil
+	}
+	jwtVerifyFailures.WithLabelValues(kind).Inc()
+	return fmt.Errorf("issued JWT of %s %s doesn't verify: %s", link.Kind, link.Name, link.Error)
+}
+
+// validationErrors joins the errors of validating claims, e.g. an expiry
+func validationErrors(claims jwt.Claims) string {
+	vr := jwt.ValidationResults{}
+	claims.Validate(&vr)
+	return strings.Join(lo.Map(vr.Errors(), func(err error, _ int) string {
+		return err.Error()
+	}), ", ")
+}
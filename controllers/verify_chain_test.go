@@ -0,0 +1,97 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestVerifyChain(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+	current, _ := nkeys.CreateAccount()
+	currentPublic, _ := current.PublicKey()
+	currentSeed, _ := current.Seed()
+	stale, _ := nkeys.CreateAccount()
+	stalePublic, _ := stale.PublicKey()
+	staleSeed, _ := stale.Seed()
+	seedSecret := func(name string, seed []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+			Data:       map[string][]byte{OPERATOR_SEED_KEY: seed},
+		}
+	}
+	signedUser := func(name, secret string) *natsv1alpha1.NatsUser {
+		user := newTestUser(name, "app")
+		user.Spec.SigningKeySecretRef = &corev1.LocalObjectReference{Name: secret}
+		return user
+	}
+
+	account := newTestAccount("app")
+	account.Spec.SigningKeys = []natsv1alpha1.AccountPublicKey{natsv1alpha1.AccountPublicKey(currentPublic), natsv1alpha1.AccountPublicKey(stalePublic)}
+	r := newTestUserReconciler(g, []*natsv1alpha1.NatsAccount{account},
+		seedSecret("current-key", currentSeed),
+		seedSecret("stale-key", staleSeed),
+		newTestUser("direct", "app"),
+		signedUser("delegated", "current-key"),
+		signedUser("rotated", "stale-key"),
+		newTestUser("other", "other-account"),
+	)
+	for _, name := range []string{"direct", "delegated", "rotated"} {
+		reconcileUser(g, r, name)
+	}
+	key := types.NamespacedName{Namespace: testNamespace, Name: "app"}
+	g.Expect(r.Get(ctx, key, account)).To(Succeed())
+	operator := &natsv1alpha1.NatsOperator{}
+	g.Expect(r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "operator"}, operator)).To(Succeed())
+
+	links, err := VerifyChain(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(links).To(HaveLen(4))
+	g.Expect(links[0]).To(Equal(ChainLink{Kind: "NatsAccount", Name: key, PublicKey: account.Status.PublicKey, Issuer: operator.Status.PublicKey}))
+	for _, link := range links {
+		g.Expect(link.Error).To(BeEmpty(), link.Name.String())
+	}
+
+	// Rotating the key out of the account breaks the users still signed with it, until they are reissued
+	account.Spec.SigningKeys = []natsv1alpha1.AccountPublicKey{natsv1alpha1.AccountPublicKey(currentPublic)}
+	g.Expect(r.Update(ctx, account)).To(Succeed())
+	ar := &NatsAccountReconciler{Client: r.Client, Scheme: r.Scheme}
+	reconcileAccount(g, ar, "app")
+
+	links, err = VerifyChain(ctx, r.Client, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(links).To(HaveLen(4))
+	broken := map[string]string{}
+	for _, link := range links {
+		if link.Error != "" {
+			broken[link.Name.Name] = link.Error
+		}
+	}
+	g.Expect(broken).To(HaveLen(1))
+	g.Expect(broken).To(HaveKeyWithValue("rotated", "JWT is signed by "+stalePublic+", which is neither the account "+account.Status.PublicKey+" nor one of its signing keys"))
+}